@@ -171,6 +171,7 @@ func (a *Application) Stop() error {
 	}
 	err = process.Signal(syscall.SIGTERM)
 	<-a.finished
+	a.saveCacheStates()
 	a.ctxCancel()
 	return err
 }
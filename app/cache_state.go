@@ -0,0 +1,127 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+)
+
+// defaultStateSaveInterval is how often the state of the cache algorithms is
+// saved when their cache zone does not set an interval.
+const defaultStateSaveInterval = 5 * time.Minute
+
+// loadCacheState restores the state of the cache algorithm of the zone from
+// its state file. It returns the restored parts by their hashes, so that the
+// ones which are not found in the storage can be removed.
+func (a *Application) loadCacheState(cz *types.CacheZone, stateFile string) map[types.ObjectIndexHash]*types.ObjectIndex {
+	snapshotter, ok := cz.Algorithm.(types.StateSnapshotter)
+	if !ok || stateFile == "" {
+		return nil
+	}
+
+	f, err := os.Open(stateFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		a.GetLogger().Errorf("Could not open the state file of cache zone `%s`: %s", cz.ID, err)
+		return nil
+	}
+	defer f.Close()
+
+	parts, err := snapshotter.LoadState(f)
+	if err != nil {
+		a.GetLogger().Errorf("Could not restore the state of cache zone `%s` from %s: %s",
+			cz.ID, stateFile, err)
+		return nil
+	}
+	a.GetLogger().Logf("Restored %d parts for cache zone `%s` from %s", len(parts), cz.ID, stateFile)
+
+	var restored = make(map[types.ObjectIndexHash]*types.ObjectIndex, len(parts))
+	for _, idx := range parts {
+		restored[idx.Hash()] = idx
+	}
+	return restored
+}
+
+// saveCacheState writes the state of the cache algorithm of the zone to its
+// state file. The file is replaced only after the whole state is written.
+func (a *Application) saveCacheState(cz *types.CacheZone, stateFile string) error {
+	snapshotter, ok := cz.Algorithm.(types.StateSnapshotter)
+	if !ok || stateFile == "" {
+		return nil
+	}
+
+	var tmpFile = stateFile + ".tmp"
+	f, err := os.OpenFile(tmpFile, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := snapshotter.SaveState(f); err != nil {
+		return utils.NewCompositeError(err, f.Close(), os.Remove(tmpFile))
+	} else if err := f.Close(); err != nil {
+		return utils.NewCompositeError(err, os.Remove(tmpFile))
+	}
+	return os.Rename(tmpFile, stateFile)
+}
+
+// saveCacheStates saves the states of the cache algorithms of all the zones.
+// It is called when the application is stopped.
+func (a *Application) saveCacheStates() {
+	for id, cz := range a.cacheZones {
+		cfgCz, ok := a.cfg.CacheZones[id]
+		if !ok {
+			continue
+		}
+		if err := a.saveCacheState(cz, cfgCz.StateFile); err != nil {
+			a.GetLogger().Errorf("Could not save the state of cache zone `%s`: %s", id, err)
+		}
+	}
+}
+
+// saveCacheStatePeriodically saves the state of the cache algorithm of the
+// zone until the application is stopped.
+func (a *Application) saveCacheStatePeriodically(cz *types.CacheZone, stateFile string, interval time.Duration) {
+	if _, ok := cz.Algorithm.(types.StateSnapshotter); !ok || stateFile == "" {
+		return
+	}
+	if interval == 0 {
+		interval = defaultStateSaveInterval
+	}
+	if err := os.MkdirAll(filepath.Dir(stateFile), 0700); err != nil {
+		a.GetLogger().Errorf("Could not create the directory of the state file of cache zone `%s`: %s",
+			cz.ID, err)
+	}
+
+	go func() {
+		var ticker = time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+			if err := a.saveCacheState(cz, stateFile); err != nil {
+				a.GetLogger().Errorf("Could not save the state of cache zone `%s`: %s", cz.ID, err)
+			}
+		}
+	}()
+}
+
+// forgetMissingParts removes from the cache algorithm of the zone the restored
+// parts which were not found in the storage.
+func (a *Application) forgetMissingParts(cz *types.CacheZone, missing map[types.ObjectIndexHash]*types.ObjectIndex) {
+	if len(missing) == 0 {
+		return
+	}
+	var parts = make([]*types.ObjectIndex, 0, len(missing))
+	for _, idx := range missing {
+		parts = append(parts, idx)
+	}
+	cz.Algorithm.Remove(parts...)
+	a.GetLogger().Logf("Removed %d restored parts which are not in the storage of cache zone `%s`",
+		len(parts), cz.ID)
+}
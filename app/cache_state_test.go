@@ -0,0 +1,70 @@
+package app
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/cache/lru"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/storage/disk"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func TestCacheStateIsRestoredAndReconciled(t *testing.T) {
+	t.Parallel()
+	tempDir, cleanup := testutils.GetTestFolder(t)
+	defer cleanup()
+
+	app, err := New(types.AppVersion{}, getConfigGetter(tempDir))
+	if err != nil {
+		t.Fatalf("Could not create an application: %s", err)
+	}
+	app.SetLogger(mock.NewLogger())
+	var cfgCz = app.cfg.CacheZones["default"]
+	cfgCz.StateFile = filepath.Join(tempDir, "default.state")
+
+	stor, err := disk.New(cfgCz, app.GetLogger())
+	if err != nil {
+		t.Fatalf("Could not initialize a storage: %s", err)
+	}
+	var stored = &types.ObjectIndex{ObjID: types.NewObjectID("key", "stored"), Part: 0}
+	var missing = &types.ObjectIndex{ObjID: types.NewObjectID("key", "missing"), Part: 0}
+	testutils.ShouldntFail(t,
+		stor.SaveMetadata(&types.ObjectMetadata{ID: stored.ObjID, ExpiresAt: time.Now().Unix() + 600}),
+		stor.SavePart(stored, strings.NewReader("test")),
+	)
+
+	var saved = lru.New(cfgCz, func(*types.ObjectIndex) error { return nil }, app.GetLogger())
+	testutils.ShouldntFail(t, saved.AddObject(stored), saved.AddObject(missing))
+	f, err := os.Create(cfgCz.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testutils.ShouldntFail(t, saved.SaveState(f), f.Close())
+
+	if err := app.reinitFromConfig(app.cfg, false); err != nil {
+		t.Fatalf("Could not init from config: %s", err)
+	}
+	defer app.ctxCancel()
+	time.Sleep(1 * time.Second)
+
+	var algorithm = app.cacheZones["default"].Algorithm
+	if !algorithm.Lookup(stored) {
+		t.Errorf("Expected %s to be in the cache", stored)
+	}
+	if algorithm.Lookup(missing) {
+		t.Errorf("Expected %s to be removed from the cache as it is not in the storage", missing)
+	}
+
+	if err := os.Remove(cfgCz.StateFile); err != nil {
+		t.Fatal(err)
+	}
+	app.saveCacheStates()
+	if _, err := os.Stat(cfgCz.StateFile); err != nil {
+		t.Errorf("Expected the state to be saved but got %s", err)
+	}
+}
@@ -92,7 +92,8 @@ func (a *Application) reinitFromConfig(cfg *config.Config, testOnly bool) (err e
 		zone.Storage.SetLogger(app.GetLogger())
 		zone.Scheduler.SetLogger(app.GetLogger())
 		zone.Algorithm.SetLogger(app.GetLogger())
-		zone.Algorithm.ChangeConfig(cfgCz.BulkRemoveTimeout, cfgCz.BulkRemoveCount, cfgCz.StorageObjects)
+		zone.Algorithm.ChangeConfig(cfgCz.BulkRemoveTimeout, cfgCz.BulkRemoveCount, cfgCz.ObjectsLimit())
+		setSpaceLimits(zone, cfgCz)
 	}
 	for id, zone := range app.cacheZones { // copy everything
 		a.cacheZones[id] = zone
@@ -114,13 +115,29 @@ func (a *Application) initCacheZone(cfgCz *config.CacheZone, testOnly bool) (err
 	}
 
 	// Initialize the cache algorithm
-	if cz.Algorithm, err = cache.New(cfgCz, cz.Storage.DiscardPart, a.GetLogger()); err != nil {
+	if cz.Algorithm, err = cache.New(cfgCz, evictPartFunc(cz), a.GetLogger()); err != nil {
 		return fmt.Errorf("Could not initialize algorithm '%s' for cache zone '%s': %s",
 			cfgCz.Algorithm, cfgCz.ID, err)
 	}
+	if remover, ok := cz.Algorithm.(types.ObjectRemover); ok {
+		remover.SetObjectRemoveFunc(evictObjectFunc(cz))
+	}
+	if notifier, ok := cz.Storage.(types.RemovalNotifier); ok {
+		// The parts which the storage removes on its own, for example while
+		// scrubbing, are not in the storage any more
+		notifier.SetRemovedFunc(cz.Algorithm.Remove)
+	}
+	setSpaceLimits(cz, cfgCz)
+	if prober, ok := cz.Storage.(types.HealthProber); ok {
+		// The degraded disks are not probed after the application is stopped
+		prober.SetProbeContext(a.ctx)
+	}
 
 	if !testOnly {
-		a.reloadCache(cz)
+		a.reloadCache(cz, cfgCz.StateFile)
+		a.scrubCache(cz, time.Duration(cfgCz.ScrubInterval)*time.Second)
+		a.saveCacheStatePeriodically(cz, cfgCz.StateFile,
+			time.Duration(cfgCz.StateSaveInterval)*time.Second)
 	}
 
 	a.cacheZones[cfgCz.ID] = cz
@@ -128,6 +145,36 @@ func (a *Application) initCacheZone(cfgCz *config.CacheZone, testOnly bool) (err
 	return nil
 }
 
+// evictPartFunc returns the function with which the cache algorithm of the
+// zone removes parts from its storage.
+func evictPartFunc(cz *types.CacheZone) func(*types.ObjectIndex) error {
+	return func(idx *types.ObjectIndex) error {
+		cz.Traffic.EvictedPart()
+		return cz.Storage.DiscardPart(idx)
+	}
+}
+
+// evictObjectFunc returns the function with which the cache algorithm of the
+// zone removes whole objects from its storage.
+func evictObjectFunc(cz *types.CacheZone) func(*types.ObjectID) error {
+	return func(id *types.ObjectID) error {
+		cz.Traffic.EvictedObject()
+		return cz.Storage.Discard(id)
+	}
+}
+
+// setSpaceLimits makes the cache algorithm of the zone evict parts when its
+// storage goes over the max_size or min_free_space limits.
+func setSpaceLimits(cz *types.CacheZone, cfgCz *config.CacheZone) {
+	limiter, ok := cz.Algorithm.(types.SpaceLimiter)
+	if !ok {
+		return
+	}
+	if usage, ok := cz.Storage.(types.UsageReporter); ok {
+		limiter.SetSpaceLimits(usage, cfgCz.MaxSize.Bytes(), cfgCz.MinFreeSpace.Bytes())
+	}
+}
+
 func (a *Application) getUpstream(upID string) (types.Upstream, error) {
 	if upID == "" {
 		return nil, nil
@@ -163,6 +210,7 @@ func (a *Application) initVirtualHost(cfgVhost *config.VirtualHost, logs accessL
 			Name:                  cfgVhost.Name,
 			CacheKey:              cfgVhost.CacheKey,
 			CacheKeyIncludesQuery: cfgVhost.CacheKeyIncludesQuery,
+			CacheKeyTemplate:      cfgVhost.CacheKeyTemplate,
 			CacheDefaultDuration:  cfgVhost.CacheDefaultDuration,
 		},
 	}
@@ -218,6 +266,7 @@ func (a *Application) initFromConfigLocationsForVHost(cfgLocations []*config.Loc
 			Name:                  locCfg.Name,
 			CacheKey:              locCfg.CacheKey,
 			CacheKeyIncludesQuery: locCfg.CacheKeyIncludesQuery,
+			CacheKeyTemplate:      locCfg.CacheKeyTemplate,
 			CacheDefaultDuration:  locCfg.CacheDefaultDuration,
 		}
 		if locations[index].Upstream, err = a.getUpstream(locCfg.Upstream); err != nil {
@@ -245,7 +294,11 @@ func (a *Application) initFromConfigLocationsForVHost(cfgLocations []*config.Loc
 	return locations, nil
 }
 
-func (a *Application) reloadCache(cz *types.CacheZone) {
+// reloadCache restores the saved state of the cache algorithm of the zone, if
+// there is one, and adds to it all the objects in the storage in the
+// background. The restored parts which are not in the storage are removed.
+func (a *Application) reloadCache(cz *types.CacheZone, stateFile string) {
+	restored := a.loadCacheState(cz, stateFile)
 	counter := 0
 	callback := func(obj *types.ObjectMetadata, parts ...*types.ObjectIndex) bool {
 		counter++
@@ -258,9 +311,11 @@ func (a *Application) reloadCache(cz *types.CacheZone) {
 			}
 		}
 
-		if !utils.IsMetadataFresh(obj) {
+		if !utils.IsMetadataKept(obj) {
 			if err := cz.Storage.Discard(obj.ID); err != nil {
 				a.GetLogger().Errorf("Error for cache zone `%s` on discarding objID `%s` in reloadCache: %s", cz.ID, obj.ID, err)
+			} else {
+				cz.Traffic.Expired()
 			}
 		} else {
 			cz.Scheduler.AddEvent(
@@ -268,10 +323,11 @@ func (a *Application) reloadCache(cz *types.CacheZone) {
 				storage.GetExpirationHandler(cz, obj.ID),
 				//!TODO: Maybe do not use time.Now but cached time. See the todo comment
 				// in utils.IsMetadataFresh.
-				time.Unix(obj.ExpiresAt, 0).Sub(time.Now()),
+				utils.MetadataKeepUntil(obj).Sub(time.Now()),
 			)
 
 			for _, idx := range parts {
+				delete(restored, idx.Hash())
 				if err := cz.Algorithm.AddObject(idx); err != nil && err != types.ErrAlreadyInCache {
 					a.GetLogger().Errorf("Error for cache zone `%s` on adding objID `%s` in reloadCache: %s", cz.ID, obj.ID, err)
 				}
@@ -303,8 +359,41 @@ func (a *Application) reloadCache(cz *types.CacheZone) {
 		a.GetLogger().Logf("Start storage reload for cache zone `%s`", cz.ID)
 		if err := cz.Storage.Iterate(callback); err != nil {
 			a.GetLogger().Errorf("For cache zone `%s` received iterator error '%s' after loading %d objects", cz.ID, err, counter)
-		} else {
+		} else if a.ctx.Err() == nil {
 			a.GetLogger().Logf("Loading contents from disk for cache zone `%s` finished: %d objects loaded!", cz.ID, counter)
+			a.forgetMissingParts(cz, restored)
+		}
+	}()
+}
+
+// scrubCache periodically scrubs the storage of the cache zone, if it supports
+// scrubbing, until the application is stopped.
+func (a *Application) scrubCache(cz *types.CacheZone, interval time.Duration) {
+	scrubber, ok := cz.Storage.(types.Scrubber)
+	if !ok || interval == 0 {
+		return
+	}
+
+	go func() {
+		var ticker = time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-a.ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			a.GetLogger().Logf("Start scrubbing the storage of cache zone `%s`", cz.ID)
+			if err := scrubber.Scrub(a.ctx); err != nil {
+				a.GetLogger().Errorf("Scrubbing the storage of cache zone `%s` stopped: %s", cz.ID, err)
+				continue
+			}
+			p := scrubber.ScrubProgress()
+			a.GetLogger().Logf("Scrubbing the storage of cache zone `%s` finished: %d objects checked, "+
+				"%d removed, %d repaired, %d temporary files and %d orphan parts removed",
+				cz.ID, p.ObjectsChecked, p.RemovedObjects, p.RepairedObjects,
+				p.RemovedTempFiles, p.RemovedOrphanParts)
 		}
 	}()
 }
@@ -3,6 +3,7 @@ package app
 import (
 	"errors"
 	"fmt"
+	"reflect"
 
 	"github.com/ironsmile/nedomi/config"
 )
@@ -68,7 +69,7 @@ func cacheZonesAreCompatible(zones1, zones2 map[string]*config.CacheZone) error
 		if zone2.Type != zone1.Type {
 			return fmt.Errorf(errTmplDifferentType, key)
 		}
-		if zone2.Path != zone1.Path {
+		if zone2.Path != zone1.Path || !reflect.DeepEqual(zone2.Paths, zone1.Paths) {
 			return fmt.Errorf(errTmplDifferentPath, key)
 		}
 
@@ -0,0 +1,391 @@
+// Package arc contains an Adaptive Replacement Cache eviction implementation.
+// It splits the cache between the parts which were requested once recently and
+// the parts which were requested at least twice. It remembers the parts which
+// were recently evicted from both and moves the target size of the split
+// towards the side whose evicted parts are requested again. Parts which are
+// requested only once, for example by scans, can not push the frequently
+// requested ones out of the cache.
+package arc
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/types"
+)
+
+// segment is one of the four lists of the ARC
+type segment int
+
+const (
+	// recent contains the cached parts which were requested once recently
+	recent segment = iota
+	// frequent contains the cached parts which were requested at least twice
+	frequent
+	// recentGhost contains the parts which were evicted from recent
+	recentGhost
+	// frequentGhost contains the parts which were evicted from frequent
+	frequentGhost
+
+	segments
+)
+
+// element is stored in the cache lookup hashmap
+type element struct {
+	listElem *list.Element
+	segment  segment
+}
+
+// ARC implements types.CacheAlgorithm. The cached parts are in the recent and
+// frequent lists. The ghost lists only contain the indexes of the evicted parts.
+type ARC struct {
+	types.SyncLogger
+
+	cfg *config.CacheZone
+
+	lists  [segments]*list.List
+	lookup map[types.ObjectIndexHash]*element
+	mutex  sync.Mutex
+
+	// capacity is the number of parts which fit in the cache and target is
+	// how many of them should be in the recent list.
+	capacity int
+	target   int
+
+	removeFunc func(*types.ObjectIndex) error
+
+	// Parts are evicted when the storage goes over these limits
+	limits *types.SpaceLimits
+
+	// Used to track cache hit/miss information
+	lookups types.LookupCounter
+}
+
+// Lookup implements part of types.CacheAlgorithm interface
+func (a *ARC) Lookup(oi *types.ObjectIndex) bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.lookups.Record(a.isCached(oi))
+}
+
+func (a *ARC) isCached(oi *types.ObjectIndex) bool {
+	el, ok := a.lookup[oi.Hash()]
+	return ok && (el.segment == recent || el.segment == frequent)
+}
+
+// ShouldKeep implements part of types.CacheAlgorithm interface
+func (a *ARC) ShouldKeep(oi *types.ObjectIndex) bool {
+	if err := a.AddObject(oi); err != nil && err != types.ErrAlreadyInCache {
+		a.GetLogger().Errorf("Error storing object: %s", err)
+	}
+	return true
+}
+
+// AddObject implements part of types.CacheAlgorithm interface
+func (a *ARC) AddObject(oi *types.ObjectIndex) error {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	if a.isCached(oi) {
+		return types.ErrAlreadyInCache
+	}
+
+	a.add(oi)
+	return nil
+}
+
+// add stores the part which is not cached. If it was evicted recently the
+// target size of the recent list is adapted and the part is stored in the
+// frequent list.
+func (a *ARC) add(oi *types.ObjectIndex) {
+	a.GetLogger().Debugf("Storing %s in arc", oi)
+
+	if el, ok := a.lookup[oi.Hash()]; ok {
+		// A ghost hit
+		recentLen, frequentLen := a.lists[recentGhost].Len(), a.lists[frequentGhost].Len()
+		if el.segment == recentGhost {
+			a.target = min(a.capacity, a.target+max(frequentLen/recentLen, 1))
+		} else {
+			a.target = max(0, a.target-max(recentLen/frequentLen, 1))
+		}
+
+		a.lists[el.segment].Remove(el.listElem)
+		delete(a.lookup, oi.Hash())
+		a.makeSpace(el.segment == frequentGhost)
+		a.push(oi, frequent)
+		a.evictForSpace()
+		return
+	}
+
+	var recentHistory = a.lists[recent].Len() + a.lists[recentGhost].Len()
+	var history = recentHistory + a.lists[frequent].Len() + a.lists[frequentGhost].Len()
+	if recentHistory >= a.capacity {
+		if a.lists[recent].Len() < a.capacity {
+			a.forgetOldest(recentGhost)
+			a.makeSpace(false)
+		} else {
+			a.evictOldest(recent)
+		}
+	} else if history >= a.capacity {
+		if history >= 2*a.capacity {
+			a.forgetOldest(frequentGhost)
+		}
+		a.makeSpace(false)
+	}
+
+	a.push(oi, recent)
+	a.evictForSpace()
+}
+
+func (a *ARC) cached() int {
+	return a.lists[recent].Len() + a.lists[frequent].Len()
+}
+
+func (a *ARC) push(oi *types.ObjectIndex, s segment) {
+	a.lookup[oi.Hash()] = &element{
+		listElem: a.lists[s].PushFront(*oi),
+		segment:  s,
+	}
+}
+
+// makeSpace evicts one part when the cache is full. It is taken from the
+// recent list when it is over its target size and from the frequent list
+// otherwise. The evicted part is remembered in the corresponding ghost list.
+func (a *ARC) makeSpace(frequentGhostHit bool) {
+	if a.cached() < a.capacity {
+		return
+	}
+	a.replace(frequentGhostHit)
+}
+
+// replace evicts one part from the cache and returns false if it is empty.
+func (a *ARC) replace(frequentGhostHit bool) bool {
+	var recentLen = a.lists[recent].Len()
+	if recentLen > 0 && (recentLen > a.target || frequentGhostHit && recentLen == a.target) {
+		return a.demoteOldest(recent, recentGhost)
+	}
+	if a.lists[frequent].Len() > 0 {
+		return a.demoteOldest(frequent, frequentGhost)
+	}
+	return a.demoteOldest(recent, recentGhost)
+}
+
+// demoteOldest moves the least recently used part of a cached list to the
+// front of a ghost list and removes it from the storage.
+func (a *ARC) demoteOldest(from, to segment) bool {
+	back := a.lists[from].Back()
+	if back == nil {
+		return false
+	}
+
+	val := a.lists[from].Remove(back).(types.ObjectIndex)
+	el := a.lookup[val.Hash()]
+	el.listElem = a.lists[to].PushFront(val)
+	el.segment = to
+	a.trimGhosts()
+
+	if err := a.removeFunc(&val); err != nil {
+		a.GetLogger().Logf("error while removing %s from cache - %s", &val, err)
+	}
+	return true
+}
+
+// evictOldest removes the least recently used part of a cached list from the
+// cache and the storage without remembering it.
+func (a *ARC) evictOldest(from segment) {
+	back := a.lists[from].Back()
+	if back == nil {
+		return
+	}
+
+	val := a.lists[from].Remove(back).(types.ObjectIndex)
+	delete(a.lookup, val.Hash())
+	if err := a.removeFunc(&val); err != nil {
+		a.GetLogger().Logf("error while removing %s from cache - %s", &val, err)
+	}
+}
+
+// forgetOldest removes the least recently used part of a ghost list.
+func (a *ARC) forgetOldest(from segment) {
+	if back := a.lists[from].Back(); back != nil {
+		val := a.lists[from].Remove(back).(types.ObjectIndex)
+		delete(a.lookup, val.Hash())
+	}
+}
+
+// trimGhosts keeps the ghost lists together no bigger than the cache. Parts
+// which are evicted for space and not because of a new part may make them
+// grow over it.
+func (a *ARC) trimGhosts() {
+	for a.lists[recentGhost].Len()+a.lists[frequentGhost].Len() > a.capacity {
+		if a.lists[recent].Len()+a.lists[recentGhost].Len() > a.capacity ||
+			a.lists[frequentGhost].Len() == 0 {
+			a.forgetOldest(recentGhost)
+		} else {
+			a.forgetOldest(frequentGhost)
+		}
+	}
+}
+
+// SetSpaceLimits implements types.SpaceLimiter.
+func (a *ARC) SetSpaceLimits(usage types.UsageReporter, maxSize, minFreeSpace uint64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	a.limits = types.NewSpaceLimits(usage, maxSize, minFreeSpace, a.cfg.PartSize.Bytes())
+	a.evictForSpace()
+}
+
+// evictForSpace evicts parts until enough of them have been removed to bring
+// the storage within its space limits. Every part is counted as a whole
+// part_size, so the usage does not have to be checked again after each
+// removal.
+func (a *ARC) evictForSpace() {
+	excess, err := a.limits.Excess()
+	if err != nil {
+		a.GetLogger().Errorf("Could not get the free space of the storage: %s", err)
+	}
+
+	var partSize = a.cfg.PartSize.Bytes()
+	for freed := uint64(0); freed < excess; freed += partSize {
+		if !a.replace(false) {
+			return
+		}
+	}
+}
+
+// Remove the objects given from the cache. They are not remembered in the
+// ghost lists.
+func (a *ARC) Remove(ois ...*types.ObjectIndex) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, oi := range ois {
+		if el, ok := a.lookup[oi.Hash()]; ok {
+			delete(a.lookup, oi.Hash())
+			a.lists[el.segment].Remove(el.listElem)
+		}
+	}
+}
+
+// PromoteObject implements part of types.CacheAlgorithm interface. The part is
+// moved to the front of the frequent list.
+func (a *ARC) PromoteObject(oi *types.ObjectIndex) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	el, ok := a.lookup[oi.Hash()]
+	if !ok || el.segment == recentGhost || el.segment == frequentGhost {
+		// This part is in the storage but not in the cache yet. So we add it.
+		a.add(oi)
+		return
+	}
+
+	if el.segment == frequent {
+		a.lists[frequent].MoveToFront(el.listElem)
+		return
+	}
+
+	a.lists[recent].Remove(el.listElem)
+	el.listElem = a.lists[frequent].PushFront(*oi)
+	el.segment = frequent
+}
+
+// ConsumedSize implements part of types.CacheAlgorithm interface
+func (a *ARC) ConsumedSize() types.BytesSize {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	return a.cfg.PartSize * types.BytesSize(a.cached())
+}
+
+func (a *ARC) init() {
+	for i := range a.lists {
+		a.lists[i] = list.New()
+	}
+	a.lookup = make(map[types.ObjectIndexHash]*element)
+	a.capacity = int(a.cfg.ObjectsLimit())
+	a.target = 0
+}
+
+// New returns ARC object ready for use.
+func New(cz *config.CacheZone, removeFunc func(*types.ObjectIndex) error,
+	logger types.Logger) *ARC {
+
+	a := &ARC{
+		cfg:        cz,
+		removeFunc: removeFunc,
+	}
+	a.SetLogger(logger)
+	a.init()
+	return a
+}
+
+// ChangeConfig changes the ARC config and start using it
+func (a *ARC) ChangeConfig(bulkRemoveTimout, bulkRemoveCount, newsize uint64) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.cfg.StorageObjects = newsize
+	a.cfg.BulkRemoveCount = bulkRemoveCount
+	a.cfg.BulkRemoveTimeout = bulkRemoveTimout
+	a.resize()
+}
+
+// resize changes the capacity of the cache. When it shrinks the parts which do
+// not fit in it any more are removed from the storage in bulks in the
+// background.
+func (a *ARC) resize() {
+	a.capacity = int(a.cfg.ObjectsLimit())
+	a.target = min(a.target, a.capacity)
+
+	var removed []types.ObjectIndex
+	for a.cached() > a.capacity {
+		var from = frequent
+		if a.lists[recent].Len() > a.target || a.lists[frequent].Len() == 0 {
+			from = recent
+		}
+		val := a.lists[from].Remove(a.lists[from].Back()).(types.ObjectIndex)
+		delete(a.lookup, val.Hash())
+		removed = append(removed, val)
+	}
+	a.trimGhosts()
+
+	if len(removed) > 0 {
+		go a.throttledRemove(removed)
+	}
+}
+
+// throttledRemove removes the elements which are not in the cache any more
+// after it was resized down.
+func (a *ARC) throttledRemove(indexes []types.ObjectIndex) {
+	types.ThrottledRemove(indexes, int(a.cfg.BulkRemoveCount),
+		time.Duration(a.cfg.BulkRemoveTimeout)*time.Millisecond, a.removeIfMissing, a.GetLogger())
+}
+
+func (a *ARC) removeIfMissing(ois ...types.ObjectIndex) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	for _, oi := range ois {
+		if !a.isCached(&oi) {
+			a.removeFunc(&oi)
+		}
+	}
+}
+
+func min(l, r int) int {
+	if l > r {
+		return r
+	}
+	return l
+}
+
+func max(l, r int) int {
+	if l < r {
+		return r
+	}
+	return l
+}
@@ -0,0 +1,191 @@
+package arc
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+)
+
+func getCache(objects uint64, removed *[]types.ObjectIndex) *ARC {
+	return New(&config.CacheZone{StorageObjects: objects, PartSize: 10},
+		func(oi *types.ObjectIndex) error {
+			if removed != nil {
+				*removed = append(*removed, *oi)
+			}
+			return nil
+		}, mock.NewLogger())
+}
+
+// request simulates a request for the part the way the cache handler does it
+func request(a *ARC, oi *types.ObjectIndex) {
+	if a.Lookup(oi) {
+		a.PromoteObject(oi)
+	} else {
+		a.ShouldKeep(oi)
+	}
+}
+
+func checkInvariants(t *testing.T, a *ARC) {
+	if cached := a.cached(); cached > a.capacity {
+		t.Errorf("There are %d cached parts but the capacity is %d", cached, a.capacity)
+	}
+	if ghosts := a.lists[recentGhost].Len() + a.lists[frequentGhost].Len(); ghosts > a.capacity {
+		t.Errorf("There are %d parts in the ghost lists but the capacity is %d", ghosts, a.capacity)
+	}
+	var total int
+	for _, l := range a.lists {
+		total += l.Len()
+	}
+	if total != len(a.lookup) {
+		t.Errorf("There are %d parts in the lists but %d in the lookup map", total, len(a.lookup))
+	}
+}
+
+func TestScansDoNotEvictFrequentParts(t *testing.T) {
+	t.Parallel()
+	var a = getCache(10, nil)
+
+	var popular = types.NewObjectID("1.1", "/popular")
+	for round := 0; round < 3; round++ {
+		for i := uint32(0); i < 5; i++ {
+			request(a, &types.ObjectIndex{ObjID: popular, Part: i})
+		}
+	}
+
+	var scan = types.NewObjectID("1.1", "/scan")
+	for i := uint32(0); i < 100; i++ {
+		request(a, &types.ObjectIndex{ObjID: scan, Part: i})
+		checkInvariants(t, a)
+	}
+
+	for i := uint32(0); i < 5; i++ {
+		oi := &types.ObjectIndex{ObjID: popular, Part: i}
+		if !a.isCached(oi) {
+			t.Errorf("Expected %s to stay in the cache during the scan", oi)
+		}
+	}
+	if objects := a.Stats().Objects(); objects != 10 {
+		t.Errorf("Expected 10 objects in the cache but there are %d", objects)
+	}
+}
+
+func TestGhostHitsAdaptTheTarget(t *testing.T) {
+	t.Parallel()
+	var removed []types.ObjectIndex
+	var a = getCache(4, &removed)
+
+	var id = types.NewObjectID("1.1", "/path")
+	for _, part := range []uint32{0, 1, 0, 1, 2, 3, 4} {
+		request(a, &types.ObjectIndex{ObjID: id, Part: part})
+		checkInvariants(t, a)
+	}
+	if len(removed) != 1 || removed[0].Part != 2 {
+		t.Fatalf("Expected part 2 to be evicted but got %v", removed)
+	}
+
+	var evicted = &types.ObjectIndex{ObjID: id, Part: 2}
+	if el, ok := a.lookup[evicted.Hash()]; !ok || el.segment != recentGhost {
+		t.Fatalf("Expected %s to be remembered in the recent ghost list", evicted)
+	}
+
+	request(a, evicted)
+	checkInvariants(t, a)
+	if a.target != 1 {
+		t.Errorf("Expected the target size of the recent list to grow to 1 but it is %d", a.target)
+	}
+	if el := a.lookup[evicted.Hash()]; el.segment != frequent {
+		t.Errorf("Expected %s to be stored in the frequent list after a ghost hit", evicted)
+	}
+}
+
+func TestRemoveAndConsumedSize(t *testing.T) {
+	t.Parallel()
+	var a = getCache(10, nil)
+	var id = types.NewObjectID("1.1", "/path")
+	for i := uint32(0); i < 5; i++ {
+		if err := a.AddObject(&types.ObjectIndex{ObjID: id, Part: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := a.AddObject(&types.ObjectIndex{ObjID: id, Part: 0}); err != types.ErrAlreadyInCache {
+		t.Errorf("Expected ErrAlreadyInCache but got %v", err)
+	}
+	a.PromoteObject(&types.ObjectIndex{ObjID: id, Part: 1})
+
+	a.Remove(&types.ObjectIndex{ObjID: id, Part: 0}, &types.ObjectIndex{ObjID: id, Part: 1})
+	checkInvariants(t, a)
+	if size := a.ConsumedSize(); size != 30 {
+		t.Errorf("Expected consumed size of 30 but got %d", size)
+	}
+	if a.Lookup(&types.ObjectIndex{ObjID: id, Part: 1}) {
+		t.Error("Expected the removed part not to be found")
+	}
+}
+
+func TestResizeDown(t *testing.T) {
+	t.Parallel()
+	var removed = make(chan types.ObjectIndex, 10)
+	var a = New(&config.CacheZone{StorageObjects: 10, PartSize: 10},
+		func(oi *types.ObjectIndex) error {
+			removed <- *oi
+			return nil
+		}, mock.NewLogger())
+	var id = types.NewObjectID("1.1", "/path")
+	for i := uint32(0); i < 10; i++ {
+		if err := a.AddObject(&types.ObjectIndex{ObjID: id, Part: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	a.ChangeConfig(1, 2, 4)
+	checkInvariants(t, a)
+	if objects := a.Stats().Objects(); objects != 4 {
+		t.Errorf("Expected 4 objects after the resize but there are %d", objects)
+	}
+	for i := 0; i < 6; i++ {
+		if oi := <-removed; oi.Part > 5 {
+			t.Errorf("Expected only the least recently used parts to be removed but %d was", oi.Part)
+		}
+	}
+}
+
+type fakeUsage struct {
+	sync.Mutex
+	used uint64
+}
+
+func (u *fakeUsage) BytesUsed() uint64 {
+	u.Lock()
+	defer u.Unlock()
+	return u.used
+}
+
+func (u *fakeUsage) FreeSpace() (uint64, error) {
+	return 1 << 30, nil
+}
+
+func TestSpaceLimits(t *testing.T) {
+	t.Parallel()
+	var usage = &fakeUsage{}
+	var a = New(&config.CacheZone{StorageObjects: 100, PartSize: 10},
+		func(oi *types.ObjectIndex) error {
+			usage.used -= 10
+			return nil
+		}, mock.NewLogger())
+	a.SetSpaceLimits(usage, 50, 0)
+
+	var id = types.NewObjectID("1.1", "/path")
+	for i := uint32(0); i < 10; i++ {
+		usage.used += 10
+		if err := a.AddObject(&types.ObjectIndex{ObjID: id, Part: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkInvariants(t, a)
+	if objects := a.Stats().Objects(); objects != 5 {
+		t.Errorf("Expected 5 objects within the space limit but there are %d", objects)
+	}
+}
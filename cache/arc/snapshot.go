@@ -0,0 +1,112 @@
+package arc
+
+import (
+	"container/list"
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// snapshotVersion should be incremented on every incompatible change of the
+// snapshot. Snapshots with other versions are not loaded.
+const snapshotVersion = 1
+
+// snapshot is the saved state of the ARC. The parts in every list are in their
+// order, from the front to the back.
+type snapshot struct {
+	Version int
+	Target  int
+	Lists   [][]snapshotPart
+}
+
+type snapshotPart struct {
+	CacheKey string
+	Path     string
+	Variant  string
+	Part     uint32
+}
+
+// SaveState implements types.StateSnapshotter.
+func (a *ARC) SaveState(w io.Writer) error {
+	a.mutex.Lock()
+	var s = snapshot{
+		Version: snapshotVersion,
+		Target:  a.target,
+		Lists:   make([][]snapshotPart, segments),
+	}
+	for i, l := range a.lists {
+		s.Lists[i] = listSnapshot(l)
+	}
+	a.mutex.Unlock()
+
+	return gob.NewEncoder(w).Encode(&s)
+}
+
+func listSnapshot(l *list.List) []snapshotPart {
+	var parts = make([]snapshotPart, 0, l.Len())
+	for e := l.Front(); e != nil; e = e.Next() {
+		oi := e.Value.(types.ObjectIndex)
+		parts = append(parts, snapshotPart{
+			CacheKey: oi.ObjID.CacheKey(),
+			Path:     oi.ObjID.Path(),
+			Variant:  oi.ObjID.Variant(),
+			Part:     oi.Part,
+		})
+	}
+	return parts
+}
+
+// LoadState implements types.StateSnapshotter. The parts which do not fit in
+// the current size of the cache are not restored. Only the cached parts are
+// returned, the ghost lists are restored as well but they are not in the
+// storage.
+func (a *ARC) LoadState(r io.Reader) ([]*types.ObjectIndex, error) {
+	var s snapshot
+	if err := gob.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	} else if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported arc snapshot version %d", s.Version)
+	} else if len(s.Lists) != int(segments) {
+		return nil, fmt.Errorf("the arc snapshot has %d lists instead of %d", len(s.Lists), segments)
+	}
+
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.init()
+	a.target = min(max(s.Target, 0), a.capacity)
+
+	var restored []*types.ObjectIndex
+	var ids = make(map[types.ObjectIDHash]*types.ObjectID)
+	for _, seg := range []segment{frequent, recent, frequentGhost, recentGhost} {
+		var limit = a.capacity - a.cached()
+		if seg == frequentGhost || seg == recentGhost {
+			limit = a.capacity - a.lists[recentGhost].Len() - a.lists[frequentGhost].Len()
+		}
+		for _, p := range s.Lists[seg] {
+			if limit <= 0 {
+				break
+			}
+			id := types.NewVariantObjectID(p.CacheKey, p.Path, p.Variant)
+			if existing, ok := ids[id.Hash()]; ok {
+				id = existing
+			} else {
+				ids[id.Hash()] = id
+			}
+			oi := types.ObjectIndex{ObjID: id, Part: p.Part}
+			if _, ok := a.lookup[oi.Hash()]; ok {
+				continue
+			}
+			a.lookup[oi.Hash()] = &element{
+				listElem: a.lists[seg].PushBack(oi),
+				segment:  seg,
+			}
+			limit--
+			if seg == recent || seg == frequent {
+				restored = append(restored, &oi)
+			}
+		}
+	}
+	return restored, nil
+}
@@ -0,0 +1,57 @@
+package arc
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+func listsContents(a *ARC) [][]string {
+	var result = make([][]string, segments)
+	for i, l := range a.lists {
+		for e := l.Front(); e != nil; e = e.Next() {
+			oi := e.Value.(types.ObjectIndex)
+			result[i] = append(result[i], oi.String())
+		}
+	}
+	return result
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	t.Parallel()
+	var original = getCache(6, nil)
+	var ids = []*types.ObjectID{
+		types.NewObjectID("1.1", "/first"),
+		types.NewVariantObjectID("1.1", "/second", "gzip"),
+	}
+	for _, id := range ids {
+		for i := uint32(0); i < 5; i++ {
+			request(original, &types.ObjectIndex{ObjID: id, Part: i})
+		}
+		request(original, &types.ObjectIndex{ObjID: id, Part: 3})
+	}
+	request(original, &types.ObjectIndex{ObjID: ids[0], Part: 0})
+
+	var buf bytes.Buffer
+	if err := original.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var restored = getCache(6, nil)
+	parts, err := restored.LoadState(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != original.cached() {
+		t.Errorf("Expected %d restored parts but got %d", original.cached(), len(parts))
+	}
+	if expected, got := listsContents(original), listsContents(restored); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected lists %v after the restore but got %v", expected, got)
+	}
+	if original.target != restored.target {
+		t.Errorf("Expected target %d after the restore but got %d", original.target, restored.target)
+	}
+	checkInvariants(t, restored)
+}
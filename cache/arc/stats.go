@@ -0,0 +1,16 @@
+package arc
+
+// This file contains the ARC's implementation of the CacheStats interface.
+
+import (
+	"github.com/ironsmile/nedomi/types"
+)
+
+// Stats implements part of types.CacheAlgorithm interface
+func (a *ARC) Stats() types.CacheStats {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+
+	var objects = uint64(a.cached())
+	return a.lookups.Stats(a.cfg.Path, objects, a.cfg.PartSize*types.BytesSize(objects))
+}
@@ -0,0 +1,181 @@
+package cache
+
+// This file contains benchmarks which replay request traces with every cache
+// algorithm and report their hit ratios. A recorded trace can be replayed with
+//
+//	go test -run none -bench Trace ./cache/ -cache-trace requests.txt
+//
+// where the trace file is in the format of the cache simulator traces. Every
+// line contains an URL followed by an inclusive byte range like `0-1048575` or
+// by the size of the object when all of it was requested.
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"testing"
+
+	"github.com/ironsmile/nedomi/cache/trace"
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/logger"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+)
+
+var traceFile = flag.String("cache-trace", "", "a file with a recorded request trace for the cache benchmarks")
+
+const (
+	benchCacheObjects = 1 << 12
+	benchTraceLength  = 1 << 18
+	benchPartSize     = 1024
+)
+
+// zipfTrace returns requests for the parts of objects whose popularity follows
+// the Zipf distribution. This is what most media workloads look like.
+func zipfTrace(r *rand.Rand, objects, parts uint64, length int) []*types.ObjectIndex {
+	var ids = make([]*types.ObjectID, objects)
+	for i := range ids {
+		ids[i] = types.NewObjectID("bench", fmt.Sprintf("/object/%d", i))
+	}
+
+	var zipf = rand.NewZipf(r, 1.1, 1, objects-1)
+	var trace = make([]*types.ObjectIndex, length)
+	for i := range trace {
+		trace[i] = &types.ObjectIndex{ObjID: ids[zipf.Uint64()], Part: uint32(r.Int63n(int64(parts)))}
+	}
+	return trace
+}
+
+// scanTrace returns the Zipf requests mixed with long sequential scans of
+// objects which are requested only once, like the ones made by crawlers.
+func scanTrace(r *rand.Rand, objects, parts uint64, length int) []*types.ObjectIndex {
+	var trace = zipfTrace(r, objects, parts, length)
+	var scanned uint64
+	for start := 0; start < len(trace); start += 4 * benchCacheObjects {
+		for i := start; i < start+benchCacheObjects && i < len(trace); i++ {
+			trace[i] = &types.ObjectIndex{
+				ObjID: types.NewObjectID("bench", fmt.Sprintf("/scan/%d", scanned/parts)),
+				Part:  uint32(scanned % parts),
+			}
+			scanned++
+		}
+	}
+	return trace
+}
+
+// readTrace reads a recorded trace from a file and breaks its requests in
+// parts.
+func readTrace(path string) ([]*types.ObjectIndex, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	requests, err := trace.Read(f, path, trace.NewParser(false).ParseTraceLine)
+	if err != nil {
+		return nil, err
+	}
+	var parts []*types.ObjectIndex
+	for _, req := range requests {
+		parts = append(parts, utils.BreakInIndexes(req.ID, req.First, req.Last, benchPartSize)...)
+	}
+	return parts, nil
+}
+
+func benchTraces(b *testing.B) map[string][]*types.ObjectIndex {
+	if *traceFile != "" {
+		trace, err := readTrace(*traceFile)
+		if err != nil {
+			b.Fatal(err)
+		}
+		return map[string][]*types.ObjectIndex{"recorded": trace}
+	}
+
+	return map[string][]*types.ObjectIndex{
+		"zipf": zipfTrace(rand.New(rand.NewSource(1)), 16*benchCacheObjects, 8, benchTraceLength),
+		"scan": scanTrace(rand.New(rand.NewSource(1)), 16*benchCacheObjects, 8, benchTraceLength),
+	}
+}
+
+// replay makes the same calls to the cache algorithm as the cache handler for
+// every request in the trace.
+func replay(ca types.CacheAlgorithm, trace []*types.ObjectIndex) {
+	for _, oi := range trace {
+		if ca.Lookup(oi) {
+			ca.PromoteObject(oi)
+		} else if ca.ShouldKeep(oi) {
+			ca.AddObject(oi)
+		}
+	}
+}
+
+func BenchmarkTrace(b *testing.B) {
+	var traces = benchTraces(b)
+	var traceNames, algorithms []string
+	for name := range traces {
+		traceNames = append(traceNames, name)
+	}
+	for algorithm := range cacheTypes {
+		algorithms = append(algorithms, algorithm)
+	}
+	sort.Strings(traceNames)
+	sort.Strings(algorithms)
+
+	l, err := logger.New(config.NewLogger("nillogger", nil))
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for _, name := range traceNames {
+		for _, algorithm := range algorithms {
+			var trace = traces[name]
+			b.Run(name+"/"+algorithm, func(b *testing.B) {
+				var stats types.CacheStats
+				for i := 0; i < b.N; i++ {
+					ca, err := New(&config.CacheZone{
+						ID:             "bench",
+						PartSize:       benchPartSize,
+						StorageObjects: benchCacheObjects,
+						Algorithm:      algorithm,
+					}, mockRemove, l)
+					if err != nil {
+						b.Fatal(err)
+					}
+					replay(ca, trace)
+					stats = ca.Stats()
+				}
+				b.ReportMetric(100*float64(stats.Hits())/float64(stats.Requests()), "hit%")
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*len(trace)), "ns/request")
+			})
+		}
+	}
+}
+
+func TestReadTrace(t *testing.T) {
+	t.Parallel()
+	f, err := os.CreateTemp("", "nedomi-trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString("# url range or size\nhttp://host/a 1500\nhttp://host/b 3072-3100\n\nhttp://host/a 1024-2047\n"); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	trace, err := readTrace(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(trace) != 4 {
+		t.Fatalf("Expected 4 requested parts in the trace but got %d", len(trace))
+	}
+	if trace[0].ObjID != trace[3].ObjID || trace[1].Part != 1 || trace[2].Part != 3 || trace[3].Part != 1 {
+		t.Errorf("Unexpected trace %v", trace)
+	}
+}
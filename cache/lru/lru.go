@@ -6,8 +6,6 @@ package lru
 import (
 	"container/list"
 	"flag"
-	"fmt"
-	"runtime"
 	"sync"
 	"time"
 
@@ -48,11 +46,22 @@ type TieredLRUCache struct {
 
 	tierListSize int
 
-	removeFunc func(*types.ObjectIndex) error
+	removeFunc       func(*types.ObjectIndex) error
+	removeObjectFunc func(*types.ObjectID) error
+
+	// Used for the object aware eviction. It is nil when it is not enabled.
+	objects        map[types.ObjectIDHash]*object
+	objectRequests uint64
+	leadingParts   uint32
+	// The object whose part is being added. It is never evicted whole because
+	// the rest of its parts are still being saved.
+	adding *types.ObjectID
+
+	// Parts are evicted when the storage goes over these limits
+	limits *types.SpaceLimits
 
 	// Used to track cache hit/miss information
-	requests uint64
-	hits     uint64
+	lookups types.LookupCounter
 }
 
 // Lookup implements part of types.CacheAlgorithm interface
@@ -60,15 +69,9 @@ func (tc *TieredLRUCache) Lookup(oi *types.ObjectIndex) bool {
 	tc.mutex.Lock()
 	defer tc.mutex.Unlock()
 
-	tc.requests++
-
 	_, ok := tc.lookup[oi.Hash()]
 
-	if ok {
-		tc.hits++
-	}
-
-	return ok
+	return tc.lookups.Record(ok)
 }
 
 // ShouldKeep implements part of types.CacheAlgorithm interface
@@ -88,6 +91,8 @@ func (tc *TieredLRUCache) AddObject(oi *types.ObjectIndex) error {
 		return types.ErrAlreadyInCache
 	}
 
+	tc.adding = oi.ObjID
+	defer func() { tc.adding = nil }()
 	lastList := tc.tiers[cacheTiers-1]
 
 	if lastList.Len() >= tc.tierListSize {
@@ -101,10 +106,52 @@ func (tc *TieredLRUCache) AddObject(oi *types.ObjectIndex) error {
 
 	tc.GetLogger().Debugf("Storing %s in lru", oi)
 	tc.lookup[oi.Hash()] = le
+	tc.trackPart(oi)
+	tc.evictForSpace()
 
 	return nil
 }
 
+// SetSpaceLimits implements types.SpaceLimiter.
+func (tc *TieredLRUCache) SetSpaceLimits(usage types.UsageReporter, maxSize, minFreeSpace uint64) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	tc.limits = types.NewSpaceLimits(usage, maxSize, minFreeSpace, tc.cfg.PartSize.Bytes())
+	tc.evictForSpace()
+}
+
+// evictForSpace removes the least recently used parts until enough of them
+// have been removed to bring the storage within its space limits. Every part
+// is counted as a whole part_size, so the usage does not have to be checked
+// again after each removal.
+func (tc *TieredLRUCache) evictForSpace() {
+	excess, err := tc.limits.Excess()
+	if err != nil {
+		tc.GetLogger().Errorf("Could not get the free space of the storage: %s", err)
+	}
+
+	var partSize = tc.cfg.PartSize.Bytes()
+	for freed := uint64(0); freed < excess; {
+		evicted := tc.evictLeastRecent()
+		if evicted == 0 {
+			return
+		}
+		freed += uint64(evicted) * partSize
+	}
+}
+
+// evictLeastRecent evicts from the lowest tier which is not empty. It returns
+// the number of evicted parts, which is 0 if the cache is empty.
+func (tc *TieredLRUCache) evictLeastRecent() int {
+	for i := cacheTiers - 1; i >= 0; i-- {
+		if tc.tiers[i].Len() > 0 {
+			return tc.evictFrom(tc.tiers[i])
+		}
+	}
+	return 0
+}
+
 // This function makes space for a new object in a full last list.
 // In case there is space in the upper lists it puts its first element upwards.
 // In case there is not - it removes its last element to make space.
@@ -147,11 +194,7 @@ func (tc *TieredLRUCache) freeSpaceInLastList() {
 	} else {
 		// There is no free slots anywhere in the upper tiers. So we will have to
 		// remove something from the cache in order to make space.
-		val := lastList.Remove(lastList.Back()).(types.ObjectIndex)
-		delete(tc.lookup, val.Hash())
-		if err := tc.removeFunc(&val); err != nil {
-			tc.GetLogger().Logf("error while removing %s from cache - %s", &val, err)
-		}
+		tc.evictFrom(lastList)
 	}
 }
 
@@ -164,6 +207,7 @@ func (tc *TieredLRUCache) Remove(ois ...*types.ObjectIndex) {
 		if el, ok := tc.lookup[oi.Hash()]; ok {
 			delete(tc.lookup, oi.Hash())
 			tc.tiers[el.ListTier].Remove(el.ListElem)
+			tc.untrackPart(oi)
 		}
 	}
 }
@@ -179,6 +223,7 @@ func (tc *TieredLRUCache) PromoteObject(oi *types.ObjectIndex) {
 		defer tc.checkTiers()
 	}
 
+	tc.touchObject(oi)
 	lruEl, ok := tc.lookup[oi.Hash()]
 
 	if !ok {
@@ -268,7 +313,8 @@ func (tc *TieredLRUCache) init() {
 		tc.tiers[i] = list.New()
 	}
 	tc.lookup = make(map[types.ObjectIndexHash]*Element)
-	tc.tierListSize = int(tc.cfg.StorageObjects / uint64(cacheTiers))
+	tc.tierListSize = int(tc.cfg.ObjectsLimit() / uint64(cacheTiers))
+	tc.initObjects()
 }
 
 // New returns TieredLRUCache object ready for use.
@@ -306,6 +352,7 @@ func (tc *TieredLRUCache) resize() {
 
 		for _, oi := range oids {
 			delete(tc.lookup, oi.Hash())
+			tc.untrackPart(&oi)
 		}
 
 		// for each tier from the upper most without the last
@@ -336,6 +383,7 @@ func (tc *TieredLRUCache) resize() {
 
 		for _, oi := range additionalOids {
 			delete(tc.lookup, oi.Hash())
+			tc.untrackPart(&oi)
 		}
 
 		go tc.throttledRemove(append(oids, additionalOids...))
@@ -343,35 +391,11 @@ func (tc *TieredLRUCache) resize() {
 	tc.tierListSize = newtierListSize
 }
 
-// remove the elements with time in between removes,
-// but only if they are not in the cache at the time of removal
+// throttledRemove removes the elements which are not in the cache any more
+// after it was resized down.
 func (tc *TieredLRUCache) throttledRemove(indexes []types.ObjectIndex) {
-	defer func() {
-		if msg := recover(); msg != nil {
-			const size = 64 << 10
-			buf := make([]byte, size)
-			buf = buf[:runtime.Stack(buf, false)]
-			tc.GetLogger().Errorf(
-				"Panic during throttled remove after resize down: %v\n%s",
-				msg, buf)
-			if debug {
-				panic(fmt.Sprintf("%v\n%s", msg, buf))
-			}
-		}
-	}()
-	var timer = time.NewTimer(0)
-	for i, n := 0, len(indexes); n > i; i += int(tc.cfg.BulkRemoveCount) {
-		tc.removeIfMissing(indexes[i:min(i+int(tc.cfg.BulkRemoveCount), n)]...)
-		timer.Reset(time.Duration(tc.cfg.BulkRemoveTimeout) * time.Millisecond)
-		<-timer.C
-	}
-}
-
-func min(l, r int) int {
-	if l > r {
-		return r
-	}
-	return l
+	types.ThrottledRemove(indexes, int(tc.cfg.BulkRemoveCount),
+		time.Duration(tc.cfg.BulkRemoveTimeout)*time.Millisecond, tc.removeIfMissing, tc.GetLogger())
 }
 
 func (tc *TieredLRUCache) removeIfMissing(ois ...types.ObjectIndex) {
@@ -10,8 +10,8 @@ import (
 )
 
 func printLru(lru *TieredLRUCache) {
-	fmt.Printf("TieredLru:\n cfg : %#v\n tierListSize: %d; requests: %d ; hits %d\n Tiers: \n",
-		lru.cfg, lru.tierListSize, lru.requests, lru.hits)
+	fmt.Printf("TieredLru:\n cfg : %#v\n tierListSize: %d; lookups: %+v\n Tiers: \n",
+		lru.cfg, lru.tierListSize, lru.lookups)
 	for index, tier := range lru.tiers {
 		fmt.Printf("%d:", index)
 		for el := tier.Front(); el != nil; el = el.Next() {
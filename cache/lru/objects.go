@@ -0,0 +1,207 @@
+package lru
+
+// This file contains the object aware eviction of the TieredLRUCache. When it
+// is enabled the cache tracks which parts of every object are cached and how
+// often the object is requested. Cold objects are evicted whole, together with
+// their metadata, and the leading parts of popular objects are kept longer
+// because they matter the most for starting a playback.
+
+import (
+	"container/list"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+const (
+	// How many of the first parts of popular objects are kept by default
+	defaultLeadingParts = 2
+
+	// Objects which were requested at least this many times recently are
+	// popular. The rest are cold and are evicted whole.
+	popularObjectHits = 2
+
+	// How many leading parts at most are skipped when looking for a victim,
+	// so that an eviction does not have to walk a whole tier.
+	maxEvictionSkips = 16
+)
+
+// object is the state of an object with cached parts
+type object struct {
+	id    *types.ObjectID
+	parts map[uint32]struct{}
+
+	// How many times parts of the object have been requested. It is halved
+	// periodically so that only the recent requests count.
+	hits uint32
+}
+
+// SetObjectRemoveFunc implements types.ObjectRemover.
+func (tc *TieredLRUCache) SetObjectRemoveFunc(removeObjectFunc func(*types.ObjectID) error) {
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+
+	tc.removeObjectFunc = removeObjectFunc
+}
+
+// initObjects starts tracking the objects if the object eviction is enabled.
+func (tc *TieredLRUCache) initObjects() {
+	if !tc.cfg.ObjectEviction {
+		tc.objects = nil
+		return
+	}
+
+	tc.objects = make(map[types.ObjectIDHash]*object)
+	tc.objectRequests = 0
+	tc.leadingParts = tc.cfg.LeadingParts
+	if tc.leadingParts == 0 {
+		tc.leadingParts = defaultLeadingParts
+	}
+}
+
+// trackPart records that the part is cached.
+func (tc *TieredLRUCache) trackPart(oi *types.ObjectIndex) {
+	if tc.objects == nil {
+		return
+	}
+
+	obj, ok := tc.objects[oi.ObjID.Hash()]
+	if !ok {
+		obj = &object{id: oi.ObjID, parts: make(map[uint32]struct{})}
+		tc.objects[oi.ObjID.Hash()] = obj
+	}
+	obj.parts[oi.Part] = struct{}{}
+}
+
+// untrackPart records that the part is not cached any more. It returns true
+// if that was the last cached part of its object.
+func (tc *TieredLRUCache) untrackPart(oi *types.ObjectIndex) bool {
+	if tc.objects == nil {
+		return false
+	}
+
+	obj, ok := tc.objects[oi.ObjID.Hash()]
+	if !ok {
+		return false
+	}
+	delete(obj.parts, oi.Part)
+	if len(obj.parts) > 0 {
+		return false
+	}
+	delete(tc.objects, oi.ObjID.Hash())
+	return true
+}
+
+// touchObject records a request for a part of the object. The hits of all the
+// objects are halved after as many requests as there are parts in the cache.
+func (tc *TieredLRUCache) touchObject(oi *types.ObjectIndex) {
+	if tc.objects == nil {
+		return
+	}
+
+	if obj, ok := tc.objects[oi.ObjID.Hash()]; ok && obj.hits < ^uint32(0) {
+		obj.hits++
+	}
+
+	tc.objectRequests++
+	if tc.objectRequests >= tc.cfg.ObjectsLimit() {
+		tc.objectRequests = 0
+		for _, obj := range tc.objects {
+			obj.hits /= 2
+		}
+	}
+}
+
+// evictFrom removes the least recently used part in the list and returns how
+// many parts were evicted. With object eviction the leading parts of popular
+// objects are moved to the front of the list instead and the cold objects are
+// evicted with all of their parts, except for the one which is being added.
+func (tc *TieredLRUCache) evictFrom(l *list.List) int {
+	for skipped := 0; ; skipped++ {
+		back := l.Back()
+		if back == nil {
+			return 0
+		}
+		val := back.Value.(types.ObjectIndex)
+
+		if tc.objects == nil {
+			tc.evictPart(l, back)
+			return 1
+		}
+
+		obj, ok := tc.objects[val.ObjID.Hash()]
+		if !ok {
+			tc.evictPart(l, back)
+			return 1
+		} else if obj.hits < popularObjectHits {
+			if tc.isAdding(val.ObjID) {
+				tc.evictPart(l, back)
+				return 1
+			}
+			return tc.evictObject(val.ObjID)
+		}
+
+		if val.Part < tc.leadingParts && skipped < maxEvictionSkips && l.Len() > 1 {
+			l.MoveToFront(back)
+			continue
+		}
+		tc.evictPart(l, back)
+		return 1
+	}
+}
+
+// evictPart removes the part in the list element from the cache and the
+// storage. The object is removed as well if this was its last cached part,
+// unless its parts are still being added.
+func (tc *TieredLRUCache) evictPart(l *list.List, e *list.Element) {
+	val := l.Remove(e).(types.ObjectIndex)
+	delete(tc.lookup, val.Hash())
+	if err := tc.removeFunc(&val); err != nil {
+		tc.GetLogger().Logf("error while removing %s from cache - %s", &val, err)
+	}
+	if tc.untrackPart(&val) && !tc.isAdding(val.ObjID) {
+		tc.removeObject(val.ObjID)
+	}
+}
+
+// isAdding returns whether a part of the object is being added at the moment.
+func (tc *TieredLRUCache) isAdding(id *types.ObjectID) bool {
+	return tc.adding != nil && tc.adding.Hash() == id.Hash()
+}
+
+// evictObject removes all the cached parts of the object and the object itself
+// from the cache and the storage. It returns the number of evicted parts.
+func (tc *TieredLRUCache) evictObject(id *types.ObjectID) int {
+	var parts []*types.ObjectIndex
+	if obj, ok := tc.objects[id.Hash()]; ok {
+		for part := range obj.parts {
+			parts = append(parts, &types.ObjectIndex{ObjID: id, Part: part})
+		}
+		delete(tc.objects, id.Hash())
+	}
+
+	for _, oi := range parts {
+		if el, ok := tc.lookup[oi.Hash()]; ok {
+			tc.tiers[el.ListTier].Remove(el.ListElem)
+			delete(tc.lookup, oi.Hash())
+		}
+		if tc.removeObjectFunc == nil {
+			if err := tc.removeFunc(oi); err != nil {
+				tc.GetLogger().Logf("error while removing %s from cache - %s", oi, err)
+			}
+		}
+	}
+
+	tc.GetLogger().Debugf("Evicting the cold object %s with %d parts from lru", id, len(parts))
+	tc.removeObject(id)
+	return len(parts)
+}
+
+// removeObject removes the object with its metadata from the storage.
+func (tc *TieredLRUCache) removeObject(id *types.ObjectID) {
+	if tc.removeObjectFunc == nil {
+		return
+	}
+	if err := tc.removeObjectFunc(id); err != nil {
+		tc.GetLogger().Logf("error while removing object %s from cache - %s", id, err)
+	}
+}
@@ -0,0 +1,180 @@
+package lru
+
+import (
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+)
+
+// getObjectEvictingCache returns a cache with object eviction which records the
+// removed parts and objects.
+func getObjectEvictingCache(cz *config.CacheZone, removedParts *[]types.ObjectIndex,
+	removedObjects *[]*types.ObjectID) *TieredLRUCache {
+	cz.ObjectEviction = true
+	lru := New(cz, func(oi *types.ObjectIndex) error {
+		*removedParts = append(*removedParts, *oi)
+		return nil
+	}, mock.NewLogger())
+	lru.SetObjectRemoveFunc(func(id *types.ObjectID) error {
+		*removedObjects = append(*removedObjects, id)
+		return nil
+	})
+	return lru
+}
+
+func TestColdObjectsAreEvictedWhole(t *testing.T) {
+	t.Parallel()
+	var removedParts []types.ObjectIndex
+	var removedObjects []*types.ObjectID
+	var lru = getObjectEvictingCache(&config.CacheZone{StorageObjects: 100, PartSize: 10},
+		&removedParts, &removedObjects)
+
+	var cold = types.NewObjectID("1.1", "/cold")
+	var other = types.NewObjectID("1.1", "/other")
+	for _, oi := range []*types.ObjectIndex{
+		{ObjID: cold, Part: 0}, {ObjID: cold, Part: 1}, {ObjID: cold, Part: 2}, {ObjID: other, Part: 0},
+	} {
+		if err := lru.AddObject(oi); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Evict a single part for space
+	lru.SetSpaceLimits(&fakeUsage{used: 40, free: 1 << 30}, 30, 0)
+
+	if len(removedObjects) != 1 || removedObjects[0] != cold {
+		t.Errorf("Expected only the cold object to be removed but got %v", removedObjects)
+	}
+	if len(removedParts) != 0 {
+		t.Errorf("Expected the parts to be removed with their object but got %v", removedParts)
+	}
+	if objects := lru.Stats().Objects(); objects != 1 {
+		t.Errorf("Expected only 1 part to stay in the cache but there are %d", objects)
+	}
+	if _, ok := lru.objects[cold.Hash()]; ok {
+		t.Error("Expected the cold object not to be tracked any more")
+	}
+}
+
+func TestLeadingPartsOfPopularObjectsAreKept(t *testing.T) {
+	t.Parallel()
+	var removedParts []types.ObjectIndex
+	var removedObjects []*types.ObjectID
+	var lru = getObjectEvictingCache(&config.CacheZone{StorageObjects: 100, PartSize: 10, LeadingParts: 1},
+		&removedParts, &removedObjects)
+
+	var popular = types.NewObjectID("1.1", "/popular")
+	for i := uint32(0); i < 3; i++ {
+		if err := lru.AddObject(&types.ObjectIndex{ObjID: popular, Part: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < popularObjectHits; i++ {
+		lru.PromoteObject(&types.ObjectIndex{ObjID: popular, Part: 2})
+	}
+
+	// Part 0 is the least recently used but it is a leading part
+	lru.SetSpaceLimits(&fakeUsage{used: 30, free: 1 << 30}, 20, 0)
+
+	if len(removedParts) != 1 || removedParts[0].Part != 1 {
+		t.Errorf("Expected only part 1 to be evicted but got %v", removedParts)
+	}
+	if len(removedObjects) != 0 {
+		t.Errorf("Expected the popular object not to be removed but got %v", removedObjects)
+	}
+	if !lru.Lookup(&types.ObjectIndex{ObjID: popular, Part: 0}) {
+		t.Error("Expected the leading part to stay in the cache")
+	}
+}
+
+func TestObjectIsRemovedWithItsLastPart(t *testing.T) {
+	t.Parallel()
+	var removedParts []types.ObjectIndex
+	var removedObjects []*types.ObjectID
+	var lru = getObjectEvictingCache(&config.CacheZone{StorageObjects: 100, PartSize: 10, LeadingParts: 1},
+		&removedParts, &removedObjects)
+
+	var popular = types.NewObjectID("1.1", "/popular")
+	var oi = &types.ObjectIndex{ObjID: popular, Part: 3}
+	if err := lru.AddObject(oi); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < popularObjectHits; i++ {
+		lru.PromoteObject(oi)
+	}
+
+	lru.SetSpaceLimits(&fakeUsage{used: 10, free: 1 << 30}, 5, 0)
+
+	if len(removedParts) != 1 || removedParts[0] != *oi {
+		t.Errorf("Expected %s to be evicted but got %v", oi, removedParts)
+	}
+	if len(removedObjects) != 1 || removedObjects[0] != popular {
+		t.Errorf("Expected the object to be removed with its last part but got %v", removedObjects)
+	}
+}
+
+func TestRemovedPartsAreNotTracked(t *testing.T) {
+	t.Parallel()
+	var removedParts []types.ObjectIndex
+	var removedObjects []*types.ObjectID
+	var lru = getObjectEvictingCache(&config.CacheZone{StorageObjects: 100, PartSize: 10},
+		&removedParts, &removedObjects)
+
+	var id = types.NewObjectID("1.1", "/path")
+	var parts = []*types.ObjectIndex{{ObjID: id, Part: 0}, {ObjID: id, Part: 1}}
+	for _, oi := range parts {
+		if err := lru.AddObject(oi); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lru.Remove(parts...)
+
+	if len(lru.objects) != 0 {
+		t.Errorf("Expected no tracked objects but there are %d", len(lru.objects))
+	}
+	if len(removedParts) != 0 || len(removedObjects) != 0 {
+		t.Error("Expected Remove not to remove anything from the storage")
+	}
+}
+
+func TestObjectBeingAddedIsNotEvictedWhole(t *testing.T) {
+	t.Parallel()
+	const partSize = 10
+	var removedParts []types.ObjectIndex
+	var removedObjects []*types.ObjectID
+	var usage = &fakeUsage{free: 1 << 30}
+	var lru = getObjectEvictingCache(&config.CacheZone{StorageObjects: 100, PartSize: partSize},
+		&removedParts, &removedObjects)
+	lru.removeFunc = func(oi *types.ObjectIndex) error {
+		removedParts = append(removedParts, *oi)
+		usage.change(-partSize)
+		return nil
+	}
+	lru.SetSpaceLimits(usage, 8*partSize, 0)
+
+	// The cold object is bigger than the whole cache
+	var big = types.NewObjectID("1.1", "/big")
+	for i := uint32(0); i < 12; i++ {
+		usage.change(partSize)
+		if err := lru.AddObject(&types.ObjectIndex{ObjID: big, Part: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(removedObjects) != 0 {
+		t.Errorf("Expected the object which is being added not to be removed but got %v", removedObjects)
+	}
+	if len(removedParts) != 4 {
+		t.Errorf("Expected only the 4 oldest parts to be evicted but got %v", removedParts)
+	}
+	for i, oi := range removedParts {
+		if oi.Part != uint32(i) {
+			t.Errorf("Expected part %d to be evicted but got %s", i, &oi)
+		}
+	}
+	if obj, ok := lru.objects[big.Hash()]; !ok || len(obj.parts) != 8 {
+		t.Errorf("Expected the object to be tracked with 8 parts but got %+v", obj)
+	}
+}
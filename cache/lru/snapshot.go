@@ -0,0 +1,92 @@
+package lru
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// snapshotVersion should be incremented on every incompatible change of the
+// snapshot. Snapshots with other versions are not loaded.
+const snapshotVersion = 1
+
+// snapshot is the saved state of the TieredLRUCache. The parts in every tier
+// are in the order of their lists, from the front to the back.
+type snapshot struct {
+	Version int
+	Tiers   [][]snapshotPart
+}
+
+type snapshotPart struct {
+	CacheKey string
+	Path     string
+	Variant  string
+	Part     uint32
+}
+
+// SaveState implements types.StateSnapshotter.
+func (tc *TieredLRUCache) SaveState(w io.Writer) error {
+	tc.mutex.Lock()
+	var s = snapshot{Version: snapshotVersion, Tiers: make([][]snapshotPart, cacheTiers)}
+	for i := range tc.tiers {
+		s.Tiers[i] = make([]snapshotPart, 0, tc.tiers[i].Len())
+		for e := tc.tiers[i].Front(); e != nil; e = e.Next() {
+			oi := e.Value.(types.ObjectIndex)
+			s.Tiers[i] = append(s.Tiers[i], snapshotPart{
+				CacheKey: oi.ObjID.CacheKey(),
+				Path:     oi.ObjID.Path(),
+				Variant:  oi.ObjID.Variant(),
+				Part:     oi.Part,
+			})
+		}
+	}
+	tc.mutex.Unlock()
+
+	return gob.NewEncoder(w).Encode(&s)
+}
+
+// LoadState implements types.StateSnapshotter. The parts which do not fit in
+// their tier with the current size of the cache are not restored.
+func (tc *TieredLRUCache) LoadState(r io.Reader) ([]*types.ObjectIndex, error) {
+	var s snapshot
+	if err := gob.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	} else if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported lru snapshot version %d", s.Version)
+	} else if len(s.Tiers) != cacheTiers {
+		return nil, fmt.Errorf("the lru snapshot has %d tiers instead of %d", len(s.Tiers), cacheTiers)
+	}
+
+	tc.mutex.Lock()
+	defer tc.mutex.Unlock()
+	tc.init()
+
+	var restored []*types.ObjectIndex
+	var ids = make(map[types.ObjectIDHash]*types.ObjectID)
+	for i, parts := range s.Tiers {
+		for _, p := range parts {
+			if tc.tiers[i].Len() >= tc.tierListSize {
+				break
+			}
+			id := types.NewVariantObjectID(p.CacheKey, p.Path, p.Variant)
+			if existing, ok := ids[id.Hash()]; ok {
+				id = existing
+			} else {
+				ids[id.Hash()] = id
+			}
+			oi := types.ObjectIndex{ObjID: id, Part: p.Part}
+			if _, ok := tc.lookup[oi.Hash()]; ok {
+				continue
+			}
+			tc.lookup[oi.Hash()] = &Element{
+				ListTier: i,
+				ListElem: tc.tiers[i].PushBack(oi),
+			}
+			tc.trackPart(&oi)
+			restored = append(restored, &oi)
+		}
+	}
+	return restored, nil
+}
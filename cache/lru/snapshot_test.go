@@ -0,0 +1,118 @@
+package lru
+
+import (
+	"bytes"
+	"encoding/gob"
+	"reflect"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+)
+
+func tiersContents(tc *TieredLRUCache) [][]string {
+	var result = make([][]string, cacheTiers)
+	for i := range tc.tiers {
+		for e := tc.tiers[i].Front(); e != nil; e = e.Next() {
+			oi := e.Value.(types.ObjectIndex)
+			result[i] = append(result[i], oi.String())
+		}
+	}
+	return result
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	t.Parallel()
+	var cz = &config.CacheZone{StorageObjects: 40, PartSize: 10}
+	var removeFunc = func(*types.ObjectIndex) error { return nil }
+	var original = New(cz, removeFunc, mock.NewLogger())
+
+	var ids = []*types.ObjectID{
+		types.NewObjectID("1.1", "/first"),
+		types.NewVariantObjectID("1.1", "/second", "gzip"),
+	}
+	for _, id := range ids {
+		for i := uint32(0); i < 5; i++ {
+			if err := original.AddObject(&types.ObjectIndex{ObjID: id, Part: i}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	for i := 0; i < 3; i++ {
+		original.PromoteObject(&types.ObjectIndex{ObjID: ids[0], Part: 1})
+		original.PromoteObject(&types.ObjectIndex{ObjID: ids[1], Part: 3})
+	}
+
+	var buf bytes.Buffer
+	if err := original.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var restored = New(cz, removeFunc, mock.NewLogger())
+	parts, err := restored.LoadState(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 10 {
+		t.Errorf("Expected 10 restored parts but got %d", len(parts))
+	}
+	for _, part := range parts {
+		if !restored.Lookup(part) {
+			t.Errorf("Restored part %s is not in the cache", part)
+		}
+	}
+
+	if expected, got := tiersContents(original), tiersContents(restored); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected tiers %v after the restore but got %v", expected, got)
+	}
+	if expected, got := original.Stats().Objects(), restored.Stats().Objects(); expected != got {
+		t.Errorf("Expected %d objects after the restore but got %d", expected, got)
+	}
+}
+
+func TestStateRestoreRespectsTierSize(t *testing.T) {
+	t.Parallel()
+	var removeFunc = func(*types.ObjectIndex) error { return nil }
+	var original = New(&config.CacheZone{StorageObjects: 40, PartSize: 10}, removeFunc, mock.NewLogger())
+	var id = types.NewObjectID("1.1", "/path")
+	for i := uint32(0); i < 10; i++ {
+		if err := original.AddObject(&types.ObjectIndex{ObjID: id, Part: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := original.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var restored = New(&config.CacheZone{StorageObjects: 16, PartSize: 10}, removeFunc, mock.NewLogger())
+	parts, err := restored.LoadState(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 4 {
+		t.Errorf("Expected only 4 parts to fit in the last tier but %d were restored", len(parts))
+	}
+}
+
+func TestStateWithWrongVersionOrTiers(t *testing.T) {
+	t.Parallel()
+	var tests = []snapshot{
+		{Version: snapshotVersion + 1, Tiers: make([][]snapshotPart, cacheTiers)},
+		{Version: snapshotVersion, Tiers: make([][]snapshotPart, cacheTiers+1)},
+	}
+	for _, s := range tests {
+		var buf bytes.Buffer
+		if err := gob.NewEncoder(&buf).Encode(&s); err != nil {
+			t.Fatal(err)
+		}
+		var tc = New(&config.CacheZone{StorageObjects: 40, PartSize: 10},
+			func(*types.ObjectIndex) error { return nil }, mock.NewLogger())
+		if _, err := tc.LoadState(&buf); err == nil {
+			t.Errorf("Expected an error when loading snapshot with version %d and %d tiers",
+				s.Version, len(s.Tiers))
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package lru
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+)
+
+// fakeUsage is a storage usage in which every part takes partSize bytes
+type fakeUsage struct {
+	sync.Mutex
+	used, free uint64
+}
+
+func (u *fakeUsage) BytesUsed() uint64 {
+	u.Lock()
+	defer u.Unlock()
+	return u.used
+}
+
+func (u *fakeUsage) FreeSpace() (uint64, error) {
+	u.Lock()
+	defer u.Unlock()
+	return u.free, nil
+}
+
+func (u *fakeUsage) change(delta int64) {
+	u.Lock()
+	defer u.Unlock()
+	u.used = uint64(int64(u.used) + delta)
+	u.free = uint64(int64(u.free) - delta)
+}
+
+func testSpaceLimits(t *testing.T, maxSize, minFreeSpace, free uint64, expected int) {
+	const partSize = 10
+	var usage = &fakeUsage{free: free}
+	var removed []uint32
+	lru := New(&config.CacheZone{StorageObjects: 100, PartSize: partSize},
+		func(oi *types.ObjectIndex) error {
+			removed = append(removed, oi.Part)
+			usage.change(-partSize)
+			return nil
+		}, mock.NewLogger())
+	lru.SetSpaceLimits(usage, maxSize, minFreeSpace)
+
+	var id = types.NewObjectID("1.1", "/path")
+	for i := 0; i < 10; i++ {
+		usage.change(partSize)
+		if err := lru.AddObject(&types.ObjectIndex{ObjID: id, Part: uint32(i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if objects := lru.Stats().Objects(); objects != uint64(expected) {
+		t.Errorf("Expected %d objects in the cache but there are %d", expected, objects)
+	}
+	for i, part := range removed {
+		if part != uint32(i) {
+			t.Errorf("Expected the least recently used parts to be removed but got %v", removed)
+			break
+		}
+	}
+	if maxSize != 0 && usage.BytesUsed() > maxSize {
+		t.Errorf("The storage uses %d bytes which is more than %d", usage.BytesUsed(), maxSize)
+	}
+	if free, _ := usage.FreeSpace(); free < minFreeSpace {
+		t.Errorf("The storage has %d free bytes which is less than %d", free, minFreeSpace)
+	}
+}
+
+func TestMaxSizeEvictsParts(t *testing.T) {
+	t.Parallel()
+	testSpaceLimits(t, 55, 0, 1000, 5)
+}
+
+func TestMinFreeSpaceEvictsParts(t *testing.T) {
+	t.Parallel()
+	testSpaceLimits(t, 0, 30, 100, 7)
+}
+
+func TestBothSpaceLimits(t *testing.T) {
+	t.Parallel()
+	testSpaceLimits(t, 80, 40, 100, 6)
+	testSpaceLimits(t, 40, 10, 100, 4)
+}
+
+func TestNoSpaceLimits(t *testing.T) {
+	t.Parallel()
+	testSpaceLimits(t, 0, 0, 50, 10)
+}
+
+func TestObjectsLimitFromMaxSize(t *testing.T) {
+	t.Parallel()
+	lru := New(&config.CacheZone{MaxSize: 400, PartSize: 10}, mockRemove, mock.NewLogger())
+	if lru.tierListSize != 10 {
+		t.Errorf("Expected tiers with 10 parts for max_size / part_size = 40 but got %d",
+			lru.tierListSize)
+	}
+}
@@ -48,3 +48,28 @@ func TestCreatingCacheAlgorithmWithNilConfigReturnsError(t *testing.T) {
 		t.Error("Expected an error when creating bogus algorithm but got none")
 	}
 }
+
+func TestCreatingAllCacheAlgorithms(t *testing.T) {
+	t.Parallel()
+	for algorithm := range cacheTypes {
+		cz := config.CacheZone{
+			ID:             "default",
+			Path:           "/does/not/matter",
+			PartSize:       4123123,
+			StorageObjects: 9813743,
+			Algorithm:      algorithm,
+		}
+
+		ca, err := New(&cz, mockRemove, mock.NewLogger())
+		if err != nil {
+			t.Errorf("Error when creating cache algorithm %s. %s", algorithm, err)
+			continue
+		}
+		if _, ok := ca.(types.SpaceLimiter); !ok {
+			t.Errorf("Expected cache algorithm %s to implement types.SpaceLimiter", algorithm)
+		}
+		if _, ok := ca.(types.StateSnapshotter); !ok {
+			t.Errorf("Expected cache algorithm %s to implement types.StateSnapshotter", algorithm)
+		}
+	}
+}
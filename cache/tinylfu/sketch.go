@@ -0,0 +1,130 @@
+package tinylfu
+
+// This file contains the frequency sketch which is used to decide whether new
+// parts are admitted in the cache.
+
+import (
+	"encoding/binary"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+const (
+	// How many rows of counters the sketch has. Every part has one counter in
+	// each row and its frequency is estimated by the smallest of them.
+	sketchDepth = 4
+
+	// The counters saturate at this value. Parts requested more often than
+	// this are equally popular as far as the admission is concerned.
+	maxCount = 15
+
+	// The counters are halved after this many requests per counter in a row.
+	resetFactor = 10
+
+	// The smallest number of counters in a row. Small caches still see many
+	// different parts and the collisions would make all of them look popular.
+	minSketchWidth = 1024
+)
+
+// The seeds with which the part hashes are mixed for every row of the sketch.
+var sketchSeeds = [sketchDepth]uint64{
+	0xc3a5c85c97cb3127, 0xb492b66fbe98f273, 0x9ae16a3b2f90404f, 0xcbf29ce484222325,
+}
+
+// sketch is a count-min sketch which estimates how many times every part has
+// been requested recently. All of its counters are halved periodically so that
+// parts which were popular a long time ago do not stay popular forever.
+type sketch struct {
+	rows       [sketchDepth][]uint8
+	mask       uint64
+	additions  uint64
+	resetAfter uint64
+}
+
+func newSketch(capacity uint64) *sketch {
+	var width uint64 = minSketchWidth
+	for width < capacity {
+		width <<= 1
+	}
+
+	s := &sketch{
+		mask:       width - 1,
+		resetAfter: width * resetFactor,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+// width returns the number of counters in every row of the sketch.
+func (s *sketch) width() uint64 {
+	return s.mask + 1
+}
+
+// increment records one request for the part. Only the smallest of its
+// counters are incremented, which keeps the overestimation caused by the
+// collisions low.
+func (s *sketch) increment(oi *types.ObjectIndex) {
+	var positions = s.positions(oi)
+	var min = s.estimateAt(positions)
+	if min >= maxCount {
+		return
+	}
+
+	for i, pos := range positions {
+		if s.rows[i][pos] == min {
+			s.rows[i][pos]++
+		}
+	}
+
+	s.additions++
+	if s.additions >= s.resetAfter {
+		s.reset()
+	}
+}
+
+// estimate returns how many times the part has been requested recently.
+func (s *sketch) estimate(oi *types.ObjectIndex) uint8 {
+	return s.estimateAt(s.positions(oi))
+}
+
+func (s *sketch) estimateAt(positions [sketchDepth]uint64) uint8 {
+	var min uint8 = maxCount
+	for i, pos := range positions {
+		if s.rows[i][pos] < min {
+			min = s.rows[i][pos]
+		}
+	}
+	return min
+}
+
+// reset halves all the counters.
+func (s *sketch) reset() {
+	for _, row := range s.rows {
+		for i := range row {
+			row[i] >>= 1
+		}
+	}
+	s.additions /= 2
+}
+
+func (s *sketch) positions(oi *types.ObjectIndex) [sketchDepth]uint64 {
+	var hash = oi.Hash()
+	// The object id part of the hash is a sha1 sum so its first bytes are
+	// already evenly distributed.
+	var h = binary.LittleEndian.Uint64(hash[:8]) ^ uint64(oi.Part)*0x9e3779b97f4a7c15
+
+	var positions [sketchDepth]uint64
+	for i, seed := range sketchSeeds {
+		positions[i] = mix(h+seed) & s.mask
+	}
+	return positions
+}
+
+// mix is the finalizer of the splitmix64 generator.
+func mix(h uint64) uint64 {
+	h = (h ^ (h >> 30)) * 0xbf58476d1ce4e5b9
+	h = (h ^ (h >> 27)) * 0x94d049bb133111eb
+	return h ^ (h >> 31)
+}
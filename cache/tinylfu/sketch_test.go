@@ -0,0 +1,61 @@
+package tinylfu
+
+import (
+	"testing"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+func TestSketchEstimates(t *testing.T) {
+	t.Parallel()
+	var s = newSketch(1000)
+	var id = types.NewObjectID("1.1", "/path")
+
+	for i := uint32(0); i < 100; i++ {
+		for j := uint32(0); j < i%10; j++ {
+			s.increment(&types.ObjectIndex{ObjID: id, Part: i})
+		}
+	}
+
+	for i := uint32(0); i < 100; i++ {
+		var oi = &types.ObjectIndex{ObjID: id, Part: i}
+		if estimate := s.estimate(oi); uint32(estimate) < i%10 {
+			t.Errorf("Expected an estimate of at least %d for part %d but got %d", i%10, i, estimate)
+		}
+	}
+}
+
+func TestSketchCountersSaturate(t *testing.T) {
+	t.Parallel()
+	var s = newSketch(1000)
+	var oi = &types.ObjectIndex{ObjID: types.NewObjectID("1.1", "/path"), Part: 3}
+
+	for i := 0; i < 3*maxCount; i++ {
+		s.increment(oi)
+	}
+	if estimate := s.estimate(oi); estimate != maxCount {
+		t.Errorf("Expected the estimate to stop at %d but got %d", maxCount, estimate)
+	}
+}
+
+func TestSketchIsHalvedPeriodically(t *testing.T) {
+	t.Parallel()
+	var s = newSketch(16)
+	var id = types.NewObjectID("1.1", "/path")
+	var popular = &types.ObjectIndex{ObjID: id, Part: 0}
+
+	for i := 0; i < 8; i++ {
+		s.increment(popular)
+	}
+	if estimate := s.estimate(popular); estimate != 8 {
+		t.Fatalf("Expected an estimate of 8 but got %d", estimate)
+	}
+
+	// Record enough requests for other parts for the counters to be reset
+	for i := uint32(1); uint64(i) <= s.resetAfter; i++ {
+		s.increment(&types.ObjectIndex{ObjID: id, Part: i})
+	}
+	if estimate := s.estimate(popular); estimate > 4 {
+		t.Errorf("Expected the estimate to be halved to at most 4 but got %d", estimate)
+	}
+}
@@ -0,0 +1,102 @@
+package tinylfu
+
+import (
+	"container/list"
+	"encoding/gob"
+	"fmt"
+	"io"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// snapshotVersion should be incremented on every incompatible change of the
+// snapshot. Snapshots with other versions are not loaded.
+const snapshotVersion = 1
+
+// snapshot is the saved state of the TinyLFU. The parts in every segment are
+// in the order of their lists, from the front to the back. The frequency
+// sketch is not saved, the restored parts are counted as requested once.
+type snapshot struct {
+	Version   int
+	Protected []snapshotPart
+	Probation []snapshotPart
+}
+
+type snapshotPart struct {
+	CacheKey string
+	Path     string
+	Variant  string
+	Part     uint32
+}
+
+// SaveState implements types.StateSnapshotter.
+func (c *TinyLFU) SaveState(w io.Writer) error {
+	c.mutex.Lock()
+	var s = snapshot{
+		Version:   snapshotVersion,
+		Protected: listSnapshot(c.protected.Len(), c.protected.Front()),
+		Probation: listSnapshot(c.probation.Len(), c.probation.Front()),
+	}
+	c.mutex.Unlock()
+
+	return gob.NewEncoder(w).Encode(&s)
+}
+
+func listSnapshot(length int, e *list.Element) []snapshotPart {
+	var parts = make([]snapshotPart, 0, length)
+	for ; e != nil; e = e.Next() {
+		oi := e.Value.(types.ObjectIndex)
+		parts = append(parts, snapshotPart{
+			CacheKey: oi.ObjID.CacheKey(),
+			Path:     oi.ObjID.Path(),
+			Variant:  oi.ObjID.Variant(),
+			Part:     oi.Part,
+		})
+	}
+	return parts
+}
+
+// LoadState implements types.StateSnapshotter. The parts which do not fit in
+// their segment with the current size of the cache are not restored.
+func (c *TinyLFU) LoadState(r io.Reader) ([]*types.ObjectIndex, error) {
+	var s snapshot
+	if err := gob.NewDecoder(r).Decode(&s); err != nil {
+		return nil, err
+	} else if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported tinylfu snapshot version %d", s.Version)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.init()
+
+	var restored []*types.ObjectIndex
+	var ids = make(map[types.ObjectIDHash]*types.ObjectID)
+	var restore = func(parts []snapshotPart, l *list.List, protected bool, limit int) {
+		for _, p := range parts {
+			if l.Len() >= limit || len(c.lookup) >= c.capacity {
+				return
+			}
+			id := types.NewVariantObjectID(p.CacheKey, p.Path, p.Variant)
+			if existing, ok := ids[id.Hash()]; ok {
+				id = existing
+			} else {
+				ids[id.Hash()] = id
+			}
+			oi := types.ObjectIndex{ObjID: id, Part: p.Part}
+			if _, ok := c.lookup[oi.Hash()]; ok {
+				continue
+			}
+			c.lookup[oi.Hash()] = &element{
+				listElem:  l.PushBack(oi),
+				protected: protected,
+			}
+			c.sketch.increment(&oi)
+			restored = append(restored, &oi)
+		}
+	}
+	restore(s.Protected, c.protected, true, c.protectedCapacity)
+	restore(s.Probation, c.probation, false, c.capacity)
+
+	return restored, nil
+}
@@ -0,0 +1,87 @@
+package tinylfu
+
+import (
+	"bytes"
+	"container/list"
+	"reflect"
+	"testing"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+func listContents(c *TinyLFU) [][]string {
+	var result [][]string
+	for _, l := range []*list.List{c.protected, c.probation} {
+		var parts []string
+		for e := l.Front(); e != nil; e = e.Next() {
+			oi := e.Value.(types.ObjectIndex)
+			parts = append(parts, oi.String())
+		}
+		result = append(result, parts)
+	}
+	return result
+}
+
+func TestStateRoundTrip(t *testing.T) {
+	t.Parallel()
+	var original = getCache(20, nil)
+	var ids = []*types.ObjectID{
+		types.NewObjectID("1.1", "/first"),
+		types.NewVariantObjectID("1.1", "/second", "gzip"),
+	}
+	for _, id := range ids {
+		for i := uint32(0); i < 5; i++ {
+			if err := original.AddObject(&types.ObjectIndex{ObjID: id, Part: i}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		original.PromoteObject(&types.ObjectIndex{ObjID: id, Part: 2})
+	}
+
+	var buf bytes.Buffer
+	if err := original.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var restored = getCache(20, nil)
+	parts, err := restored.LoadState(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 10 {
+		t.Errorf("Expected 10 restored parts but got %d", len(parts))
+	}
+	if expected, got := listContents(original), listContents(restored); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected segments %v after the restore but got %v", expected, got)
+	}
+}
+
+func TestStateRestoreRespectsCapacity(t *testing.T) {
+	t.Parallel()
+	var original = getCache(20, nil)
+	var id = types.NewObjectID("1.1", "/path")
+	for i := uint32(0); i < 20; i++ {
+		if err := original.AddObject(&types.ObjectIndex{ObjID: id, Part: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := original.SaveState(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	var restored = getCache(5, nil)
+	parts, err := restored.LoadState(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parts) != 5 {
+		t.Errorf("Expected only 5 parts to fit in the cache but %d were restored", len(parts))
+	}
+	for i, part := range parts {
+		if part.Part != uint32(19-i) {
+			t.Errorf("Expected the most recent parts to be restored but got %s", part)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package tinylfu
+
+// This file contains the TinyLFU's implementation of the CacheStats interface.
+
+import (
+	"github.com/ironsmile/nedomi/types"
+)
+
+// Stats implements part of types.CacheAlgorithm interface
+func (c *TinyLFU) Stats() types.CacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	var objects = uint64(len(c.lookup))
+	return c.lookups.Stats(c.cfg.Path, objects, c.cfg.PartSize*types.BytesSize(objects))
+}
@@ -0,0 +1,340 @@
+// Package tinylfu contains a cache eviction implementation which keeps the parts
+// in a segmented LRU and admits new parts in it only when they are expected to
+// be requested more often than the parts they would replace. Their popularity
+// is estimated with a frequency sketch of the recent requests. This keeps the
+// parts which are requested only once, for example by crawlers and scans, from
+// pushing the working set out of the cache.
+package tinylfu
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/types"
+)
+
+// How many percent of the cache are reserved for the parts which were
+// requested again after they had been stored.
+const protectedPercent = 80
+
+// element is stored in the cache lookup hashmap
+type element struct {
+	listElem  *list.Element
+	protected bool
+}
+
+// TinyLFU implements types.CacheAlgorithm. New parts are stored in the
+// probation segment and are moved to the protected segment when they are
+// requested again. The parts which are pushed out of the protected segment go
+// back to the front of the probation segment. The eviction victim is always the
+// least recently used part in the probation segment.
+type TinyLFU struct {
+	types.SyncLogger
+
+	cfg *config.CacheZone
+
+	sketch    *sketch
+	probation *list.List
+	protected *list.List
+	lookup    map[types.ObjectIndexHash]*element
+	mutex     sync.Mutex
+
+	capacity          int
+	protectedCapacity int
+
+	removeFunc func(*types.ObjectIndex) error
+
+	// Parts are evicted when the storage goes over these limits
+	limits *types.SpaceLimits
+
+	// Used to track cache hit/miss information
+	lookups types.LookupCounter
+}
+
+// Lookup implements part of types.CacheAlgorithm interface. Every lookup is
+// recorded in the frequency sketch, whether the part is in the cache or not.
+func (c *TinyLFU) Lookup(oi *types.ObjectIndex) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.sketch.increment(oi)
+
+	_, ok := c.lookup[oi.Hash()]
+	return c.lookups.Record(ok)
+}
+
+// ShouldKeep implements part of types.CacheAlgorithm interface. When the cache
+// is full the part is kept only if it is more popular than the part which would
+// be evicted to make space for it.
+func (c *TinyLFU) ShouldKeep(oi *types.ObjectIndex) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.lookup[oi.Hash()]; ok {
+		return true
+	}
+
+	if !c.admit(oi) {
+		c.GetLogger().Debugf("Not admitting %s in tinylfu", oi)
+		return false
+	}
+
+	c.add(oi)
+	return true
+}
+
+// admit returns whether the part should be added to the cache.
+func (c *TinyLFU) admit(oi *types.ObjectIndex) bool {
+	if len(c.lookup) < c.capacity {
+		return true
+	}
+
+	victim, _ := c.victim()
+	if victim == nil {
+		return true
+	}
+	victimOi := victim.Value.(types.ObjectIndex)
+	return c.sketch.estimate(oi) > c.sketch.estimate(&victimOi)
+}
+
+// AddObject implements part of types.CacheAlgorithm interface. The part is
+// added without an admission check because it is already in the storage.
+func (c *TinyLFU) AddObject(oi *types.ObjectIndex) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := c.lookup[oi.Hash()]; ok {
+		return types.ErrAlreadyInCache
+	}
+
+	c.add(oi)
+	return nil
+}
+
+func (c *TinyLFU) add(oi *types.ObjectIndex) {
+	for len(c.lookup) >= c.capacity {
+		if !c.evictVictim() {
+			break
+		}
+	}
+
+	c.GetLogger().Debugf("Storing %s in tinylfu", oi)
+	c.lookup[oi.Hash()] = &element{listElem: c.probation.PushFront(*oi)}
+	c.evictForSpace()
+}
+
+// victim returns the list element of the part which will be evicted next and
+// the list it is in. The element is nil if the cache is empty.
+func (c *TinyLFU) victim() (*list.Element, *list.List) {
+	if back := c.probation.Back(); back != nil {
+		return back, c.probation
+	}
+	return c.protected.Back(), c.protected
+}
+
+// popVictim removes the next eviction victim from the cache but not from the
+// storage. It returns false if the cache is empty.
+func (c *TinyLFU) popVictim() (types.ObjectIndex, bool) {
+	victim, l := c.victim()
+	if victim == nil {
+		return types.ObjectIndex{}, false
+	}
+
+	val := l.Remove(victim).(types.ObjectIndex)
+	delete(c.lookup, val.Hash())
+	return val, true
+}
+
+// evictVictim removes the next eviction victim from the cache and the storage.
+// It returns false if the cache is empty.
+func (c *TinyLFU) evictVictim() bool {
+	val, ok := c.popVictim()
+	if !ok {
+		return false
+	}
+
+	if err := c.removeFunc(&val); err != nil {
+		c.GetLogger().Logf("error while removing %s from cache - %s", &val, err)
+	}
+	return true
+}
+
+func (c *TinyLFU) listOf(el *element) *list.List {
+	if el.protected {
+		return c.protected
+	}
+	return c.probation
+}
+
+// SetSpaceLimits implements types.SpaceLimiter.
+func (c *TinyLFU) SetSpaceLimits(usage types.UsageReporter, maxSize, minFreeSpace uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.limits = types.NewSpaceLimits(usage, maxSize, minFreeSpace, c.cfg.PartSize.Bytes())
+	c.evictForSpace()
+}
+
+// evictForSpace removes eviction victims until enough of them have been
+// removed to bring the storage within its space limits. Every part is counted
+// as a whole part_size, so the usage does not have to be checked again after
+// each removal.
+func (c *TinyLFU) evictForSpace() {
+	excess, err := c.limits.Excess()
+	if err != nil {
+		c.GetLogger().Errorf("Could not get the free space of the storage: %s", err)
+	}
+
+	var partSize = c.cfg.PartSize.Bytes()
+	for freed := uint64(0); freed < excess; freed += partSize {
+		if !c.evictVictim() {
+			return
+		}
+	}
+}
+
+// Remove the objects given from the cache.
+func (c *TinyLFU) Remove(ois ...*types.ObjectIndex) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, oi := range ois {
+		if el, ok := c.lookup[oi.Hash()]; ok {
+			delete(c.lookup, oi.Hash())
+			c.listOf(el).Remove(el.listElem)
+		}
+	}
+}
+
+// PromoteObject implements part of types.CacheAlgorithm interface. Parts in
+// the probation segment are moved to the protected one and parts in the
+// protected segment are moved to its front.
+func (c *TinyLFU) PromoteObject(oi *types.ObjectIndex) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	el, ok := c.lookup[oi.Hash()]
+	if !ok {
+		// This part is in the storage but not in the cache yet. So we add it.
+		c.add(oi)
+		return
+	}
+
+	if el.protected {
+		c.protected.MoveToFront(el.listElem)
+		return
+	}
+
+	c.probation.Remove(el.listElem)
+	el.listElem = c.protected.PushFront(*oi)
+	el.protected = true
+	c.demoteProtected()
+}
+
+// demoteProtected moves the least recently used parts of the protected segment
+// to the front of the probation segment until the protected one fits in its
+// capacity.
+func (c *TinyLFU) demoteProtected() {
+	for c.protected.Len() > c.protectedCapacity {
+		val := c.protected.Remove(c.protected.Back()).(types.ObjectIndex)
+		el, ok := c.lookup[val.Hash()]
+		if !ok {
+			c.GetLogger().Errorf("ERROR! Object in cache list was not found in the "+
+				" lookup map: %v", val)
+			continue
+		}
+		el.listElem = c.probation.PushFront(val)
+		el.protected = false
+	}
+}
+
+// ConsumedSize implements part of types.CacheAlgorithm interface
+func (c *TinyLFU) ConsumedSize() types.BytesSize {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.cfg.PartSize * types.BytesSize(len(c.lookup))
+}
+
+// setCapacity sets the sizes of the cache and its segments for the current
+// config. The frequency sketch is replaced if it is too small or too big for
+// the new size.
+func (c *TinyLFU) setCapacity() {
+	c.capacity = int(c.cfg.ObjectsLimit())
+	c.protectedCapacity = c.capacity * protectedPercent / 100
+
+	if c.sketch == nil || newSketch(uint64(c.capacity)).width() != c.sketch.width() {
+		c.sketch = newSketch(uint64(c.capacity))
+	}
+}
+
+func (c *TinyLFU) init() {
+	c.probation = list.New()
+	c.protected = list.New()
+	c.lookup = make(map[types.ObjectIndexHash]*element)
+	c.setCapacity()
+}
+
+// New returns TinyLFU object ready for use.
+func New(cz *config.CacheZone, removeFunc func(*types.ObjectIndex) error,
+	logger types.Logger) *TinyLFU {
+
+	c := &TinyLFU{
+		cfg:        cz,
+		removeFunc: removeFunc,
+	}
+	c.SetLogger(logger)
+	c.init()
+	return c
+}
+
+// ChangeConfig changes the TinyLFU config and start using it
+func (c *TinyLFU) ChangeConfig(bulkRemoveTimout, bulkRemoveCount, newsize uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.cfg.StorageObjects = newsize
+	c.cfg.BulkRemoveCount = bulkRemoveCount
+	c.cfg.BulkRemoveTimeout = bulkRemoveTimout
+	c.resize()
+}
+
+// resize changes the sizes of the segments. When the cache shrinks the parts
+// which do not fit in it any more are removed from the storage in bulks in the
+// background.
+func (c *TinyLFU) resize() {
+	c.setCapacity()
+	c.demoteProtected()
+
+	var removed []types.ObjectIndex
+	for len(c.lookup) > c.capacity {
+		val, ok := c.popVictim()
+		if !ok {
+			break
+		}
+		removed = append(removed, val)
+	}
+
+	if len(removed) > 0 {
+		go c.throttledRemove(removed)
+	}
+}
+
+// throttledRemove removes the elements which are not in the cache any more
+// after it was resized down.
+func (c *TinyLFU) throttledRemove(indexes []types.ObjectIndex) {
+	types.ThrottledRemove(indexes, int(c.cfg.BulkRemoveCount),
+		time.Duration(c.cfg.BulkRemoveTimeout)*time.Millisecond, c.removeIfMissing, c.GetLogger())
+}
+
+func (c *TinyLFU) removeIfMissing(ois ...types.ObjectIndex) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for _, oi := range ois {
+		if _, ok := c.lookup[oi.Hash()]; !ok {
+			c.removeFunc(&oi)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package tinylfu
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+)
+
+func getCache(objects uint64, removed *[]types.ObjectIndex) *TinyLFU {
+	return New(&config.CacheZone{StorageObjects: objects, PartSize: 10},
+		func(oi *types.ObjectIndex) error {
+			if removed != nil {
+				*removed = append(*removed, *oi)
+			}
+			return nil
+		}, mock.NewLogger())
+}
+
+// request simulates a request for the part the way the cache handler does it
+func request(c *TinyLFU, oi *types.ObjectIndex) {
+	if c.Lookup(oi) {
+		c.PromoteObject(oi)
+	} else {
+		c.ShouldKeep(oi)
+	}
+}
+
+func TestOneHitWondersAreNotAdmitted(t *testing.T) {
+	t.Parallel()
+	var removed []types.ObjectIndex
+	var c = getCache(10, &removed)
+
+	var popular = types.NewObjectID("1.1", "/popular")
+	for round := 0; round < 3; round++ {
+		for i := uint32(0); i < 10; i++ {
+			request(c, &types.ObjectIndex{ObjID: popular, Part: i})
+		}
+	}
+
+	var scan = types.NewObjectID("1.1", "/scan")
+	for i := uint32(0); i < 100; i++ {
+		oi := &types.ObjectIndex{ObjID: scan, Part: i}
+		if c.Lookup(oi) {
+			t.Errorf("Did not expect %s to be in the cache", oi)
+		} else if c.ShouldKeep(oi) {
+			t.Errorf("Expected %s not to be admitted in the cache", oi)
+		}
+	}
+
+	if len(removed) != 0 {
+		t.Errorf("Expected no parts to be evicted but these were: %v", removed)
+	}
+	for i := uint32(0); i < 10; i++ {
+		oi := &types.ObjectIndex{ObjID: popular, Part: i}
+		if _, ok := c.lookup[oi.Hash()]; !ok {
+			t.Errorf("Expected %s to stay in the cache", oi)
+		}
+	}
+}
+
+func TestPopularPartsAreAdmitted(t *testing.T) {
+	t.Parallel()
+	var removed []types.ObjectIndex
+	var c = getCache(10, &removed)
+
+	var id = types.NewObjectID("1.1", "/path")
+	for i := uint32(0); i < 10; i++ {
+		request(c, &types.ObjectIndex{ObjID: id, Part: i})
+	}
+
+	var newcomer = &types.ObjectIndex{ObjID: id, Part: 10}
+	for i := 0; i < 2; i++ {
+		request(c, newcomer)
+	}
+	if _, ok := c.lookup[newcomer.Hash()]; !ok {
+		t.Fatalf("Expected %s to be admitted after it was requested twice", newcomer)
+	}
+
+	if len(removed) != 1 || removed[0].Part != 0 {
+		t.Errorf("Expected the least recently used part 0 to be evicted but got %v", removed)
+	}
+	if objects := c.Stats().Objects(); objects != 10 {
+		t.Errorf("Expected 10 objects in the cache but there are %d", objects)
+	}
+}
+
+func TestPromotionToTheProtectedSegment(t *testing.T) {
+	t.Parallel()
+	var c = getCache(10, nil)
+	var id = types.NewObjectID("1.1", "/path")
+	for i := uint32(0); i < 10; i++ {
+		if err := c.AddObject(&types.ObjectIndex{ObjID: id, Part: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.AddObject(&types.ObjectIndex{ObjID: id, Part: 0}); err != types.ErrAlreadyInCache {
+		t.Errorf("Expected ErrAlreadyInCache but got %v", err)
+	}
+
+	for i := uint32(0); i < 10; i++ {
+		c.PromoteObject(&types.ObjectIndex{ObjID: id, Part: i})
+	}
+	if c.protected.Len() != c.protectedCapacity {
+		t.Errorf("Expected %d parts in the protected segment but there are %d",
+			c.protectedCapacity, c.protected.Len())
+	}
+	if c.probation.Len() != 10-c.protectedCapacity {
+		t.Errorf("Expected %d parts in the probation segment but there are %d",
+			10-c.protectedCapacity, c.probation.Len())
+	}
+
+	// The first promoted parts were pushed back to probation
+	for i := uint32(0); i < uint32(10-c.protectedCapacity); i++ {
+		oi := &types.ObjectIndex{ObjID: id, Part: i}
+		if c.lookup[oi.Hash()].protected {
+			t.Errorf("Expected %s to be demoted to the probation segment", oi)
+		}
+	}
+
+	c.Remove(&types.ObjectIndex{ObjID: id, Part: 9}, &types.ObjectIndex{ObjID: id, Part: 0})
+	if objects := c.Stats().Objects(); objects != 8 {
+		t.Errorf("Expected 8 objects after the removal but there are %d", objects)
+	}
+	if size := c.ConsumedSize(); size != 80 {
+		t.Errorf("Expected consumed size of 80 but got %d", size)
+	}
+}
+
+func TestResizeDown(t *testing.T) {
+	t.Parallel()
+	var removed = make(chan types.ObjectIndex, 10)
+	var c = New(&config.CacheZone{StorageObjects: 10, PartSize: 10},
+		func(oi *types.ObjectIndex) error {
+			removed <- *oi
+			return nil
+		}, mock.NewLogger())
+	var id = types.NewObjectID("1.1", "/path")
+	for i := uint32(0); i < 10; i++ {
+		if err := c.AddObject(&types.ObjectIndex{ObjID: id, Part: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c.ChangeConfig(1, 2, 4)
+	if objects := c.Stats().Objects(); objects != 4 {
+		t.Errorf("Expected 4 objects after the resize but there are %d", objects)
+	}
+	for i := 0; i < 6; i++ {
+		if oi := <-removed; oi.Part > 5 {
+			t.Errorf("Expected only the least recently used parts to be removed but %d was", oi.Part)
+		}
+	}
+}
+
+type fakeUsage struct {
+	sync.Mutex
+	used uint64
+}
+
+func (u *fakeUsage) BytesUsed() uint64 {
+	u.Lock()
+	defer u.Unlock()
+	return u.used
+}
+
+func (u *fakeUsage) FreeSpace() (uint64, error) {
+	return 1 << 30, nil
+}
+
+func TestSpaceLimits(t *testing.T) {
+	t.Parallel()
+	var usage = &fakeUsage{}
+	var c = New(&config.CacheZone{StorageObjects: 100, PartSize: 10},
+		func(oi *types.ObjectIndex) error {
+			usage.used -= 10
+			return nil
+		}, mock.NewLogger())
+	c.SetSpaceLimits(usage, 50, 0)
+
+	var id = types.NewObjectID("1.1", "/path")
+	for i := uint32(0); i < 10; i++ {
+		usage.used += 10
+		if err := c.AddObject(&types.ObjectIndex{ObjID: id, Part: i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if objects := c.Stats().Objects(); objects != 5 {
+		t.Errorf("Expected 5 objects within the space limit but there are %d", objects)
+	}
+}
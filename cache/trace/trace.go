@@ -0,0 +1,201 @@
+// Package trace reads the request logs which are replayed against the cache
+// algorithms by the cache simulator and the cache benchmarks.
+package trace
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// Request is a request for a byte range of an object, both ends inclusive.
+type Request struct {
+	ID    *types.ObjectID
+	First uint64
+	Last  uint64
+
+	// The size of the object or 0 if it is not known
+	Size uint64
+}
+
+// Parser reads requests from one of the supported formats. It keeps a single
+// ObjectID for every object so that the requests do not take too much memory.
+type Parser struct {
+	includeQuery bool
+	ids          map[string]*types.ObjectID
+}
+
+// NewParser returns a parser which uses the query of the URLs in the object IDs
+// if includeQuery is true.
+func NewParser(includeQuery bool) *Parser {
+	return &Parser{
+		includeQuery: includeQuery,
+		ids:          make(map[string]*types.ObjectID),
+	}
+}
+
+func (p *Parser) objectID(cacheKey string, u *url.URL) *types.ObjectID {
+	var path = u.Path
+	if p.includeQuery {
+		path = u.String()
+	}
+
+	var key = cacheKey + " " + path
+	id, ok := p.ids[key]
+	if !ok {
+		id = types.NewObjectID(cacheKey, path)
+		p.ids[key] = id
+	}
+	return id
+}
+
+// errSkipped is returned for the lines which do not contain a request that
+// involves the cache, for example failed requests or comments. Read leaves
+// these lines out.
+var errSkipped = errors.New("the line is skipped")
+
+// errPartialSkipped is returned for the partial responses in the access log.
+// The log does not contain their ranges, so they can not be simulated.
+var errPartialSkipped = errors.New("the partial response is skipped")
+
+// ParseLogLine parses a line of the nedomi access log. The location of the
+// request is used as a cache key. The log does not contain the requested
+// ranges, so only full responses are used.
+func (p *Parser) ParseLogLine(line string) (*Request, error) {
+	var start = strings.Index(line, `] "`)
+	if start < 0 {
+		return nil, fmt.Errorf("no request in the log line")
+	}
+	var prefix = strings.Fields(line[:start])
+	if len(prefix) < 3 || prefix[1] != "->" {
+		return nil, fmt.Errorf("no location in the log line")
+	}
+
+	reqLine, rest, err := unquote(line[start+3:])
+	if err != nil {
+		return nil, err
+	}
+	// The URI may contain spaces after it is unquoted
+	var first, last = strings.IndexByte(reqLine, ' '), strings.LastIndexByte(reqLine, ' ')
+	var fields = strings.Fields(rest)
+	if first < 0 || first == last || len(fields) < 2 {
+		return nil, fmt.Errorf("malformed log line")
+	}
+	var method, uri = reqLine[:first], reqLine[first+1 : last]
+
+	status, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return nil, fmt.Errorf("malformed status: %s", err)
+	}
+	size, err := strconv.ParseUint(fields[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("malformed response size: %s", err)
+	}
+	if method != http.MethodGet || size == 0 ||
+		(status != http.StatusOK && status != http.StatusPartialContent) {
+		return nil, errSkipped
+	} else if status == http.StatusPartialContent {
+		return nil, errPartialSkipped
+	}
+
+	u, err := url.ParseRequestURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Request{ID: p.objectID(prefix[2], u), Last: size - 1, Size: size}, nil
+}
+
+// unquote returns the quoted string in the beginning of s, without the
+// escaping done by the access log, and what follows it. The log escapes the
+// strings as Go does, so they are unquoted with strconv.
+func unquote(s string) (string, string, error) {
+	for i := 0; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			unquoted, err := strconv.Unquote(`"` + s[:i+1])
+			if err != nil {
+				return "", "", fmt.Errorf("malformed quoted string: %s", err)
+			}
+			return unquoted, s[i+1:], nil
+		case '\\':
+			i++
+		}
+	}
+	return "", "", fmt.Errorf("unterminated quoted string")
+}
+
+// ParseTraceLine parses a line of a generic trace. Every line contains an URL
+// followed either by an inclusive byte range like `0-1048575` or by the size of
+// the object when all of it was requested. The host of the URL is used as a
+// cache key.
+func (p *Parser) ParseTraceLine(line string) (*Request, error) {
+	var fields = strings.Fields(line)
+	if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+		return nil, errSkipped
+	} else if len(fields) != 2 {
+		return nil, fmt.Errorf("expected an URL and a byte range or size")
+	}
+
+	u, err := url.Parse(fields[0])
+	if err != nil {
+		return nil, err
+	}
+
+	var r = &Request{ID: p.objectID(u.Host, u)}
+	if dash := strings.IndexByte(fields[1], '-'); dash >= 0 {
+		if r.First, err = strconv.ParseUint(fields[1][:dash], 10, 64); err != nil {
+			return nil, fmt.Errorf("malformed range: %s", err)
+		}
+		if r.Last, err = strconv.ParseUint(fields[1][dash+1:], 10, 64); err != nil {
+			return nil, fmt.Errorf("malformed range: %s", err)
+		}
+		if r.Last < r.First {
+			return nil, fmt.Errorf("the range %s ends before it starts", fields[1])
+		}
+		return r, nil
+	}
+
+	if r.Size, err = strconv.ParseUint(fields[1], 10, 64); err != nil {
+		return nil, fmt.Errorf("malformed size: %s", err)
+	} else if r.Size == 0 {
+		return nil, errSkipped
+	}
+	r.Last = r.Size - 1
+	return r, nil
+}
+
+// Read reads all the requests from r with the given line parser. The
+// number of the skipped partial responses is logged, since they may be a big
+// part of the log.
+func Read(r io.Reader, name string, parse func(string) (*Request, error)) ([]*Request, error) {
+	var requests []*Request
+	var partial int
+	var scanner = bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for line := 1; scanner.Scan(); line++ {
+		req, err := parse(scanner.Text())
+		if err == errSkipped {
+			continue
+		} else if err == errPartialSkipped {
+			partial++
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("%s:%d: %s", name, line, err)
+		}
+		requests = append(requests, req)
+	}
+	if partial > 0 {
+		log.Printf("Warning: skipped %d partial responses in %s because their ranges are not known",
+			partial, name)
+	}
+	return requests, scanner.Err()
+}
@@ -0,0 +1,136 @@
+package trace
+
+import (
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseLogLine(t *testing.T) {
+	t.Parallel()
+	var p = NewParser(false)
+
+	req, err := p.ParseLogLine(`127.0.0.1 -> default 5af3c2 - - [17/Oct/2016:15:04:05 +0300] ` +
+		`"GET /video.mp4?start=10 HTTP/1.1" 200 5000000 123456`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.ID.CacheKey() != "default" || req.ID.Path() != "/video.mp4" {
+		t.Errorf("Unexpected object id %s", req.ID)
+	}
+	if req.First != 0 || req.Last != 4999999 || req.Size != 5000000 {
+		t.Errorf("Unexpected range %d-%d/%d", req.First, req.Last, req.Size)
+	}
+
+	again, err := p.ParseLogLine(`127.0.0.1 -> default 5af3c3 - - [17/Oct/2016:15:04:06 +0300] ` +
+		`"GET /video.mp4 HTTP/1.1" 200 5000000 123456`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again.ID != req.ID {
+		t.Error("Expected the requests for the same object to have the same id")
+	}
+
+	var partial = `127.0.0.1 -> default 5af3c3 - - [17/Oct/2016:15:04:06 +0300] ` +
+		`"GET /video.mp4 HTTP/1.1" 206 100 123456`
+	if _, err := p.ParseLogLine(partial); err != errPartialSkipped {
+		t.Errorf("Expected the partial response to be skipped but got %v", err)
+	}
+
+	for _, skipped := range []string{
+		`127.0.0.1 -> default 5af3c4 - - [17/Oct/2016:15:04:07 +0300] "GET /missing HTTP/1.1" 404 10 1`,
+		`127.0.0.1 -> default 5af3c5 - - [17/Oct/2016:15:04:08 +0300] "HEAD /video.mp4 HTTP/1.1" 200 0 1`,
+	} {
+		if _, err := p.ParseLogLine(skipped); err != errSkipped {
+			t.Errorf("Expected the line to be skipped but got %v: %s", err, skipped)
+		}
+	}
+
+	if _, err := p.ParseLogLine("not a log line"); err == nil || err == errSkipped {
+		t.Errorf("Expected an error for a malformed line but got %v", err)
+	}
+}
+
+func TestParseWrittenLogLine(t *testing.T) {
+	t.Parallel()
+	// The same as the lines written by app/write_log.go
+	var u = &url.URL{Path: "/with\"quote.mp4", RawQuery: "q=\" \xff\u00e9"}
+	var quoted = strconv.Quote(u.RequestURI())
+	var line = `10.0.0.1 -> example.com/media 12 - - [` + time.Now().Format("02/Jan/2006:15:04:05 -0700") +
+		`] "` + http.MethodGet + ` ` + quoted[1:len(quoted)-1] + ` HTTP/1.1" 200 42 7`
+
+	req, err := NewParser(false).ParseLogLine(line)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.ID.CacheKey() != "example.com/media" || req.ID.Path() != u.Path {
+		t.Errorf("Unexpected object id %s", req.ID)
+	}
+}
+
+func TestUnquote(t *testing.T) {
+	t.Parallel()
+	unquoted, rest, err := unquote(`a\"b\\c\td\x01e\u00a0f" rest`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unquoted != "a\"b\\c\td\x01e\u00a0f" || rest != " rest" {
+		t.Errorf("Unexpected unquoted string %q and rest %q", unquoted, rest)
+	}
+
+	for _, malformed := range []string{`unterminated`, `bad\q escape"`} {
+		if _, _, err := unquote(malformed); err == nil {
+			t.Errorf("Expected an error for %q", malformed)
+		}
+	}
+}
+
+func TestParseTraceLine(t *testing.T) {
+	t.Parallel()
+	var p = NewParser(true)
+
+	req, err := p.ParseTraceLine("http://example.com/video.mp4?q=1 100-199")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.ID.CacheKey() != "example.com" || req.ID.Path() != "http://example.com/video.mp4?q=1" {
+		t.Errorf("Unexpected object id %s", req.ID)
+	}
+	if req.First != 100 || req.Last != 199 || req.Size != 0 {
+		t.Errorf("Unexpected range %d-%d/%d", req.First, req.Last, req.Size)
+	}
+
+	whole, err := p.ParseTraceLine("http://example.com/image.jpg 300")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if whole.First != 0 || whole.Last != 299 || whole.Size != 300 {
+		t.Errorf("Unexpected range %d-%d/%d", whole.First, whole.Last, whole.Size)
+	}
+
+	for _, malformed := range []string{"/path", "/path 200-100", "/path a-b", "/path 1 2"} {
+		if _, err := p.ParseTraceLine(malformed); err == nil || err == errSkipped {
+			t.Errorf("Expected an error for %q but got %v", malformed, err)
+		}
+	}
+}
+
+func TestRead(t *testing.T) {
+	t.Parallel()
+	var p = NewParser(false)
+	requests, err := Read(strings.NewReader("# comment\n/a 10\n\n/b 0-5\n"), "test", p.ParseTraceLine)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 2 {
+		t.Errorf("Expected 2 requests but got %d", len(requests))
+	}
+
+	if _, err := Read(strings.NewReader("/a 10\n/b\n"), "test", p.ParseTraceLine); err == nil ||
+		!strings.HasPrefix(err.Error(), "test:2:") {
+		t.Errorf("Expected an error for the second line but got %v", err)
+	}
+}
@@ -8,27 +8,68 @@ import (
 
 // CacheZone contains all configuration options for cache zones.
 type CacheZone struct {
-	ID                 string
-	Type               string          `json:"type"`
-	Path               string          `json:"path"`
-	StorageObjects     uint64          `json:"storage_objects"`
-	PartSize           types.BytesSize `json:"part_size"`
-	Algorithm          string          `json:"cache_algorithm"`
-	BulkRemoveCount    uint64          `json:"bulk_remove_count"`
-	BulkRemoveTimeout  uint64          `json:"bulk_remove_timeout"`
-	SkipCacheKeyInPath bool            `json:"skip_cache_key_in_path"`
+	ID                   string
+	Type                 string          `json:"type"`
+	Path                 string          `json:"path"`
+	Paths                []CacheZonePath `json:"paths"`
+	Placement            string          `json:"placement"`
+	StorageObjects       uint64          `json:"storage_objects"`
+	PartSize             types.BytesSize `json:"part_size"`
+	MaxSize              types.BytesSize `json:"max_size"`
+	MinFreeSpace         types.BytesSize `json:"min_free_space"`
+	MemoryTierSize       types.BytesSize `json:"memory_tier_size"`
+	Algorithm            string          `json:"cache_algorithm"`
+	BulkRemoveCount      uint64          `json:"bulk_remove_count"`
+	BulkRemoveTimeout    uint64          `json:"bulk_remove_timeout"`
+	SkipCacheKeyInPath   bool            `json:"skip_cache_key_in_path"`
+	MetadataCacheObjects uint64          `json:"metadata_cache_objects"`
+	MetadataFormat       string          `json:"metadata_format"`
+	PartChecksums        bool            `json:"part_checksums"`
+	VerifyChecksumsEvery uint64          `json:"verify_checksums_every"`
+	ScrubInterval        uint64          `json:"scrub_interval"`
+	ScrubRate            uint64          `json:"scrub_rate"`
+	StateFile            string          `json:"state_file"`
+	StateSaveInterval    uint64          `json:"state_save_interval"`
+	ObjectEviction       bool            `json:"object_eviction"`
+	LeadingParts         uint32          `json:"leading_parts"`
+}
+
+// CacheZonePath is one of the disks of a cache zone which spans multiple
+// disks. The objects are distributed between them according to their weights.
+type CacheZonePath struct {
+	Path   string `json:"path"`
+	Weight uint32 `json:"weight"`
 }
 
 // Validate checks a CacheZone config section for errors.
 func (cz *CacheZone) Validate() error {
 	//!TODO: support flexible type and config check for different modules
-	if cz.ID == "" || cz.Type == "" || cz.Path == "" || cz.Algorithm == "" || cz.PartSize == 0 {
+	if cz.ID == "" || cz.Type == "" || cz.Algorithm == "" || cz.PartSize == 0 {
 		return errors.New("missing or invalid information in the cache zone config section")
 	}
 
+	// The memory storage is the only one which does not need a path
+	if cz.Path == "" && len(cz.Paths) == 0 && cz.Type != "memory" {
+		return errors.New("missing path in the cache zone config section")
+	}
+	for _, p := range cz.Paths {
+		if p.Path == "" {
+			return errors.New("empty path in the paths of the cache zone config section")
+		}
+	}
+
 	return nil
 }
 
+// ObjectsLimit returns how many parts the cache algorithm of the zone may
+// keep. When storage_objects is not set it is derived from max_size.
+func (cz *CacheZone) ObjectsLimit() uint64 {
+	if cz.StorageObjects == 0 && cz.PartSize != 0 {
+		return cz.MaxSize.Bytes() / cz.PartSize.Bytes()
+	}
+	return cz.StorageObjects
+}
+
 // GetSubsections returns nil (CacheZone has no subsections).
 func (cz *CacheZone) GetSubsections() []Section {
 	return nil
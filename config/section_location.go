@@ -4,19 +4,22 @@ import (
 	"encoding/json"
 	"fmt"
 	"time"
+
+	"github.com/ironsmile/nedomi/types"
 )
 
 // baseLocation contains the basic configuration options for virtual host's. location.
 type baseLocation struct {
 	HeadersRewrite
 	Name                  string
-	Upstream              string    `json:"upstream"`
-	CacheZone             string    `json:"cache_zone"`
-	CacheKey              string    `json:"cache_key"`
-	CacheDefaultDuration  string    `json:"cache_default_duration"`
-	Handlers              []Handler `json:"handlers"`
-	Logger                Logger    `json:"logger"`
-	CacheKeyIncludesQuery bool      `json:"cache_key_includes_query"`
+	Upstream              string                  `json:"upstream"`
+	CacheZone             string                  `json:"cache_zone"`
+	CacheKey              string                  `json:"cache_key"`
+	CacheDefaultDuration  string                  `json:"cache_default_duration"`
+	Handlers              []Handler               `json:"handlers"`
+	Logger                Logger                  `json:"logger"`
+	CacheKeyIncludesQuery bool                    `json:"cache_key_includes_query"`
+	CacheKeyTemplate      *types.CacheKeyTemplate `json:"cache_key_template"`
 }
 
 // Location contains all configuration options for virtual host's location.
@@ -30,10 +33,18 @@ type Location struct {
 // UnmarshalJSON is a custom JSON unmashalling that also implements inheritance
 // and custom field initiation
 func (ls *Location) UnmarshalJSON(buff []byte) error {
+	// The inherited template is shared with the parent, so it must not be
+	// overwritten in place by json.Unmarshal
+	var inheritedKeyTemplate = ls.CacheKeyTemplate
+	ls.CacheKeyTemplate = nil
+
 	// Parse the baseLocation values
 	if err := json.Unmarshal(buff, &ls.baseLocation); err != nil {
 		return err
 	}
+	if ls.CacheKeyTemplate == nil {
+		ls.CacheKeyTemplate = inheritedKeyTemplate
+	}
 
 	// Convert the location string to time.Duration
 	if ls.baseLocation.CacheDefaultDuration == "" {
@@ -3,6 +3,8 @@ package config
 import (
 	"testing"
 	"time"
+
+	"github.com/ironsmile/nedomi/types"
 )
 
 func TestLocationJSONUnmarshallingValidLocation(t *testing.T) {
@@ -120,6 +122,40 @@ func TestLocationJSONUnmarshallingAndVeirfyingCacheDefaultDuration(t *testing.T)
 	}
 }
 
+func TestLocationCacheKeyTemplate(t *testing.T) {
+	t.Parallel()
+	inherited, err := types.NewCacheKeyTemplate("{host}{path}")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	loc := newLocForTesting()
+	loc.CacheKeyTemplate = inherited
+	if err := loc.UnmarshalJSON([]byte(`{"cache_zone": "default"}`)); err != nil {
+		t.Fatal(err)
+	}
+	if loc.CacheKeyTemplate != inherited {
+		t.Errorf("Expected the template to be inherited but got %s", loc.CacheKeyTemplate)
+	}
+
+	loc = newLocForTesting()
+	loc.CacheKeyTemplate = inherited
+	err = loc.UnmarshalJSON([]byte(`{"cache_zone": "default", "cache_key_template": "{path}?{args}"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if loc.CacheKeyTemplate.String() != "{path}?{args}" || inherited.String() != "{host}{path}" {
+		t.Errorf("Expected own template {path}?{args} and unchanged inherited one but got %s and %s",
+			loc.CacheKeyTemplate, inherited)
+	}
+
+	loc = newLocForTesting()
+	err = loc.UnmarshalJSON([]byte(`{"cache_zone": "default", "cache_key_template": "{path"}`))
+	if err == nil {
+		t.Error("Expected an error for an invalid cache key template")
+	}
+}
+
 func newLocForTesting() *Location {
 	loc := new(Location)
 	cfg := &Config{
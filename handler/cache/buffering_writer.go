@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/ironsmile/nedomi/utils/httputils"
+)
+
+// bufferingWriter keeps in memory an upstream response body with an unknown
+// length (e.g. a chunked one). When it is closed the body is saved in the
+// storage, unless it turned out to be bigger than the limit.
+type bufferingWriter struct {
+	limit      uint64
+	buf        []byte
+	overflowed bool
+	save       func([]byte) error
+}
+
+func (b *bufferingWriter) Write(p []byte) (int, error) {
+	if b.overflowed {
+		return len(p), nil
+	}
+	if uint64(len(b.buf)+len(p)) > b.limit {
+		// The response is too big, it is passed to the client but not cached
+		b.overflowed = true
+		b.buf = nil
+		return len(p), nil
+	}
+	b.buf = append(b.buf, p...)
+	return len(p), nil
+}
+
+func (b *bufferingWriter) Close() error {
+	if b.overflowed {
+		return nil
+	}
+	return b.save(b.buf)
+}
+
+// canBuffer returns whether the body of the upstream response, which has an
+// unknown length, can be buffered so it can be cached once it is complete.
+func (h *reqHandler) canBuffer(rw *httputils.FlexibleResponseWriter) bool {
+	return h.maxBufferedSize > 0 && h.req.Method == "GET" &&
+		rw.Code == http.StatusOK && rw.Headers.Get("Content-Length") == ""
+}
+
+// newBufferingWriter returns a bufferingWriter which saves the metadata and
+// the parts of the object when the whole response body is received.
+func (h *reqHandler) newBufferingWriter(rw *httputils.FlexibleResponseWriter,
+	expiresIn time.Duration) *bufferingWriter {
+	return &bufferingWriter{
+		limit: h.maxBufferedSize,
+		save: func(body []byte) error {
+			var size = uint64(len(body))
+			h.useVariantOf(rw, size, expiresIn)
+			obj := h.newMetadata(rw, size, expiresIn)
+			if err := h.Cache.Storage.SaveMetadata(obj); err != nil {
+				return err
+			}
+
+			pw := PartWriter(h.Cache, h.objID, httputils.ContentRange{Length: size, ObjSize: size})
+			if _, err := pw.Write(body); err != nil {
+				return err
+			}
+			if err := pw.Close(); err != nil {
+				return err
+			}
+
+			h.Logger.Debugf("[%s] Saved buffered response with size %d", h.reqID, size)
+			h.scheduleExpiration(obj)
+			return nil
+		},
+	}
+}
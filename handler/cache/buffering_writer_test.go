@@ -0,0 +1,58 @@
+package cache
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func TestResponsesWithoutContentLength(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	var err error
+	app.cacheHandler, err = New(config.NewHandler("cache", []byte(`{"max_buffered_size": "100"}`)),
+		app.cacheHandler.Location, app.up)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var requests uint32
+	var chunked = func(file, contents string) {
+		app.fsmap[file] = contents
+		app.up.HandleFunc("/"+file, func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddUint32(&requests, 1)
+			w.Header().Set("Expires", time.Now().Add(time.Hour).Format(time.RFC1123))
+			w.WriteHeader(http.StatusOK)
+			for i := 0; i < len(contents); i += 7 {
+				_, _ = w.Write([]byte(contents[i:min(i+7, len(contents))]))
+			}
+		})
+	}
+	chunked("small", testutils.GenerateMeAString(3, 93))
+	chunked("empty", "")
+	chunked("big", testutils.GenerateMeAString(4, 101))
+
+	for _, file := range []string{"small", "empty"} {
+		atomic.StoreUint32(&requests, 0)
+		app.testFullRequest(file)
+		app.testFullRequest(file)
+		if file != "empty" {
+			app.testRange(file, 10, 30)
+		}
+		if got := atomic.LoadUint32(&requests); got != 1 {
+			t.Errorf("Expected %s to be cached but there were %d upstream requests", file, got)
+		}
+	}
+
+	atomic.StoreUint32(&requests, 0)
+	app.testFullRequest("big")
+	app.testFullRequest("big")
+	if got := atomic.LoadUint32(&requests); got != 2 {
+		t.Errorf("Expected responses over the limit not to be cached but there were %d upstream requests", got)
+	}
+}
@@ -0,0 +1,42 @@
+package cache
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+func TestCacheKeyTemplateDropsSignedTokens(t *testing.T) {
+	t.Parallel()
+	app, up, file := newRevalidationApp(t)
+	defer app.cleanup()
+	tmpl, err := types.NewCacheKeyTemplate("{path}?{args:-token,-utm_*}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.cacheHandler.CacheKeyTemplate = tmpl
+
+	var contents = up.contents.Load().(string)
+	var request = func(query string) {
+		req, err := http.NewRequest("GET", "http://example.com/"+file+query, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		app.testRequest(req, contents, http.StatusOK)
+	}
+
+	atomic.StoreUint32(&up.requests, 0)
+	request("?token=first&page=1")
+	request("?page=1&token=second")
+	request("?utm_source=mail&page=1&token=third")
+	if got := atomic.LoadUint32(&up.requests); got != 1 {
+		t.Errorf("Expected 1 upstream request but there were %d", got)
+	}
+
+	request("?page=2&token=first")
+	if got := atomic.LoadUint32(&up.requests); got != 2 {
+		t.Errorf("Expected a different object for a different page but there were %d upstream requests", got)
+	}
+}
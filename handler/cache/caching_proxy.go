@@ -1,19 +1,56 @@
 package cache
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
+	"time"
 
 	"github.com/ironsmile/nedomi/config"
 	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
 )
 
+// DefaultKeepStale is for how long expired objects which can be revalidated
+// with a conditional request are kept in the cache if there is no explicit
+// `keep_stale` setting.
+const DefaultKeepStale = time.Hour
+
+// DefaultMaxBufferedSize is the biggest upstream response without a
+// Content-Length header that is buffered so it can be cached if there is no
+// explicit `max_buffered_size` setting.
+const DefaultMaxBufferedSize = 1024 * 1024
+
+// Settings contains the possible settings for the caching proxy handler.
+type Settings struct {
+	// For how long after they expire should objects which have an ETag or
+	// Last-Modified header be kept in the cache, so that they can be
+	// revalidated with a conditional request instead of downloaded again.
+	KeepStale string `json:"keep_stale"`
+
+	// Upstream responses without a Content-Length header (e.g. chunked ones)
+	// are kept in memory until they are complete and then cached, but only if
+	// they are not bigger than this. Setting it to "0" disables the buffering.
+	MaxBufferedSize *types.BytesSize `json:"max_buffered_size"`
+
+	// When enabled, gzip and brotli encoded upstream responses are cached as
+	// separate variants of the objects. Clients receive the encoding they
+	// accept and the ones which do not accept any are served decompressed
+	// gzip variants if there is no cached identity one.
+	CacheCompressed bool `json:"cache_compressed"`
+}
+
 // CachingProxy is resposible for caching the metadata and parts the requested
 // objects to `loc.Storage`, according to the `loc.Algorithm`.
 type CachingProxy struct {
 	*types.Location
-	cfg  *config.Handler
-	next http.Handler
+	cfg       *config.Handler
+	next      http.Handler
+	inFlight  *inFlightRegistry
+	keepStale time.Duration
+
+	maxBufferedSize uint64
+	cacheCompressed bool
 }
 
 // New creates and returns a ready to used Handler.
@@ -26,7 +63,37 @@ func New(cfg *config.Handler, loc *types.Location, next http.Handler) (*CachingP
 		return nil, fmt.Errorf("caching proxy handler for %s needs a configured cache zone", loc.Name)
 	}
 
-	return &CachingProxy{loc, cfg, next}, nil
+	var s Settings
+	if cfg != nil && len(cfg.Settings) != 0 {
+		if err := json.Unmarshal(cfg.Settings, &s); err != nil {
+			return nil, fmt.Errorf("error while parsing settings for handler.cache - %s",
+				utils.ShowContextOfJSONError(err, cfg.Settings))
+		}
+	}
+
+	var keepStale = DefaultKeepStale
+	if s.KeepStale != "" {
+		var err error
+		if keepStale, err = time.ParseDuration(s.KeepStale); err != nil || keepStale < 0 {
+			return nil, fmt.Errorf("caching proxy handler for %s has an invalid keep_stale `%s`",
+				loc.Name, s.KeepStale)
+		}
+	}
+
+	var maxBufferedSize uint64 = DefaultMaxBufferedSize
+	if s.MaxBufferedSize != nil {
+		maxBufferedSize = s.MaxBufferedSize.Bytes()
+	}
+
+	return &CachingProxy{
+		Location:        loc,
+		cfg:             cfg,
+		next:            next,
+		inFlight:        zoneInFlightRegistry(loc.Cache),
+		keepStale:       keepStale,
+		maxBufferedSize: maxBufferedSize,
+		cacheCompressed: s.CacheCompressed,
+	}, nil
 }
 
 // ServeHTTP is the main serving function
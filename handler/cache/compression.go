@@ -0,0 +1,153 @@
+package cache
+
+import (
+	"compress/gzip"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/cacheutils"
+	"github.com/ironsmile/nedomi/utils/httputils"
+)
+
+// The content encodings which are cached when the `cache_compressed` setting
+// is enabled, in the order in which they are preferred.
+var compressedEncodings = []string{"br", "gzip"}
+
+var errDecompressionAborted = errors.New("reading of the compressed object was aborted")
+
+// contentEncoding returns the normalized Content-Encoding from the headers.
+func contentEncoding(headers http.Header) string {
+	return strings.ToLower(strings.TrimSpace(headers.Get("Content-Encoding")))
+}
+
+// hasVaryField returns whether the request header is listed in the Vary headers.
+func hasVaryField(headers http.Header, field string) bool {
+	for _, f := range cacheutils.VaryFields(headers) {
+		if f == field {
+			return true
+		}
+	}
+	return false
+}
+
+// cacheableEncodings returns the content encodings which can be cached.
+func (h *reqHandler) cacheableEncodings() []string {
+	if !h.cacheCompressed {
+		return nil
+	}
+	return compressedEncodings
+}
+
+// clientEncodings returns the cacheable content encodings that the client
+// accepts, in the order in which they are preferred.
+func (h *reqHandler) clientEncodings() []string {
+	var result []string
+	var acceptEncoding = h.req.Header.Get("Accept-Encoding")
+	for _, encoding := range h.cacheableEncodings() {
+		if httputils.AcceptsEncoding(acceptEncoding, encoding) {
+			result = append(result, encoding)
+		}
+	}
+	return result
+}
+
+// upstreamAcceptEncoding returns the Accept-Encoding header which should be
+// sent to the upstream. When parts of an already cached object are requested,
+// it is the encoding of that object.
+func (h *reqHandler) upstreamAcceptEncoding() string {
+	if h.obj != nil {
+		return contentEncoding(h.obj.Headers)
+	}
+	return strings.Join(h.clientEncodings(), ", ")
+}
+
+// findVariant looks for the cached variant of the object which is the best
+// match for the client request. The supplied metadata is of the primary object
+// and it has a Vary header.
+func (h *reqHandler) findVariant(primary *types.ObjectMetadata) (*types.ObjectMetadata, error) {
+	var encodings = append(h.clientEncodings(), "")
+	if h.cacheCompressed && len(encodings) == 1 {
+		// gzip variants can be decompressed for clients that do not accept
+		// any compression
+		encodings = append(encodings, "gzip")
+	}
+
+	for i, encoding := range encodings {
+		id := h.variantID(primary.Headers, encoding)
+		if i == 0 {
+			// This is where a new response will most likely be cached
+			h.objID = id
+		}
+
+		if id.Hash() == primary.ID.Hash() {
+			if contentEncoding(primary.Headers) != "" {
+				// Encoded responses are always saved as variants, so this
+				// is only the metadata of one of them.
+				continue
+			}
+			h.objID = id
+			return primary, nil
+		}
+
+		obj, err := h.Cache.Storage.GetMetadata(id)
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			h.objID = id
+			return nil, err
+		}
+		h.Logger.Debugf("[%s] Found variant %s", h.reqID, id)
+		h.objID = id
+		return obj, nil
+	}
+
+	return nil, os.ErrNotExist
+}
+
+// needsDecompression returns whether the cached object is gzip encoded but the
+// client does not accept it.
+func (h *reqHandler) needsDecompression() bool {
+	return contentEncoding(h.obj.Headers) == "gzip" &&
+		!httputils.AcceptsEncoding(h.req.Header.Get("Accept-Encoding"), "gzip")
+}
+
+// knownDecompressed responds with the whole decompressed cached object. The
+// requested range, if any, is ignored as the decompressed size is not known.
+func (h *reqHandler) knownDecompressed() {
+	httputils.CopyHeadersWithout(h.obj.Headers, h.resp.Header(), "Content-Encoding")
+	if etag := h.resp.Header().Get("ETag"); strings.HasPrefix(etag, `"`) {
+		// The decompressed representation is not byte-for-byte the same
+		h.resp.Header().Set("ETag", "W/"+etag)
+	}
+	h.rewriteTimeBasedHeaders()
+	h.resp.WriteHeader(h.obj.Code)
+	if h.req.Method == "HEAD" || h.obj.Size == 0 {
+		return
+	}
+
+	r, w := io.Pipe()
+	defer func() {
+		_ = r.Close()
+	}()
+	go func() {
+		if h.lazilyCopy(w, 0, h.obj.Size-1) {
+			_ = w.Close()
+		} else {
+			_ = w.CloseWithError(errDecompressionAborted)
+		}
+	}()
+
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		h.Logger.Errorf("[%s] Could not decompress %s: %s", h.reqID, h.objID, err)
+		return
+	}
+	if copied, err := io.Copy(h.resp, gz); err != nil {
+		h.Logger.Logf("[%s] Error sending decompressed contents after %dbytes of %s: %s",
+			h.reqID, copied, h.objID, err)
+	}
+}
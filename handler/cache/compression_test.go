@@ -0,0 +1,96 @@
+package cache
+
+import (
+	"bytes"
+	"compress/gzip"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/utils/httputils"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func TestCompressedVariants(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	var err error
+	app.cacheHandler, err = New(config.NewHandler("cache", []byte(`{"cache_compressed": true}`)),
+		app.cacheHandler.Location, app.up)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var file = "manifest.m3u8"
+	var contents = testutils.GenerateMeAString(6, 300)
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	if _, err := gz.Write([]byte(contents)); err != nil {
+		t.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var encoded = map[string]string{
+		"gzip": buf.String(),
+		"br":   "pretend this is brotli",
+	}
+
+	var requests = make(map[string]*uint32)
+	for _, encoding := range []string{"", "gzip", "br"} {
+		requests[encoding] = new(uint32)
+	}
+	app.up.HandleFunc("/"+file, func(w http.ResponseWriter, r *http.Request) {
+		var body, encoding = contents, ""
+		for _, e := range []string{"br", "gzip"} {
+			if httputils.AcceptsEncoding(r.Header.Get("Accept-Encoding"), e) {
+				body, encoding = encoded[e], e
+				break
+			}
+		}
+		atomic.AddUint32(requests[encoding], 1)
+		w.Header().Set("Expires", time.Now().Add(time.Hour).Format(time.RFC1123))
+		w.Header().Set("Vary", "Accept-Encoding")
+		if encoding != "" {
+			w.Header().Set("Content-Encoding", encoding)
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader([]byte(body)))
+	})
+
+	var request = func(acceptEncoding, expected string) {
+		req, err := http.NewRequest("GET", "http://example.com/"+file, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if acceptEncoding != "" {
+			req.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+		app.testRequest(req, expected, http.StatusOK)
+	}
+
+	for i := 0; i < 2; i++ {
+		request("gzip, deflate", encoded["gzip"])
+		// decompressed from the cached gzip variant
+		request("", contents)
+		request("br", encoded["br"])
+		// both are cached, br is preferred
+		request("gzip, br", encoded["br"])
+		request("gzip;q=0, br;q=0", contents)
+	}
+
+	// Ranges are of the encoded representation
+	req := reqForRange(file, 10, 20)
+	req.Header.Set("Accept-Encoding", "gzip")
+	app.testRequest(req, encoded["gzip"][10:30], http.StatusPartialContent)
+
+	var expected = map[string]uint32{"": 0, "gzip": 1, "br": 1}
+	for encoding, count := range requests {
+		if got := atomic.LoadUint32(count); got != expected[encoding] {
+			t.Errorf("Expected %d upstream requests for encoding '%s' but got %d",
+				expected[encoding], encoding, got)
+		}
+	}
+}
@@ -0,0 +1,45 @@
+package cache
+
+import (
+	"net/http"
+	"sync/atomic"
+	"testing"
+)
+
+func TestConditionalRequestsForCachedObjects(t *testing.T) {
+	t.Parallel()
+	app, up, file := newRevalidationApp(t)
+	defer app.cleanup()
+	var contents = app.fsmap[file]
+	var etag = `"` + contents[:8] + `"`
+	atomic.StoreUint32(&up.requests, 0)
+
+	var tests = []struct {
+		headers  map[string]string
+		expected string
+		code     int
+	}{
+		{map[string]string{"If-None-Match": etag}, "", http.StatusNotModified},
+		{map[string]string{"If-None-Match": etag, "Range": "bytes=2-5"}, "", http.StatusNotModified},
+		{map[string]string{"If-None-Match": `"other"`}, contents, http.StatusOK},
+		{map[string]string{"If-Match": etag}, contents, http.StatusOK},
+		{map[string]string{"If-Match": `"other"`}, "Precondition Failed\n", http.StatusPreconditionFailed},
+		{map[string]string{"If-Range": etag, "Range": "bytes=2-5"}, contents[2:6], http.StatusPartialContent},
+		{map[string]string{"If-Range": `"other"`, "Range": "bytes=2-5"}, contents, http.StatusOK},
+	}
+
+	for _, test := range tests {
+		req, err := http.NewRequest("GET", "http://example.com/"+file, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range test.headers {
+			req.Header.Set(key, value)
+		}
+		app.testRequest(req, test.expected, test.code)
+	}
+
+	if got := atomic.LoadUint32(&up.requests); got != 0 {
+		t.Errorf("Expected the conditional requests to be served from cache but there were %d upstream requests", got)
+	}
+}
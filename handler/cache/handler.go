@@ -1,6 +1,7 @@
 package cache
 
 import (
+	"mime/multipart"
 	"net/http"
 	"os"
 	"strconv"
@@ -27,12 +28,21 @@ type reqHandler struct {
 // handle tries to respond to client request by loading metadata and file parts
 // from the cache. If there are missing parts, they are retrieved from the upstream.
 func (h *reqHandler) handle() {
-	h.objID = h.NewObjectIDForURL(h.req.URL)
+	h.objID = h.NewObjectIDForRequest(h.req)
 	h.reqID, _ = contexts.GetRequestID(h.req.Context())
 	h.Logger.Debugf("[%s] Caching proxy access: %s %s", h.reqID, h.req.Method, h.req.RequestURI)
 
-	rng := h.req.Header.Get("Range")
+	if hr, ok := h.Cache.Storage.(types.HealthReporter); ok && !hr.Healthy() {
+		h.Logger.Debugf("[%s] Storage is degraded, bypassing the cache...", h.reqID)
+		h.next.ServeHTTP(h.resp, h.req)
+		return
+	}
+
 	obj, err := h.Cache.Storage.GetMetadata(h.objID)
+	if err == nil && len(cacheutils.VaryFields(obj.Headers)) > 0 {
+		h.Logger.Debugf("[%s] Object has variants, looking for a matching one", h.reqID)
+		obj, err = h.findVariant(obj)
+	}
 	if os.IsNotExist(err) {
 		h.Logger.Debugf("[%s] No metadata on storage, proxying...", h.reqID)
 		h.carbonCopyProxy()
@@ -45,49 +55,79 @@ func (h *reqHandler) handle() {
 				http.StatusInternalServerError)
 			return
 		}
-		if discardErr := h.Cache.Storage.Discard(h.objID); discardErr != nil {
-			h.Logger.Errorf("[%s] Storage error when discarding of object's data: %s",
-				h.reqID, discardErr)
-		}
+		h.discard()
 		h.carbonCopyProxy()
 	} else if !utils.IsMetadataFresh(obj) {
-		h.Logger.Debugf("[%s] Metadata is stale, proxying...", h.reqID)
-		//!TODO: optimize, do only a head request when the metadata is stale?
-		if discardErr := h.Cache.Storage.Discard(h.objID); discardErr != nil {
-			h.Logger.Errorf("[%s] Storage error when discarding of object's data: %s",
-				h.reqID, discardErr)
-		}
-		h.carbonCopyProxy()
+		h.Logger.Debugf("[%s] Metadata is stale, revalidating...", h.reqID)
+		h.revalidate(obj)
 	} else if !cacheutils.CacheSatisfiesRequest(obj, h.req) {
 		h.Logger.Debugf("[%s] Client does not want cached response or the cache does not"+
 			"satisfy the request, proxying...", h.reqID)
 		h.carbonCopyProxy()
 	} else {
-		h.obj = obj
-		//!TODO: advertise that we support ranges - send "Accept-Ranges: bytes"?
-
-		//!TODO: evaluate conditional requests: https://tools.ietf.org/html/rfc7232
-		//!TODO: Also, handle this from RFC7233:
-		// "The Range header field is evaluated after evaluating the precondition
-		// header fields defined in [RFC7232], and only if the result in absence
-		// of the Range header field would be a 200 (OK) response.  In other
-		// words, Range is ignored when a conditional GET would result in a 304
-		// (Not Modified) response."
-
-		if rng != "" {
-			h.Logger.Debugf("[%s] Serving range '%s', preferably from cache...",
-				h.reqID, rng)
-			h.knownRanged()
-		} else {
-			h.Logger.Debugf("[%s] Serving full object, preferably from cache...",
-				h.reqID)
-			h.knownFull()
+		h.serveFromCache(obj)
+	}
+}
+
+// serveFromCache responds to the client using the supplied metadata and the
+// cached parts. Missing parts are retrieved from the upstream.
+func (h *reqHandler) serveFromCache(obj *types.ObjectMetadata) {
+	h.obj = obj
+	//!TODO: advertise that we support ranges - send "Accept-Ranges: bytes"?
+
+	// From RFC7233: "The Range header field is evaluated after evaluating the
+	// precondition header fields defined in [RFC7232], and only if the result
+	// in absence of the Range header field would be a 200 (OK) response.  In
+	// other words, Range is ignored when a conditional GET would result in a
+	// 304 (Not Modified) response."
+	if h.obj.Code == http.StatusOK {
+		switch code := httputils.CheckPreconditions(h.req, h.obj.Headers); code {
+		case http.StatusNotModified:
+			h.Logger.Debugf("[%s] Object was not modified, responding with 304", h.reqID)
+			h.notModified()
+			return
+		case http.StatusPreconditionFailed:
+			h.Logger.Debugf("[%s] Precondition failed, responding with 412", h.reqID)
+			http.Error(h.resp, http.StatusText(code), code)
+			return
 		}
 	}
+
+	if h.needsDecompression() {
+		h.Logger.Debugf("[%s] Serving decompressed object from cache...", h.reqID)
+		h.knownDecompressed()
+	} else if rng := h.req.Header.Get("Range"); rng != "" && !httputils.CheckIfRange(h.req, h.obj.Headers) {
+		h.Logger.Debugf("[%s] If-Range does not match, serving full object instead of '%s'...",
+			h.reqID, rng)
+		h.knownFull()
+	} else if rng != "" {
+		h.Logger.Debugf("[%s] Serving range '%s', preferably from cache...",
+			h.reqID, rng)
+		h.knownRanged()
+	} else {
+		h.Logger.Debugf("[%s] Serving full object, preferably from cache...",
+			h.reqID)
+		h.knownFull()
+	}
 }
 
 func (h *reqHandler) carbonCopyProxy() {
-	flexibleResp := httputils.NewFlexibleResponseWriter(h.getResponseHook())
+	h.proxy(h.getNormalizedRequest(), h.getResponseHook())
+}
+
+// proxy sends the request to the next handler and passes its response to the
+// hook, which decides where the response body should go. The received body is
+// counted as upstream traffic of the cache zone.
+func (h *reqHandler) proxy(req *http.Request, hook func(*httputils.FlexibleResponseWriter)) {
+	flexibleResp := httputils.NewFlexibleResponseWriter(func(rw *httputils.FlexibleResponseWriter) {
+		hook(rw)
+		if rw.BodyWriter != nil {
+			rw.BodyWriter = &countingWriteCloser{
+				WriteCloser: rw.BodyWriter,
+				count:       h.Cache.Traffic.AddUpstreamBytes,
+			}
+		}
+	})
 	defer func() {
 		if flexibleResp.BodyWriter != nil {
 			if err := flexibleResp.BodyWriter.Close(); err != nil {
@@ -98,15 +138,9 @@ func (h *reqHandler) carbonCopyProxy() {
 				}
 			}
 		}
-		//!TODO: cache small upstream responses that we did not cache because
-		// there was no Content-Length header in the upstream response but it
-		// was otherwise cacheable? Examples are folder listings for apache and
-		// ngingx: `curl -i http://mirror.rackspace.com/` or `curl -i
-		// https://mirrors.uni-plovdiv.net/`
-
 	}()
 
-	h.next.ServeHTTP(flexibleResp, h.getNormalizedRequest())
+	h.next.ServeHTTP(flexibleResp, req)
 }
 
 func (h *reqHandler) knownRanged() {
@@ -117,10 +151,17 @@ func (h *reqHandler) knownRanged() {
 		return
 	}
 
+	if httputils.RangesSize(ranges) > h.obj.Size {
+		// The client asks for more than the whole object, which is most likely
+		// an attack, so the ranges are ignored like in net/http.ServeContent
+		h.Logger.Debugf("[%s] Requested ranges are bigger than the object, serving it whole",
+			h.reqID)
+		h.knownFull()
+		return
+	}
+
 	if len(ranges) != 1 {
-		// We do not support multiple ranges but maybe the upstream does
-		//!TODO: implement support for multiple ranges
-		h.carbonCopyProxy()
+		h.knownMultiRanged(ranges)
 		return
 	}
 	reqRange := ranges[0]
@@ -137,27 +178,77 @@ func (h *reqHandler) knownRanged() {
 	h.lazilyRespond(ranges[0].Start, ranges[0].Start+ranges[0].Length-1)
 }
 
+// knownMultiRanged responds with a multipart/byteranges body which contains
+// every one of the requested ranges.
+func (h *reqHandler) knownMultiRanged(ranges []httputils.Range) {
+	var contentType = h.obj.Headers.Get("Content-Type")
+	var boundary = multipart.NewWriter(nil).Boundary()
+	var size = httputils.MultipartByterangesSize(ranges, boundary, contentType, h.obj.Size)
+
+	httputils.CopyHeaders(h.obj.Headers, h.resp.Header())
+	h.resp.Header().Set("Content-Type", httputils.MultipartByterangesContentType(boundary))
+	h.resp.Header().Set("Content-Length", strconv.FormatUint(size, 10))
+	h.rewriteTimeBasedHeaders()
+	h.resp.WriteHeader(http.StatusPartialContent)
+	if h.req.Method == "HEAD" {
+		return
+	}
+
+	var mw = multipart.NewWriter(h.resp)
+	if err := mw.SetBoundary(boundary); err != nil {
+		h.Logger.Errorf("[%s] Unexpected invalid boundary %s: %s", h.reqID, boundary, err)
+		return
+	}
+	for _, rng := range ranges {
+		part, err := mw.CreatePart(httputils.RangePartHeader(rng, contentType, h.obj.Size))
+		if err != nil {
+			h.Logger.Logf("[%s] Error sending the multipart header for %s: %s",
+				h.reqID, rng.ContentRange(h.obj.Size), err)
+			return
+		}
+		if !h.lazilyCopy(part, rng.Start, rng.Start+rng.Length-1) {
+			return
+		}
+	}
+	if err := mw.Close(); err != nil {
+		h.Logger.Logf("[%s] Error finishing the multipart response: %s", h.reqID, err)
+	}
+}
+
 func (h *reqHandler) knownFull() {
 	httputils.CopyHeaders(h.obj.Headers, h.resp.Header())
 	h.resp.Header().Set("Content-Length", strconv.FormatUint(h.obj.Size, 10))
 	h.rewriteTimeBasedHeaders()
 	h.resp.WriteHeader(h.obj.Code)
-	if h.req.Method == "HEAD" {
+	if h.req.Method == "HEAD" || h.obj.Size == 0 {
 		return
 	}
 
-	var responseSize = h.obj.Size
-	if responseSize != 0 {
-		responseSize--
+	h.lazilyRespond(0, h.obj.Size-1)
+}
+
+// notModified responds with 304 and the headers from RFC7232, section 4.1
+// which would have been sent in a 200 (OK) response.
+func (h *reqHandler) notModified() {
+	for _, header := range notModifiedHeaders {
+		if values, ok := h.obj.Headers[header]; ok {
+			h.resp.Header()[header] = utils.CopyStringSlice(values)
+		}
 	}
-	h.lazilyRespond(0, responseSize)
+	h.rewriteTimeBasedHeaders()
+	h.resp.WriteHeader(http.StatusNotModified)
 }
 
 func (h *reqHandler) rewriteTimeBasedHeaders() {
 	var nowUnix = time.Now().Unix()
+	var maxAge = h.obj.ExpiresAt - nowUnix
+	if maxAge < 0 {
+		maxAge = 0
+		h.resp.Header().Set("Warning", `110 - "Response is Stale"`)
+	}
 	h.resp.Header().Set("Expires", time.Unix(h.obj.ExpiresAt, 0).Format(http.TimeFormat))
 	h.resp.Header().Set("Age", strconv.FormatInt(nowUnix-h.obj.ResponseTimestamp, 10))
-	h.resp.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(h.obj.ExpiresAt-nowUnix, 10))
+	h.resp.Header().Set("Cache-Control", "max-age="+strconv.FormatInt(maxAge, 10))
 }
 
 func isPartWriterShorWrite(err error) bool {
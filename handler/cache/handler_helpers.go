@@ -2,12 +2,16 @@ package cache
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net/http"
 	"os"
+	"reflect"
 	"sort"
 	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
@@ -25,6 +29,11 @@ var hopHeaders = httputils.GetHopByHopHeaders()
 var metadataHeadersToFilter = append(hopHeaders,
 	"Content-Length", "Content-Range", "Expires", "Age", "Cache-Control")
 
+// These are sent with 304 Not Modified responses. The time based headers are
+// added separately by rewriteTimeBasedHeaders.
+var notModifiedHeaders = []string{
+	"Content-Location", "Date", "ETag", "Last-Modified", "Vary"}
+
 // Returns a new HTTP 1.1 request that has no body. It also clears headers like
 // accept-encoding and rearranges the requested ranges so they match part
 func (h *reqHandler) getNormalizedRequest() *http.Request {
@@ -40,67 +49,133 @@ func (h *reqHandler) getNormalizedRequest() *http.Request {
 	}
 
 	httputils.CopyHeadersWithout(h.req.Header, result.Header, "Accept-Encoding")
+	if h.cacheCompressed {
+		if acceptEncoding := h.upstreamAcceptEncoding(); acceptEncoding != "" {
+			result.Header.Set("Accept-Encoding", acceptEncoding)
+		}
+	}
 
-	//!TODO: fix requested range to be divisible by the storage partSize
+	if rng := result.Header.Get("Range"); rng != "" {
+		if aligned, ok := alignRange(rng, h.Cache.Storage.PartSize()); ok {
+			result.Header.Set("Range", aligned)
+		}
+	}
 
 	return result
 }
 
+// alignRange widens a single byte range so that it starts and ends on part
+// boundaries. This way every part that is downloaded can be saved in the
+// storage. Suffix ranges and multiple ranges can not be aligned without knowing
+// the object size, so false is returned for them.
+func alignRange(rng string, partSize uint64) (string, bool) {
+	const b = "bytes="
+	if !strings.HasPrefix(rng, b) || strings.Contains(rng, ",") {
+		return "", false
+	}
+	var spec = strings.TrimSpace(rng[len(b):])
+	var i = strings.Index(spec, "-")
+	if i <= 0 {
+		return "", false
+	}
+
+	start, err := strconv.ParseUint(strings.TrimSpace(spec[:i]), 10, 64)
+	if err != nil {
+		return "", false
+	}
+	var aligned = b + strconv.FormatUint(start-start%partSize, 10) + "-"
+	if end := strings.TrimSpace(spec[i+1:]); end != "" {
+		e, err := strconv.ParseUint(end, 10, 64)
+		if err != nil || e < start {
+			return "", false
+		}
+		aligned += strconv.FormatUint(e-e%partSize+partSize-1, 10)
+	}
+	return aligned, true
+}
+
+// getClientWriter writes the response status to the client and returns where
+// the response body for it should be written. When the upstream range was
+// widened by getNormalizedRequest, only the bytes which the client requested
+// are sent to it.
+func (h *reqHandler) getClientWriter(rw *httputils.FlexibleResponseWriter) io.WriteCloser {
+	var clientRange = h.req.Header.Get("Range")
+	if rw.Code != http.StatusPartialContent || clientRange == "" {
+		h.resp.WriteHeader(rw.Code)
+		return utils.AddCloser(h.resp)
+	}
+
+	respRange, err := httputils.GetResponseRange(rw.Code, rw.Headers)
+	if err != nil {
+		h.resp.WriteHeader(rw.Code)
+		return utils.AddCloser(h.resp)
+	}
+	ranges, err := httputils.ParseRequestRange(clientRange, respRange.ObjSize)
+	if err != nil {
+		h.Logger.Debugf("[%s] Client range %s is not satisfiable for object with size %d",
+			h.reqID, clientRange, respRange.ObjSize)
+		h.resp.Header().Del("Content-Length")
+		h.resp.Header().Set("Content-Range", "bytes */"+strconv.FormatUint(respRange.ObjSize, 10))
+		h.resp.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		return utils.NopCloser(ioutil.Discard)
+	}
+	if len(ranges) != 1 || ranges[0].Start < respRange.Start ||
+		ranges[0].Start+ranges[0].Length > respRange.Start+respRange.Length {
+		// Not something we have widened, the upstream response is passed as it is
+		h.resp.WriteHeader(rw.Code)
+		return utils.AddCloser(h.resp)
+	}
+
+	var reqRange = ranges[0]
+	h.resp.Header().Set("Content-Range", reqRange.ContentRange(respRange.ObjSize))
+	h.resp.Header().Set("Content-Length", strconv.FormatUint(reqRange.Length, 10))
+	h.resp.WriteHeader(rw.Code)
+	return utils.RangeWriteCloser(utils.AddCloser(h.resp),
+		reqRange.Start-respRange.Start, reqRange.Length)
+}
+
 func (h *reqHandler) getResponseHook() func(*httputils.FlexibleResponseWriter) {
 
 	return func(rw *httputils.FlexibleResponseWriter) {
 		h.Logger.Debugf("[%s] Received headers for %s, sending them to client...",
 			h.reqID, h.req.URL)
 		httputils.CopyHeadersWithout(rw.Headers, h.resp.Header(), hopHeaders...)
-		h.resp.WriteHeader(rw.Code)
+		clientWriter := h.getClientWriter(rw)
 
-		isCacheable := cacheutils.IsResponseCacheable(rw.Code, rw.Headers)
+		isCacheable := cacheutils.IsResponseCacheable(rw.Code, rw.Headers, h.cacheableEncodings()...)
 		if !isCacheable {
 			h.Logger.Debugf("[%s] Response is non-cacheable", h.reqID)
-			rw.BodyWriter = utils.AddCloser(h.resp)
+			rw.BodyWriter = clientWriter
 			return
 		}
 
 		expiresIn := cacheutils.ResponseExpiresIn(rw.Headers, h.CacheDefaultDuration)
 		if expiresIn <= 0 {
 			h.Logger.Debugf("[%s] Response expires in the past: %s", h.reqID, expiresIn)
-			rw.BodyWriter = utils.AddCloser(h.resp)
+			rw.BodyWriter = clientWriter
 			return
 		}
 
 		responseRange, err := httputils.GetResponseRange(rw.Code, rw.Headers)
-		if err != nil {
+		if err != nil && h.canBuffer(rw) {
+			h.Logger.Debugf("[%s] Response has unknown length, buffering it up to %d bytes",
+				h.reqID, h.maxBufferedSize)
+			rw.BodyWriter = utils.MultiWriteCloser(
+				clientWriter,
+				h.newBufferingWriter(rw, expiresIn),
+			)
+			return
+		} else if err != nil {
 			h.Logger.Debugf("[%s] Was not able to get response range (%s)",
 				h.reqID, err)
-			rw.BodyWriter = utils.AddCloser(h.resp)
+			rw.BodyWriter = clientWriter
 			return
 		}
 
 		h.Logger.Debugf("[%s] Response is cacheable! Caching metadata and parts", h.reqID)
 
-		code := rw.Code
-		if code == http.StatusPartialContent {
-			// 206 is returned only if the server would
-			// have returned 200 with a normal request
-			code = http.StatusOK
-		}
-
-		//!TODO: maybe call cached time.Now. See the comment in utils.IsMetadataFresh
-		now := time.Now()
-
-		obj := &types.ObjectMetadata{
-			ID:                h.objID,
-			ResponseTimestamp: now.Unix(),
-			Code:              code,
-			Size:              responseRange.ObjSize,
-			Headers:           make(http.Header),
-			ExpiresAt:         now.Add(expiresIn).Unix(),
-		}
-		httputils.CopyHeadersWithout(rw.Headers, obj.Headers, metadataHeadersToFilter...)
-		// maybe the server does not return date, we should set it then
-		if obj.Headers.Get("Date") == "" {
-			obj.Headers.Set("Date", now.Format(http.TimeFormat))
-		}
+		h.useVariantOf(rw, responseRange.ObjSize, expiresIn)
+		obj := h.newMetadata(rw, responseRange.ObjSize, expiresIn)
 
 		//!TODO: consult the cache algorithm whether to save the metadata
 		//!TODO: optimize this, save the metadata only when it's newer
@@ -109,87 +184,284 @@ func (h *reqHandler) getResponseHook() func(*httputils.FlexibleResponseWriter) {
 		if err := h.Cache.Storage.SaveMetadata(obj); err != nil {
 			h.Logger.Errorf("[%s] Could not save metadata for %s: %s",
 				h.reqID, obj.ID, err)
-			rw.BodyWriter = utils.AddCloser(h.resp)
+			rw.BodyWriter = clientWriter
 			return
 		}
 
 		if h.req.Method == "HEAD" {
-			rw.BodyWriter = utils.AddCloser(h.resp)
+			rw.BodyWriter = clientWriter
 			return
 		}
 
 		rw.BodyWriter = utils.MultiWriteCloser(
-			utils.AddCloser(h.resp),
+			clientWriter,
 			PartWriter(h.Cache, h.objID, *responseRange),
 		)
 
-		h.Logger.Debugf("[%s] Setting the cached data to expire in %s", h.reqID, expiresIn)
-		h.Cache.Scheduler.AddEvent(
-			h.objID.Hash(),
-			storage.GetExpirationHandler(h.Cache, h.objID),
-			expiresIn,
-		)
+		h.scheduleExpiration(obj)
 	}
 }
 
+// variantID returns the ID of the variant of the object, which is selected by
+// the supplied Vary response headers, the headers sent to the upstream and the
+// content encoding.
+func (h *reqHandler) variantID(respHeaders http.Header, encoding string) *types.ObjectID {
+	primary := h.objID.Primary()
+	key := cacheutils.VariantKey(respHeaders, h.getNormalizedRequest().Header)
+	if encoding != "" {
+		if key != "" {
+			key += "\n"
+		}
+		key += "Content-Encoding: " + encoding
+	}
+	return types.NewVariantObjectID(primary.CacheKey(), primary.Path(), key)
+}
+
+// useVariantOf points the handler to the variant of the object which is
+// selected by the Vary header of the upstream response. The metadata of the
+// primary object is saved as well, so future requests can find the Vary header
+// and look for their variant. It also records the keys of the cached variants
+// so that they can be purged together with the object, which is why it is kept
+// in the storage for at least as long as them.
+func (h *reqHandler) useVariantOf(rw *httputils.FlexibleResponseWriter,
+	size uint64, expiresIn time.Duration) {
+	h.objID = h.variantID(rw.Headers, contentEncoding(rw.Headers))
+	var variant = h.objID.Variant()
+	if variant == "" {
+		return
+	}
+
+	primary := h.newMetadata(rw, size, expiresIn)
+	primary.ID = h.objID.Primary()
+	existing, err := h.Cache.Storage.GetMetadata(primary.ID)
+	if err == nil && reflect.DeepEqual(
+		cacheutils.VaryFields(existing.Headers), cacheutils.VaryFields(primary.Headers)) {
+		// The primary object already leads to the variants, it may even be
+		// one of them
+		var keepUntil = utils.MetadataKeepUntil(existing).Unix()
+		if hasVariant(existing, variant) && keepUntil >= primary.KeepUntil {
+			return
+		}
+		if keepUntil < primary.KeepUntil {
+			keepUntil = primary.KeepUntil
+		}
+		primary = utils.CopyMetadata(existing)
+		primary.KeepUntil = keepUntil
+	} else if err == nil {
+		// The variants of the previous Vary header are still in the storage
+		primary.Variants = existing.Variants
+	}
+	if !hasVariant(primary, variant) {
+		primary.Variants = append(primary.Variants, variant)
+	}
+
+	if err := h.Cache.Storage.SaveMetadata(primary); err != nil {
+		h.Logger.Errorf("[%s] Could not save metadata for %s: %s",
+			h.reqID, primary.ID, err)
+		return
+	}
+	h.scheduleExpiration(primary)
+}
+
+func hasVariant(obj *types.ObjectMetadata, variant string) bool {
+	for _, v := range obj.Variants {
+		if v == variant {
+			return true
+		}
+	}
+	return false
+}
+
+// newMetadata returns the metadata for the object from the upstream response.
+func (h *reqHandler) newMetadata(rw *httputils.FlexibleResponseWriter,
+	size uint64, expiresIn time.Duration) *types.ObjectMetadata {
+	code := rw.Code
+	if code == http.StatusPartialContent {
+		// 206 is returned only if the server would
+		// have returned 200 with a normal request
+		code = http.StatusOK
+	}
+
+	//!TODO: maybe call cached time.Now. See the comment in utils.IsMetadataFresh
+	now := time.Now()
+
+	obj := &types.ObjectMetadata{
+		ID:                h.objID,
+		ResponseTimestamp: now.Unix(),
+		Code:              code,
+		Size:              size,
+		Headers:           make(http.Header),
+		ExpiresAt:         now.Add(expiresIn).Unix(),
+	}
+	httputils.CopyHeadersWithout(rw.Headers, obj.Headers, metadataHeadersToFilter...)
+	if contentEncoding(obj.Headers) != "" && !hasVaryField(obj.Headers, "Accept-Encoding") {
+		// The encoded variants can only be found if Accept-Encoding is there
+		obj.Headers.Add("Vary", "Accept-Encoding")
+	}
+	// maybe the server does not return date, we should set it then
+	if obj.Headers.Get("Date") == "" {
+		obj.Headers.Set("Date", now.Format(http.TimeFormat))
+	}
+	h.setStaleLimits(obj, rw.Headers)
+	return obj
+}
+
+// setStaleLimits sets for how long after it expires the object can be served
+// stale and for how long it should be kept in the storage, according to the
+// upstream headers and the handler settings.
+func (h *reqHandler) setStaleLimits(obj *types.ObjectMetadata, headers http.Header) {
+	whileRevalidate, ifError := cacheutils.ResponseStaleDurations(headers)
+	obj.StaleWhileRevalidate = int64(whileRevalidate / time.Second)
+	obj.StaleIfError = int64(ifError / time.Second)
+
+	var keep = obj.StaleWhileRevalidate
+	if obj.StaleIfError > keep {
+		keep = obj.StaleIfError
+	}
+	if keepStale := int64(h.keepStale / time.Second); cacheutils.HasValidators(obj) && keepStale > keep {
+		keep = keepStale
+	}
+	obj.KeepUntil = obj.ExpiresAt + keep
+}
+
+// scheduleExpiration schedules the removal of the object from the storage
+// once it is no longer useful.
+func (h *reqHandler) scheduleExpiration(obj *types.ObjectMetadata) {
+	//!TODO: maybe call cached time.Now. See the comment in utils.IsMetadataFresh
+	keepFor := utils.MetadataKeepUntil(obj).Sub(time.Now())
+	h.Logger.Debugf("[%s] Setting the cached data to expire in %s", h.reqID, keepFor)
+	h.Cache.Scheduler.AddEvent(
+		obj.ID.Hash(),
+		storage.GetExpirationHandler(h.Cache, obj.ID),
+		keepFor,
+	)
+}
+
 func idSuffix(s, e uint64) []byte {
 	return strconv.AppendUint(append(strconv.AppendUint([]byte(`->b=`), s, 10), '-'), e, 10)
 }
 
-func (h *reqHandler) getUpstreamReader(start, end uint64) io.ReadCloser {
+// getUpstreamReader makes an upstream request for the [start, end] range of the
+// object. If fetch is not nil, the received body is also shared with all other
+// requests which have joined the fetch's parts.
+func (h *reqHandler) getUpstreamReader(start, end uint64, fetch *inFlightFetch) io.ReadCloser {
 	subh := *h
 	// ->start-end
 	var newCtx context.Context
 	newCtx, subh.reqID = contexts.AppendToRequestID(subh.req.Context(), idSuffix(start, end))
 	subh.req = subh.getNormalizedRequest()
 	subh.req = subh.req.WithContext(newCtx)
+	// The client preconditions were already evaluated, we need the data itself
+	for _, header := range conditionalHeaders {
+		subh.req.Header.Del(header)
+	}
 	subh.req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
 
 	h.Logger.Debugf("[%s] Making upstream request for %s, bytes [%d-%d]...",
 		subh.reqID, subh.req.URL, start, end)
 
-	//!TODO: optimize requests for the same pieces?
-	//       if possible, make only 1 request to the upstream for the same part
-
 	r, w := io.Pipe()
+	closeWithError := func(err error) {
+		_ = w.CloseWithError(err)
+		if fetch != nil {
+			_ = fetch.CloseWithError(err)
+		}
+	}
 	subh.resp = httputils.NewFlexibleResponseWriter(func(rw *httputils.FlexibleResponseWriter) {
 		respRng, err := httputils.GetResponseRange(rw.Code, rw.Headers)
 		if err != nil {
 			h.Logger.Debugf("[%s] Could not parse the content-range"+
 				"for the partial upstream request: %s",
 				subh.reqID, err)
-			_ = w.CloseWithError(err)
+			closeWithError(err)
+			return
 		}
 		h.Logger.Debugf("[%s] Received response with status %d and range %v",
 			subh.reqID, rw.Code, respRng)
+		var body io.WriteCloser = w
+		if fetch != nil {
+			body = utils.MultiWriteCloser(w, utils.NopCloser(fetch))
+		}
 		if rw.Code == http.StatusPartialContent {
 			//!TODO: check whether the returned range corresponds to the requested range
-			rw.BodyWriter = w
+			rw.BodyWriter = body
 		} else if rw.Code == http.StatusOK {
-			//!TODO: handle this, use skipWriter or something like that
-			_ = w.CloseWithError(fmt.Errorf("NOT IMPLEMENTED"))
+			// The upstream ignored the range. The parts before the requested
+			// range are still saved by the response hook while they are skipped
+			// here and the rest of the response is not downloaded at all.
+			h.Logger.Debugf("[%s] Upstream ignored the range, skipping to byte %d...",
+				subh.reqID, start)
+			rw.BodyWriter = &stoppingWriteCloser{
+				WriteCloser: utils.RangeWriteCloser(body, start, end-start+1),
+				limit:       end + 1,
+			}
 		} else {
-			_ = w.CloseWithError(
-				fmt.Errorf("Upstream responded with status %d", rw.Code))
+			closeWithError(fmt.Errorf("Upstream responded with status %d", rw.Code))
 		}
 	})
 	go utils.SafeExecute(
-		subh.carbonCopyProxy,
+		func() {
+			subh.carbonCopyProxy()
+			if fetch != nil {
+				// Everything that was received is already saved
+				_ = fetch.Close()
+			}
+		},
 		func(err error) {
 			h.Logger.Errorf("[%s] Panic inside carbonCopyProxy %s", subh.reqID, err)
-			w.CloseWithError(err) // !TODO maybe some other error
+			closeWithError(err) // !TODO maybe some other error
 		},
 	)
 	return newWholeChunkReadCloser(r, h.Cache.PartSize.Bytes())
 }
 
+var errUpstreamRangeReceived = errors.New("the requested range was received from the upstream")
+
+// stoppingWriteCloser fails all writes after `limit` bytes were written to it.
+// It is used to stop downloading upstream response bodies that are bigger
+// than what we need.
+type stoppingWriteCloser struct {
+	io.WriteCloser
+	limit uint64
+}
+
+func (s *stoppingWriteCloser) Write(p []byte) (int, error) {
+	if s.limit == 0 {
+		return 0, errUpstreamRangeReceived
+	}
+	n, err := s.WriteCloser.Write(p)
+	s.limit -= umin(uint64(n), s.limit)
+	return n, err
+}
+
+// getInFlightReader returns a reader for a part which is being downloaded by
+// another request. If that download fails, the rest of the part is requested
+// from the upstream separately.
+func (h *reqHandler) getInFlightReader(part *inFlightPart) io.ReadCloser {
+	h.Logger.Debugf("[%s] Joining the in-flight upstream request for %s",
+		h.reqID, part.idx)
+	partSize := h.Cache.Storage.PartSize()
+	return &inFlightPartReader{
+		part: part,
+		fallback: func() io.ReadCloser {
+			h.Logger.Debugf("[%s] The in-flight request for %s failed, retrying",
+				h.reqID, part.idx)
+			fromByte := uint64(part.idx.Part) * partSize
+			return h.getUpstreamReader(fromByte, fromByte+part.size-1, nil)
+		},
+	}
+}
+
 // if error is returned - it is 'too many open files'
 func (h *reqHandler) getPartFromStorage(idx *types.ObjectIndex) (io.ReadCloser, error) {
 	cached := h.Cache.Algorithm.Lookup(idx)
 	r, err := h.Cache.Storage.GetPart(idx)
 	if err == nil {
 		h.Cache.Algorithm.PromoteObject(idx)
-		return r, nil
+		if promoter, ok := h.Cache.Storage.(types.PartPromoter); ok {
+			promoter.PromotePart(idx)
+		}
+		return &countingReadCloser{ReadCloser: r, count: h.Cache.Traffic.AddCachedBytes}, nil
 	}
 	if !os.IsNotExist(err) {
 		if isTooManyFiles(err) {
@@ -225,21 +497,37 @@ func (h *reqHandler) getContents(indexes []*types.ObjectIndex, from int,
 		return (parts[i].Part > indexes[from].Part &&
 			parts[i].Part <= indexes[len(indexes)-1].Part)
 	})
+	var missing = indexes[from:]
 	if i < len(parts) { // there is a part
+		missing = indexes[from : from+int(parts[i].Part-indexes[from].Part)]
+	}
+
+	inFlight, fetch := h.inFlight.joinOrStart(missing, partSize, h.obj.Size)
+	if inFlight != nil {
+		return h.getInFlightReader(inFlight), 1, nil
+	}
+	var fetched = len(fetch.parts)
+	toByte := umin(h.obj.Size, uint64(missing[fetched-1].Part+1)*partSize-1)
+	upstream := h.getUpstreamReader(fromByte, toByte, fetch)
+
+	if fetched == len(missing) && i < len(parts) {
 		r, _ = h.getPartFromStorage(parts[i])
 		if r != nil {
-			toByte := umin(h.obj.Size, uint64(parts[i].Part)*partSize-1)
-			return utils.MultiReadCloser(
-					h.getUpstreamReader(fromByte, toByte), r),
-				int(parts[i].Part-indexes[from].Part) + 1, nil
+			return utils.MultiReadCloser(upstream, r), fetched + 1, nil
 		}
 	}
 
-	toByte := umin(h.obj.Size, uint64(indexes[len(indexes)-1].Part+1)*partSize-1)
-	return h.getUpstreamReader(fromByte, toByte), len(indexes) - from, nil
+	return upstream, fetched, nil
 }
 
 func (h *reqHandler) lazilyRespond(start, end uint64) {
+	h.lazilyCopy(h.resp, start, end)
+}
+
+// lazilyCopy writes the [start, end] bytes of the object to w, loading them
+// from the storage or the upstream. It returns false if there was an error and
+// the writing was stopped.
+func (h *reqHandler) lazilyCopy(w io.Writer, start, end uint64) bool {
 	partSize := h.Cache.Storage.PartSize()
 	indexes := utils.BreakInIndexes(h.objID, start, end, partSize)
 	startOffset := start % partSize
@@ -251,7 +539,7 @@ func (h *reqHandler) lazilyRespond(start, end uint64) {
 			h.Logger.Errorf(
 				"[%s] Unexpected error while trying to load %s from storage: %s",
 				h.reqID, indexes[i], err)
-			return
+			return false
 		}
 		if i == 0 && startOffset > 0 {
 			contents, err = utils.SkipReadCloser(contents, int64(startOffset))
@@ -259,7 +547,7 @@ func (h *reqHandler) lazilyRespond(start, end uint64) {
 				h.Logger.Errorf(
 					"[%s] Unexpected error while trying to skip %d from %s: %s",
 					h.reqID, startOffset, indexes[i], err)
-				return
+				return false
 			}
 		}
 		if i+partsCount == len(indexes) {
@@ -271,7 +559,7 @@ func (h *reqHandler) lazilyRespond(start, end uint64) {
 			contents = utils.LimitReadCloser(contents, int64(endLimit))
 		}
 
-		if copied, err := io.Copy(h.resp, contents); err != nil {
+		if copied, err := io.Copy(w, contents); err != nil {
 			h.Logger.Logf(
 				"[%s] Error sending contents after %dbytes of %s, parts[%d-%d]: %s",
 				h.reqID, copied, h.objID, indexes[i].Part,
@@ -288,11 +576,12 @@ func (h *reqHandler) lazilyRespond(start, end uint64) {
 		}
 
 		if shouldReturn {
-			return
+			return false
 		}
 
 		i += partsCount
 	}
+	return true
 }
 
 func isTooManyFiles(err error) bool {
@@ -1 +1,101 @@
 package cache
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func TestAlignRange(t *testing.T) {
+	t.Parallel()
+	var tests = map[string]string{
+		"bytes=0-4":     "bytes=0-4",
+		"bytes=7-12":    "bytes=5-14",
+		"bytes=5-5":     "bytes=5-9",
+		"bytes=13-":     "bytes=10-",
+		"bytes=-10":     "",
+		"bytes=1-2,5-6": "",
+		"bytes=7-2":     "",
+		"bytes=a-2":     "",
+		"lines=1-2":     "",
+	}
+	for rng, expected := range tests {
+		aligned, ok := alignRange(rng, 5)
+		if ok != (expected != "") || aligned != expected {
+			t.Errorf("Expected %s to be aligned to '%s' but got '%s' (%t)", rng, expected, aligned, ok)
+		}
+	}
+}
+
+func TestUpstreamRangesArePartAligned(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	var file = "aligned"
+	var up = &revalidationUpstream{}
+	up.contents.Store(testutils.GenerateMeAString(5, 63))
+	app.fsmap[file] = up.contents.Load().(string)
+	app.up.Handle("/"+file, up)
+
+	// The widened range is satisfiable but the requested one is not
+	app.testRequest(reqForRange(file, 63, 2), "", http.StatusRequestedRangeNotSatisfiable)
+
+	app.testRange(file, 7, 6)
+	app.testRange(file, 61, 10)
+	atomic.StoreUint32(&up.requests, 0)
+	app.testRange(file, 5, 10)
+	app.testRange(file, 60, 3)
+	if got := atomic.LoadUint32(&up.requests); got != 0 {
+		t.Errorf("Expected all the downloaded parts to be cached but there were %d upstream requests", got)
+	}
+}
+
+func TestUpstreamIgnoringRanges(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	var (
+		file     = "ignoring"
+		contents = testutils.GenerateMeAString(8, 2000)
+		requests uint32
+		sent     uint32
+	)
+	app.fsmap[file] = contents
+	app.up.HandleFunc("/"+file, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddUint32(&requests, 1)
+		w.Header().Set("Expires", time.Now().Add(time.Hour).Format(time.RFC1123))
+		w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+		w.WriteHeader(http.StatusOK)
+		if r.Method == "HEAD" {
+			return
+		}
+		for i := 0; i < len(contents); i += 10 {
+			if _, err := w.Write([]byte(contents[i : i+10])); err != nil {
+				return
+			}
+			atomic.AddUint32(&sent, 10)
+		}
+	})
+
+	// Only the metadata is cached by a HEAD request
+	req, err := http.NewRequest("HEAD", "http://example.com/"+file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.testRequest(req, "", http.StatusOK)
+
+	app.testRange(file, 23, 10)
+	if got := atomic.LoadUint32(&sent); got >= uint32(len(contents)) {
+		t.Errorf("Expected the transfer to be stopped after the range but %d bytes were sent", got)
+	}
+
+	atomic.StoreUint32(&requests, 0)
+	app.testRange(file, 0, 35)
+	if got := atomic.LoadUint32(&requests); got != 0 {
+		t.Errorf("Expected the skipped parts to be cached but there were %d upstream requests", got)
+	}
+}
@@ -24,15 +24,17 @@ func TestTooManyFiles(t *testing.T) {
 			t.Fatal("Errof on syscall.SetRlimit", err)
 		}
 	}(*nofileRlimit)
-	var file = app.getFileName()
+	var files = app.getFileSizes()
 
-	app.testFullRequest(file) // this should succeed
+	app.testFullRequest(files[0].path) // this should succeed
 
 	nofileRlimit.Cur = 0
 	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, nofileRlimit); err != nil {
 		t.Fatal("Errof on syscall.SetRlimit", err)
 	}
-	req, err := http.NewRequest("GET", "http://example.com/"+file, nil)
+	// The metadata of the requested file is cached in memory by the storage,
+	// so another one has to be requested for its metadata to be read from disk
+	req, err := http.NewRequest("GET", "http://example.com/"+files[1].path, nil)
 	if err != nil {
 		t.Fatal(err)
 	}
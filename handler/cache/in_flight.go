@@ -0,0 +1,282 @@
+package cache
+
+import (
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+)
+
+var errInFlightAborted = errors.New("the upstream request for the part was aborted")
+
+// inFlightRegistry keeps track of the object parts which are currently being
+// downloaded from the upstream for a cache zone. It is used so that concurrent
+// cache misses for the same part result in a single upstream request, even
+// when they come through different locations which use the zone. It also
+// tracks the objects which are being revalidated in the background.
+type inFlightRegistry struct {
+	sync.Mutex
+	parts        map[types.ObjectIndexHash]*inFlightPart
+	revalidating map[types.ObjectIDHash]struct{}
+}
+
+func newInFlightRegistry() *inFlightRegistry {
+	return &inFlightRegistry{
+		parts:        make(map[types.ObjectIndexHash]*inFlightPart),
+		revalidating: make(map[types.ObjectIDHash]struct{}),
+	}
+}
+
+// zoneInFlightRegistry returns the registry of the zone, which is shared by
+// all of its caching handlers.
+func zoneInFlightRegistry(cz *types.CacheZone) *inFlightRegistry {
+	return cz.InFlight(func() interface{} {
+		return newInFlightRegistry()
+	}).(*inFlightRegistry)
+}
+
+// joinOrStart returns a reader for the first of the supplied indexes if it is
+// already being downloaded by someone else. If it is not, it registers as many
+// consecutive parts from the start of indexes as possible (stopping at the
+// first one that is already in flight) and returns the fetch which should be
+// fed with the upstream data for them.
+func (r *inFlightRegistry) joinOrStart(indexes []*types.ObjectIndex,
+	partSize, objSize uint64) (*inFlightPart, *inFlightFetch) {
+	r.Lock()
+	defer r.Unlock()
+
+	if p, ok := r.parts[indexes[0].Hash()]; ok {
+		return p, nil
+	}
+
+	fetch := &inFlightFetch{registry: r}
+	for _, idx := range indexes {
+		hash := idx.Hash()
+		if _, ok := r.parts[hash]; ok {
+			break
+		}
+		p := newInFlightPart(idx, partSizeAt(idx.Part, partSize, objSize))
+		r.parts[hash] = p
+		fetch.parts = append(fetch.parts, p)
+	}
+
+	return nil, fetch
+}
+
+func (r *inFlightRegistry) remove(p *inFlightPart) {
+	r.Lock()
+	defer r.Unlock()
+
+	hash := p.idx.Hash()
+	if r.parts[hash] == p {
+		delete(r.parts, hash)
+	}
+}
+
+// startRevalidation marks the object as being revalidated. It returns false if
+// it is already being revalidated by someone else.
+func (r *inFlightRegistry) startRevalidation(id *types.ObjectID) bool {
+	r.Lock()
+	defer r.Unlock()
+
+	if _, ok := r.revalidating[id.Hash()]; ok {
+		return false
+	}
+	r.revalidating[id.Hash()] = struct{}{}
+	return true
+}
+
+func (r *inFlightRegistry) finishRevalidation(id *types.ObjectID) {
+	r.Lock()
+	defer r.Unlock()
+	delete(r.revalidating, id.Hash())
+}
+
+func partSizeAt(part uint32, partSize, objSize uint64) uint64 {
+	var start = uint64(part) * partSize
+	if start >= objSize {
+		return 0
+	}
+	return umin(partSize, objSize-start)
+}
+
+// inFlightPart holds the already received contents of a part which is being
+// downloaded from the upstream.
+type inFlightPart struct {
+	idx  *types.ObjectIndex
+	size uint64
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	buf  []byte
+	done bool
+	err  error
+}
+
+func newInFlightPart(idx *types.ObjectIndex, size uint64) *inFlightPart {
+	p := &inFlightPart{idx: idx, size: size, done: size == 0}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// append adds as much of the data as the part can hold and returns how many
+// bytes were used.
+func (p *inFlightPart) append(data []byte) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.buf == nil {
+		p.buf = make([]byte, 0, p.size)
+	}
+	n := int(umin(uint64(len(data)), p.size-uint64(len(p.buf))))
+	p.buf = append(p.buf, data[:n]...)
+	if uint64(len(p.buf)) == p.size {
+		p.done = true
+	}
+	p.cond.Broadcast()
+	return n
+}
+
+func (p *inFlightPart) isFull() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.done
+}
+
+func (p *inFlightPart) hasData() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.buf) > 0
+}
+
+func (p *inFlightPart) fail(err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if !p.done && p.err == nil {
+		p.err = err
+		p.cond.Broadcast()
+	}
+}
+
+// readAt blocks until there is data at the provided offset or the part is
+// either finished or failed.
+func (p *inFlightPart) readAt(b []byte, off uint64) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for off >= uint64(len(p.buf)) && !p.done && p.err == nil {
+		p.cond.Wait()
+	}
+	if off < uint64(len(p.buf)) {
+		return copy(b, p.buf[off:]), nil
+	}
+	if p.err != nil {
+		return 0, p.err
+	}
+	return 0, io.EOF
+}
+
+// inFlightFetch is the io.Writer which receives the upstream response body for
+// a sequence of registered parts and makes it available to every reader that
+// has joined them. Received parts are kept in the registry until they are
+// surely saved in the storage, so late joiners can still find them somewhere.
+type inFlightFetch struct {
+	registry *inFlightRegistry
+	parts    []*inFlightPart
+	released int
+	current  int
+	closed   bool
+	mu       sync.Mutex
+}
+
+func (f *inFlightFetch) Write(data []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.releaseSaved()
+	var written int
+	for written < len(data) && f.current < len(f.parts) {
+		written += f.parts[f.current].append(data[written:])
+		for f.current < len(f.parts) && f.parts[f.current].isFull() {
+			f.current++
+		}
+	}
+	// Everything after the registered parts is not interesting for the
+	// readers, so it is simply ignored.
+	return len(data), nil
+}
+
+// releaseSaved removes the fully received parts from the registry once data
+// after them has been received. The PartWriter saves a part in the storage
+// only after it receives the data after it, so this happens on the Write call
+// following it.
+func (f *inFlightFetch) releaseSaved() {
+	if f.current == len(f.parts) || !f.parts[f.current].hasData() {
+		return
+	}
+	for ; f.released < f.current; f.released++ {
+		f.registry.remove(f.parts[f.released])
+	}
+}
+
+// Close finishes the fetch, failing any parts that were not fully received.
+// It must be called only after the whole upstream response has been processed.
+func (f *inFlightFetch) Close() error {
+	return f.CloseWithError(errInFlightAborted)
+}
+
+// CloseWithError finishes the fetch and any waiting readers of parts which were
+// not fully received will get the supplied error.
+func (f *inFlightFetch) CloseWithError(err error) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	for _, p := range f.parts[f.released:] {
+		p.fail(err)
+		f.registry.remove(p)
+	}
+	return nil
+}
+
+// inFlightPartReader reads a part that is being downloaded by another request.
+// If the download fails, the reader continues with its own upstream request
+// created by the fallback function.
+type inFlightPartReader struct {
+	part     *inFlightPart
+	pos      uint64
+	fallback func() io.ReadCloser
+	rest     io.ReadCloser
+}
+
+func (r *inFlightPartReader) Read(b []byte) (int, error) {
+	if r.rest != nil {
+		return r.rest.Read(b)
+	}
+	n, err := r.part.readAt(b, r.pos)
+	r.pos += uint64(n)
+	if err != nil && err != io.EOF {
+		// The original request failed, make our own
+		r.rest, err = utils.SkipReadCloser(r.fallback(), int64(r.pos))
+		if err != nil {
+			return n, err
+		}
+		if n == 0 {
+			return r.rest.Read(b)
+		}
+	}
+	return n, err
+}
+
+func (r *inFlightPartReader) Close() error {
+	if r.rest != nil {
+		return r.rest.Close()
+	}
+	return nil
+}
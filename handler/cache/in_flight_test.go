@@ -0,0 +1,132 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/utils"
+	"github.com/ironsmile/nedomi/utils/httputils"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func TestConcurrentMissesAreCoalesced(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	var (
+		file           = "coalesced"
+		contents       = testutils.GenerateMeAString(3, 53)
+		rangeRequests  uint32
+		halfWritten    = make(chan struct{})
+		release        = make(chan struct{})
+		halfWrittenOne sync.Once
+	)
+	app.fsmap[file] = contents
+
+	app.up.HandleFunc("/"+file, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Expires", time.Now().Add(time.Hour).Format(time.RFC1123))
+		ranges, err := httputils.ParseRequestRange(r.Header.Get("Range"), uint64(len(contents)))
+		if err != nil || len(ranges) != 1 {
+			w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+			w.WriteHeader(http.StatusOK)
+			if r.Method != "HEAD" {
+				_, _ = w.Write([]byte(contents))
+			}
+			return
+		}
+		atomic.AddUint32(&rangeRequests, 1)
+		rng := ranges[0]
+		body := contents[rng.Start : rng.Start+rng.Length]
+		w.Header().Set("Content-Range", rng.ContentRange(uint64(len(contents))))
+		w.Header().Set("Content-Length", strconv.FormatUint(rng.Length, 10))
+		w.WriteHeader(http.StatusPartialContent)
+		_, _ = w.Write([]byte(body[:len(body)/2]))
+		halfWrittenOne.Do(func() { close(halfWritten) })
+		<-release
+		_, _ = w.Write([]byte(body[len(body)/2:]))
+	})
+
+	// Only the metadata is cached by a HEAD request
+	req, err := http.NewRequest("HEAD", "http://example.com/"+file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.testRequest(req, "", http.StatusOK)
+
+	var wg sync.WaitGroup
+	request := func() {
+		defer wg.Done()
+		app.testFullRequest(file)
+	}
+	wg.Add(1)
+	go request()
+	<-halfWritten
+
+	// late joiners in the middle of the transfer
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go request()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+
+	if got := atomic.LoadUint32(&rangeRequests); got != 1 {
+		t.Errorf("Expected exactly 1 upstream request but there were %d", got)
+	}
+}
+
+func TestInFlightReaderFallsBackOnFailure(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	var file = app.getFileName()
+	var contents = app.fsmap[file]
+
+	req, err := http.NewRequest("HEAD", "http://example.com/"+file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.testRequest(req, "", http.StatusOK)
+
+	var objID = app.cacheHandler.NewObjectIDForURL(req.URL)
+	var partSize = app.cacheHandler.Cache.Storage.PartSize()
+	obj, err := app.cacheHandler.Cache.Storage.GetMetadata(objID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var indexes = utils.BreakInIndexes(objID, 0, obj.Size-1, partSize)
+	part, fetch := app.cacheHandler.inFlight.joinOrStart(indexes[:1], partSize, obj.Size)
+	if part != nil || fetch == nil || len(fetch.parts) != 1 {
+		t.Fatalf("Expected to start a new fetch, got %v and %v", part, fetch)
+	}
+	if _, err := fetch.Write([]byte(contents[:2])); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = fetch.Close()
+	}()
+	app.testFullRequest(file)
+}
+
+func TestHandlersOfAZoneShareTheInFlightRegistry(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+
+	var loc = *app.cacheHandler.Location
+	loc.Name = "another location"
+	other, err := New(nil, &loc, app.up)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.inFlight != app.cacheHandler.inFlight {
+		t.Error("Expected the handlers of the same zone to share the in-flight registry")
+	}
+}
@@ -95,6 +95,7 @@ func (pw *partWriter) flushBuffer() error {
 	} else if err := pw.cz.Storage.SavePart(idx, bytes.NewBuffer(pw.buf)); err != nil {
 		return err
 	}
+	pw.cz.Traffic.Inserted()
 	pw.buf = nil
 	if err := pw.cz.Algorithm.AddObject(idx); err != nil && err != types.ErrAlreadyInCache {
 		return err
@@ -103,16 +104,20 @@ func (pw *partWriter) flushBuffer() error {
 }
 
 func (pw *partWriter) Close() error {
+	// A whole part in the buffer is saved even if the rest of the data
+	// did not arrive
+	if pw.buf != nil {
+		if err := pw.flushBuffer(); err != nil {
+			return err
+		}
+	}
 	if pw.currentPos-pw.startPos != pw.length {
 		return errors.WithStack(&partWriterShortWrite{
 			expected: pw.length,
 			actual:   pw.currentPos - pw.startPos,
 		})
 	}
-	if pw.buf == nil {
-		return nil
-	}
-	return pw.flushBuffer()
+	return nil
 }
 
 type partWriterShortWrite struct {
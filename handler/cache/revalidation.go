@@ -0,0 +1,178 @@
+package cache
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"time"
+
+	"github.com/ironsmile/nedomi/contexts"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+	"github.com/ironsmile/nedomi/utils/cacheutils"
+	"github.com/ironsmile/nedomi/utils/httputils"
+)
+
+// Request preconditions. These are removed from the client's request whenever
+// we need the object itself from the upstream or make our own conditional
+// request to it.
+var conditionalHeaders = []string{
+	"If-Match",
+	"If-None-Match",
+	"If-Modified-Since",
+	"If-Unmodified-Since",
+	"If-Range",
+}
+
+// revalidate handles requests for objects which are in the storage but are
+// no longer fresh. When allowed by stale-while-revalidate, the cached object is
+// served right away and revalidated in the background. Otherwise the upstream
+// is asked whether the cached object is still valid before responding.
+func (h *reqHandler) revalidate(obj *types.ObjectMetadata) {
+	if cacheutils.CacheSatisfiesRequest(obj, h.req) && isStaleUsable(obj, obj.StaleWhileRevalidate) {
+		h.Logger.Debugf("[%s] Serving stale object while revalidating it...", h.reqID)
+		h.revalidateInBackground(obj)
+		h.serveFromCache(obj)
+		return
+	}
+
+	var useCache bool
+	h.proxy(h.getConditionalRequest(obj), func(rw *httputils.FlexibleResponseWriter) {
+		if rw.Code == http.StatusNotModified {
+			h.Logger.Debugf("[%s] Object was not modified, serving it from cache", h.reqID)
+			obj = h.refreshMetadata(obj, rw.Headers)
+		} else if rw.Code >= http.StatusInternalServerError && isStaleUsable(obj, obj.StaleIfError) {
+			h.Logger.Debugf("[%s] Upstream responded with %d, serving stale object",
+				h.reqID, rw.Code)
+		} else if h.isNewRepresentation(rw) {
+			h.Logger.Debugf("[%s] Object was modified, discarding the cached one", h.reqID)
+			h.discard()
+			h.getResponseHook()(rw)
+			return
+		} else {
+			h.Logger.Debugf("[%s] Upstream responded with %d, keeping the cached object",
+				h.reqID, rw.Code)
+			h.getResponseHook()(rw)
+			return
+		}
+		useCache = true
+		rw.BodyWriter = utils.NopCloser(ioutil.Discard)
+	})
+
+	if useCache {
+		h.serveFromCache(obj)
+	}
+}
+
+// revalidateInBackground makes a conditional HEAD request for the object
+// without blocking the client request. Only one background revalidation per
+// object is made at a time.
+func (h *reqHandler) revalidateInBackground(obj *types.ObjectMetadata) {
+	if !h.inFlight.startRevalidation(h.objID) {
+		h.Logger.Debugf("[%s] Object is already being revalidated", h.reqID)
+		return
+	}
+
+	subh := *h
+	subh.req = h.getConditionalRequest(obj)
+	subh.req.Method = "HEAD"
+	subh.reqID = types.RequestID(append(append([]byte(nil), h.reqID...), "->revalidate"...))
+	// The revalidation should not be canceled when the client request finishes
+	subh.req = subh.req.WithContext(contexts.NewIDContext(context.Background(), subh.reqID))
+	subh.resp = httputils.NewFlexibleResponseWriter(func(rw *httputils.FlexibleResponseWriter) {
+		rw.BodyWriter = utils.NopCloser(ioutil.Discard)
+	})
+
+	go utils.SafeExecute(
+		func() {
+			defer h.inFlight.finishRevalidation(h.objID)
+			subh.proxy(subh.req, func(rw *httputils.FlexibleResponseWriter) {
+				if rw.Code == http.StatusNotModified {
+					subh.Logger.Debugf("[%s] Object was not modified", subh.reqID)
+					subh.refreshMetadata(obj, rw.Headers)
+				} else if subh.isNewRepresentation(rw) {
+					subh.Logger.Debugf("[%s] Object was modified, discarding the cached one",
+						subh.reqID)
+					subh.discard()
+					subh.getResponseHook()(rw)
+					return
+				} else {
+					subh.Logger.Logf("[%s] Upstream responded with %d while revalidating %s",
+						subh.reqID, rw.Code, subh.objID)
+				}
+				rw.BodyWriter = utils.NopCloser(ioutil.Discard)
+			})
+		},
+		func(err error) {
+			h.Logger.Errorf("[%s] Panic while revalidating: %s", subh.reqID, err)
+		},
+	)
+}
+
+// isNewRepresentation returns whether the upstream response to a revalidation
+// request replaces the cached object. Errors and responses which can not be
+// cached do not, so the cached object is kept for them.
+func (h *reqHandler) isNewRepresentation(rw *httputils.FlexibleResponseWriter) bool {
+	return cacheutils.IsResponseCacheable(rw.Code, rw.Headers, h.cacheableEncodings()...)
+}
+
+// getConditionalRequest returns a normalized request to which the upstream can
+// respond with 304 Not Modified if the cached object is still valid.
+func (h *reqHandler) getConditionalRequest(obj *types.ObjectMetadata) *http.Request {
+	req := h.getNormalizedRequest()
+	for _, header := range conditionalHeaders {
+		req.Header.Del(header)
+	}
+	if etag := obj.Headers.Get("ETag"); etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified := obj.Headers.Get("Last-Modified"); lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+	return req
+}
+
+// refreshMetadata saves new metadata for the object after the upstream has
+// confirmed that the cached one is still valid. The cached parts are kept, only
+// the headers and expiration time are updated.
+func (h *reqHandler) refreshMetadata(obj *types.ObjectMetadata, headers http.Header) *types.ObjectMetadata {
+	//!TODO: maybe call cached time.Now. See the comment in utils.IsMetadataFresh
+	now := time.Now()
+	expiresIn := cacheutils.ResponseExpiresIn(headers, h.CacheDefaultDuration)
+	if expiresIn < 0 {
+		expiresIn = 0
+	}
+
+	refreshed := *obj
+	refreshed.ResponseTimestamp = now.Unix()
+	refreshed.ExpiresAt = now.Add(expiresIn).Unix()
+	refreshed.Headers = make(http.Header)
+	httputils.CopyHeaders(obj.Headers, refreshed.Headers)
+	httputils.CopyHeadersWithout(headers, refreshed.Headers, metadataHeadersToFilter...)
+	h.setStaleLimits(&refreshed, headers)
+
+	if err := h.Cache.Storage.SaveMetadata(&refreshed); err != nil {
+		h.Logger.Errorf("[%s] Could not save refreshed metadata for %s: %s",
+			h.reqID, refreshed.ID, err)
+		return &refreshed
+	}
+	h.scheduleExpiration(&refreshed)
+	return &refreshed
+}
+
+// discard removes the cached object and all of its parts.
+func (h *reqHandler) discard() {
+	if discardErr := h.Cache.Storage.Discard(h.objID); discardErr != nil {
+		h.Logger.Errorf("[%s] Storage error when discarding of object's data: %s",
+			h.reqID, discardErr)
+	} else {
+		h.Cache.Traffic.Discarded()
+	}
+}
+
+// isStaleUsable returns whether the stale object can still be used for up to
+// `seconds` after it has expired.
+func isStaleUsable(obj *types.ObjectMetadata, seconds int64) bool {
+	//!TODO: maybe call cached time.Now. See the comment in utils.IsMetadataFresh
+	return seconds > 0 && time.Now().Unix() < obj.ExpiresAt+seconds
+}
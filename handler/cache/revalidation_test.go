@@ -0,0 +1,215 @@
+package cache
+
+import (
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+type revalidationUpstream struct {
+	contents    atomic.Value
+	code        int32
+	requests    uint32
+	conditional uint32
+}
+
+func (u *revalidationUpstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	atomic.AddUint32(&u.requests, 1)
+	if r.Header.Get("If-None-Match") != "" {
+		atomic.AddUint32(&u.conditional, 1)
+	}
+	if code := atomic.LoadInt32(&u.code); code != 0 {
+		w.WriteHeader(int(code))
+		return
+	}
+	contents := u.contents.Load().(string)
+	w.Header().Set("Cache-Control", "max-age=3600")
+	w.Header().Set("ETag", `"`+contents[:8]+`"`)
+	http.ServeContent(w, r, "", time.Time{}, strings.NewReader(contents))
+}
+
+func newRevalidationApp(t *testing.T) (*testApp, *revalidationUpstream, string) {
+	app := newTestApp(t)
+	var file = "revalidated"
+	var up = &revalidationUpstream{}
+	up.contents.Store(testutils.GenerateMeAString(7, 43))
+	app.fsmap[file] = up.contents.Load().(string)
+	app.up.Handle("/"+file, up)
+
+	app.testFullRequest(file)
+	return app, up, file
+}
+
+func (t *testApp) makeStale(file string, modify func(*types.ObjectMetadata)) *types.ObjectMetadata {
+	req, err := http.NewRequest("GET", "http://example.com/"+file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var storage = t.cacheHandler.Cache.Storage
+	obj, err := storage.GetMetadata(t.cacheHandler.NewObjectIDForURL(req.URL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	obj.ExpiresAt = time.Now().Unix() - 10
+	modify(obj)
+	if err := storage.SaveMetadata(obj); err != nil {
+		t.Fatal(err)
+	}
+	return obj
+}
+
+func (t *testApp) getMetadata(obj *types.ObjectMetadata) *types.ObjectMetadata {
+	newObj, err := t.cacheHandler.Cache.Storage.GetMetadata(obj.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newObj
+}
+
+func TestStaleObjectIsRevalidated(t *testing.T) {
+	t.Parallel()
+	app, up, file := newRevalidationApp(t)
+	defer app.cleanup()
+
+	obj := app.makeStale(file, func(*types.ObjectMetadata) {})
+	atomic.StoreUint32(&up.requests, 0)
+	app.testFullRequest(file)
+	app.testRange(file, 3, 20)
+
+	if got := atomic.LoadUint32(&up.requests); got != 1 {
+		t.Errorf("Expected 1 upstream request but there were %d", got)
+	}
+	if got := atomic.LoadUint32(&up.conditional); got != 1 {
+		t.Errorf("Expected 1 conditional upstream request but there were %d", got)
+	}
+	if !utils.IsMetadataFresh(app.getMetadata(obj)) {
+		t.Error("Expected the revalidated object to be fresh")
+	}
+}
+
+func TestStaleWhileRevalidate(t *testing.T) {
+	t.Parallel()
+	app, up, file := newRevalidationApp(t)
+	defer app.cleanup()
+
+	obj := app.makeStale(file, func(obj *types.ObjectMetadata) {
+		obj.StaleWhileRevalidate = 60
+	})
+	atomic.StoreInt32(&up.code, http.StatusInternalServerError)
+	app.testFullRequest(file)
+
+	// the background revalidation failed, so the object is still stale
+	for atomic.LoadUint32(&up.conditional) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	atomic.StoreInt32(&up.code, 0)
+	app.testFullRequest(file)
+
+	for i := 0; i < 100 && !utils.IsMetadataFresh(app.getMetadata(obj)); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	if !utils.IsMetadataFresh(app.getMetadata(obj)) {
+		t.Error("Expected the object to be revalidated in the background")
+	}
+}
+
+func TestStaleIfError(t *testing.T) {
+	t.Parallel()
+	app, up, file := newRevalidationApp(t)
+	defer app.cleanup()
+
+	app.makeStale(file, func(obj *types.ObjectMetadata) {
+		obj.StaleIfError = 60
+	})
+	atomic.StoreInt32(&up.code, http.StatusBadGateway)
+	app.testFullRequest(file)
+
+	app.makeStale(file, func(obj *types.ObjectMetadata) {
+		obj.StaleIfError = 0
+	})
+	req, err := http.NewRequest("GET", "http://example.com/"+file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	app.testRequest(req, "", http.StatusBadGateway)
+}
+
+func TestModifiedStaleObjectIsReplaced(t *testing.T) {
+	t.Parallel()
+	app, up, file := newRevalidationApp(t)
+	defer app.cleanup()
+
+	obj := app.makeStale(file, func(*types.ObjectMetadata) {})
+	up.contents.Store(testutils.GenerateMeAString(11, 37))
+	app.fsmap[file] = up.contents.Load().(string)
+
+	app.testFullRequest(file)
+	app.testRange(file, 5, 10)
+	if got := app.getMetadata(obj).Size; got != 37 {
+		t.Errorf("Expected the new object to be cached but its size is %d", got)
+	}
+}
+
+func (t *testApp) hasMetadata(obj *types.ObjectMetadata) bool {
+	_, err := t.cacheHandler.Cache.Storage.GetMetadata(obj.ID)
+	return err == nil
+}
+
+func TestRevalidationErrorKeepsObject(t *testing.T) {
+	t.Parallel()
+	app, up, file := newRevalidationApp(t)
+	defer app.cleanup()
+
+	obj := app.makeStale(file, func(*types.ObjectMetadata) {})
+	req, err := http.NewRequest("GET", "http://example.com/"+file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, code := range []int{http.StatusNotFound, http.StatusForbidden, http.StatusInternalServerError} {
+		atomic.StoreInt32(&up.code, int32(code))
+		app.testRequest(req, "", code)
+		if !app.hasMetadata(obj) {
+			t.Fatalf("The cached object was discarded after the upstream responded with %d", code)
+		}
+	}
+
+	atomic.StoreInt32(&up.code, 0)
+	app.testFullRequest(file)
+	if !utils.IsMetadataFresh(app.getMetadata(obj)) {
+		t.Error("Expected the object to be revalidated once the upstream works")
+	}
+}
+
+func TestBackgroundRevalidationErrorKeepsObject(t *testing.T) {
+	t.Parallel()
+	app, up, file := newRevalidationApp(t)
+	defer app.cleanup()
+
+	obj := app.makeStale(file, func(obj *types.ObjectMetadata) {
+		obj.StaleWhileRevalidate = 60
+	})
+	atomic.StoreInt32(&up.code, http.StatusNotFound)
+	atomic.StoreUint32(&up.conditional, 0)
+	app.testFullRequest(file)
+
+	for atomic.LoadUint32(&up.conditional) == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// wait for the background revalidation to finish with the object
+	for i := 0; i < 100 && !app.cacheHandler.inFlight.startRevalidation(obj.ID); i++ {
+		time.Sleep(5 * time.Millisecond)
+	}
+	app.cacheHandler.inFlight.finishRevalidation(obj.ID)
+
+	if !app.hasMetadata(obj) {
+		t.Fatal("The cached object was discarded after the upstream responded with 404")
+	}
+	atomic.StoreInt32(&up.code, 0)
+	app.testFullRequest(file)
+}
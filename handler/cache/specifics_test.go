@@ -1,8 +1,17 @@
 package cache
 
 import (
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
 	"testing"
 
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/httputils"
 	"github.com/ironsmile/nedomi/utils/testutils"
 )
 
@@ -48,3 +57,83 @@ func TestZeroSizeFile(t *testing.T) {
 	app.testFullRequest(file)
 	app.testFullRequest(file)
 }
+
+func TestMultipleRanges(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	var file = "multi"
+	var contents = testutils.GenerateMeAString(3, 200)
+	app.fsmap[file] = contents
+	defer app.cleanup()
+
+	// Only some of the parts will be in the cache
+	app.testRange(file, 12, 20)
+
+	req, err := http.NewRequest("GET", "http://example.com/"+file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ranges = []httputils.Range{{Start: 0, Length: 3}, {Start: 10, Length: 30}, {Start: 190, Length: 10}}
+	req.Header.Set("Range", "bytes=0-2,10-39,-10")
+	var rec = httptest.NewRecorder()
+	app.cacheHandler.ServeHTTP(rec, req)
+	if rec.Code != http.StatusPartialContent {
+		t.Fatalf("Expected 206 but got %d", rec.Code)
+	}
+	if cl := rec.Header().Get("Content-Length"); cl != strconv.Itoa(rec.Body.Len()) {
+		t.Errorf("Content-Length %s does not match the body length %d", cl, rec.Body.Len())
+	}
+
+	mediaType, params, err := mime.ParseMediaType(rec.Header().Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Unexpected content type %s: %v", mediaType, err)
+	}
+	var reader = multipart.NewReader(rec.Body, params["boundary"])
+	for _, rng := range ranges {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cr := part.Header.Get("Content-Range"); cr != rng.ContentRange(uint64(len(contents))) {
+			t.Errorf("Expected Content-Range %s but got %s", rng.ContentRange(uint64(len(contents))), cr)
+		}
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if expected := contents[rng.Start : rng.Start+rng.Length]; string(body) != expected {
+			t.Errorf("Expected part '%s' but got '%s'", expected, body)
+		}
+	}
+	if _, err := reader.NextPart(); err != io.EOF {
+		t.Errorf("Expected the multipart body to end but got %v", err)
+	}
+}
+
+type unhealthyStorage struct {
+	types.Storage
+}
+
+func (s unhealthyStorage) Healthy() bool {
+	return false
+}
+
+func TestDegradedStorageIsBypassed(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	var file = app.getFileName()
+	var st = app.cacheHandler.Cache.Storage
+	app.cacheHandler.Cache.Storage = unhealthyStorage{st}
+
+	app.testFullRequest(file)
+	app.testRange(file, 2, 3)
+
+	req, err := http.NewRequest("GET", "http://example.com/"+file, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := st.GetMetadata(app.cacheHandler.NewObjectIDForRequest(req)); err == nil {
+		t.Error("Expected the object not to be cached while the storage is degraded")
+	}
+}
@@ -0,0 +1,56 @@
+package cache
+
+// This file contains the wrappers which count the traffic of the cache zone.
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+)
+
+// countingReadCloser counts the bytes which are read through it. The bytes
+// which are skipped with Seek are not counted.
+type countingReadCloser struct {
+	io.ReadCloser
+	count func(uint64)
+}
+
+func (c *countingReadCloser) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.count(uint64(n))
+	return n, err
+}
+
+// WriteTo keeps the WriteTo or ReadFrom of the wrapped reader and the
+// destination in use, so that copying the contents stays cheap.
+func (c *countingReadCloser) WriteTo(w io.Writer) (int64, error) {
+	n, err := io.Copy(w, c.ReadCloser)
+	c.count(uint64(n))
+	return n, err
+}
+
+// Seek is forwarded to the wrapped reader if it is an io.Seeker, so that the
+// start of a part is not read when it is skipped. Otherwise only skipping
+// forward from the current position is supported and the skipped bytes are
+// read and thrown away.
+func (c *countingReadCloser) Seek(offset int64, whence int) (int64, error) {
+	if seeker, ok := c.ReadCloser.(io.Seeker); ok {
+		return seeker.Seek(offset, whence)
+	}
+	if whence != io.SeekCurrent || offset < 0 {
+		return 0, errors.New("countingReadCloser: only skipping forward is supported")
+	}
+	return io.CopyN(ioutil.Discard, c.ReadCloser, offset)
+}
+
+// countingWriteCloser counts the bytes which are written through it.
+type countingWriteCloser struct {
+	io.WriteCloser
+	count func(uint64)
+}
+
+func (c *countingWriteCloser) Write(p []byte) (int, error) {
+	n, err := c.WriteCloser.Write(p)
+	c.count(uint64(n))
+	return n, err
+}
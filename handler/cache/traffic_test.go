@@ -0,0 +1,48 @@
+package cache
+
+import (
+	"testing"
+)
+
+func TestZoneTraffic(t *testing.T) {
+	t.Parallel()
+	const path, content = "traffic", "twelve bytes"
+	app := newTestAppFromMap(t, map[string]string{path: content})
+	defer app.cleanup()
+	var traffic = &app.cacheHandler.Cache.Traffic
+
+	app.testFullRequest(path)
+	var first = traffic.Traffic()
+	if first.UpstreamBytes != uint64(len(content)) || first.CachedBytes != 0 {
+		t.Errorf("Expected the whole object to come from the upstream but got %+v", first)
+	}
+	if first.Insertions != 3 {
+		t.Errorf("Expected all 3 parts of the object to be inserted but got %+v", first)
+	}
+
+	app.testFullRequest(path)
+	var second = traffic.Traffic()
+	if second.CachedBytes != uint64(len(content)) || second.UpstreamBytes != first.UpstreamBytes {
+		t.Errorf("Expected the whole object to come from the cache but got %+v", second)
+	}
+	if second.Insertions != first.Insertions || second.EvictedParts != 0 || second.EvictedObjects != 0 || second.Discards != 0 {
+		t.Errorf("Expected nothing to change in the storage but got %+v", second)
+	}
+}
+
+func TestSkippedBytesAreNotCounted(t *testing.T) {
+	t.Parallel()
+	const path, content = "skipped", "twelve bytes"
+	app := newTestAppFromMap(t, map[string]string{path: content})
+	defer app.cleanup()
+	var traffic = &app.cacheHandler.Cache.Traffic
+
+	app.testFullRequest(path)
+	var cached = traffic.Traffic().CachedBytes
+
+	// The range starts in the middle of the first part
+	app.testRange(path, 2, 5)
+	if served := traffic.Traffic().CachedBytes - cached; served != 5 {
+		t.Errorf("Expected only the 5 bytes of the range to be counted but got %d", served)
+	}
+}
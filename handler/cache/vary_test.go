@@ -0,0 +1,75 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func TestVariantsAreCachedSeparately(t *testing.T) {
+	t.Parallel()
+	app := newTestApp(t)
+	defer app.cleanup()
+	var (
+		requests uint32
+		variants = map[string]string{
+			"bg": testutils.GenerateMeAString(1, 33),
+			"en": testutils.GenerateMeAString(2, 47),
+			"":   testutils.GenerateMeAString(3, 11),
+		}
+	)
+	var handler = func(vary string) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddUint32(&requests, 1)
+			var contents = variants[r.Header.Get("Accept-Language")]
+			w.Header().Set("Expires", time.Now().Add(time.Hour).Format(time.RFC1123))
+			w.Header().Set("Vary", vary)
+			w.Header().Set("Content-Length", strconv.Itoa(len(contents)))
+			w.WriteHeader(http.StatusOK)
+			_, _ = w.Write([]byte(contents))
+		}
+	}
+	app.up.HandleFunc("/varied", handler("Accept-Language"))
+	app.up.HandleFunc("/uncacheable", handler("*"))
+
+	var request = func(path, lang string) {
+		req, err := http.NewRequest("GET", "http://example.com/"+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if lang != "" {
+			req.Header.Set("Accept-Language", lang)
+		}
+		app.testRequest(req, variants[lang], http.StatusOK)
+	}
+
+	for i := 0; i < 3; i++ {
+		for _, lang := range []string{"bg", "en", ""} {
+			request("varied", lang)
+		}
+	}
+	if got := atomic.LoadUint32(&requests); got != 3 {
+		t.Errorf("Expected one upstream request per variant but there were %d", got)
+	}
+	req, err := http.NewRequest("GET", "http://example.com/varied", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	primary, err := app.cacheHandler.Cache.Storage.GetMetadata(app.cacheHandler.NewObjectIDForURL(req.URL))
+	if err != nil {
+		t.Fatal(err)
+	} else if len(primary.Variants) != 3 {
+		t.Errorf("Expected the primary object to know about the 3 variants but it has %q", primary.Variants)
+	}
+
+	atomic.StoreUint32(&requests, 0)
+	request("uncacheable", "bg")
+	request("uncacheable", "bg")
+	if got := atomic.LoadUint32(&requests); got != 2 {
+		t.Errorf("Expected responses with `Vary: *` not to be cached but there were %d upstream requests", got)
+	}
+}
@@ -72,36 +72,68 @@ func (ph *Handler) purgeAll(reqID types.RequestID, app types.App, pr purgeReques
 			continue
 		}
 
-		var oid = location.NewObjectIDForURL(u)
+		// Only the URL is known, so any headers or cookies in the location's
+		// cache key template are considered empty
+		var oid = location.NewObjectIDForRequest(&http.Request{
+			URL: u, Host: u.Host, Header: make(http.Header)})
 
-		parts, err := location.Cache.Storage.GetAvailableParts(oid)
+		if pres[uString], err = ph.purge(reqID, location.Cache, oid); err != nil {
+			return nil, err
+		}
+	}
+	return pres, nil
+}
+
+// purge discards the object and all of its cached variants from the storage
+// and the cache algorithm of the zone. It returns whether any parts of them
+// were purged.
+func (ph *Handler) purge(reqID types.RequestID, cz *types.CacheZone, oid *types.ObjectID) (bool, error) {
+	var ids = []*types.ObjectID{oid}
+	obj, err := cz.Storage.GetMetadata(oid)
+	if err == nil {
+		for _, variant := range obj.Variants {
+			ids = append(ids, types.NewVariantObjectID(oid.CacheKey(), oid.Path(), variant))
+		}
+	} else if !os.IsNotExist(err) {
+		ph.logger.Errorf(
+			"[%s] got error while getting the metadata of object '%s' - %s",
+			reqID, oid, err)
+		return false, err
+	}
+
+	var purged bool
+	for _, id := range ids {
+		parts, err := cz.Storage.GetAvailableParts(id)
 
 		if err != nil {
 			if !os.IsNotExist(err) {
 				ph.logger.Errorf(
 					"[%s] got error while gettings parts of object '%s' - %s",
-					reqID, oid, err)
-				return nil, err
+					reqID, id, err)
+				return false, err
 			}
 		}
 
-		if len(parts) == 0 {
+		// The primary object of the variants has only metadata
+		if len(parts) == 0 && (id != oid || len(ids) == 1) {
 			continue
 		}
 
-		if err = location.Cache.Storage.Discard(oid); err != nil {
+		if err = cz.Storage.Discard(id); err != nil {
 			if !os.IsNotExist(err) {
 				ph.logger.Errorf(
 					"[%s] got error while purging object '%s' - %s",
-					reqID, oid, err)
-				return nil, err
+					reqID, id, err)
+				return false, err
 			}
+		} else {
+			cz.Traffic.Discarded()
 		}
 
-		location.Cache.Algorithm.Remove(parts...)
-		pres[uString] = err == nil // err is os.ErrNotExist
+		cz.Algorithm.Remove(parts...)
+		purged = purged || (len(parts) > 0 && err == nil) // err is os.ErrNotExist
 	}
-	return pres, nil
+	return purged, nil
 }
 
 // New creates and returns a ready to used ServerPurgeHandler.
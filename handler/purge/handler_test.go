@@ -6,6 +6,7 @@ import (
 	"encoding/json"
 	"net/http"
 	"net/http/httptest"
+	"os"
 	"testing"
 
 	"github.com/ironsmile/nedomi/config"
@@ -277,3 +278,37 @@ func TestPurgeBadGetParts(t *testing.T) {
 	purger.ServeHTTP(rec, req)
 	testCode(t, rec.Code, http.StatusInternalServerError)
 }
+
+func TestPurgeVariants(t *testing.T) {
+	t.Parallel()
+	var variant = types.NewVariantObjectID(cacheKey1, path1, "Accept-Language: bg")
+	var st = storageWithObjects(t, variant)
+	testutils.ShouldntFail(t, st.SaveMetadata(&types.ObjectMetadata{
+		ID:       obj1,
+		Headers:  http.Header{"Vary": {"Accept-Language"}},
+		Variants: []string{variant.Variant()},
+	}))
+	ctx, purger, _ := testSetupWithStorage(t, st)
+
+	req, err := http.NewRequest("POST", testURL, bytes.NewReader([]byte(`["`+url1+`"]`)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	purger.ServeHTTP(rec, req.WithContext(ctx))
+	testCode(t, rec.Code, http.StatusOK)
+	var pr purgeResult
+	if err = json.Unmarshal(rec.Body.Bytes(), &pr); err != nil {
+		t.Fatal(err)
+	}
+	checkPr(t, pr, []string{url1}, true)
+
+	for _, id := range []*types.ObjectID{obj1, variant} {
+		if _, err := st.GetMetadata(id); !os.IsNotExist(err) {
+			t.Errorf("Expected the metadata of %s to be purged but got %v", id, err)
+		}
+	}
+	if parts, _ := st.GetAvailableParts(variant); len(parts) != 0 {
+		t.Errorf("Expected the parts of the variant to be purged but there are %d", len(parts))
+	}
+}
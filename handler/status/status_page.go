@@ -72,7 +72,7 @@ func (ssh *ServerStatusHandler) ServeHTTP(w http.ResponseWriter, r *http.Request
 func newStatistics(app types.App, cacheZones map[string]*types.CacheZone) statisticsRoot {
 	var zones = make([]zoneStat, 0, len(cacheZones))
 	for _, cacheZone := range cacheZones {
-		var stats = cacheZone.Algorithm.Stats()
+		var stats = cacheZone.Stats()
 		zones = append(zones, zoneStat{
 			ID:          stats.ID(),
 			Hits:        stats.Hits(),
@@ -80,6 +80,10 @@ func newStatistics(app types.App, cacheZones map[string]*types.CacheZone) statis
 			Objects:     stats.Objects(),
 			CacheHitPrc: stats.CacheHitPrc(),
 			Size:        stats.Size().Bytes(),
+			BytesUsed:   bytesUsed(cacheZone.Storage),
+			Healthy:     isHealthy(cacheZone.Storage),
+			Scrub:       scrubProgress(cacheZone.Storage),
+			ZoneTraffic: stats.Traffic(),
 		})
 	}
 
@@ -134,6 +138,39 @@ type zoneStat struct {
 	Objects     uint64 `json:"objects"`
 	CacheHitPrc string `json:"hit_percentage"`
 	Size        uint64 `json:"size"`
+	BytesUsed   uint64 `json:"bytes_used"`
+	Healthy     bool   `json:"healthy"`
+
+	Scrub *types.ScrubProgress `json:"scrub,omitempty"`
+
+	// The traffic fields are inlined in the JSON of the zone
+	types.ZoneTraffic
+}
+
+// scrubProgress returns the progress of the scrubbing of the storage or nil if
+// it does not support scrubbing.
+func scrubProgress(storage types.Storage) *types.ScrubProgress {
+	if scrubber, ok := storage.(types.Scrubber); ok {
+		progress := scrubber.ScrubProgress()
+		return &progress
+	}
+	return nil
+}
+
+// bytesUsed returns the actual space taken by the storage if it reports it.
+func bytesUsed(storage types.Storage) uint64 {
+	if ur, ok := storage.(types.UsageReporter); ok {
+		return ur.BytesUsed()
+	}
+	return 0
+}
+
+// isHealthy returns false if the storage reports failures of its devices.
+func isHealthy(storage types.Storage) bool {
+	if hr, ok := storage.(types.HealthReporter); ok {
+		return hr.Healthy()
+	}
+	return true
 }
 
 // New creates and returns a ready to used ServerStatusHandler.
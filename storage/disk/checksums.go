@@ -0,0 +1,122 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+)
+
+// The checksums of the parts of an object are appended to a file in its
+// directory, so saving a part does not rewrite anything. Every record is the
+// part number followed by its checksum and the last record of a part wins.
+const (
+	checksumsFileName   = "checksums"
+	checksumsRecordSize = 8
+)
+
+// checksums holds the state of the part checksums of a disk.
+type checksums struct {
+	verifyEvery uint64
+	reads       uint64 // accessed atomically
+}
+
+func newChecksums(verifyEvery uint64) *checksums {
+	if verifyEvery == 0 {
+		verifyEvery = 1
+	}
+	return &checksums{verifyEvery: verifyEvery}
+}
+
+// shouldVerify returns true for one in every verifyEvery reads.
+func (c *checksums) shouldVerify() bool {
+	return atomic.AddUint64(&c.reads, 1)%c.verifyEvery == 0
+}
+
+func (s *Disk) getChecksumsPath(id *types.ObjectID) string {
+	return filepath.Join(s.getObjectIDPath(id), checksumsFileName)
+}
+
+// saveChecksum appends the checksum of the saved part to the checksums file of
+// its object.
+func (s *Disk) saveChecksum(idx *types.ObjectIndex, checksum uint32) error {
+	var path = s.getChecksumsPath(idx.ObjID)
+	var before = pathUsage(path)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, s.filePermissions)
+	if err != nil {
+		return err
+	}
+
+	var record [checksumsRecordSize]byte
+	binary.BigEndian.PutUint32(record[:4], idx.Part)
+	binary.BigEndian.PutUint32(record[4:], checksum)
+	if _, err := f.Write(record[:]); err != nil {
+		return utils.NewCompositeError(err, f.Close())
+	} else if err := f.Close(); err != nil {
+		return err
+	}
+	s.addUsage(pathUsage(path) - before)
+	return nil
+}
+
+// getChecksum returns the last saved checksum of the part, if there is one.
+func (s *Disk) getChecksum(idx *types.ObjectIndex) (uint32, bool) {
+	data, err := ioutil.ReadFile(s.getChecksumsPath(idx.ObjID))
+	if err != nil {
+		return 0, false
+	}
+	var checksum, found = uint32(0), false
+	for ; len(data) >= checksumsRecordSize; data = data[checksumsRecordSize:] {
+		if binary.BigEndian.Uint32(data[:4]) == idx.Part {
+			checksum, found = binary.BigEndian.Uint32(data[4:]), true
+		}
+	}
+	return checksum, found
+}
+
+// verifyPart reads the whole part, which is at most part_size, and checks it
+// against its checksum before returning it. A part which does not match is
+// discarded and os.ErrNotExist is returned, so that it is fetched again from
+// the upstream. Only some of the reads are verified if the disk is configured
+// so. Parts without a checksum are returned as they are.
+func (s *Disk) verifyPart(idx *types.ObjectIndex, f *os.File) (io.ReadCloser, error) {
+	if !s.checksums.shouldVerify() {
+		return f, nil
+	}
+	expected, ok := s.getChecksum(idx)
+	if !ok {
+		return f, nil
+	}
+
+	data, err := ioutil.ReadAll(f)
+	if err := utils.NewCompositeError(s.track(err), f.Close()); err != nil {
+		return nil, err
+	}
+	if crc32.ChecksumIEEE(data) != expected {
+		s.GetLogger().Errorf("[DiskStorage] Part %s does not match its checksum, discarding it", idx)
+		if err := s.DiscardPart(idx); err != nil {
+			s.GetLogger().Errorf("[DiskStorage] Error discarding the corrupted part %s: %s", idx, err)
+		} else {
+			s.notifyRemoved(idx)
+		}
+		return nil, os.ErrNotExist
+	}
+	return bytesReadCloser{bytes.NewReader(data)}, nil
+}
+
+// bytesReadCloser is a verified part in memory. It is an io.Seeker, so that
+// the start of the part can be skipped without reading it.
+type bytesReadCloser struct {
+	*bytes.Reader
+}
+
+func (bytesReadCloser) Close() error {
+	return nil
+}
@@ -0,0 +1,176 @@
+package disk
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+)
+
+func getChecksumsDisk(t *testing.T, verifyEvery uint64) (*Disk, func()) {
+	_, path, cleanup := getTestDiskStorage(t, 10)
+	d, err := New(&config.CacheZone{
+		Path:                 path,
+		PartSize:             10,
+		PartChecksums:        true,
+		VerifyChecksumsEvery: verifyEvery,
+	}, mock.NewLogger())
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return d, cleanup
+}
+
+func readPart(d *Disk, idx *types.ObjectIndex) (string, error) {
+	r, err := d.GetPart(idx)
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	return string(data), err
+}
+
+func TestCorruptedPartIsDiscarded(t *testing.T) {
+	t.Parallel()
+	d, cleanup := getChecksumsDisk(t, 1)
+	defer cleanup()
+
+	var id = types.NewObjectID("key", "/corrupted")
+	var idx = &types.ObjectIndex{ObjID: id, Part: 1}
+	saveMetadata(t, d, &types.ObjectMetadata{ID: id, Size: 20, Headers: http.Header{}})
+	if err := d.SavePart(idx, strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := d.getChecksum(idx); !ok {
+		t.Fatal("Expected the checksum of the part to be saved")
+	}
+	if data, err := readPart(d, idx); err != nil || data != "0123456789" {
+		t.Errorf("Unexpected part contents `%s` and error %v", data, err)
+	}
+
+	if err := ioutil.WriteFile(d.getObjectIndexPath(idx), []byte("0123456780"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPart(d, idx); !os.IsNotExist(err) {
+		t.Errorf("Expected a checksum mismatch but got %v", err)
+	}
+	if _, err := os.Stat(d.getObjectIndexPath(idx)); !os.IsNotExist(err) {
+		t.Errorf("Expected the corrupted part to be discarded but got %v", err)
+	}
+
+	// The part is fetched again and saved with a new checksum
+	if err := d.SavePart(idx, strings.NewReader("abcdefghij")); err != nil {
+		t.Fatal(err)
+	}
+	if data, err := readPart(d, idx); err != nil || data != "abcdefghij" {
+		t.Errorf("Unexpected part contents `%s` and error %v", data, err)
+	}
+}
+
+func TestChecksumsAreSampled(t *testing.T) {
+	t.Parallel()
+	d, cleanup := getChecksumsDisk(t, 3)
+	defer cleanup()
+
+	var id = types.NewObjectID("key", "/sampled")
+	var idx = &types.ObjectIndex{ObjID: id, Part: 0}
+	saveMetadata(t, d, &types.ObjectMetadata{ID: id, Size: 10, Headers: http.Header{}})
+	if err := d.SavePart(idx, strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(d.getObjectIndexPath(idx), []byte("corrupted!"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 1; i < 3; i++ {
+		if _, err := readPart(d, idx); err != nil {
+			t.Errorf("Expected read %d not to be verified but got %s", i, err)
+		}
+	}
+	if _, err := readPart(d, idx); !os.IsNotExist(err) {
+		t.Errorf("Expected the third read to be verified but got %v", err)
+	}
+}
+
+func TestSavingMetadataKeepsChecksums(t *testing.T) {
+	t.Parallel()
+	d, cleanup := getChecksumsDisk(t, 1)
+	defer cleanup()
+
+	var id = types.NewObjectID("key", "/refreshed")
+	var idx = &types.ObjectIndex{ObjID: id, Part: 1}
+	saveMetadata(t, d, &types.ObjectMetadata{ID: id, Size: 20, Headers: http.Header{}})
+	if err := d.SavePart(idx, strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	saveMetadata(t, d, &types.ObjectMetadata{ID: id, Size: 20, ExpiresAt: 1000, Headers: http.Header{}})
+
+	if err := ioutil.WriteFile(d.getObjectIndexPath(idx), []byte("0123456780"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readPart(d, idx); !os.IsNotExist(err) {
+		t.Errorf("Expected a checksum mismatch after the metadata was saved but got %v", err)
+	}
+}
+
+func TestPartsWithoutChecksumsAreNotVerified(t *testing.T) {
+	t.Parallel()
+	d, cleanup := getChecksumsDisk(t, 1)
+	defer cleanup()
+
+	var idx = &types.ObjectIndex{ObjID: types.NewObjectID("key", "/unverified"), Part: 0}
+	d.checksums = nil
+	if err := d.SavePart(idx, strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+	d.checksums = newChecksums(1)
+	if data, err := readPart(d, idx); err != nil || data != "0123456789" {
+		t.Errorf("Unexpected part contents `%s` and error %v", data, err)
+	}
+}
+
+func TestPartsAreVerifiedBeforeTheyAreRead(t *testing.T) {
+	t.Parallel()
+	d, cleanup := getChecksumsDisk(t, 1)
+	defer cleanup()
+
+	var idx = &types.ObjectIndex{ObjID: types.NewObjectID("key", "/verified"), Part: 0}
+	if err := d.SavePart(idx, strings.NewReader("0123456789")); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the middle of the part is read, as for a range request
+	r, err := d.GetPart(idx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r, err = utils.SkipReadCloser(r, 3); err != nil {
+		t.Fatal(err)
+	}
+	var middle = make([]byte, 4)
+	if _, err := io.ReadFull(r, middle); err != nil || string(middle) != "3456" {
+		t.Errorf("Unexpected middle `%s` of the part and error %v", middle, err)
+	}
+	if err := r.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := ioutil.WriteFile(d.getObjectIndexPath(idx), []byte("0123456780"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if r, err := d.GetPart(idx); !os.IsNotExist(err) {
+		t.Errorf("Expected the corrupted part not to be returned but got %v, %v", r, err)
+	}
+	if _, err := os.Stat(d.getObjectIndexPath(idx)); !os.IsNotExist(err) {
+		t.Errorf("Expected the corrupted part to be discarded but got %v", err)
+	}
+}
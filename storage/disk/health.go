@@ -0,0 +1,211 @@
+package disk
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/ironsmile/nedomi/utils"
+)
+
+const (
+	// The I/O errors are counted in windows of this duration
+	healthWindow = 10 * time.Second
+	// The disk is degraded when there are at least healthMinErrors errors in a
+	// window and they are more than healthMaxErrorRate of all the operations
+	healthMinErrors    = 10
+	healthMaxErrorRate = 0.5
+	// How often a degraded disk is checked whether it works again
+	healthProbeInterval = 30 * time.Second
+
+	probeFileName = ".nedomi-probe"
+)
+
+// health tracks the rate of the I/O errors of a disk. When there are too many
+// of them the disk is marked as degraded and a probe is started which checks
+// periodically whether the disk works again, until it does or done is closed.
+type health struct {
+	mu            sync.Mutex
+	windowStart   time.Time
+	operations    uint64
+	errors        uint64
+	degraded      bool
+	degradedSince time.Time
+	probeInterval time.Duration
+	probe         func() error
+	onChange      func(healthy bool)
+	done          <-chan struct{}
+}
+
+func newHealth(probe func() error, onChange func(healthy bool)) *health {
+	return &health{
+		windowStart:   time.Now(),
+		probeInterval: healthProbeInterval,
+		probe:         probe,
+		onChange:      onChange,
+	}
+}
+
+// record counts the result of a disk operation.
+func (h *health) record(err error) {
+	var failed = isIOError(err)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.degraded {
+		return
+	}
+
+	if now := time.Now(); now.Sub(h.windowStart) > healthWindow {
+		h.windowStart, h.operations, h.errors = now, 0, 0
+	}
+	h.operations++
+	if !failed {
+		return
+	}
+	h.errors++
+	if h.errors >= healthMinErrors && float64(h.errors) > healthMaxErrorRate*float64(h.operations) {
+		h.degraded = true
+		h.degradedSince = time.Now()
+		go h.probeUntilHealthy(h.done)
+		go h.onChange(false)
+	}
+}
+
+// healthy returns false while the disk is degraded.
+func (h *health) healthy() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return !h.degraded
+}
+
+// since returns the time when the disk was degraded.
+func (h *health) since() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.degradedSince
+}
+
+// stopProbesOn makes the probes stop when done is closed.
+func (h *health) stopProbesOn(done <-chan struct{}) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.done = done
+}
+
+func (h *health) probeUntilHealthy(done <-chan struct{}) {
+	var ticker = time.NewTicker(h.probeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		if h.probe() == nil {
+			h.mu.Lock()
+			h.degraded = false
+			h.windowStart, h.operations, h.errors = time.Now(), 0, 0
+			h.mu.Unlock()
+			h.onChange(true)
+			return
+		}
+	}
+}
+
+// isIOError returns whether the error is caused by a failure of the disk. A
+// full disk, missing permissions, missing files and the limits for open files
+// are not disk failures.
+func isIOError(err error) bool {
+	var errno error
+	switch e := err.(type) {
+	case *os.PathError:
+		errno = e.Err
+	case *os.LinkError:
+		errno = e.Err
+	case *os.SyscallError:
+		errno = e.Err
+	case *utils.CompositeError:
+		for _, err := range *e {
+			if isIOError(err) {
+				return true
+			}
+		}
+		return false
+	default:
+		return false
+	}
+	switch errno {
+	case syscall.EIO, syscall.EROFS, syscall.ENXIO, syscall.ENODEV:
+		return true
+	}
+	return false
+}
+
+// probeDisk writes, reads and removes a small file in the disk's directory.
+func (s *Disk) probeDisk() error {
+	var path = filepath.Join(s.path, probeFileName)
+	var contents = []byte(appendRandomSuffix("probe"))
+	if err := ioutil.WriteFile(path, contents, s.filePermissions); err != nil {
+		return err
+	}
+	read, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	if string(read) != string(contents) {
+		return os.ErrInvalid
+	}
+	return os.Remove(path)
+}
+
+// track records the result of a disk operation for the health of the disk
+// and returns the error unchanged.
+func (s *Disk) track(err error) error {
+	s.health.record(err)
+	return err
+}
+
+// Healthy implements types.HealthReporter. It returns false when the disk has
+// returned too many I/O errors recently and has not recovered since.
+func (s *Disk) Healthy() bool {
+	return s.health.healthy()
+}
+
+// SetProbeContext implements types.HealthProber. A degraded disk is not
+// probed any more once the context is done.
+func (s *Disk) SetProbeContext(ctx context.Context) {
+	s.health.stopProbesOn(ctx.Done())
+}
+
+// DegradedSince returns the time when the disk was marked as degraded. It is
+// meaningful only while Healthy returns false.
+func (s *Disk) DegradedSince() time.Time {
+	return s.health.since()
+}
+
+// SetHealthChangedFunc sets a function which is called whenever the disk is
+// degraded or starts working again.
+func (s *Disk) SetHealthChangedFunc(onChange func(healthy bool)) {
+	s.callbacksLock.Lock()
+	defer s.callbacksLock.Unlock()
+	s.onHealthChange = onChange
+}
+
+func (s *Disk) healthChanged(healthy bool) {
+	if healthy {
+		s.GetLogger().Logf("[DiskStorage] The disk at %s works again", s.path)
+	} else {
+		s.GetLogger().Errorf("[DiskStorage] Too many I/O errors, the disk at %s is degraded", s.path)
+	}
+
+	s.callbacksLock.Lock()
+	onChange := s.onHealthChange
+	s.callbacksLock.Unlock()
+	if onChange != nil {
+		onChange(healthy)
+	}
+}
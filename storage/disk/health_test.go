@@ -0,0 +1,136 @@
+package disk
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/utils"
+)
+
+func TestIsIOError(t *testing.T) {
+	t.Parallel()
+	var tests = []struct {
+		err      error
+		expected bool
+	}{
+		{nil, false},
+		{errors.New("not a disk error"), false},
+		{&os.PathError{Op: "open", Path: "/", Err: syscall.EIO}, true},
+		{&os.PathError{Op: "open", Path: "/", Err: syscall.ENOSPC}, false},
+		{&os.PathError{Op: "open", Path: "/", Err: syscall.EACCES}, false},
+		{&os.PathError{Op: "read", Path: "/", Err: syscall.ENXIO}, true},
+		{&os.PathError{Op: "open", Path: "/", Err: syscall.ENOENT}, false},
+		{&os.PathError{Op: "open", Path: "/", Err: syscall.EMFILE}, false},
+		{&os.LinkError{Op: "rename", Old: "/a", New: "/b", Err: syscall.EROFS}, true},
+		{utils.NewCompositeError(errors.New("copy"), &os.PathError{Err: syscall.EIO}), true},
+		{utils.NewCompositeError(errors.New("copy"), &os.PathError{Err: syscall.ENOENT}), false},
+	}
+
+	for _, test := range tests {
+		if got := isIOError(test.err); got != test.expected {
+			t.Errorf("isIOError(%#v) returned %t, expected %t", test.err, got, test.expected)
+		}
+	}
+}
+
+func TestHealthDegradesAndRecovers(t *testing.T) {
+	t.Parallel()
+	var changes = make(chan bool, 2)
+	var probeErr = make(chan error, 1)
+	probeErr <- syscall.EIO
+	h := newHealth(func() error {
+		select {
+		case err := <-probeErr:
+			return err
+		default:
+			return nil
+		}
+	}, func(healthy bool) { changes <- healthy })
+	h.probeInterval = 10 * time.Millisecond
+
+	var ioErr = &os.PathError{Op: "write", Path: "/", Err: syscall.EIO}
+	for i := 0; i < healthMinErrors-1; i++ {
+		h.record(ioErr)
+	}
+	h.record(nil)
+	h.record(os.ErrNotExist)
+	if !h.healthy() {
+		t.Fatal("Expected the disk to be healthy with too few errors")
+	}
+
+	h.record(ioErr)
+	if h.healthy() {
+		t.Fatal("Expected the disk to be degraded")
+	}
+	if h.since().IsZero() {
+		t.Error("Expected the time of the degradation to be set")
+	}
+
+	for _, expected := range []bool{false, true} {
+		select {
+		case healthy := <-changes:
+			if healthy != expected {
+				t.Errorf("Expected a health change to %t but got %t", expected, healthy)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Timed out waiting for a health change to %t", expected)
+		}
+	}
+	if !h.healthy() {
+		t.Error("Expected the disk to be healthy after a successful probe")
+	}
+}
+
+func TestProbesStopWhenDone(t *testing.T) {
+	t.Parallel()
+	var probes = make(chan struct{}, 100)
+	h := newHealth(func() error {
+		probes <- struct{}{}
+		return syscall.EIO
+	}, func(bool) {})
+	h.probeInterval = time.Millisecond
+	var done = make(chan struct{})
+	h.stopProbesOn(done)
+
+	var ioErr = &os.PathError{Op: "write", Path: "/", Err: syscall.EIO}
+	for i := 0; i < healthMinErrors; i++ {
+		h.record(ioErr)
+	}
+	select {
+	case <-probes:
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for the degraded disk to be probed")
+	}
+
+	close(done)
+	time.Sleep(10 * time.Millisecond)
+	for len(probes) > 0 {
+		<-probes
+	}
+	time.Sleep(10 * time.Millisecond)
+	if len(probes) != 0 {
+		t.Errorf("Expected no probes after done is closed but got %d", len(probes))
+	}
+	if h.healthy() {
+		t.Error("Expected the disk to stay degraded")
+	}
+}
+
+func TestDiskProbe(t *testing.T) {
+	t.Parallel()
+	d, _, cleanup := getTestDiskStorage(t, 10)
+	defer cleanup()
+
+	if err := d.probeDisk(); err != nil {
+		t.Errorf("Unexpected probe error: %s", err)
+	}
+	if _, err := os.Stat(d.path + "/" + probeFileName); !os.IsNotExist(err) {
+		t.Errorf("Expected the probe file to be removed but got %v", err)
+	}
+	if !d.Healthy() {
+		t.Error("Expected a new disk to be healthy")
+	}
+}
@@ -1,12 +1,13 @@
 package disk
 
 import (
-	"encoding/json"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"io/ioutil"
 	"os"
 	"path/filepath"
+	"sync"
 
 	"github.com/ironsmile/nedomi/config"
 	"github.com/ironsmile/nedomi/types"
@@ -15,12 +16,28 @@ import (
 
 // Disk implements the Storage interface by writing data to a disk
 type Disk struct {
+	// bytesUsed is accessed atomically, so it must be 64-bit aligned
+	bytesUsed int64
 	types.SyncLogger
 	partSize           uint64
 	path               string
 	dirPermissions     os.FileMode
 	filePermissions    os.FileMode
 	skipCacheKeyInPath bool
+	metadataFormat     string
+	metadataCache      *metadataCache
+	health             *health
+	checksums          *checksums
+	scrubber           *scrubber
+	// usageCounted is closed when the files which were on the disk at
+	// startup are added to bytesUsed
+	usageCounted chan struct{}
+
+	// removed is called with the parts which the disk removes on its own and
+	// onHealthChange whenever the disk is degraded or works again
+	callbacksLock  sync.Mutex
+	removed        func(...*types.ObjectIndex)
+	onHealthChange func(healthy bool)
 }
 
 // PartSize the maximum part size for the disk storage.
@@ -28,11 +45,27 @@ func (s *Disk) PartSize() uint64 {
 	return s.partSize
 }
 
-// GetMetadata returns the metadata on disk for this object, if present.
+// GetMetadata returns the metadata on disk for this object, if present. The
+// metadata of the recently used objects is cached in memory.
 func (s *Disk) GetMetadata(id *types.ObjectID) (*types.ObjectMetadata, error) {
-	//!TODO: optimize - reading and parsing the file from disk every time is very ineffictient
 	s.GetLogger().Debugf("[DiskStorage] Getting metadata for %s...", id)
-	return s.getObjectMetadata(s.getObjectMetadataPath(id))
+	obj, generation := s.metadataCache.get(id)
+	if obj != nil {
+		return obj, nil
+	}
+
+	obj, err := s.getObjectMetadata(s.getObjectMetadataPath(id))
+	if s.track(err) != nil {
+		return nil, err
+	}
+	s.metadataCache.add(obj, generation)
+	return obj, nil
+}
+
+// MetadataCacheStats returns how many GetMetadata calls were served from the
+// in-memory metadata cache and how many had to read the disk.
+func (s *Disk) MetadataCacheStats() (hits, misses uint64) {
+	return s.metadataCache.stats()
 }
 
 // GetPart returns an io.ReadCloser that will read the specified part of the
@@ -40,9 +73,12 @@ func (s *Disk) GetMetadata(id *types.ObjectID) (*types.ObjectMetadata, error) {
 func (s *Disk) GetPart(idx *types.ObjectIndex) (io.ReadCloser, error) {
 	s.GetLogger().Debugf("[DiskStorage] Getting file data for %s...", idx)
 	f, err := os.Open(s.getObjectIndexPath(idx))
-	if err != nil {
+	if s.track(err) != nil {
 		return nil, err
 	}
+	if s.checksums != nil {
+		return s.verifyPart(idx, f)
+	}
 
 	return f, nil
 }
@@ -51,12 +87,12 @@ func (s *Disk) GetPart(idx *types.ObjectIndex) (io.ReadCloser, error) {
 // parts of for the object specified by the provided objectMetadata
 func (s *Disk) GetAvailableParts(oid *types.ObjectID) ([]*types.ObjectIndex, error) {
 	dir, err := os.Open(s.getObjectIDPath(oid))
-	if err != nil {
+	if s.track(err) != nil {
 		return nil, err
 	}
 	defer dir.Close()
 	names, err := dir.Readdirnames(-1)
-	if err != nil {
+	if s.track(err) != nil {
 		return nil, err
 	}
 
@@ -83,35 +119,42 @@ func (s *Disk) GetAvailableParts(oid *types.ObjectID) ([]*types.ObjectIndex, err
 // SaveMetadata writes the supplied metadata to the disk.
 func (s *Disk) SaveMetadata(m *types.ObjectMetadata) error {
 	s.GetLogger().Debugf("[DiskStorage] Saving metadata for %s...", m.ID)
+	return s.track(s.saveMetadata(m))
+}
 
+func (s *Disk) saveMetadata(m *types.ObjectMetadata) error {
 	tmpPath := appendRandomSuffix(s.getObjectMetadataPath(m.ID))
 	f, err := s.createFile(tmpPath)
 	if err != nil {
 		return err
 	}
 
-	if err = json.NewEncoder(f).Encode(m); err != nil {
+	if err = s.encodeMetadata(f, m); err != nil {
 		return utils.NewCompositeError(err, f.Close())
 	} else if err := f.Close(); err != nil {
 		return err
 	}
 
-	//!TODO: use a faster encoding than json (some binary marshaller? gob?)
-
-	return os.Rename(tmpPath, s.getObjectMetadataPath(m.ID))
+	return s.metadataCache.store(m, func() error {
+		return s.renameTracked(tmpPath, s.getObjectMetadataPath(m.ID))
+	})
 }
 
 // SavePart writes the contents of the supplied object part to the disk.
 func (s *Disk) SavePart(idx *types.ObjectIndex, data io.Reader) error {
 	s.GetLogger().Debugf("[DiskStorage] Saving file data for %s...", idx)
+	return s.track(s.savePart(idx, data))
+}
 
+func (s *Disk) savePart(idx *types.ObjectIndex, data io.Reader) error {
 	tmpPath := appendRandomSuffix(s.getObjectIndexPath(idx))
 	f, err := s.createFile(tmpPath)
 	if err != nil {
 		return err
 	}
 
-	if savedSize, err := io.Copy(f, data); err != nil {
+	var checksum = crc32.NewIEEE()
+	if savedSize, err := io.Copy(f, io.TeeReader(data, checksum)); err != nil {
 		return utils.NewCompositeError(err, f.Close(), os.Remove(tmpPath))
 	} else if uint64(savedSize) > s.partSize {
 		err = fmt.Errorf("Object part has invalid size %d", savedSize)
@@ -120,25 +163,60 @@ func (s *Disk) SavePart(idx *types.ObjectIndex, data io.Reader) error {
 		return err
 	}
 
-	return os.Rename(tmpPath, s.getObjectIndexPath(idx))
+	// The checksum is saved first, so that a part is never left without it
+	if s.checksums != nil {
+		if err := s.saveChecksum(idx, checksum.Sum32()); err != nil {
+			return utils.NewCompositeError(err, os.Remove(tmpPath))
+		}
+	}
+	return s.renameTracked(tmpPath, s.getObjectIndexPath(idx))
 }
 
 // Discard removes the object and its metadata from the disk.
 func (s *Disk) Discard(id *types.ObjectID) error {
 	s.GetLogger().Debugf("[DiskStorage] Discarding %s...", id)
+	return s.track(s.discard(id))
+}
+
+func (s *Disk) discard(id *types.ObjectID) error {
 	oldPath := s.getObjectIDPath(id)
 	tmpPath := appendRandomSuffix(oldPath)
-	if err := os.Rename(oldPath, tmpPath); err != nil {
+	if err := s.metadataCache.discard(id, func() error {
+		return os.Rename(oldPath, tmpPath)
+	}); err != nil {
 		return err
 	}
 
-	return os.RemoveAll(tmpPath)
+	return s.removeTree(tmpPath)
+}
+
+// SetRemovedFunc implements types.RemovalNotifier.
+func (s *Disk) SetRemovedFunc(removed func(...*types.ObjectIndex)) {
+	s.callbacksLock.Lock()
+	defer s.callbacksLock.Unlock()
+	s.removed = removed
+}
+
+// notifyRemoved reports the parts which the disk has removed on its own.
+func (s *Disk) notifyRemoved(parts ...*types.ObjectIndex) {
+	s.callbacksLock.Lock()
+	removed := s.removed
+	s.callbacksLock.Unlock()
+	if removed != nil && len(parts) > 0 {
+		removed(parts...)
+	}
 }
 
 // DiscardPart removes the specified part of an Object from the disk.
 func (s *Disk) DiscardPart(idx *types.ObjectIndex) error {
 	s.GetLogger().Debugf("[DiskStorage] Discarding %s...", idx)
-	return os.Remove(s.getObjectIndexPath(idx))
+	var path = s.getObjectIndexPath(idx)
+	var removed = pathUsage(path)
+	err := os.Remove(path)
+	if err == nil {
+		s.addUsage(-removed)
+	}
+	return s.track(err)
 }
 
 // Iterate is a disk-specific function that iterates over all the objects on the
@@ -162,6 +240,10 @@ func (s *Disk) Iterate(callback func(*types.ObjectMetadata, ...*types.ObjectInde
 		for _, objectDir := range objectDirs {
 			objectDirPath := filepath.Join(rootDir, objectDir.Name(), objectMetadataFileName)
 			//!TODO: continue on os.ErrNotExist, delete on other errors?
+			// The metadata in a directory which is not named after the hash
+			// of an object is rejected by getObjectMetadata
+			hash, _ := objectHashOfDir(objectDir.Name())
+			generation := s.metadataCache.currentGeneration(hash)
 			obj, err := s.getObjectMetadata(objectDirPath)
 			if err != nil {
 				s.GetLogger().Errorf(
@@ -176,6 +258,7 @@ func (s *Disk) Iterate(callback func(*types.ObjectMetadata, ...*types.ObjectInde
 					objectDirPath, err)
 				continue
 			}
+			s.metadataCache.add(obj, generation)
 			if !callback(obj, parts...) {
 				return nil
 			}
@@ -201,16 +284,46 @@ func New(cfg *config.CacheZone, log types.Logger) (*Disk, error) {
 		return nil, fmt.Errorf("cannot stat the disk storage path %s: %s", cfg.Path, err)
 	}
 
+	var metadataFormat = cfg.MetadataFormat
+	if metadataFormat == "" {
+		metadataFormat = MetadataFormatJSON
+	} else if !isValidMetadataFormat(metadataFormat) {
+		return nil, fmt.Errorf("invalid metadata format `%s`", metadataFormat)
+	}
+
+	var metadataCacheSize = int(cfg.MetadataCacheObjects)
+	if metadataCacheSize == 0 {
+		metadataCacheSize = DefaultMetadataCacheSize
+	}
+
 	s := &Disk{
 		partSize:           cfg.PartSize.Bytes(),
 		path:               cfg.Path,
 		dirPermissions:     0700 | os.ModeDir, //!TODO: get from the config
 		filePermissions:    0600,              //!TODO: get from the config
 		skipCacheKeyInPath: cfg.SkipCacheKeyInPath,
+		metadataFormat:     metadataFormat,
+		metadataCache:      newMetadataCache(metadataCacheSize),
+		usageCounted:       make(chan struct{}),
 	}
+	s.scrubber = newScrubber(cfg.ScrubRate)
+	if cfg.PartChecksums {
+		s.checksums = newChecksums(cfg.VerifyChecksumsEvery)
+	}
+	s.health = newHealth(s.probeDisk, s.healthChanged)
 	s.SetLogger(log)
 
-	return s, s.saveSettingsOnDisk(cfg)
+	if err := s.saveSettingsOnDisk(cfg); err != nil {
+		return s, err
+	}
+	// The used space is needed only for the limits and walking a big disk
+	// takes a long time, so it is not done without them or at startup
+	if cfg.MaxSize != 0 || cfg.MinFreeSpace != 0 {
+		go s.countUsage()
+	} else {
+		close(s.usageCounted)
+	}
+	return s, nil
 }
 
 const (
@@ -0,0 +1,173 @@
+package disk
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+)
+
+// DefaultMetadataCacheSize is the number of objects for which the metadata is
+// kept in memory when the cache zone does not set metadata_cache_objects.
+const DefaultMetadataCacheSize = 10000
+
+// The objects are spread over this many stripes by the first byte of their
+// hash. Every stripe has its own generation and lock for the changes of the
+// metadata on the disk.
+const metadataCacheStripes = 256
+
+// metadataCache keeps the metadata of the recently used objects in memory so
+// that it does not have to be read from the disk and parsed on every request.
+// The least recently used metadata is removed when the cache is full. The
+// disk operations which change the metadata are done outside of its lock.
+type metadataCache struct {
+	mu      sync.Mutex
+	maxSize int
+	list    *list.List // of *types.ObjectMetadata, the most recent in front
+	lookup  map[types.ObjectIDHash]*list.Element
+	// generations are incremented on every change of the stored metadata of
+	// the objects in their stripe. They are used to detect whether metadata
+	// read from the disk may be outdated.
+	generations [metadataCacheStripes]uint64
+	// changes serialize the changes of the metadata on the disk for the
+	// objects in the same stripe
+	changes [metadataCacheStripes]sync.Mutex
+
+	hits   uint64
+	misses uint64
+}
+
+func newMetadataCache(maxSize int) *metadataCache {
+	return &metadataCache{
+		maxSize: maxSize,
+		list:    list.New(),
+		lookup:  make(map[types.ObjectIDHash]*list.Element),
+	}
+}
+
+func stripeOf(hash types.ObjectIDHash) int {
+	return int(hash[0]) % metadataCacheStripes
+}
+
+// get returns a copy of the cached metadata for the object and nil if it is
+// not in the cache. The second result is the generation with which the
+// metadata read from the disk should be added after a miss.
+func (c *metadataCache) get(id *types.ObjectID) (*types.ObjectMetadata, uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var generation = c.generations[stripeOf(id.Hash())]
+	if el, ok := c.lookup[id.Hash()]; ok {
+		c.hits++
+		c.list.MoveToFront(el)
+		return utils.CopyMetadata(el.Value.(*types.ObjectMetadata)), generation
+	}
+	c.misses++
+	return nil, generation
+}
+
+// currentGeneration returns the generation with which the metadata of the
+// object with the supplied hash should be added when it is about to be read
+// from the disk.
+func (c *metadataCache) currentGeneration(hash types.ObjectIDHash) uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.generations[stripeOf(hash)]
+}
+
+// add caches metadata which was read from the disk. It is ignored if metadata
+// in the same stripe was saved or discarded since the generation was returned,
+// because what was read may already be outdated.
+func (c *metadataCache) add(obj *types.ObjectMetadata, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation == c.generations[stripeOf(obj.ID.Hash())] {
+		c.set(obj)
+	}
+}
+
+// store calls persist and caches the metadata if it succeeds. The saves and
+// discards of the same object are serialized, so that the cached metadata is
+// the same as the one on the disk. Until persist returns the previous metadata
+// is still served from the cache.
+func (c *metadataCache) store(obj *types.ObjectMetadata, persist func() error) error {
+	var stripe = stripeOf(obj.ID.Hash())
+	c.changes[stripe].Lock()
+	defer c.changes[stripe].Unlock()
+
+	var err = persist()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generations[stripe]++
+	if err != nil {
+		c.remove(obj.ID)
+		return err
+	}
+	c.set(obj)
+	return nil
+}
+
+// discard removes the object's metadata from the cache and calls persist.
+// Metadata which is read from the disk while persist runs is not cached.
+func (c *metadataCache) discard(id *types.ObjectID, persist func() error) error {
+	var stripe = stripeOf(id.Hash())
+	c.changes[stripe].Lock()
+	defer c.changes[stripe].Unlock()
+
+	c.forgetIn(stripe, id)
+	var err = persist()
+	c.forgetIn(stripe, id)
+	return err
+}
+
+func (c *metadataCache) forgetIn(stripe int, id *types.ObjectID) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.generations[stripe]++
+	c.remove(id)
+}
+
+// forget removes the metadata of the object with the supplied hash from the
+// cache and returns its ID, or nil if it was not cached. It is used when the
+// object is removed without its ID being known.
+func (c *metadataCache) forget(hash types.ObjectIDHash) *types.ObjectID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.lookup[hash]
+	if !ok {
+		return nil
+	}
+	c.generations[stripeOf(hash)]++
+	id := el.Value.(*types.ObjectMetadata).ID
+	c.remove(id)
+	return id
+}
+
+// stats returns the number of metadata reads which were served from the
+// cache and the ones which had to go to the disk.
+func (c *metadataCache) stats() (hits, misses uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses
+}
+
+func (c *metadataCache) set(obj *types.ObjectMetadata) {
+	obj = utils.CopyMetadata(obj)
+	if el, ok := c.lookup[obj.ID.Hash()]; ok {
+		el.Value = obj
+		c.list.MoveToFront(el)
+		return
+	}
+	if c.list.Len() >= c.maxSize {
+		oldest := c.list.Remove(c.list.Back()).(*types.ObjectMetadata)
+		delete(c.lookup, oldest.ID.Hash())
+	}
+	c.lookup[obj.ID.Hash()] = c.list.PushFront(obj)
+}
+
+func (c *metadataCache) remove(id *types.ObjectID) {
+	if el, ok := c.lookup[id.Hash()]; ok {
+		c.list.Remove(el)
+		delete(c.lookup, id.Hash())
+	}
+}
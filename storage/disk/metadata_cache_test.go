@@ -0,0 +1,127 @@
+package disk
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+	"testing"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+func TestMetadataCacheIsBounded(t *testing.T) {
+	t.Parallel()
+	c := newMetadataCache(2)
+	var objs = []*types.ObjectMetadata{
+		{ID: types.NewObjectID("key", "/1"), Headers: http.Header{}},
+		{ID: types.NewObjectID("key", "/2"), Headers: http.Header{}},
+		{ID: types.NewObjectID("key", "/3"), Headers: http.Header{}},
+	}
+	for _, obj := range objs[:2] {
+		c.add(obj, c.currentGeneration(obj.ID.Hash()))
+	}
+	// the first object becomes the most recently used
+	if obj, _ := c.get(objs[0].ID); obj == nil {
+		t.Fatal("Expected the first object to be cached")
+	}
+	c.add(objs[2], c.currentGeneration(objs[2].ID.Hash()))
+
+	if obj, _ := c.get(objs[1].ID); obj != nil {
+		t.Error("Expected the least recently used object to be removed")
+	}
+	for _, expected := range []*types.ObjectMetadata{objs[0], objs[2]} {
+		if obj, _ := c.get(expected.ID); obj == nil || obj.ID != expected.ID {
+			t.Errorf("Expected %s to be cached but got %v", expected.ID, obj)
+		}
+	}
+	if hits, misses := c.stats(); hits != 3 || misses != 1 {
+		t.Errorf("Expected 3 hits and 1 miss but got %d and %d", hits, misses)
+	}
+}
+
+func TestMetadataCacheIgnoresOutdatedReads(t *testing.T) {
+	t.Parallel()
+	c := newMetadataCache(10)
+	obj := &types.ObjectMetadata{ID: types.NewObjectID("key", "/path"), Size: 1}
+
+	_, generation := c.get(obj.ID)
+	newer := *obj
+	newer.Size = 2
+	if err := c.store(&newer, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	// The metadata read before the save must not replace the saved one
+	c.add(obj, generation)
+	if got, _ := c.get(obj.ID); got == nil || got.Size != 2 {
+		t.Errorf("Expected the saved metadata to be cached but got %+v", got)
+	}
+
+	if err := c.discard(obj.ID, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := c.get(obj.ID); got != nil {
+		t.Errorf("Expected the discarded metadata to be removed but got %+v", got)
+	}
+
+	// Failed saves are not cached
+	if err := c.store(obj, func() error { return os.ErrPermission }); err != os.ErrPermission {
+		t.Errorf("Expected the persist error but got %v", err)
+	}
+	if got, _ := c.get(obj.ID); got != nil {
+		t.Errorf("Expected the failed save not to be cached but got %+v", got)
+	}
+}
+
+func TestGetMetadataUsesTheCache(t *testing.T) {
+	t.Parallel()
+	d, _, cleanup := getTestDiskStorage(t, 10)
+	defer cleanup()
+	saveMetadata(t, d, obj1)
+
+	hits, misses := d.MetadataCacheStats()
+	for i := 0; i < 5; i++ {
+		obj, err := d.GetMetadata(obj1.ID)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// changes to the returned metadata must not affect the cached one
+		obj.Headers["test"][0] = "changed"
+	}
+	newHits, newMisses := d.MetadataCacheStats()
+	if newHits-hits != 5 || newMisses != misses {
+		t.Errorf("Expected 5 cache hits but got %d hits and %d misses",
+			newHits-hits, newMisses-misses)
+	}
+	if obj, _ := d.GetMetadata(obj1.ID); obj.Headers["test"][0] != "mest" {
+		t.Errorf("The cached metadata was changed: %v", obj.Headers)
+	}
+
+	if err := d.Discard(obj1.ID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.GetMetadata(obj1.ID); !os.IsNotExist(err) {
+		t.Errorf("Expected a not exist error after discarding but got %v", err)
+	}
+}
+
+func TestMetadataCacheSavesDoNotAffectOtherObjects(t *testing.T) {
+	t.Parallel()
+	c := newMetadataCache(10)
+	read := &types.ObjectMetadata{ID: types.NewObjectID("key", "/read")}
+	var saved *types.ObjectMetadata
+	for i := 0; saved == nil; i++ {
+		id := types.NewObjectID("key", fmt.Sprintf("/saved/%d", i))
+		if stripeOf(id.Hash()) != stripeOf(read.ID.Hash()) {
+			saved = &types.ObjectMetadata{ID: id}
+		}
+	}
+
+	_, generation := c.get(read.ID)
+	if err := c.store(saved, func() error { return nil }); err != nil {
+		t.Fatal(err)
+	}
+	c.add(read, generation)
+	if got, _ := c.get(read.ID); got == nil {
+		t.Error("Expected the read metadata to be cached after the save of another object")
+	}
+}
@@ -0,0 +1,255 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"sort"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// The formats in which the disk storage can write the objects' metadata. The
+// metadata in any of them can always be read, so the format of a zone can be
+// changed without losing its cache.
+const (
+	MetadataFormatJSON   = "json"
+	MetadataFormatBinary = "binary"
+)
+
+// binaryMetadataMagic is at the start of every metadata file in the binary
+// format. JSON metadata always starts with '{', so the two are easy to tell
+// apart.
+var binaryMetadataMagic = []byte("NDMD")
+
+// binaryMetadataVersion is the version of the binary format which is written.
+// It follows the magic bytes and should be incremented on every change of the
+// format, keeping the decoding of the previous versions. Version 2 added the
+// part checksums after the headers, version 3 the variant keys after them and
+// version 4 removed the part checksums, which are kept in their own file.
+const binaryMetadataVersion = 4
+
+// maxBinaryMetadataString limits the length of the strings in the binary
+// metadata, so that a corrupted length can not cause a huge allocation.
+const maxBinaryMetadataString = 1 << 20
+
+var errInvalidBinaryMetadata = errors.New("invalid binary metadata")
+
+func isValidMetadataFormat(format string) bool {
+	return format == MetadataFormatJSON || format == MetadataFormatBinary
+}
+
+// encodeMetadata writes the metadata in the configured format of the storage.
+func (s *Disk) encodeMetadata(w io.Writer, m *types.ObjectMetadata) error {
+	if s.metadataFormat == MetadataFormatBinary {
+		_, err := w.Write(encodeBinaryMetadata(m))
+		return err
+	}
+	return json.NewEncoder(w).Encode(m)
+}
+
+// decodeMetadata parses metadata in any of the supported formats.
+func decodeMetadata(data []byte) (*types.ObjectMetadata, error) {
+	if bytes.HasPrefix(data, binaryMetadataMagic) {
+		return decodeBinaryMetadata(data)
+	}
+	obj := &types.ObjectMetadata{}
+	if err := json.Unmarshal(data, obj); err != nil {
+		return nil, err
+	}
+	if obj.ID == nil {
+		return nil, fmt.Errorf("metadata without an object ID")
+	}
+	return obj, nil
+}
+
+// encodeBinaryMetadata returns the metadata in the binary format. It consists
+// of the magic bytes, the version byte, the fields of the metadata as varints
+// and length-prefixed strings and a CRC32 checksum of everything before it.
+func encodeBinaryMetadata(m *types.ObjectMetadata) []byte {
+	var e metadataEncoder
+	e.buf = append(e.buf, binaryMetadataMagic...)
+	e.buf = append(e.buf, binaryMetadataVersion)
+
+	e.string(m.ID.CacheKey())
+	e.string(m.ID.Path())
+	e.string(m.ID.Variant())
+	e.varint(m.ResponseTimestamp)
+	e.varint(int64(m.Code))
+	e.uvarint(m.Size)
+	e.varint(m.ExpiresAt)
+	e.varint(m.StaleWhileRevalidate)
+	e.varint(m.StaleIfError)
+	e.varint(m.KeepUntil)
+
+	var keys = make([]string, 0, len(m.Headers))
+	for key := range m.Headers {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	e.uvarint(uint64(len(keys)))
+	for _, key := range keys {
+		e.string(key)
+		e.uvarint(uint64(len(m.Headers[key])))
+		for _, value := range m.Headers[key] {
+			e.string(value)
+		}
+	}
+
+	e.uvarint(uint64(len(m.Variants)))
+	for _, variant := range m.Variants {
+		e.string(variant)
+	}
+
+	var checksum [4]byte
+	binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(e.buf))
+	return append(e.buf, checksum[:]...)
+}
+
+func decodeBinaryMetadata(data []byte) (*types.ObjectMetadata, error) {
+	var header = len(binaryMetadataMagic) + 1
+	if len(data) < header+4 {
+		return nil, errInvalidBinaryMetadata
+	}
+	payload, checksum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(checksum) {
+		return nil, fmt.Errorf("binary metadata checksum mismatch")
+	}
+	var version = payload[header-1]
+	if version < 1 || version > binaryMetadataVersion {
+		return nil, fmt.Errorf("unsupported binary metadata version %d", version)
+	}
+
+	var d = metadataDecoder{data: payload[header:]}
+	cacheKey, path, variant := d.string(), d.string(), d.string()
+	obj := &types.ObjectMetadata{
+		ResponseTimestamp:    d.varint(),
+		Code:                 int(d.varint()),
+		Size:                 d.uvarint(),
+		ExpiresAt:            d.varint(),
+		StaleWhileRevalidate: d.varint(),
+		StaleIfError:         d.varint(),
+		KeepUntil:            d.varint(),
+	}
+
+	headersCount := d.uvarint()
+	// Every header takes at least two bytes
+	if headersCount > uint64(len(d.data)) {
+		return nil, errInvalidBinaryMetadata
+	}
+	obj.Headers = make(http.Header, headersCount)
+	for i := uint64(0); i < headersCount && d.err == nil; i++ {
+		key := d.string()
+		valuesCount := d.uvarint()
+		if valuesCount > uint64(len(d.data)) {
+			return nil, errInvalidBinaryMetadata
+		}
+		var values = make([]string, 0, valuesCount)
+		for j := uint64(0); j < valuesCount; j++ {
+			values = append(values, d.string())
+		}
+		obj.Headers[key] = values
+	}
+
+	if version == 2 || version == 3 {
+		// The part checksums are not in the metadata any more
+		checksumsCount := d.uvarint()
+		if checksumsCount > uint64(len(d.data)) {
+			return nil, errInvalidBinaryMetadata
+		}
+		for i := uint64(0); i < 2*checksumsCount && d.err == nil; i++ {
+			d.uvarint()
+		}
+	}
+
+	if version >= 3 {
+		variantsCount := d.uvarint()
+		if variantsCount > uint64(len(d.data)) {
+			return nil, errInvalidBinaryMetadata
+		}
+		for i := uint64(0); i < variantsCount && d.err == nil; i++ {
+			obj.Variants = append(obj.Variants, d.string())
+		}
+	}
+
+	if d.err != nil {
+		return nil, d.err
+	} else if len(d.data) != 0 {
+		return nil, fmt.Errorf("%d unexpected bytes at the end of the binary metadata", len(d.data))
+	} else if cacheKey == "" || path == "" {
+		return nil, fmt.Errorf("invalid object ID in the binary metadata")
+	}
+	obj.ID = types.NewVariantObjectID(cacheKey, path, variant)
+	return obj, nil
+}
+
+type metadataEncoder struct {
+	buf     []byte
+	scratch [binary.MaxVarintLen64]byte
+}
+
+func (e *metadataEncoder) uvarint(v uint64) {
+	n := binary.PutUvarint(e.scratch[:], v)
+	e.buf = append(e.buf, e.scratch[:n]...)
+}
+
+func (e *metadataEncoder) varint(v int64) {
+	n := binary.PutVarint(e.scratch[:], v)
+	e.buf = append(e.buf, e.scratch[:n]...)
+}
+
+func (e *metadataEncoder) string(s string) {
+	e.uvarint(uint64(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+// metadataDecoder reads the binary metadata fields. After the first error
+// all reads return zero values and the error is kept in err.
+type metadataDecoder struct {
+	data []byte
+	err  error
+}
+
+func (d *metadataDecoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.data)
+	if n <= 0 {
+		d.err = errInvalidBinaryMetadata
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *metadataDecoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.data)
+	if n <= 0 {
+		d.err = errInvalidBinaryMetadata
+		return 0
+	}
+	d.data = d.data[n:]
+	return v
+}
+
+func (d *metadataDecoder) string() string {
+	length := d.uvarint()
+	if d.err != nil {
+		return ""
+	} else if length > maxBinaryMetadataString || length > uint64(len(d.data)) {
+		d.err = errInvalidBinaryMetadata
+		return ""
+	}
+	s := string(d.data[:length])
+	d.data = d.data[length:]
+	return s
+}
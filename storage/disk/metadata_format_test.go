@@ -0,0 +1,173 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"hash/crc32"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+)
+
+var formatTestObjects = []*types.ObjectMetadata{
+	obj1, obj2, obj3,
+	{
+		ID:                   types.NewVariantObjectID("variant", "/path", "Accept-Encoding: gzip"),
+		ResponseTimestamp:    time.Now().Unix(),
+		Code:                 206,
+		Size:                 1 << 40,
+		Headers:              http.Header{"Vary": {"Accept-Encoding"}, "Empty": {""}},
+		ExpiresAt:            time.Now().Unix() - 100,
+		StaleWhileRevalidate: 60,
+		StaleIfError:         -1,
+		KeepUntil:            time.Now().Unix() + 1000,
+	},
+	{
+		ID:      types.NewObjectID("no", "/headers"),
+		Headers: http.Header{},
+	},
+	{
+		ID:       types.NewObjectID("with", "/variants"),
+		Headers:  http.Header{"Vary": {"Accept-Language"}},
+		Variants: []string{"Accept-Language: bg", "Accept-Language: en"},
+	},
+}
+
+func TestBinaryMetadataRoundTrip(t *testing.T) {
+	t.Parallel()
+	for _, obj := range formatTestObjects {
+		data := encodeBinaryMetadata(obj)
+		if !bytes.HasPrefix(data, binaryMetadataMagic) {
+			t.Errorf("The binary metadata for %s does not start with the magic bytes", obj.ID)
+		}
+		decoded, err := decodeMetadata(data)
+		if err != nil {
+			t.Errorf("Could not decode the binary metadata for %s: %s", obj.ID, err)
+		} else if !reflect.DeepEqual(decoded, obj) {
+			t.Errorf("Expected %#v but got %#v", obj, decoded)
+		}
+	}
+}
+
+func TestJSONMetadataIsDecoded(t *testing.T) {
+	t.Parallel()
+	for _, obj := range formatTestObjects {
+		data, err := json.Marshal(obj)
+		if err != nil {
+			t.Fatal(err)
+		}
+		decoded, err := decodeMetadata(data)
+		if err != nil {
+			t.Errorf("Could not decode the JSON metadata for %s: %s", obj.ID, err)
+		} else if !reflect.DeepEqual(decoded, obj) {
+			t.Errorf("Expected %#v but got %#v", obj, decoded)
+		}
+	}
+}
+
+func TestInvalidBinaryMetadata(t *testing.T) {
+	t.Parallel()
+	valid := encodeBinaryMetadata(formatTestObjects[3])
+
+	corrupted := append([]byte(nil), valid...)
+	corrupted[len(corrupted)/2]++
+	if _, err := decodeMetadata(corrupted); err == nil {
+		t.Error("Expected an error for corrupted metadata")
+	}
+
+	for i := len(binaryMetadataMagic); i < len(valid); i++ {
+		if _, err := decodeMetadata(valid[:i]); err == nil {
+			t.Errorf("Expected an error for metadata truncated to %d bytes", i)
+		}
+	}
+
+	newer := encodeBinaryMetadata(formatTestObjects[3])
+	newer[len(binaryMetadataMagic)] = binaryMetadataVersion + 1
+	if _, err := decodeMetadata(newer); err == nil {
+		t.Error("Expected an error for an unknown version")
+	}
+}
+
+func TestOlderBinaryMetadataVersions(t *testing.T) {
+	t.Parallel()
+	obj := formatTestObjects[3]
+	// The versions differ only in the fields after the headers: version 1 has
+	// none of them, version 2 has the part checksums, version 3 the checksums
+	// and the variants and version 4 only the variants
+	var afterHeaders = map[byte][]byte{
+		1: nil,
+		2: {1, 0, 42},
+		3: {2, 0, 42, 1, 43, 0},
+	}
+	data := encodeBinaryMetadata(obj)
+	for version, fields := range afterHeaders {
+		payload := append([]byte(nil), data[:len(data)-5]...)
+		payload = append(payload, fields...)
+		payload[len(binaryMetadataMagic)] = version
+		var checksum [4]byte
+		binary.BigEndian.PutUint32(checksum[:], crc32.ChecksumIEEE(payload))
+
+		decoded, err := decodeMetadata(append(payload, checksum[:]...))
+		if err != nil {
+			t.Errorf("Could not decode version %d metadata: %s", version, err)
+		} else if !reflect.DeepEqual(decoded, obj) {
+			t.Errorf("Expected %#v but got %#v", obj, decoded)
+		}
+	}
+}
+
+func TestDiskMetadataFormats(t *testing.T) {
+	t.Parallel()
+	jsonDisk, path, cleanup := getTestDiskStorage(t, 10)
+	defer cleanup()
+	saveMetadata(t, jsonDisk, obj1)
+
+	newDisk := func(format string) *Disk {
+		d, err := New(&config.CacheZone{
+			Path:           path,
+			PartSize:       10,
+			MetadataFormat: format,
+		}, mock.NewLogger())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	if _, err := New(&config.CacheZone{Path: path, PartSize: 10, MetadataFormat: "xml"},
+		mock.NewLogger()); err == nil {
+		t.Error("Expected an error for an unknown metadata format")
+	}
+
+	// The JSON metadata is read by a storage which writes binary
+	binaryDisk := newDisk(MetadataFormatBinary)
+	if read, err := binaryDisk.GetMetadata(obj1.ID); err != nil || !reflect.DeepEqual(read, obj1) {
+		t.Errorf("Could not read the JSON metadata: %v, %#v", err, read)
+	}
+	saveMetadata(t, binaryDisk, obj2)
+	data, err := ioutil.ReadFile(binaryDisk.getObjectMetadataPath(obj2.ID))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(data, binaryMetadataMagic) {
+		t.Errorf("Expected binary metadata but got %s", data)
+	}
+
+	// A new storage without cached metadata reads both formats from the disk
+	var found = make(map[string]bool)
+	if err := newDisk(MetadataFormatJSON).Iterate(func(obj *types.ObjectMetadata, _ ...*types.ObjectIndex) bool {
+		found[obj.ID.StrHash()] = true
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if !found[obj1.ID.StrHash()] || !found[obj2.ID.StrHash()] {
+		t.Errorf("Expected both objects to be found but got %v", found)
+	}
+}
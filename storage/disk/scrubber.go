@@ -0,0 +1,264 @@
+package disk
+
+import (
+	"context"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+// DefaultScrubRate is how many object directories are checked per second by
+// the scrubber when the cache zone does not set a rate.
+const DefaultScrubRate = 100
+
+// Temporary files which are younger than this may still be written to, so
+// the scrubber leaves them alone. The same goes for parts without metadata.
+const scrubMinAge = 10 * time.Minute
+
+var errScrubRunning = errors.New("the disk is already being scrubbed")
+
+// scrubber keeps the progress of the scrubbing of a disk.
+type scrubber struct {
+	sync.Mutex
+	rate     uint64
+	minAge   time.Duration
+	progress types.ScrubProgress
+}
+
+func newScrubber(rate uint64) *scrubber {
+	if rate == 0 {
+		rate = DefaultScrubRate
+	}
+	return &scrubber{rate: rate, minAge: scrubMinAge}
+}
+
+func (sc *scrubber) update(f func(*types.ScrubProgress)) {
+	sc.Lock()
+	defer sc.Unlock()
+	f(&sc.progress)
+}
+
+// ScrubProgress implements types.Scrubber.
+func (s *Disk) ScrubProgress() types.ScrubProgress {
+	s.scrubber.Lock()
+	defer s.scrubber.Unlock()
+	return s.scrubber.progress
+}
+
+// Scrub implements types.Scrubber. It goes over all of the object
+// directories of the disk with the configured rate. Temporary files left by
+// interrupted writes and discards, and parts without metadata are removed.
+// Objects with unreadable metadata or metadata for another object are
+// removed and parts which do not have the expected size are discarded.
+func (s *Disk) Scrub(ctx context.Context) error {
+	var alreadyRunning bool
+	s.scrubber.update(func(p *types.ScrubProgress) {
+		alreadyRunning = p.Running
+		if !alreadyRunning {
+			*p = types.ScrubProgress{Running: true, Started: time.Now()}
+		}
+	})
+	if alreadyRunning {
+		return errScrubRunning
+	}
+	defer s.scrubber.update(func(p *types.ScrubProgress) {
+		p.Running = false
+		p.Finished = time.Now()
+	})
+
+	rootDirs, err := filepath.Glob(s.path + s.iterateGlob())
+	if err != nil {
+		return err
+	}
+	s.scrubber.update(func(p *types.ScrubProgress) { p.DirsTotal = uint64(len(rootDirs)) })
+
+	var limit <-chan time.Time
+	if wait := time.Second / time.Duration(s.scrubber.rate); wait > 0 {
+		var ticker = time.NewTicker(wait)
+		defer ticker.Stop()
+		limit = ticker.C
+	}
+
+	for _, rootDir := range rootDirs {
+		entries, err := ioutil.ReadDir(rootDir)
+		if err != nil {
+			s.GetLogger().Errorf("[DiskStorage] Scrubber could not read %s: %s", rootDir, err)
+		}
+		for _, entry := range entries {
+			if limit != nil {
+				select {
+				case <-ctx.Done():
+					return ctx.Err()
+				case <-limit:
+				}
+			} else if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			s.scrubEntry(filepath.Join(rootDir, entry.Name()), entry)
+		}
+		s.scrubber.update(func(p *types.ScrubProgress) { p.DirsChecked++ })
+	}
+	return nil
+}
+
+// scrubEntry checks a single entry in the directories which hold the objects.
+func (s *Disk) scrubEntry(path string, fi os.FileInfo) {
+	if isTempName(fi.Name()) {
+		if s.removeIfOld(path, fi) {
+			s.scrubber.update(func(p *types.ScrubProgress) { p.RemovedTempFiles++ })
+		}
+		return
+	} else if !fi.IsDir() {
+		return
+	}
+
+	entries, err := ioutil.ReadDir(path)
+	if err != nil {
+		s.GetLogger().Errorf("[DiskStorage] Scrubber could not read %s: %s", path, err)
+		return
+	}
+	var parts = make(map[uint32]os.FileInfo, len(entries))
+	var checksumsFile os.FileInfo
+	for _, entry := range entries {
+		if isTempName(entry.Name()) {
+			if s.removeIfOld(filepath.Join(path, entry.Name()), entry) {
+				s.scrubber.update(func(p *types.ScrubProgress) { p.RemovedTempFiles++ })
+			}
+		} else if entry.Name() == checksumsFileName {
+			checksumsFile = entry
+		} else if part, err := s.getPartNumberFromFile(entry.Name()); err == nil {
+			parts[part] = entry
+		}
+	}
+
+	obj, err := s.getObjectMetadata(filepath.Join(path, objectMetadataFileName))
+	if os.IsNotExist(err) {
+		s.scrubOrphanParts(path, parts, checksumsFile)
+		return
+	} else if _, ok := err.(*os.PathError); ok {
+		// The metadata could not be read, which does not mean it is invalid
+		s.GetLogger().Errorf("[DiskStorage] Scrubber could not read the metadata in %s: %s",
+			path, s.track(err))
+		return
+	} else if err == nil && obj.ID.StrHash() != filepath.Base(path) {
+		err = errors.New("the metadata is for another object")
+	}
+	if err != nil {
+		s.GetLogger().Logf("[DiskStorage] Scrubber is removing the object in %s: %s", path, err)
+		id := s.forgetObjectIn(path)
+		if err := s.removeTree(path); err != nil {
+			s.GetLogger().Errorf("[DiskStorage] Scrubber could not remove %s: %s", path, err)
+		} else {
+			s.notifyRemovedParts(id, parts)
+		}
+		s.scrubber.update(func(p *types.ScrubProgress) { p.RemovedObjects++ })
+		return
+	}
+
+	var repaired bool
+	for part, fi := range parts {
+		// The size of objects with unknown length is not checked
+		if obj.Size == 0 || uint64(fi.Size()) == s.getPartSize(part, obj.Size) {
+			continue
+		}
+		idx := &types.ObjectIndex{ObjID: obj.ID, Part: part}
+		s.GetLogger().Logf("[DiskStorage] Scrubber is discarding %s with invalid size %d",
+			idx, fi.Size())
+		if err := s.DiscardPart(idx); err != nil && !os.IsNotExist(err) {
+			s.GetLogger().Errorf("[DiskStorage] Scrubber could not discard %s: %s", idx, err)
+		} else {
+			s.notifyRemoved(idx)
+		}
+		repaired = true
+	}
+	s.scrubber.update(func(p *types.ScrubProgress) {
+		p.ObjectsChecked++
+		if repaired {
+			p.RepairedObjects++
+		}
+	})
+}
+
+// scrubOrphanParts removes the old parts in an object directory without
+// metadata, together with their checksums when all of them are removed. The
+// directory itself is removed if it becomes empty.
+func (s *Disk) scrubOrphanParts(path string, parts map[uint32]os.FileInfo, checksumsFile os.FileInfo) {
+	var removed = make(map[uint32]os.FileInfo, len(parts))
+	for part, fi := range parts {
+		if s.removeIfOld(filepath.Join(path, getPartFilename(part)), fi) {
+			removed[part] = fi
+			s.scrubber.update(func(p *types.ScrubProgress) { p.RemovedOrphanParts++ })
+		}
+	}
+	if len(removed) > 0 {
+		s.notifyRemovedParts(s.forgetObjectIn(path), removed)
+	}
+	if checksumsFile != nil && len(removed) == len(parts) {
+		s.removeIfOld(filepath.Join(path, checksumsFileName), checksumsFile)
+	}
+	// Fails when there is something left in the directory
+	_ = os.Remove(path)
+}
+
+// forgetObjectIn removes the cached metadata of the object in the directory
+// and returns its ID. The metadata on the disk can not be read, so the ID is
+// known only when the metadata is still cached, which is the case for the
+// recently used objects which the cache algorithm knows about.
+func (s *Disk) forgetObjectIn(path string) *types.ObjectID {
+	hash, ok := objectHashOfDir(path)
+	if !ok {
+		return nil
+	}
+	return s.metadataCache.forget(hash)
+}
+
+// objectHashOfDir returns the hash of the object from the name of its
+// directory.
+func objectHashOfDir(path string) (types.ObjectIDHash, bool) {
+	var hash types.ObjectIDHash
+	decoded, err := hex.DecodeString(filepath.Base(path))
+	if err != nil || len(decoded) != len(hash) {
+		return hash, false
+	}
+	copy(hash[:], decoded)
+	return hash, true
+}
+
+// notifyRemovedParts reports the removed parts of the object, if its ID is
+// known.
+func (s *Disk) notifyRemovedParts(id *types.ObjectID, parts map[uint32]os.FileInfo) {
+	if id == nil {
+		return
+	}
+	var indexes = make([]*types.ObjectIndex, 0, len(parts))
+	for part := range parts {
+		indexes = append(indexes, &types.ObjectIndex{ObjID: id, Part: part})
+	}
+	s.notifyRemoved(indexes...)
+}
+
+// removeIfOld removes the file or directory if it has not been modified
+// recently and returns whether it was removed.
+func (s *Disk) removeIfOld(path string, fi os.FileInfo) bool {
+	if time.Since(fi.ModTime()) < s.scrubber.minAge {
+		return false
+	}
+	if err := s.removeTree(path); err != nil {
+		s.GetLogger().Errorf("[DiskStorage] Scrubber could not remove %s: %s", path, err)
+		return false
+	}
+	return true
+}
+
+// isTempName returns whether the file name is of a temporary file, created by
+// appendRandomSuffix.
+func isTempName(name string) bool {
+	return strings.Contains(name, "_")
+}
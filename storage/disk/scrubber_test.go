@@ -0,0 +1,164 @@
+package disk
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ironsmile/nedomi/types"
+)
+
+func makeOld(t *testing.T, path string) {
+	var old = time.Now().Add(-2 * scrubMinAge)
+	if err := os.Chtimes(path, old, old); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func writeTestFile(t *testing.T, path, contents string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestScrub(t *testing.T) {
+	t.Parallel()
+	d, _, cleanup := getTestDiskStorage(t, 10)
+	defer cleanup()
+	d.scrubber.rate = 1e6
+	var removed = make(map[string]bool)
+	d.SetRemovedFunc(func(parts ...*types.ObjectIndex) {
+		for _, idx := range parts {
+			removed[idx.String()] = true
+		}
+	})
+
+	saveObject := func(path string, size uint64, parts ...string) *types.ObjectID {
+		id := types.NewObjectID("key", path)
+		saveMetadata(t, d, &types.ObjectMetadata{ID: id, Size: size, Headers: http.Header{}})
+		for i, part := range parts {
+			idx := &types.ObjectIndex{ObjID: id, Part: uint32(i)}
+			if err := d.SavePart(idx, strings.NewReader(part)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return id
+	}
+
+	// A valid object with temporary files from interrupted writes
+	valid := saveObject("/valid", 15, "0123456789", "01234")
+	oldTemp := appendRandomSuffix(d.getObjectMetadataPath(valid))
+	writeTestFile(t, oldTemp, "{")
+	makeOld(t, oldTemp)
+	newTemp := appendRandomSuffix(d.getObjectIndexPath(&types.ObjectIndex{ObjID: valid, Part: 1}))
+	writeTestFile(t, newTemp, "01")
+
+	// An interrupted discard
+	discarded := appendRandomSuffix(d.getObjectIDPath(types.NewObjectID("key", "/discarded")))
+	writeTestFile(t, filepath.Join(discarded, objectMetadataFileName), "{}")
+	makeOld(t, discarded)
+
+	// Parts without metadata, one of them too new to be removed
+	orphan := types.NewObjectID("key", "/orphan")
+	orphanParts := []string{
+		d.getObjectIndexPath(&types.ObjectIndex{ObjID: orphan, Part: 0}),
+		d.getObjectIndexPath(&types.ObjectIndex{ObjID: orphan, Part: 1}),
+	}
+	writeTestFile(t, orphanParts[0], "0123456789")
+	writeTestFile(t, orphanParts[1], "0123456789")
+	makeOld(t, orphanParts[0])
+
+	// Unreadable metadata
+	corrupted := saveObject("/corrupted", 10, "0123456789")
+	writeTestFile(t, d.getObjectMetadataPath(corrupted), "{not json")
+
+	// Metadata which can not be read, but may be valid
+	unreadable := saveObject("/unreadable", 10, "0123456789")
+	if err := os.Remove(d.getObjectMetadataPath(unreadable)); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(d.getObjectMetadataPath(unreadable), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	// A torn part
+	torn := saveObject("/torn", 20, "0123456789", "0123456789")
+	tornPart := &types.ObjectIndex{ObjID: torn, Part: 1}
+	writeTestFile(t, d.getObjectIndexPath(tornPart), "01234")
+
+	if err := d.Scrub(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	p := d.ScrubProgress()
+	if p.Running || p.Finished.IsZero() || p.DirsChecked != p.DirsTotal || p.DirsTotal == 0 {
+		t.Errorf("Unexpected progress after the scrub %+v", p)
+	}
+	if p.ObjectsChecked != 2 || p.RemovedObjects != 1 || p.RepairedObjects != 1 ||
+		p.RemovedTempFiles != 2 || p.RemovedOrphanParts != 1 {
+		t.Errorf("Unexpected scrub results %+v", p)
+	}
+
+	exists := func(path string) bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+	if exists(oldTemp) || exists(discarded) || exists(orphanParts[0]) ||
+		exists(d.getObjectIDPath(corrupted)) || exists(d.getObjectIndexPath(tornPart)) {
+		t.Error("Expected the inconsistent files to be removed")
+	}
+	if !exists(newTemp) || !exists(orphanParts[1]) {
+		t.Error("Expected the recently modified files to be kept")
+	}
+	if parts, err := d.GetAvailableParts(valid); err != nil || len(parts) != 2 {
+		t.Errorf("Expected the valid object to be kept but got %v, %v", parts, err)
+	}
+	if !exists(d.getObjectIndexPath(&types.ObjectIndex{ObjID: unreadable, Part: 0})) {
+		t.Error("Expected the object with unreadable metadata to be kept")
+	}
+	if parts, err := d.GetAvailableParts(torn); err != nil || len(parts) != 1 {
+		t.Errorf("Expected the torn object to have one part but got %v, %v", parts, err)
+	}
+	if _, err := d.GetMetadata(corrupted); !os.IsNotExist(err) {
+		t.Errorf("Expected the cached metadata of the removed object to be forgotten but got %v", err)
+	}
+
+	// The IDs of the orphan parts are not known
+	var expected = map[string]bool{
+		(&types.ObjectIndex{ObjID: corrupted, Part: 0}).String(): true,
+		tornPart.String(): true,
+	}
+	if !reflect.DeepEqual(removed, expected) {
+		t.Errorf("Expected the removed parts %v to be reported but got %v", expected, removed)
+	}
+}
+
+func TestScrubIsCanceled(t *testing.T) {
+	t.Parallel()
+	d, _, cleanup := getTestDiskStorage(t, 10)
+	defer cleanup()
+	for i := 0; i < 5; i++ {
+		saveMetadata(t, d, &types.ObjectMetadata{
+			ID:      types.NewObjectID("key", "/"+string(rune('a'+i))),
+			Headers: http.Header{},
+		})
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := d.Scrub(ctx); err != context.Canceled {
+		t.Errorf("Expected the scrub to be canceled but got %v", err)
+	}
+	if p := d.ScrubProgress(); p.Running || p.ObjectsChecked != 0 {
+		t.Errorf("Unexpected progress after the canceled scrub %+v", p)
+	}
+}
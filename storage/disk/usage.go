@@ -0,0 +1,93 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"syscall"
+)
+
+// BytesUsed implements types.UsageReporter. It returns the space taken on the
+// disk by the files of the storage, including the metadata and the unused
+// parts of the last blocks of the files.
+func (s *Disk) BytesUsed() uint64 {
+	if used := atomic.LoadInt64(&s.bytesUsed); used > 0 {
+		return uint64(used)
+	}
+	return 0
+}
+
+// FreeSpace implements types.UsageReporter. It returns how many bytes are
+// available for writing on the filesystem of the disk.
+func (s *Disk) FreeSpace() (uint64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(s.path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Bavail) * uint64(st.Bsize), nil
+}
+
+func (s *Disk) addUsage(delta int64) {
+	atomic.AddInt64(&s.bytesUsed, delta)
+}
+
+// countUsage adds the space taken by the files which were on the disk when it
+// was created to the used bytes. Files which are saved or removed while it
+// walks the disk may be counted twice or not at all until the next restart.
+func (s *Disk) countUsage() {
+	defer close(s.usageCounted)
+	s.addUsage(treeUsage(s.path))
+}
+
+// renameTracked moves the newly written file at tmpPath over the one at path
+// and adds the difference of their sizes to the used bytes.
+func (s *Disk) renameTracked(tmpPath, path string) error {
+	var added, replaced = pathUsage(tmpPath), pathUsage(path)
+	if err := os.Rename(tmpPath, path); err != nil {
+		return err
+	}
+	s.addUsage(added - replaced)
+	return nil
+}
+
+// removeTree removes the file or directory with everything in it and subtracts
+// the space it took from the used bytes.
+func (s *Disk) removeTree(path string) error {
+	var removed = treeUsage(path)
+	if err := os.RemoveAll(path); err != nil {
+		return err
+	}
+	s.addUsage(-removed)
+	return nil
+}
+
+// fileUsage returns the space taken by the file on the disk, which may be more
+// than its size since whole blocks are allocated for it.
+func fileUsage(fi os.FileInfo) int64 {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return int64(st.Blocks) * 512
+	}
+	return fi.Size()
+}
+
+// pathUsage returns the space taken by the file at path or 0 if it is missing.
+func pathUsage(path string) int64 {
+	fi, err := os.Lstat(path)
+	if err != nil {
+		return 0
+	}
+	return fileUsage(fi)
+}
+
+// treeUsage returns the space taken by all of the files under root. The
+// directories themselves are not counted.
+func treeUsage(root string) int64 {
+	var total int64
+	_ = filepath.Walk(root, func(_ string, fi os.FileInfo, err error) error {
+		if err == nil && fi.Mode().IsRegular() {
+			total += fileUsage(fi)
+		}
+		return nil
+	})
+	return total
+}
@@ -0,0 +1,102 @@
+package disk
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+func TestBytesUsed(t *testing.T) {
+	t.Parallel()
+	diskPath, cleanup := testutils.GetTestFolder(t)
+	defer cleanup()
+	var cfg = &config.CacheZone{Path: diskPath, PartSize: 10, MaxSize: 1000}
+	d, err := New(cfg, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-d.usageCounted
+
+	var initial = d.BytesUsed()
+	var id = types.NewObjectID("key", "/path")
+	if err := d.SaveMetadata(&types.ObjectMetadata{ID: id, Size: 20}); err != nil {
+		t.Fatal(err)
+	}
+	var withMetadata = d.BytesUsed()
+	if withMetadata <= initial {
+		t.Errorf("Expected the metadata to take space but the usage is %d", withMetadata)
+	}
+
+	for i := uint32(0); i < 2; i++ {
+		idx := &types.ObjectIndex{ObjID: id, Part: i}
+		if err := d.SavePart(idx, strings.NewReader("0123456789")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var withParts = d.BytesUsed()
+	if withParts <= withMetadata {
+		t.Errorf("Expected the parts to take space but the usage is %d", withParts)
+	}
+	// Overwriting a part should not change the usage
+	if err := d.SavePart(&types.ObjectIndex{ObjID: id, Part: 1}, strings.NewReader("9876543210")); err != nil {
+		t.Fatal(err)
+	}
+	if d.BytesUsed() != withParts {
+		t.Errorf("Expected the usage to stay %d after overwriting a part but it is %d",
+			withParts, d.BytesUsed())
+	}
+
+	// The usage of existing files is counted by a new storage
+	reopened, err := New(cfg, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-reopened.usageCounted
+	if reopened.BytesUsed() != withParts {
+		t.Errorf("Expected the reopened storage to use %d bytes but it uses %d",
+			withParts, reopened.BytesUsed())
+	}
+
+	if err := d.DiscardPart(&types.ObjectIndex{ObjID: id, Part: 0}); err != nil {
+		t.Fatal(err)
+	}
+	if d.BytesUsed() >= withParts {
+		t.Errorf("Expected the usage to decrease after discarding a part but it is %d",
+			d.BytesUsed())
+	}
+	if err := d.Discard(id); err != nil {
+		t.Fatal(err)
+	}
+	if d.BytesUsed() != initial {
+		t.Errorf("Expected the usage to return to %d after discarding the object but it is %d",
+			initial, d.BytesUsed())
+	}
+
+	if free, err := d.FreeSpace(); err != nil || free == 0 {
+		t.Errorf("Expected some free space but got %d, %v", free, err)
+	}
+}
+
+func TestUsageIsNotCountedWithoutLimits(t *testing.T) {
+	t.Parallel()
+	d, diskPath, cleanup := getTestDiskStorage(t, 10)
+	defer cleanup()
+	var id = types.NewObjectID("key", "/path")
+	if err := d.SaveMetadata(&types.ObjectMetadata{ID: id, Size: 20}); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := New(&config.CacheZone{Path: diskPath, PartSize: 10}, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-reopened.usageCounted
+	if reopened.BytesUsed() != 0 {
+		t.Errorf("Expected the disk not to be walked without limits but it uses %d bytes",
+			reopened.BytesUsed())
+	}
+}
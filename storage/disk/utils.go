@@ -5,6 +5,7 @@ import (
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io/ioutil"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -87,24 +88,22 @@ func (s *Disk) getPartNumberFromFile(name string) (uint32, error) {
 }
 
 func (s *Disk) getObjectMetadata(objPath string) (*types.ObjectMetadata, error) {
-	f, err := os.Open(objPath)
+	data, err := ioutil.ReadFile(objPath)
 	if err != nil {
 		return nil, err
 	}
 
-	obj := &types.ObjectMetadata{}
-	if err := json.NewDecoder(f).Decode(&obj); err != nil {
-		return nil, utils.NewCompositeError(err, f.Close())
+	obj, err := decodeMetadata(data)
+	if err != nil {
+		return nil, err
 	}
 
 	if filepath.Base(filepath.Dir(objPath)) != obj.ID.StrHash() {
-		err := fmt.Errorf("The object %s was in the wrong directory: %s", obj.ID, objPath)
-		return nil, utils.NewCompositeError(err, f.Close())
+		return nil, fmt.Errorf("The object %s was in the wrong directory: %s", obj.ID, objPath)
 	}
-	//!TODO: add more validation? ex. compare the cache key as well? also the
-	// data itself may be corrupted or from an old app version
+	//!TODO: add more validation? ex. compare the cache key as well?
 
-	return obj, f.Close()
+	return obj, nil
 }
 
 func (s *Disk) checkPreviousDiskSettings(newSettings *config.CacheZone) error {
@@ -0,0 +1,255 @@
+// Package memory implements a storage which keeps all of the cached objects
+// and their parts in RAM.
+package memory
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils"
+)
+
+// ErrNotEnoughMemory is returned by SavePart when saving the part would make
+// the storage exceed its byte budget.
+var ErrNotEnoughMemory = errors.New("the memory storage byte budget is exhausted")
+
+// Memory implements the Storage interface by keeping the data in RAM
+type Memory struct {
+	types.SyncLogger
+	partSize uint64
+	maxSize  uint64
+
+	mu      sync.RWMutex
+	used    uint64
+	objects map[types.ObjectIDHash]*object
+}
+
+// object holds the metadata and the parts of a single cached object. The
+// metadata may be nil when only parts of the object have been saved.
+type object struct {
+	id       *types.ObjectID
+	metadata *types.ObjectMetadata
+	parts    map[uint32][]byte
+}
+
+// PartSize the maximum part size for the memory storage.
+func (s *Memory) PartSize() uint64 {
+	return s.partSize
+}
+
+// BytesUsed returns the number of bytes taken by the parts in the storage.
+func (s *Memory) BytesUsed() uint64 {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.used
+}
+
+// FreeSpace returns how much of the byte budget of the storage is unused.
+func (s *Memory) FreeSpace() (uint64, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.maxSize - s.used, nil
+}
+
+// MaxSize returns the byte budget of the storage.
+func (s *Memory) MaxSize() uint64 {
+	return s.maxSize
+}
+
+// GetMetadata returns a copy of the metadata in memory for this object, if present.
+func (s *Memory) GetMetadata(id *types.ObjectID) (*types.ObjectMetadata, error) {
+	s.GetLogger().Debugf("[MemoryStorage] Getting metadata for %s...", id)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	obj, ok := s.objects[id.Hash()]
+	if !ok || obj.metadata == nil {
+		return nil, os.ErrNotExist
+	}
+	return utils.CopyMetadata(obj.metadata), nil
+}
+
+// GetPart returns an io.ReadCloser that will read the specified part of the
+// object from memory.
+func (s *Memory) GetPart(idx *types.ObjectIndex) (io.ReadCloser, error) {
+	s.GetLogger().Debugf("[MemoryStorage] Getting file data for %s...", idx)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	obj, ok := s.objects[idx.ObjID.Hash()]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	data, ok := obj.parts[idx.Part]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	// The saved parts are never modified, so they can be read without a lock
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// GetAvailableParts returns types.ObjectIndexMap including all the available
+// parts of for the object specified by the provided objectMetadata
+func (s *Memory) GetAvailableParts(oid *types.ObjectID) ([]*types.ObjectIndex, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	obj, ok := s.objects[oid.Hash()]
+	if !ok {
+		return nil, os.ErrNotExist
+	}
+	return obj.indexes(oid), nil
+}
+
+// SaveMetadata stores a copy of the supplied metadata in memory.
+func (s *Memory) SaveMetadata(m *types.ObjectMetadata) error {
+	s.GetLogger().Debugf("[MemoryStorage] Saving metadata for %s...", m.ID)
+	var metadata = utils.CopyMetadata(m)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.getOrCreate(m.ID).metadata = metadata
+	return nil
+}
+
+// SavePart stores the contents of the supplied object part in memory. It
+// returns ErrNotEnoughMemory if there is no room for the part in the byte
+// budget of the storage.
+func (s *Memory) SavePart(idx *types.ObjectIndex, data io.Reader) error {
+	s.GetLogger().Debugf("[MemoryStorage] Saving file data for %s...", idx)
+
+	// Read one byte more than the part size so that bigger parts are detected
+	buf, err := ioutil.ReadAll(io.LimitReader(data, int64(s.partSize)+1))
+	if err != nil {
+		return err
+	} else if uint64(len(buf)) > s.partSize {
+		return fmt.Errorf("Object part has invalid size %d", len(buf))
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj := s.getOrCreate(idx.ObjID)
+	var replaced = uint64(len(obj.parts[idx.Part]))
+	if s.used-replaced+uint64(len(buf)) > s.maxSize {
+		return ErrNotEnoughMemory
+	}
+	s.used = s.used - replaced + uint64(len(buf))
+	obj.parts[idx.Part] = buf
+	return nil
+}
+
+// Discard removes the object and its metadata from memory.
+func (s *Memory) Discard(id *types.ObjectID) error {
+	s.GetLogger().Debugf("[MemoryStorage] Discarding %s...", id)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[id.Hash()]
+	if !ok {
+		return os.ErrNotExist
+	}
+	for _, data := range obj.parts {
+		s.used -= uint64(len(data))
+	}
+	delete(s.objects, id.Hash())
+	return nil
+}
+
+// DiscardPart removes the specified part of an Object from memory.
+func (s *Memory) DiscardPart(idx *types.ObjectIndex) error {
+	s.GetLogger().Debugf("[MemoryStorage] Discarding %s...", idx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	obj, ok := s.objects[idx.ObjID.Hash()]
+	if !ok {
+		return os.ErrNotExist
+	}
+	data, ok := obj.parts[idx.Part]
+	if !ok {
+		return os.ErrNotExist
+	}
+	s.used -= uint64(len(data))
+	delete(obj.parts, idx.Part)
+	if len(obj.parts) == 0 && obj.metadata == nil {
+		delete(s.objects, idx.ObjID.Hash())
+	}
+	return nil
+}
+
+// Iterate iterates over all the objects in memory and passes them to the
+// supplied callback function. Objects without metadata are skipped. If the
+// callback function returns false, the iteration stops.
+func (s *Memory) Iterate(callback func(*types.ObjectMetadata, ...*types.ObjectIndex) bool) error {
+	type entry struct {
+		metadata *types.ObjectMetadata
+		parts    []*types.ObjectIndex
+	}
+
+	// The callback is called without holding the lock so that it can use
+	// the storage
+	s.mu.RLock()
+	var entries = make([]entry, 0, len(s.objects))
+	for _, obj := range s.objects {
+		if obj.metadata != nil {
+			entries = append(entries, entry{utils.CopyMetadata(obj.metadata), obj.indexes(obj.id)})
+		}
+	}
+	s.mu.RUnlock()
+
+	for _, e := range entries {
+		if !callback(e.metadata, e.parts...) {
+			return nil
+		}
+	}
+	return nil
+}
+
+// New returns a new memory storage that ready for use. Its byte budget is
+// the zone's max_size or, if it is not set, storage_objects * part_size.
+func New(cfg *config.CacheZone, log types.Logger) (*Memory, error) {
+	if cfg == nil || log == nil {
+		return nil, fmt.Errorf("nil constructor parameters")
+	}
+
+	if cfg.PartSize == 0 {
+		return nil, fmt.Errorf("invalid partSize value")
+	}
+
+	var maxSize = cfg.MaxSize.Bytes()
+	if maxSize == 0 {
+		maxSize = cfg.StorageObjects * cfg.PartSize.Bytes()
+	}
+	if maxSize == 0 {
+		return nil, fmt.Errorf("memory storage needs max_size or storage_objects")
+	}
+
+	s := &Memory{
+		partSize: cfg.PartSize.Bytes(),
+		maxSize:  maxSize,
+		objects:  make(map[types.ObjectIDHash]*object),
+	}
+	s.SetLogger(log)
+
+	return s, nil
+}
+
+// getOrCreate returns the object with the supplied id. It must be called with
+// the write lock held.
+func (s *Memory) getOrCreate(id *types.ObjectID) *object {
+	obj, ok := s.objects[id.Hash()]
+	if !ok {
+		obj = &object{id: id, parts: make(map[uint32][]byte)}
+		s.objects[id.Hash()] = obj
+	}
+	return obj
+}
+
+func (o *object) indexes(id *types.ObjectID) []*types.ObjectIndex {
+	var parts = make([]*types.ObjectIndex, 0, len(o.parts))
+	for part := range o.parts {
+		parts = append(parts, &types.ObjectIndex{ObjID: id, Part: part})
+	}
+	return parts
+}
@@ -0,0 +1,215 @@
+package memory
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+)
+
+func newTestMemory(t *testing.T, maxSize types.BytesSize) *Memory {
+	m, err := New(&config.CacheZone{PartSize: 5, MaxSize: maxSize}, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m
+}
+
+func TestConstructor(t *testing.T) {
+	t.Parallel()
+	if _, err := New(nil, mock.NewLogger()); err == nil {
+		t.Error("Expected an error with a nil config")
+	}
+	if _, err := New(&config.CacheZone{MaxSize: 10}, mock.NewLogger()); err == nil {
+		t.Error("Expected an error with zero part size")
+	}
+	if _, err := New(&config.CacheZone{PartSize: 5}, mock.NewLogger()); err == nil {
+		t.Error("Expected an error without max_size and storage_objects")
+	}
+
+	m, err := New(&config.CacheZone{PartSize: 5, StorageObjects: 3}, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.MaxSize() != 15 {
+		t.Errorf("Expected the budget to be storage_objects * part_size but it is %d", m.MaxSize())
+	}
+}
+
+func TestMetadataIsCopied(t *testing.T) {
+	t.Parallel()
+	m := newTestMemory(t, 100)
+	obj := &types.ObjectMetadata{
+		ID:      types.NewObjectID("key", "/path"),
+		Size:    10,
+		Headers: http.Header{"X-Test": {"value"}},
+	}
+
+	if _, err := m.GetMetadata(obj.ID); !os.IsNotExist(err) {
+		t.Errorf("Expected a not exist error but got %v", err)
+	}
+	if err := m.SaveMetadata(obj); err != nil {
+		t.Fatal(err)
+	}
+	obj.Headers.Set("X-Test", "changed")
+
+	got, err := m.GetMetadata(obj.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Size != 10 || got.Headers.Get("X-Test") != "value" {
+		t.Errorf("Unexpected metadata %+v", got)
+	}
+	got.Headers.Set("X-Test", "changed")
+	if got, _ = m.GetMetadata(obj.ID); got.Headers.Get("X-Test") != "value" {
+		t.Error("The stored metadata was changed through the returned one")
+	}
+}
+
+func TestPartsAndBudget(t *testing.T) {
+	t.Parallel()
+	m := newTestMemory(t, 12)
+	id := types.NewObjectID("key", "/path")
+	idx := func(part uint32) *types.ObjectIndex {
+		return &types.ObjectIndex{ObjID: id, Part: part}
+	}
+
+	if err := m.SavePart(idx(0), strings.NewReader("123456")); err == nil {
+		t.Error("Expected an error for a part bigger than the part size")
+	}
+	for i, data := range []string{"01234", "56789"} {
+		if err := m.SavePart(idx(uint32(i)), strings.NewReader(data)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := m.SavePart(idx(2), strings.NewReader("abcde")); err != ErrNotEnoughMemory {
+		t.Errorf("Expected ErrNotEnoughMemory but got %v", err)
+	}
+	if err := m.SavePart(idx(2), strings.NewReader("ab")); err != nil {
+		t.Errorf("Expected the small part to fit in the budget but got %s", err)
+	}
+	// Replacing a part should only count the difference
+	if err := m.SavePart(idx(1), strings.NewReader("xyz")); err != nil {
+		t.Fatal(err)
+	}
+	if m.BytesUsed() != 10 {
+		t.Errorf("Expected 10 used bytes but got %d", m.BytesUsed())
+	}
+	if free, err := m.FreeSpace(); err != nil || free != m.MaxSize()-10 {
+		t.Errorf("Expected %d free bytes but got %d, %v", m.MaxSize()-10, free, err)
+	}
+
+	r, err := m.GetPart(idx(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := ioutil.ReadAll(r); !bytes.Equal(data, []byte("xyz")) {
+		t.Errorf("Unexpected part contents %s", data)
+	}
+	if parts, err := m.GetAvailableParts(id); err != nil || len(parts) != 3 {
+		t.Errorf("Expected 3 parts but got %v, %v", parts, err)
+	}
+
+	if err := m.DiscardPart(idx(0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetPart(idx(0)); !os.IsNotExist(err) {
+		t.Errorf("Expected the discarded part to be missing but got %v", err)
+	}
+	if m.BytesUsed() != 5 {
+		t.Errorf("Expected 5 used bytes but got %d", m.BytesUsed())
+	}
+
+	if err := m.Discard(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := m.GetAvailableParts(id); !os.IsNotExist(err) {
+		t.Errorf("Expected the discarded object to be missing but got %v", err)
+	}
+	if m.BytesUsed() != 0 {
+		t.Errorf("Expected no used bytes but got %d", m.BytesUsed())
+	}
+	if err := m.Discard(id); !os.IsNotExist(err) {
+		t.Errorf("Expected a not exist error but got %v", err)
+	}
+}
+
+func TestIterate(t *testing.T) {
+	t.Parallel()
+	m := newTestMemory(t, 100)
+	var ids = []*types.ObjectID{
+		types.NewObjectID("key", "/first"),
+		types.NewObjectID("key", "/second"),
+	}
+	for _, id := range ids {
+		if err := m.SaveMetadata(&types.ObjectMetadata{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+		if err := m.SavePart(&types.ObjectIndex{ObjID: id, Part: 1}, strings.NewReader("abc")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Parts without metadata are not returned
+	orphan := &types.ObjectIndex{ObjID: types.NewObjectID("key", "/orphan")}
+	if err := m.SavePart(orphan, strings.NewReader("abc")); err != nil {
+		t.Fatal(err)
+	}
+
+	var found = make(map[string]int)
+	err := m.Iterate(func(obj *types.ObjectMetadata, parts ...*types.ObjectIndex) bool {
+		// the storage should be usable from the callback
+		if _, err := m.GetMetadata(obj.ID); err != nil {
+			t.Error(err)
+		}
+		found[obj.ID.Path()] = len(parts)
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 2 || found["/first"] != 1 || found["/second"] != 1 {
+		t.Errorf("Unexpected iteration result %v", found)
+	}
+
+	var count int
+	if err := m.Iterate(func(*types.ObjectMetadata, ...*types.ObjectIndex) bool {
+		count++
+		return false
+	}); err != nil || count != 1 {
+		t.Errorf("Expected the iteration to stop after 1 object but got %d, %v", count, err)
+	}
+}
+
+func TestConcurrentUsage(t *testing.T) {
+	t.Parallel()
+	m := newTestMemory(t, 1000)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := types.NewObjectID("key", "/path")
+			idx := &types.ObjectIndex{ObjID: id, Part: uint32(i)}
+			for j := 0; j < 100; j++ {
+				_ = m.SaveMetadata(&types.ObjectMetadata{ID: id, Headers: http.Header{}})
+				_ = m.SavePart(idx, strings.NewReader("abcde"))
+				_, _ = m.GetMetadata(id)
+				if r, err := m.GetPart(idx); err == nil {
+					_, _ = ioutil.ReadAll(r)
+				}
+				_ = m.DiscardPart(idx)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if m.BytesUsed() != 0 {
+		t.Errorf("Expected no used bytes after all parts were discarded but got %d", m.BytesUsed())
+	}
+}
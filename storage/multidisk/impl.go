@@ -0,0 +1,426 @@
+// Package multidisk implements a storage which spreads the objects of a single
+// cache zone over multiple disks.
+package multidisk
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/storage/disk"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/upstream/balancing/weighted"
+)
+
+// DefaultPlacement is the weighted balancing algorithm which is used for
+// choosing the disk of each object when the cache zone does not set one.
+const DefaultPlacement = "rendezvous"
+
+// The weighted balancing algorithms which always choose the same disk for the
+// same object and move only the objects of a disk when it is removed. The
+// random one can not be used for placement.
+var consistentPlacements = map[string]bool{
+	"ketama":       true,
+	"legacyketama": true,
+	"rendezvous":   true,
+}
+
+// MultiDisk implements the Storage interface with a disk storage for each of
+// the configured paths. Every object, together with all of its parts, is
+// stored on a single disk which is chosen by consistent hashing of its ID.
+type MultiDisk struct {
+	types.SyncLogger
+	partSize  uint64
+	disks     map[string]*disk.Disk
+	paths     []string
+	addresses []*types.UpstreamAddress
+	placement types.UpstreamBalancingAlgorithm
+
+	// fallback places the objects of the degraded disks on the healthy ones
+	fallbackLock    sync.Mutex
+	fallback        types.UpstreamBalancingAlgorithm
+	fallbackHealthy []bool
+	newPlacement    func() types.UpstreamBalancingAlgorithm
+
+	// copies are the objects which were written to the fallback disks while
+	// the disk they are placed on was degraded, by the path of that disk
+	copiesLock sync.Mutex
+	copies     map[string]map[types.ObjectIDHash]*types.ObjectID
+	removed    func(...*types.ObjectIndex)
+}
+
+// PartSize the maximum part size for the storage.
+func (s *MultiDisk) PartSize() uint64 {
+	return s.partSize
+}
+
+// GetMetadata returns the metadata for this object from its disk, if present.
+func (s *MultiDisk) GetMetadata(id *types.ObjectID) (*types.ObjectMetadata, error) {
+	d, err := s.diskFor(id)
+	if err != nil {
+		return nil, err
+	}
+	return d.GetMetadata(id)
+}
+
+// GetPart returns an io.ReadCloser that will read the specified part of the
+// object from its disk.
+func (s *MultiDisk) GetPart(idx *types.ObjectIndex) (io.ReadCloser, error) {
+	d, err := s.diskFor(idx.ObjID)
+	if err != nil {
+		return nil, err
+	}
+	return d.GetPart(idx)
+}
+
+// GetAvailableParts returns types.ObjectIndexMap including all the available
+// parts of for the object specified by the provided objectMetadata
+func (s *MultiDisk) GetAvailableParts(id *types.ObjectID) ([]*types.ObjectIndex, error) {
+	d, err := s.diskFor(id)
+	if err != nil {
+		return nil, err
+	}
+	return d.GetAvailableParts(id)
+}
+
+// SaveMetadata writes the supplied metadata to the object's disk.
+func (s *MultiDisk) SaveMetadata(m *types.ObjectMetadata) error {
+	d, err := s.diskForWrite(m.ID)
+	if err != nil {
+		return err
+	}
+	return d.SaveMetadata(m)
+}
+
+// SavePart writes the contents of the supplied object part to the object's disk.
+func (s *MultiDisk) SavePart(idx *types.ObjectIndex, data io.Reader) error {
+	d, err := s.diskForWrite(idx.ObjID)
+	if err != nil {
+		return err
+	}
+	return d.SavePart(idx, data)
+}
+
+// Discard removes the object and its metadata from its disk.
+func (s *MultiDisk) Discard(id *types.ObjectID) error {
+	d, err := s.diskFor(id)
+	if err != nil {
+		return err
+	}
+	return d.Discard(id)
+}
+
+// DiscardPart removes the specified part of an Object from its disk.
+func (s *MultiDisk) DiscardPart(idx *types.ObjectIndex) error {
+	d, err := s.diskFor(idx.ObjID)
+	if err != nil {
+		return err
+	}
+	return d.DiscardPart(idx)
+}
+
+// Iterate iterates over the objects on all of the disks and passes them to the
+// supplied callback function. Objects which are on a different disk than the
+// one they are placed on, for example after a disk has been added or its
+// weight has been changed, are discarded instead. If the callback function
+// returns false, the iteration stops.
+func (s *MultiDisk) Iterate(callback func(*types.ObjectMetadata, ...*types.ObjectIndex) bool) error {
+	for _, path := range s.paths {
+		var current = s.disks[path]
+		var stopped bool
+		err := current.Iterate(func(obj *types.ObjectMetadata, parts ...*types.ObjectIndex) bool {
+			if d, err := s.placedOn(obj.ID); err == nil && d != current {
+				s.GetLogger().Debugf("[MultiDiskStorage] Discarding misplaced object %s from %s",
+					obj.ID, path)
+				if err := current.Discard(obj.ID); err != nil {
+					s.GetLogger().Errorf("[MultiDiskStorage] Error discarding misplaced object %s from %s: %s",
+						obj.ID, path, err)
+				}
+				return true
+			}
+			stopped = !callback(obj, parts...)
+			return !stopped
+		})
+		if err != nil {
+			return err
+		} else if stopped {
+			return nil
+		}
+	}
+	return nil
+}
+
+// BytesUsed implements types.UsageReporter. It returns the space taken on all
+// of the disks.
+func (s *MultiDisk) BytesUsed() uint64 {
+	var used uint64
+	for _, d := range s.disks {
+		used += d.BytesUsed()
+	}
+	return used
+}
+
+// FreeSpace implements types.UsageReporter. It returns the sum of the free
+// space of all the disks.
+func (s *MultiDisk) FreeSpace() (uint64, error) {
+	var free uint64
+	for _, d := range s.disks {
+		diskFree, err := d.FreeSpace()
+		if err != nil {
+			return 0, err
+		}
+		free += diskFree
+	}
+	return free, nil
+}
+
+// Scrub implements types.Scrubber by scrubbing the disks one after another.
+func (s *MultiDisk) Scrub(ctx context.Context) error {
+	for _, path := range s.paths {
+		if err := s.disks[path].Scrub(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ScrubProgress implements types.Scrubber. It returns the combined progress
+// of all of the disks.
+func (s *MultiDisk) ScrubProgress() types.ScrubProgress {
+	var total types.ScrubProgress
+	for _, path := range s.paths {
+		p := s.disks[path].ScrubProgress()
+		total.Running = total.Running || p.Running
+		if !p.Started.IsZero() && (total.Started.IsZero() || p.Started.Before(total.Started)) {
+			total.Started = p.Started
+		}
+		if p.Finished.After(total.Finished) {
+			total.Finished = p.Finished
+		}
+		total.DirsChecked += p.DirsChecked
+		total.DirsTotal += p.DirsTotal
+		total.ObjectsChecked += p.ObjectsChecked
+		total.RemovedTempFiles += p.RemovedTempFiles
+		total.RemovedOrphanParts += p.RemovedOrphanParts
+		total.RemovedObjects += p.RemovedObjects
+		total.RepairedObjects += p.RepairedObjects
+	}
+	if total.Running {
+		total.Finished = time.Time{}
+	}
+	return total
+}
+
+// SetLogger changes the Logger of the storage and all of its disks.
+func (s *MultiDisk) SetLogger(logger types.Logger) {
+	s.SyncLogger.SetLogger(logger)
+	for _, d := range s.disks {
+		d.SetLogger(logger)
+	}
+}
+
+// SetRemovedFunc implements types.RemovalNotifier for all of the disks. It is
+// also called with the parts of the fallback copies which are discarded when
+// a disk works again.
+func (s *MultiDisk) SetRemovedFunc(removed func(...*types.ObjectIndex)) {
+	s.copiesLock.Lock()
+	s.removed = removed
+	s.copiesLock.Unlock()
+	for _, d := range s.disks {
+		d.SetRemovedFunc(removed)
+	}
+}
+
+// SetProbeContext implements types.HealthProber for all of the disks.
+func (s *MultiDisk) SetProbeContext(ctx context.Context) {
+	for _, d := range s.disks {
+		d.SetProbeContext(ctx)
+	}
+}
+
+// Healthy implements types.HealthReporter. The storage is healthy while at
+// least one of its disks is.
+func (s *MultiDisk) Healthy() bool {
+	for _, d := range s.disks {
+		if d.Healthy() {
+			return true
+		}
+	}
+	return false
+}
+
+// placedOn returns the disk on which the object is placed when all the disks
+// are healthy.
+func (s *MultiDisk) placedOn(id *types.ObjectID) (*disk.Disk, error) {
+	addr, err := s.placement.Get(id.StrHash())
+	if err != nil {
+		return nil, err
+	}
+	return s.disks[addr.Hostname], nil
+}
+
+// diskFor returns the disk which should be used for the object. When the disk
+// on which the object is placed is degraded, the object is placed on one of
+// the healthy disks instead. Such objects are discarded when the disk works
+// again or by Iterate after a restart.
+func (s *MultiDisk) diskFor(id *types.ObjectID) (*disk.Disk, error) {
+	d, err := s.placedOn(id)
+	if err != nil || d.Healthy() {
+		return d, err
+	}
+
+	fallback := s.fallbackPlacement()
+	if fallback == nil {
+		return d, nil
+	}
+	addr, err := fallback.Get(id.StrHash())
+	if err != nil {
+		return nil, err
+	}
+	return s.disks[addr.Hostname], nil
+}
+
+// diskForWrite returns the disk on which the object should be written and
+// remembers it when that is not the disk the object is placed on.
+func (s *MultiDisk) diskForWrite(id *types.ObjectID) (*disk.Disk, error) {
+	addr, err := s.placement.Get(id.StrHash())
+	if err != nil {
+		return nil, err
+	}
+	d, err := s.diskFor(id)
+	if err != nil || d == s.disks[addr.Hostname] {
+		return d, err
+	}
+
+	s.copiesLock.Lock()
+	defer s.copiesLock.Unlock()
+	var path = addr.Hostname
+	if s.copies[path] == nil {
+		s.copies[path] = make(map[types.ObjectIDHash]*types.ObjectID)
+	}
+	s.copies[path][id.Hash()] = id
+	return d, nil
+}
+
+// diskHealthChanged discards the objects which were written to the other disks
+// while the disk at path was degraded. They would not be found on them any
+// more and the copies on the disk itself may be stale.
+func (s *MultiDisk) diskHealthChanged(path string, healthy bool) {
+	if !healthy {
+		return
+	}
+	s.copiesLock.Lock()
+	copies, removed := s.copies[path], s.removed
+	delete(s.copies, path)
+	s.copiesLock.Unlock()
+
+	for _, id := range copies {
+		for diskPath, d := range s.disks {
+			parts, err := d.GetAvailableParts(id)
+			if os.IsNotExist(err) {
+				continue
+			}
+			s.GetLogger().Debugf("[MultiDiskStorage] Discarding fallback copy of %s from %s",
+				id, diskPath)
+			if err := d.Discard(id); err != nil && !os.IsNotExist(err) {
+				s.GetLogger().Errorf("[MultiDiskStorage] Error discarding fallback copy of %s from %s: %s",
+					id, diskPath, err)
+				continue
+			}
+			if removed != nil && len(parts) > 0 {
+				removed(parts...)
+			}
+		}
+	}
+}
+
+// fallbackPlacement returns a placement over the currently healthy disks or
+// nil if none of them is healthy. It is rebuilt whenever their health changes.
+func (s *MultiDisk) fallbackPlacement() types.UpstreamBalancingAlgorithm {
+	s.fallbackLock.Lock()
+	defer s.fallbackLock.Unlock()
+
+	var changed = s.fallback == nil
+	var healthy = make([]bool, len(s.paths))
+	var addresses = make([]*types.UpstreamAddress, 0, len(s.paths))
+	for i, path := range s.paths {
+		healthy[i] = s.disks[path].Healthy()
+		if healthy[i] {
+			addresses = append(addresses, s.addresses[i])
+		}
+		changed = changed || healthy[i] != s.fallbackHealthy[i]
+	}
+	if len(addresses) == 0 {
+		return nil
+	}
+	if changed {
+		s.fallback = s.newPlacement()
+		s.fallback.Set(addresses)
+		s.fallbackHealthy = healthy
+	}
+	return s.fallback
+}
+
+// New returns a new multi-disk storage that ready for use. Every one of the
+// zone's paths gets its own disk storage with the rest of the zone settings.
+func New(cfg *config.CacheZone, log types.Logger) (*MultiDisk, error) {
+	if cfg == nil || log == nil {
+		return nil, fmt.Errorf("nil constructor parameters")
+	}
+
+	if len(cfg.Paths) == 0 {
+		return nil, fmt.Errorf("multidisk storage needs paths")
+	}
+
+	var placementName = cfg.Placement
+	if placementName == "" {
+		placementName = DefaultPlacement
+	}
+	newPlacement, ok := weighted.Algorithms[placementName]
+	if !ok || !consistentPlacements[placementName] {
+		return nil, fmt.Errorf("invalid placement algorithm `%s`", placementName)
+	}
+
+	s := &MultiDisk{
+		partSize:     cfg.PartSize.Bytes(),
+		disks:        make(map[string]*disk.Disk, len(cfg.Paths)),
+		placement:    newPlacement(),
+		newPlacement: newPlacement,
+		copies:       make(map[string]map[types.ObjectIDHash]*types.ObjectID),
+	}
+	s.SyncLogger.SetLogger(log)
+
+	s.addresses = make([]*types.UpstreamAddress, 0, len(cfg.Paths))
+	for _, p := range cfg.Paths {
+		if _, ok := s.disks[p.Path]; ok {
+			return nil, fmt.Errorf("duplicated path `%s`", p.Path)
+		}
+		var diskCfg = *cfg
+		diskCfg.Path = p.Path
+		diskCfg.Paths = nil
+		d, err := disk.New(&diskCfg, log)
+		if err != nil {
+			return nil, fmt.Errorf("could not initialize the disk at `%s`: %s", p.Path, err)
+		}
+		var path = p.Path
+		d.SetHealthChangedFunc(func(healthy bool) { s.diskHealthChanged(path, healthy) })
+		s.disks[p.Path] = d
+		s.paths = append(s.paths, p.Path)
+
+		var weight = p.Weight
+		if weight == 0 {
+			weight = config.DefaultUpstreamWeight
+		}
+		// The balancing algorithms identify the addresses by their host
+		addr := &types.UpstreamAddress{Hostname: p.Path, Weight: weight}
+		addr.Host = p.Path
+		s.addresses = append(s.addresses, addr)
+	}
+	s.placement.Set(s.addresses)
+
+	return s, nil
+}
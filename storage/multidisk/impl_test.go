@@ -0,0 +1,328 @@
+package multidisk
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+const testObjects = 300
+
+func getTestPaths(t *testing.T, count int) ([]string, func()) {
+	var paths []string
+	var cleanups []func()
+	for i := 0; i < count; i++ {
+		path, cleanup := testutils.GetTestFolder(t)
+		paths = append(paths, path)
+		cleanups = append(cleanups, cleanup)
+	}
+	return paths, func() {
+		for _, cleanup := range cleanups {
+			cleanup()
+		}
+	}
+}
+
+func newTestMultiDisk(t *testing.T, placement string, paths []string, weights ...uint32) *MultiDisk {
+	var cfg = &config.CacheZone{PartSize: 10, Placement: placement}
+	for i, path := range paths {
+		cfg.Paths = append(cfg.Paths, config.CacheZonePath{Path: path, Weight: weights[i]})
+	}
+	s, err := New(cfg, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// breakDisk makes reading the metadata of the objects on the disk fail with an
+// I/O error by replacing it with links to an unmapped address of the memory of
+// the process.
+func breakDisk(t *testing.T, path string) {
+	const unreadable = "/proc/self/mem"
+	if _, err := os.Stat(unreadable); err != nil {
+		t.Skipf("Can not simulate I/O errors without %s: %s", unreadable, err)
+	}
+	err := filepath.Walk(path, func(file string, fi os.FileInfo, err error) error {
+		if err != nil || fi.Name() != "objID" {
+			return err
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		return os.Symlink(unreadable, file)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testObjectID(i int) *types.ObjectID {
+	return types.NewObjectID("test", fmt.Sprintf("/object/%d", i))
+}
+
+func saveTestObjects(t *testing.T, s *MultiDisk) {
+	for i := 0; i < testObjects; i++ {
+		id := testObjectID(i)
+		if err := s.SaveMetadata(&types.ObjectMetadata{ID: id}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.SavePart(&types.ObjectIndex{ObjID: id}, strings.NewReader("part")); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// countObjects returns how many of the test objects are on each of the disks.
+func countObjects(t *testing.T, s *MultiDisk) map[string]int {
+	var counts = make(map[string]int)
+	for path, d := range s.disks {
+		for i := 0; i < testObjects; i++ {
+			if _, err := d.GetMetadata(testObjectID(i)); err == nil {
+				counts[path]++
+			} else if !os.IsNotExist(err) {
+				t.Fatal(err)
+			}
+		}
+	}
+	return counts
+}
+
+func TestConstructor(t *testing.T) {
+	t.Parallel()
+	paths, cleanup := getTestPaths(t, 1)
+	defer cleanup()
+	var tests = []*config.CacheZone{
+		nil,
+		{PartSize: 10},
+		{PartSize: 10, Paths: []config.CacheZonePath{{Path: paths[0]}}, Placement: "random"},
+		{PartSize: 10, Paths: []config.CacheZonePath{{Path: paths[0]}}, Placement: "bogus"},
+		{PartSize: 10, Paths: []config.CacheZonePath{{Path: paths[0]}, {Path: paths[0]}}},
+		{PartSize: 10, Paths: []config.CacheZonePath{{Path: "/this/path/should/not/exist"}}},
+	}
+	for i, cfg := range tests {
+		if _, err := New(cfg, mock.NewLogger()); err == nil {
+			t.Errorf("Expected an error for config %d", i)
+		}
+	}
+}
+
+func TestObjectsAreSpreadByWeight(t *testing.T) {
+	t.Parallel()
+	for placement := range consistentPlacements {
+		paths, cleanup := getTestPaths(t, 2)
+		s := newTestMultiDisk(t, placement, paths, 1, 3)
+		saveTestObjects(t, s)
+
+		counts := countObjects(t, s)
+		if counts[paths[0]]+counts[paths[1]] != testObjects {
+			t.Errorf("[%s] Expected every object to be on exactly one disk: %v", placement, counts)
+		}
+		if counts[paths[0]] == 0 || counts[paths[0]] >= counts[paths[1]] {
+			t.Errorf("[%s] Expected the heavier disk to have more objects: %v", placement, counts)
+		}
+		for i := 0; i < testObjects; i++ {
+			if parts, err := s.GetAvailableParts(testObjectID(i)); err != nil || len(parts) != 1 {
+				t.Errorf("[%s] Expected the part of object %d with its metadata but got %v, %v",
+					placement, i, parts, err)
+			}
+		}
+		cleanup()
+	}
+}
+
+func TestRemovingADiskKeepsTheOtherObjects(t *testing.T) {
+	t.Parallel()
+	paths, cleanup := getTestPaths(t, 3)
+	defer cleanup()
+	s := newTestMultiDisk(t, "", paths, 1, 1, 1)
+	saveTestObjects(t, s)
+	before := countObjects(t, s)
+
+	// Without the last disk only its objects should be lost
+	s = newTestMultiDisk(t, "", paths[:2], 1, 1)
+	var found int
+	for i := 0; i < testObjects; i++ {
+		if _, err := s.GetMetadata(testObjectID(i)); err == nil {
+			found++
+		}
+	}
+	if expected := before[paths[0]] + before[paths[1]]; found != expected {
+		t.Errorf("Expected %d objects to be found but there were %d", expected, found)
+	}
+}
+
+func TestIterateDiscardsMisplacedObjects(t *testing.T) {
+	t.Parallel()
+	paths, cleanup := getTestPaths(t, 3)
+	defer cleanup()
+	s := newTestMultiDisk(t, "", paths[:2], 1, 1)
+	saveTestObjects(t, s)
+
+	// Adding a disk moves some of the objects to it
+	s = newTestMultiDisk(t, "", paths, 1, 1, 1)
+	var iterated int
+	if err := s.Iterate(func(obj *types.ObjectMetadata, parts ...*types.ObjectIndex) bool {
+		iterated++
+		if _, err := s.GetMetadata(obj.ID); err != nil {
+			t.Errorf("Iterated over object %s which can not be found: %s", obj.ID, err)
+		}
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	counts := countObjects(t, s)
+	if counts[paths[2]] != 0 || iterated != counts[paths[0]]+counts[paths[1]] {
+		t.Errorf("Expected only the correctly placed objects to be iterated over: %d, %v",
+			iterated, counts)
+	}
+	if iterated == 0 || iterated == testObjects {
+		t.Errorf("Expected some of the objects to be moved to the new disk but %d remained", iterated)
+	}
+
+	var count int
+	if err := s.Iterate(func(*types.ObjectMetadata, ...*types.ObjectIndex) bool {
+		count++
+		return false
+	}); err != nil || count != 1 {
+		t.Errorf("Expected the iteration to stop after 1 object but got %d, %v", count, err)
+	}
+}
+
+func TestDegradedDiskIsSkipped(t *testing.T) {
+	t.Parallel()
+	paths, cleanup := getTestPaths(t, 2)
+	defer cleanup()
+	saveTestObjects(t, newTestMultiDisk(t, "", paths, 1, 1))
+	var broken = paths[0]
+	breakDisk(t, broken)
+	// A new storage does not have the metadata cached, so it reads the disk
+	s := newTestMultiDisk(t, "", paths, 1, 1)
+
+	var failed int
+	for i := 0; i < testObjects; i++ {
+		if _, err := s.GetMetadata(testObjectID(i)); err != nil {
+			failed++
+		}
+	}
+	if failed == 0 {
+		t.Fatal("Expected some of the reads to fail before the disk is degraded")
+	}
+	if s.disks[broken].Healthy() {
+		t.Fatal("Expected the broken disk to be degraded")
+	}
+	if !s.Healthy() {
+		t.Error("Expected the storage to be healthy while one of the disks works")
+	}
+
+	for i := 0; i < testObjects; i++ {
+		id := testObjectID(i)
+		if err := s.SaveMetadata(&types.ObjectMetadata{ID: id}); err != nil {
+			t.Fatalf("Unexpected error after the disk was degraded: %s", err)
+		}
+		if _, err := s.GetMetadata(id); err != nil {
+			t.Errorf("Could not get the metadata of %s: %s", id, err)
+		}
+	}
+}
+
+func TestFallbackCopiesAreDiscardedOnRecovery(t *testing.T) {
+	t.Parallel()
+	paths, cleanup := getTestPaths(t, 2)
+	defer cleanup()
+	var broken = paths[0]
+	var unrelated = newTestMultiDisk(t, "", paths, 1, 1)
+	for i := 0; i < testObjects; i++ {
+		if err := unrelated.SaveMetadata(&types.ObjectMetadata{ID: testObjectID(-i - 1)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	breakDisk(t, broken)
+
+	s := newTestMultiDisk(t, "", paths, 1, 1)
+	var removed = make(map[types.ObjectIDHash]int)
+	s.SetRemovedFunc(func(parts ...*types.ObjectIndex) {
+		for _, part := range parts {
+			removed[part.ObjID.Hash()]++
+		}
+	})
+	var working = s.disks[paths[1]]
+	for i := 0; i < testObjects && s.disks[broken].Healthy(); i++ {
+		_, _ = s.disks[broken].GetMetadata(testObjectID(-i - 1))
+	}
+	if s.disks[broken].Healthy() {
+		t.Fatal("Expected the broken disk to be degraded")
+	}
+	saveTestObjects(t, s)
+
+	var copies int
+	for i := 0; i < testObjects; i++ {
+		id := testObjectID(i)
+		if d, _ := s.placedOn(id); d == s.disks[broken] {
+			copies++
+		}
+		if _, err := working.GetMetadata(id); err != nil {
+			t.Fatalf("Expected %s on the working disk: %s", id, err)
+		}
+	}
+	if copies == 0 {
+		t.Fatal("Expected some of the objects to be placed on the broken disk")
+	}
+
+	// The disk is replaced with an empty one
+	if err := os.RemoveAll(broken); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Mkdir(broken, 0700); err != nil {
+		t.Fatal(err)
+	}
+	s.diskHealthChanged(broken, true)
+
+	if got := countObjects(t, s)[paths[1]]; got != testObjects-copies {
+		t.Errorf("Expected %d objects on the working disk after the recovery, got %d",
+			testObjects-copies, got)
+	}
+	if len(removed) != copies {
+		t.Errorf("Expected the parts of %d objects to be reported removed, got %d",
+			copies, len(removed))
+	}
+	for i := 0; i < testObjects; i++ {
+		id := testObjectID(i)
+		if d, _ := s.placedOn(id); d == working {
+			if _, ok := removed[id.Hash()]; ok {
+				t.Errorf("Object %s placed on the working disk was reported removed", id)
+			}
+		}
+	}
+}
+
+func TestScrubAllDisks(t *testing.T) {
+	t.Parallel()
+	paths, cleanup := getTestPaths(t, 3)
+	defer cleanup()
+	s := newTestMultiDisk(t, "", paths, 1, 1, 1)
+	saveTestObjects(t, s)
+
+	if err := s.Scrub(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	p := s.ScrubProgress()
+	if p.Running || p.Finished.IsZero() || p.Started.After(p.Finished) {
+		t.Errorf("Unexpected scrub times %+v", p)
+	}
+	if p.ObjectsChecked != testObjects || p.RemovedObjects != 0 || p.RepairedObjects != 0 {
+		t.Errorf("Expected all %d objects to be checked and kept but got %+v", testObjects, p)
+	}
+	if p.DirsChecked != p.DirsTotal {
+		t.Errorf("Expected all the directories to be checked but got %+v", p)
+	}
+}
@@ -156,8 +156,11 @@ func (em *Scheduler) expiresHandler() {
 			if nextExpire == nil {
 				continue
 			}
-			em.deleteRequest <- nextExpire.Key
-			delete(expiresDict, nextExpire.Key)
+			// The event may have been rescheduled since this entry was added
+			if expiresDict[nextExpire.Key].Equal(nextExpire.Expires) {
+				em.deleteRequest <- nextExpire.Key
+				delete(expiresDict, nextExpire.Key)
+			}
 
 			heap.Remove(expires, 0)
 		}
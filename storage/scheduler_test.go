@@ -72,6 +72,22 @@ func TestMultipleSetsOnTheSameKey(t *testing.T) {
 	}
 }
 
+func TestReschedulingLaterOnTheSameKey(t *testing.T) {
+	t.Parallel()
+	logger := mock.NewLogger()
+	mp := NewScheduler(logger)
+	defer mp.Destroy()
+	var expected = "later"
+
+	ch := make(chan string)
+	mp.AddEvent(fooKey, writeFunc(ch, "sooner"), 100*time.Millisecond)
+	mp.AddEvent(fooKey, writeFunc(ch, expected), 300*time.Millisecond)
+
+	if got := waitAround(t, ch, 300*time.Millisecond); got != expected {
+		t.Errorf("expected '%s' got '%s'", expected, got)
+	}
+}
+
 func waitAround(t *testing.T, ch chan string, around time.Duration) string {
 	var tooSoon = true
 	for {
@@ -0,0 +1,272 @@
+// Package tiered implements a storage which keeps the most used parts in RAM
+// in front of a disk storage.
+package tiered
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/storage/disk"
+	"github.com/ironsmile/nedomi/storage/memory"
+	"github.com/ironsmile/nedomi/types"
+)
+
+// How many times a part has to be promoted by the cache algorithm before it is
+// copied to the memory tier.
+const promotionThreshold = 2
+
+// Tiered implements the Storage interface with a memory tier over a disk one.
+// All data is written to the disk. Parts which are promoted often by the cache
+// algorithm are copied to the memory tier when they are read. When there is
+// no room in the memory for a newly promoted part, the least recently promoted
+// ones are demoted, which removes them only from the memory tier.
+type Tiered struct {
+	*disk.Disk
+	memory *memory.Memory
+
+	mu sync.Mutex
+	// How many times each part which is not in memory has been promoted
+	promotions map[types.ObjectIndexHash]uint32
+	// The parts in the memory tier. The most recently promoted are in front.
+	inMemory       *list.List
+	inMemoryLookup map[types.ObjectIndexHash]*list.Element
+	maxTracked     int
+	// changes are incremented whenever the objects whose hashes start with
+	// their index are saved or discarded. A part read from the disk is moved
+	// to memory only if its object did not change while it was read.
+	changes [256]uint64
+
+	memoryHits uint64
+	diskReads  uint64
+}
+
+// GetPart returns the part from the first tier which has it. If the part from
+// the disk is hot enough, it is copied to the memory tier.
+func (s *Tiered) GetPart(idx *types.ObjectIndex) (io.ReadCloser, error) {
+	if r, err := s.memory.GetPart(idx); err == nil {
+		s.mu.Lock()
+		s.memoryHits++
+		s.mu.Unlock()
+		return r, nil
+	}
+
+	s.mu.Lock()
+	s.diskReads++
+	var promote = s.promotions[idx.Hash()] >= promotionThreshold
+	var generation = s.changes[idx.ObjID.Hash()[0]]
+	s.mu.Unlock()
+	r, err := s.Disk.GetPart(idx)
+	if err != nil || !promote {
+		return r, err
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if closeErr := r.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	s.moveToMemory(idx, data, generation)
+	return ioutil.NopCloser(bytes.NewReader(data)), nil
+}
+
+// PromotePart implements types.PartPromoter. It counts the promotions of the
+// parts which are only on the disk and marks the ones in memory as recently
+// used.
+func (s *Tiered) PromotePart(idx *types.ObjectIndex) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var hash = idx.Hash()
+	if el, ok := s.inMemoryLookup[hash]; ok {
+		s.inMemory.MoveToFront(el)
+		return
+	}
+	if _, ok := s.promotions[hash]; !ok && len(s.promotions) >= s.maxTracked {
+		s.agePromotions()
+	}
+	s.promotions[hash]++
+}
+
+// SavePart writes the part to the disk. A previous version of the part is
+// removed from the memory tier, also if it was moved there while saving.
+func (s *Tiered) SavePart(idx *types.ObjectIndex, data io.Reader) error {
+	s.removeFromMemory(idx)
+	defer s.removeFromMemory(idx)
+	return s.Disk.SavePart(idx, data)
+}
+
+// Discard removes the object from both tiers.
+func (s *Tiered) Discard(id *types.ObjectID) error {
+	s.discardFromMemory(id)
+	defer s.discardFromMemory(id)
+	return s.Disk.Discard(id)
+}
+
+// discardFromMemory removes the parts of the object from the memory tier.
+func (s *Tiered) discardFromMemory(id *types.ObjectID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.changes[id.Hash()[0]]++
+	parts, _ := s.memory.GetAvailableParts(id)
+	for _, idx := range parts {
+		if el, ok := s.inMemoryLookup[idx.Hash()]; ok {
+			s.inMemory.Remove(el)
+			delete(s.inMemoryLookup, idx.Hash())
+		}
+	}
+	if err := s.memory.Discard(id); err != nil && !os.IsNotExist(err) {
+		s.GetLogger().Errorf("[TieredStorage] Error discarding %s from memory: %s", id, err)
+	}
+}
+
+// DiscardPart removes the part from both tiers.
+func (s *Tiered) DiscardPart(idx *types.ObjectIndex) error {
+	s.forget(idx)
+	defer s.forget(idx)
+	return s.Disk.DiscardPart(idx)
+}
+
+// SetRemovedFunc implements types.RemovalNotifier. The parts which the disk
+// removes on its own, for example because they do not match their checksums,
+// are removed from the memory tier as well before they are reported.
+func (s *Tiered) SetRemovedFunc(removed func(...*types.ObjectIndex)) {
+	s.Disk.SetRemovedFunc(func(parts ...*types.ObjectIndex) {
+		for _, idx := range parts {
+			s.forget(idx)
+		}
+		if removed != nil {
+			removed(parts...)
+		}
+	})
+}
+
+// forget removes the part from the memory tier and its promotions.
+func (s *Tiered) forget(idx *types.ObjectIndex) {
+	s.removeFromMemory(idx)
+	s.mu.Lock()
+	delete(s.promotions, idx.Hash())
+	s.mu.Unlock()
+}
+
+// SetLogger changes the Logger of both tiers.
+func (s *Tiered) SetLogger(logger types.Logger) {
+	s.Disk.SetLogger(logger)
+	s.memory.SetLogger(logger)
+}
+
+// Stats returns how many parts were read from the memory tier and from the disk.
+func (s *Tiered) Stats() (memoryHits, diskReads uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.memoryHits, s.diskReads
+}
+
+// moveToMemory saves the part in the memory tier, demoting as many of the
+// least recently promoted parts as needed to make room for it. The part is not
+// saved if its object was changed since the generation was taken, because the
+// data may be outdated.
+func (s *Tiered) moveToMemory(idx *types.ObjectIndex, data []byte, generation uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var hash = idx.Hash()
+	if _, ok := s.inMemoryLookup[hash]; ok || s.changes[idx.ObjID.Hash()[0]] != generation {
+		return
+	}
+
+	for {
+		err := s.memory.SavePart(idx, bytes.NewReader(data))
+		if err == nil {
+			break
+		} else if err != memory.ErrNotEnoughMemory || s.inMemory.Len() == 0 {
+			s.GetLogger().Errorf("[TieredStorage] Could not move %s to memory: %s", idx, err)
+			return
+		}
+		s.demote(s.inMemory.Back())
+	}
+
+	s.GetLogger().Debugf("[TieredStorage] Moved %s to memory", idx)
+	delete(s.promotions, hash)
+	s.inMemoryLookup[hash] = s.inMemory.PushFront(*idx)
+}
+
+// demote removes the part in the list element from the memory tier. It must
+// be called with the lock held.
+func (s *Tiered) demote(el *list.Element) {
+	idx := s.inMemory.Remove(el).(types.ObjectIndex)
+	delete(s.inMemoryLookup, idx.Hash())
+	s.GetLogger().Debugf("[TieredStorage] Demoting %s to disk", &idx)
+	if err := s.memory.DiscardPart(&idx); err != nil && !os.IsNotExist(err) {
+		s.GetLogger().Errorf("[TieredStorage] Error demoting %s: %s", &idx, err)
+	}
+}
+
+func (s *Tiered) removeFromMemory(idx *types.ObjectIndex) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.changes[idx.ObjID.Hash()[0]]++
+	if el, ok := s.inMemoryLookup[idx.Hash()]; ok {
+		s.demote(el)
+	}
+}
+
+// agePromotions halves the promotion counts and forgets the parts which were
+// promoted only once. This way the tracked parts are bounded and only the
+// recently hot parts get to the memory tier. It must be called with the lock
+// held.
+func (s *Tiered) agePromotions() {
+	for hash, count := range s.promotions {
+		if count /= 2; count == 0 {
+			delete(s.promotions, hash)
+		} else {
+			s.promotions[hash] = count
+		}
+	}
+}
+
+// New returns a new tiered storage that ready for use. The disk tier uses the
+// whole zone configuration and the memory tier is limited by memory_tier_size.
+func New(cfg *config.CacheZone, log types.Logger) (*Tiered, error) {
+	if cfg == nil || log == nil {
+		return nil, fmt.Errorf("nil constructor parameters")
+	}
+
+	if cfg.MemoryTierSize == 0 {
+		return nil, fmt.Errorf("tiered storage needs memory_tier_size")
+	}
+
+	d, err := disk.New(cfg, log)
+	if err != nil {
+		return nil, err
+	}
+	m, err := memory.New(&config.CacheZone{
+		PartSize: cfg.PartSize,
+		MaxSize:  cfg.MemoryTierSize,
+	}, log)
+	if err != nil {
+		return nil, err
+	}
+
+	// Track the promotions for a few times more parts than the memory can hold
+	var maxTracked = 4 * int(cfg.MemoryTierSize.Bytes()/cfg.PartSize.Bytes())
+	if maxTracked < 1024 {
+		maxTracked = 1024
+	}
+
+	s := &Tiered{
+		Disk:           d,
+		memory:         m,
+		promotions:     make(map[types.ObjectIndexHash]uint32),
+		inMemory:       list.New(),
+		inMemoryLookup: make(map[types.ObjectIndexHash]*list.Element),
+		maxTracked:     maxTracked,
+	}
+	s.SetRemovedFunc(nil)
+	return s, nil
+}
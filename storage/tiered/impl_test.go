@@ -0,0 +1,253 @@
+package tiered
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+	"github.com/ironsmile/nedomi/utils/testutils"
+)
+
+var id = types.NewObjectID("key", "/path")
+
+func idx(part uint32) *types.ObjectIndex {
+	return &types.ObjectIndex{ObjID: id, Part: part}
+}
+
+func newTestTiered(t *testing.T, memoryParts int) (*Tiered, func()) {
+	s, _, cleanup := newTestTieredWithPath(t, memoryParts)
+	return s, cleanup
+}
+
+func newTestTieredWithPath(t *testing.T, memoryParts int) (*Tiered, string, func()) {
+	path, cleanup := testutils.GetTestFolder(t)
+	s, err := New(&config.CacheZone{
+		ID:             "test",
+		Path:           path,
+		PartSize:       5,
+		StorageObjects: 100,
+		MemoryTierSize: types.BytesSize(5 * memoryParts),
+	}, mock.NewLogger())
+	if err != nil {
+		cleanup()
+		t.Fatal(err)
+	}
+	return s, path, cleanup
+}
+
+func readPart(t *testing.T, s *Tiered, idx *types.ObjectIndex, expected string) {
+	r, err := s.GetPart(idx)
+	if err != nil {
+		t.Fatalf("Could not get %s: %s", idx, err)
+	}
+	defer r.Close()
+	if data, err := ioutil.ReadAll(r); err != nil || string(data) != expected {
+		t.Errorf("Expected %s for %s but got %s, %v", expected, idx, data, err)
+	}
+}
+
+func savePart(t *testing.T, s *Tiered, idx *types.ObjectIndex, data string) {
+	if err := s.SavePart(idx, strings.NewReader(data)); err != nil {
+		t.Fatalf("Could not save %s: %s", idx, err)
+	}
+}
+
+// use simulates a read of the part by the cache handler
+func use(t *testing.T, s *Tiered, idx *types.ObjectIndex, expected string) {
+	readPart(t, s, idx, expected)
+	s.PromotePart(idx)
+}
+
+func inMemory(s *Tiered, idx *types.ObjectIndex) bool {
+	_, err := s.memory.GetPart(idx)
+	return err == nil
+}
+
+func TestConstructor(t *testing.T) {
+	t.Parallel()
+	path, cleanup := testutils.GetTestFolder(t)
+	defer cleanup()
+	if _, err := New(nil, mock.NewLogger()); err == nil {
+		t.Error("Expected an error with a nil config")
+	}
+	if _, err := New(&config.CacheZone{Path: path, PartSize: 5}, mock.NewLogger()); err == nil {
+		t.Error("Expected an error without memory_tier_size")
+	}
+}
+
+func TestHotPartsArePromoted(t *testing.T) {
+	t.Parallel()
+	s, cleanup := newTestTiered(t, 2)
+	defer cleanup()
+	savePart(t, s, idx(0), "01234")
+
+	for i := 0; i < promotionThreshold; i++ {
+		if inMemory(s, idx(0)) {
+			t.Fatalf("The part is in memory after %d promotions", i)
+		}
+		use(t, s, idx(0), "01234")
+	}
+	use(t, s, idx(0), "01234")
+	if !inMemory(s, idx(0)) {
+		t.Fatal("Expected the hot part to be in memory")
+	}
+	use(t, s, idx(0), "01234")
+	if memoryHits, diskReads := s.Stats(); memoryHits != 1 || diskReads != promotionThreshold+1 {
+		t.Errorf("Unexpected stats: %d memory hits and %d disk reads", memoryHits, diskReads)
+	}
+
+	// The part must still be on the disk
+	r, err := s.Disk.GetPart(idx(0))
+	if err != nil {
+		t.Fatalf("Expected the part to be on the disk: %s", err)
+	}
+	r.Close()
+}
+
+func TestColdPartsAreDemoted(t *testing.T) {
+	t.Parallel()
+	s, cleanup := newTestTiered(t, 2)
+	defer cleanup()
+	var contents = []string{"aaaaa", "bbbbb", "ccccc"}
+	for part, data := range contents {
+		savePart(t, s, idx(uint32(part)), data)
+		for i := 0; i <= promotionThreshold; i++ {
+			use(t, s, idx(uint32(part)), data)
+		}
+		if part == 1 {
+			// part 0 is used again, so part 1 is the least recently promoted
+			use(t, s, idx(0), contents[0])
+		}
+	}
+
+	if !inMemory(s, idx(0)) || inMemory(s, idx(1)) || !inMemory(s, idx(2)) {
+		t.Errorf("Expected only part 1 to be demoted: %t %t %t",
+			inMemory(s, idx(0)), inMemory(s, idx(1)), inMemory(s, idx(2)))
+	}
+	readPart(t, s, idx(1), contents[1])
+}
+
+func TestDiscardingFromBothTiers(t *testing.T) {
+	t.Parallel()
+	s, cleanup := newTestTiered(t, 4)
+	defer cleanup()
+	if err := s.SaveMetadata(&types.ObjectMetadata{ID: id}); err != nil {
+		t.Fatal(err)
+	}
+	for part := uint32(0); part < 3; part++ {
+		savePart(t, s, idx(part), "01234")
+		for i := 0; i <= promotionThreshold; i++ {
+			use(t, s, idx(part), "01234")
+		}
+	}
+
+	// Saving a part again replaces the one in memory
+	savePart(t, s, idx(2), "56789")
+	readPart(t, s, idx(2), "56789")
+
+	if err := s.DiscardPart(idx(0)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetPart(idx(0)); !os.IsNotExist(err) {
+		t.Errorf("Expected the discarded part to be missing but got %v", err)
+	}
+
+	if err := s.Discard(id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetPart(idx(1)); !os.IsNotExist(err) {
+		t.Errorf("Expected the discarded object to be missing but got %v", err)
+	}
+	if s.inMemory.Len() != 0 || len(s.inMemoryLookup) != 0 {
+		t.Errorf("Expected no parts in memory but there are %d", s.inMemory.Len())
+	}
+}
+
+func TestDiscardedPartsAreNotMovedToMemory(t *testing.T) {
+	t.Parallel()
+	s, cleanup := newTestTiered(t, 4)
+	defer cleanup()
+	savePart(t, s, idx(0), "01234")
+
+	// A part which is read while its object is discarded
+	var generation = s.changes[id.Hash()[0]]
+	if err := s.Discard(id); err != nil {
+		t.Fatal(err)
+	}
+	s.moveToMemory(idx(0), []byte("01234"), generation)
+	if inMemory(s, idx(0)) {
+		t.Error("Expected the part of the discarded object not to be moved to memory")
+	}
+
+	savePart(t, s, idx(0), "56789")
+	s.moveToMemory(idx(0), []byte("56789"), s.changes[id.Hash()[0]])
+	if !inMemory(s, idx(0)) {
+		t.Error("Expected the part to be moved to memory when its object did not change")
+	}
+}
+
+func TestPromotionsAreBounded(t *testing.T) {
+	t.Parallel()
+	s, cleanup := newTestTiered(t, 1)
+	defer cleanup()
+	for part := 0; part < 3*s.maxTracked; part++ {
+		s.PromotePart(idx(uint32(part)))
+	}
+	if len(s.promotions) > s.maxTracked {
+		t.Errorf("Expected at most %d tracked parts but there are %d", s.maxTracked, len(s.promotions))
+	}
+}
+
+func TestPartsRemovedByTheDisk(t *testing.T) {
+	t.Parallel()
+	s, path, cleanup := newTestTieredWithPath(t, 2)
+	defer cleanup()
+	var removed []*types.ObjectIndex
+	s.SetRemovedFunc(func(parts ...*types.ObjectIndex) {
+		removed = append(removed, parts...)
+	})
+	if err := s.SaveMetadata(&types.ObjectMetadata{ID: id, Size: 10}); err != nil {
+		t.Fatal(err)
+	}
+	savePart(t, s, idx(0), "aaaaa")
+	savePart(t, s, idx(1), "bbbbb")
+	for i := 0; i <= promotionThreshold; i++ {
+		use(t, s, idx(0), "aaaaa")
+	}
+	if !inMemory(s, idx(0)) {
+		t.Fatal("Expected the hot part to be in memory")
+	}
+
+	// Tear the part on the disk, so that the scrubber discards it
+	err := filepath.Walk(path, func(path string, fi os.FileInfo, err error) error {
+		if err != nil || fi.IsDir() {
+			return err
+		}
+		if data, err := ioutil.ReadFile(path); err == nil && string(data) == "aaaaa" {
+			return ioutil.WriteFile(path, []byte("aa"), 0600)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Scrub(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if inMemory(s, idx(0)) {
+		t.Error("Expected the part discarded by the disk to be removed from memory")
+	}
+	if _, err := s.GetPart(idx(0)); !os.IsNotExist(err) {
+		t.Errorf("Expected the discarded part to be missing but got %v", err)
+	}
+	if len(removed) != 1 || removed[0].Part != 0 {
+		t.Errorf("Expected the discarded part to be reported but got %v", removed)
+	}
+}
@@ -1,6 +1,10 @@
 package storage
 
-import "github.com/ironsmile/nedomi/types"
+import (
+	"os"
+
+	"github.com/ironsmile/nedomi/types"
+)
 
 // GetExpirationHandler returns a potentially long-lived callback that removes
 // the specified object from the storage.
@@ -9,8 +13,10 @@ func GetExpirationHandler(cz *types.CacheZone, id *types.ObjectID) func(types.Lo
 		//!TODO: simplify and ignore the cache algorithm when expiring objects.
 		// It is only supposed to take into account client interest in the
 		// object parts, not whether they are expired due to upstream timeouts
+		// The object may have already been evicted as a whole by the cache
+		// algorithm, so it is not an error if it is missing.
 		parts, err := cz.Storage.GetAvailableParts(id)
-		if err != nil {
+		if err != nil && !os.IsNotExist(err) {
 			logger.Errorf("Error while removing expired object %s from zone %s: %s", id, cz.ID, err)
 		}
 
@@ -18,7 +24,9 @@ func GetExpirationHandler(cz *types.CacheZone, id *types.ObjectID) func(types.Lo
 
 		//!TODO: make head request to upstream and possibly postpone the
 		// removal, if nothing has changed in the file
-		if err := cz.Storage.Discard(id); err != nil {
+		if err := cz.Storage.Discard(id); err == nil {
+			cz.Traffic.Expired()
+		} else if !os.IsNotExist(err) {
 			logger.Errorf("Error while discarding expired object %s from zone %s: %s", id, cz.ID, err)
 		}
 	}
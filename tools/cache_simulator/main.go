@@ -0,0 +1,147 @@
+// This program replays request logs against the cache algorithms and reports
+// how well each of them would do with the given part size and number of parts.
+// It does not use a storage, so it can be used for sizing cache zones and
+// choosing their algorithms without changing the production configs.
+//
+// It reads nedomi access logs or generic traces in which every line contains an
+// URL followed by an inclusive byte range like `0-1048575` or by the size of
+// the object when all of it was requested:
+//
+//	go run tools/cache_simulator/*.go -part-size 2m -storage-objects 100000 access.log
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/ironsmile/nedomi/cache"
+	"github.com/ironsmile/nedomi/cache/trace"
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/logger"
+	"github.com/ironsmile/nedomi/types"
+)
+
+var (
+	format         string
+	algorithms     string
+	partSize       string
+	storageObjects uint64
+	maxSize        string
+	includeQuery   bool
+)
+
+func init() {
+	flag.StringVar(&format, "format", "log",
+		"The format of the input. `log` for nedomi access logs or `trace` for URL and byte range traces")
+	flag.StringVar(&algorithms, "algorithms", "lru,tinylfu,arc",
+		"A comma separated list of the cache algorithms which will be simulated")
+	flag.StringVar(&partSize, "part-size", "2m", "The part_size of the simulated cache zone")
+	flag.Uint64Var(&storageObjects, "storage-objects", 0,
+		"The storage_objects of the simulated cache zone")
+	flag.StringVar(&maxSize, "max-size", "",
+		"The max_size of the simulated cache zone. It is used when -storage-objects is not given")
+	flag.BoolVar(&includeQuery, "include-query", false,
+		"Whether the query is part of the cache key, like cache_key_includes_query")
+}
+
+func main() {
+	flag.Parse()
+
+	cz, err := cacheZone()
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	requests, err := readAll(flag.Args())
+	if err != nil {
+		log.Fatalln("Error reading the requests:", err)
+	}
+
+	l, err := logger.New(config.NewLogger("nillogger", nil))
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	var w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(w, "algorithm\trequests\tparts\thit ratio\tbyte hit ratio\tupstream bytes\t")
+	for _, algorithm := range strings.Split(algorithms, ",") {
+		var algorithmCz = *cz
+		algorithmCz.Algorithm = strings.TrimSpace(algorithm)
+		ca, err := cache.New(&algorithmCz, func(*types.ObjectIndex) error { return nil }, l)
+		if err != nil {
+			log.Fatalln(err)
+		}
+
+		res := simulate(ca, algorithmCz.PartSize.Bytes(), requests)
+		fmt.Fprintf(w, "%s\t%d\t%d\t%.2f%%\t%.2f%%\t%d\t\n", algorithmCz.Algorithm,
+			res.requests, res.parts, res.hitRatio(), res.byteHitRatio(), res.upstreamBytes)
+	}
+	if err := w.Flush(); err != nil {
+		log.Fatalln(err)
+	}
+}
+
+// cacheZone returns the config of the simulated cache zone.
+func cacheZone() (*config.CacheZone, error) {
+	var cz = &config.CacheZone{ID: "simulated", StorageObjects: storageObjects}
+
+	var err error
+	if cz.PartSize, err = types.BytesSizeFromString(partSize); err != nil {
+		return nil, fmt.Errorf("Invalid -part-size: %s", err)
+	} else if cz.PartSize == 0 {
+		return nil, fmt.Errorf("The -part-size can not be 0")
+	}
+
+	if maxSize != "" {
+		if cz.MaxSize, err = types.BytesSizeFromString(maxSize); err != nil {
+			return nil, fmt.Errorf("Invalid -max-size: %s", err)
+		}
+	}
+	if cz.ObjectsLimit() == 0 {
+		return nil, fmt.Errorf("Either -storage-objects or -max-size is required. See -h.")
+	}
+	return cz, nil
+}
+
+// readAll reads the requests from all the files or from the standard input if
+// there are none.
+func readAll(files []string) ([]*trace.Request, error) {
+	var p = trace.NewParser(includeQuery)
+	var parse func(string) (*trace.Request, error)
+	switch format {
+	case "log":
+		parse = p.ParseLogLine
+	case "trace":
+		parse = p.ParseTraceLine
+	default:
+		return nil, fmt.Errorf("unknown format %s", format)
+	}
+
+	if len(files) == 0 {
+		return trace.Read(os.Stdin, "stdin", parse)
+	}
+
+	var requests []*trace.Request
+	for _, file := range files {
+		fileRequests, err := readFile(file, parse)
+		if err != nil {
+			return nil, err
+		}
+		requests = append(requests, fileRequests...)
+	}
+	return requests, nil
+}
+
+func readFile(file string, parse func(string) (*trace.Request, error)) ([]*trace.Request, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	return trace.Read(f, file, parse)
+}
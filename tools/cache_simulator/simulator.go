@@ -0,0 +1,86 @@
+package main
+
+// This file contains the replaying of the requests against a cache algorithm.
+
+import (
+	"github.com/ironsmile/nedomi/cache/trace"
+	"github.com/ironsmile/nedomi/types"
+)
+
+// result contains the statistics of a replayed trace.
+type result struct {
+	requests    uint64
+	parts       uint64
+	hits        uint64
+	bytes       uint64
+	cachedBytes uint64
+
+	// The bytes which would have been fetched from the upstream. Whole parts
+	// are fetched for the missing parts, like the cache handler does.
+	upstreamBytes uint64
+}
+
+// hitRatio returns the percent of the requested parts which were cached.
+func (r *result) hitRatio() float64 {
+	if r.parts == 0 {
+		return 0
+	}
+	return 100 * float64(r.hits) / float64(r.parts)
+}
+
+// byteHitRatio returns the percent of the requested bytes which were served
+// from the cache.
+func (r *result) byteHitRatio() float64 {
+	if r.bytes == 0 {
+		return 0
+	}
+	return 100 * float64(r.cachedBytes) / float64(r.bytes)
+}
+
+// simulate replays the requests against the cache algorithm making the same
+// calls to it as the cache handler.
+func simulate(ca types.CacheAlgorithm, partSize uint64, requests []*trace.Request) *result {
+	var res = &result{}
+	for _, req := range requests {
+		res.requests++
+		for part := req.First / partSize; part <= req.Last/partSize; part++ {
+			var partStart, partEnd = part * partSize, (part+1)*partSize - 1
+			if req.Size != 0 && partEnd >= req.Size {
+				partEnd = req.Size - 1
+			}
+			var served = min(partEnd, req.Last) - max(partStart, req.First) + 1
+
+			res.parts++
+			res.bytes += served
+
+			var idx = &types.ObjectIndex{ObjID: req.ID, Part: uint32(part)}
+			if ca.Lookup(idx) {
+				ca.PromoteObject(idx)
+				res.hits++
+				res.cachedBytes += served
+				continue
+			}
+
+			res.upstreamBytes += partEnd - partStart + 1
+			if ca.ShouldKeep(idx) {
+				// Most algorithms add the part in ShouldKeep already
+				_ = ca.AddObject(idx)
+			}
+		}
+	}
+	return res
+}
+
+func min(l, r uint64) uint64 {
+	if l > r {
+		return r
+	}
+	return l
+}
+
+func max(l, r uint64) uint64 {
+	if l < r {
+		return r
+	}
+	return l
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/ironsmile/nedomi/cache"
+	"github.com/ironsmile/nedomi/cache/trace"
+	"github.com/ironsmile/nedomi/config"
+	"github.com/ironsmile/nedomi/mock"
+	"github.com/ironsmile/nedomi/types"
+)
+
+func TestSimulate(t *testing.T) {
+	t.Parallel()
+	ca, err := cache.New(&config.CacheZone{StorageObjects: 100, PartSize: 10, Algorithm: "lru"},
+		func(*types.ObjectIndex) error { return nil }, mock.NewLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var id = types.NewObjectID("key", "/path")
+	var res = simulate(ca, 10, []*trace.Request{
+		{ID: id, First: 0, Last: 24, Size: 25},
+		{ID: id, First: 5, Last: 14},
+		{ID: id, First: 20, Last: 39},
+	})
+
+	if res.requests != 3 || res.parts != 7 {
+		t.Errorf("Expected 3 requests for 7 parts but got %d for %d", res.requests, res.parts)
+	}
+	if res.hits != 3 {
+		t.Errorf("Expected 3 part hits but got %d", res.hits)
+	}
+	// 25 bytes of the whole object, 10 of the second and 20 of the third
+	if res.bytes != 55 || res.cachedBytes != 20 {
+		t.Errorf("Expected 20 of the 55 bytes to be cached but got %d of %d", res.cachedBytes, res.bytes)
+	}
+	// The whole object and part 3 which is only in the third request
+	if res.upstreamBytes != 35 {
+		t.Errorf("Expected 35 upstream bytes but got %d", res.upstreamBytes)
+	}
+}
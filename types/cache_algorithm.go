@@ -1,6 +1,9 @@
 package types
 
-import "errors"
+import (
+	"errors"
+	"io"
+)
 
 // CacheAlgorithm interface defines how a cache should behave
 type CacheAlgorithm interface {
@@ -42,3 +45,31 @@ type CacheAlgorithm interface {
 var (
 	ErrAlreadyInCache = errors.New("Object already in cache")
 )
+
+// SpaceLimiter is implemented by cache algorithms which can keep the storage
+// of their zone within a space budget. After adding an object they evict the
+// least valuable parts until the storage takes at most maxSize bytes and at
+// least minFreeSpace bytes are free. Zero limits are not enforced.
+type SpaceLimiter interface {
+	SetSpaceLimits(usage UsageReporter, maxSize, minFreeSpace uint64)
+}
+
+// StateSnapshotter is implemented by cache algorithms which can save their
+// state, so that the order of the cached parts is not lost when the
+// application is restarted.
+type StateSnapshotter interface {
+	// SaveState writes the current state of the algorithm.
+	SaveState(w io.Writer) error
+
+	// LoadState replaces the state of the algorithm with the saved one and
+	// returns the restored parts. They are not checked against the storage,
+	// so the ones which are missing from it have to be removed afterwards.
+	LoadState(r io.Reader) ([]*ObjectIndex, error)
+}
+
+// ObjectRemover is implemented by cache algorithms which can evict whole
+// objects. They remove the evicted objects with the given function so that
+// their metadata does not stay in the storage.
+type ObjectRemover interface {
+	SetObjectRemoveFunc(func(*ObjectID) error)
+}
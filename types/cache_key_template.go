@@ -0,0 +1,213 @@
+package types
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// CacheKeyTemplate describes how the path of the ObjectID for a request is
+// built. It is parsed from a string in which literal text is mixed with
+// placeholders in curly braces:
+//
+//	{host}             - the requested host
+//	{path}             - the URL path
+//	{args}             - all query arguments, sorted by name
+//	{args:id,q}        - only the listed query arguments, sorted by name
+//	{args:-utm_*,-sig} - all query arguments without the listed ones
+//	{header:Name}      - the value of a request header
+//	{cookie:name}      - the value of a request cookie
+//
+// Argument names ending in `*` match every argument with that prefix. This
+// way tracking parameters and signed tokens can be dropped from the key.
+type CacheKeyTemplate struct {
+	template string
+	parts    []keyTemplatePart
+}
+
+// keyTemplatePart renders a single piece of the cache key.
+type keyTemplatePart func(req *http.Request, buf []byte) []byte
+
+// NewCacheKeyTemplate parses the template string and returns an error if it
+// is not valid.
+func NewCacheKeyTemplate(template string) (*CacheKeyTemplate, error) {
+	var t = &CacheKeyTemplate{template: template}
+	for remaining := template; remaining != ""; {
+		start := strings.IndexAny(remaining, "{}")
+		if start == -1 {
+			t.parts = append(t.parts, literalPart(remaining))
+			break
+		}
+		if remaining[start] == '}' {
+			return nil, fmt.Errorf("unexpected '}' in cache key template `%s`", template)
+		}
+		if start > 0 {
+			t.parts = append(t.parts, literalPart(remaining[:start]))
+		}
+		end := strings.IndexByte(remaining[start:], '}')
+		if end == -1 {
+			return nil, fmt.Errorf("unclosed '{' in cache key template `%s`", template)
+		}
+		part, err := placeholderPart(remaining[start+1 : start+end])
+		if err != nil {
+			return nil, fmt.Errorf("%s in cache key template `%s`", err, template)
+		}
+		t.parts = append(t.parts, part)
+		remaining = remaining[start+end+1:]
+	}
+
+	if len(t.parts) == 0 {
+		return nil, fmt.Errorf("empty cache key template")
+	}
+	return t, nil
+}
+
+// Execute returns the cache key path for the request. ObjectIDs can not have
+// empty paths, so the URL path of the request is used when all placeholders of
+// the template render empty values.
+func (t *CacheKeyTemplate) Execute(req *http.Request) string {
+	var buf []byte
+	for _, part := range t.parts {
+		buf = part(req, buf)
+	}
+	if len(buf) == 0 {
+		if req.URL.Path == "" {
+			return "/"
+		}
+		return req.URL.Path
+	}
+	return string(buf)
+}
+
+func (t *CacheKeyTemplate) String() string {
+	return t.template
+}
+
+// UnmarshalJSON parses the template from a JSON string.
+func (t *CacheKeyTemplate) UnmarshalJSON(buff []byte) error {
+	var template string
+	if err := json.Unmarshal(buff, &template); err != nil {
+		return err
+	}
+	parsed, err := NewCacheKeyTemplate(template)
+	if err != nil {
+		return err
+	}
+	*t = *parsed
+	return nil
+}
+
+// MarshalJSON encodes the template as a JSON string.
+func (t *CacheKeyTemplate) MarshalJSON() ([]byte, error) {
+	return json.Marshal(t.template)
+}
+
+func literalPart(literal string) keyTemplatePart {
+	return func(_ *http.Request, buf []byte) []byte {
+		return append(buf, literal...)
+	}
+}
+
+func placeholderPart(placeholder string) (keyTemplatePart, error) {
+	name, arg := placeholder, ""
+	if i := strings.IndexByte(placeholder, ':'); i != -1 {
+		name, arg = placeholder[:i], placeholder[i+1:]
+		if arg == "" {
+			return nil, fmt.Errorf("missing argument for {%s}", placeholder)
+		}
+	}
+
+	switch name {
+	case "host":
+		if arg != "" {
+			return nil, fmt.Errorf("{host} does not take arguments")
+		}
+		return hostPart, nil
+	case "path":
+		if arg != "" {
+			return nil, fmt.Errorf("{path} does not take arguments")
+		}
+		return pathPart, nil
+	case "args":
+		return argsPart(arg), nil
+	case "header":
+		if arg == "" {
+			return nil, fmt.Errorf("{header} requires a header name")
+		}
+		return headerPart(http.CanonicalHeaderKey(arg)), nil
+	case "cookie":
+		if arg == "" {
+			return nil, fmt.Errorf("{cookie} requires a cookie name")
+		}
+		return cookiePart(arg), nil
+	}
+	return nil, fmt.Errorf("unknown placeholder {%s}", placeholder)
+}
+
+func hostPart(req *http.Request, buf []byte) []byte {
+	if req.Host != "" {
+		return append(buf, req.Host...)
+	}
+	return append(buf, req.URL.Host...)
+}
+
+func pathPart(req *http.Request, buf []byte) []byte {
+	return append(buf, req.URL.Path...)
+}
+
+func headerPart(name string) keyTemplatePart {
+	return func(req *http.Request, buf []byte) []byte {
+		return append(buf, strings.Join(req.Header[name], ",")...)
+	}
+}
+
+func cookiePart(name string) keyTemplatePart {
+	return func(req *http.Request, buf []byte) []byte {
+		if cookie, err := req.Cookie(name); err == nil {
+			return append(buf, cookie.Value...)
+		}
+		return buf
+	}
+}
+
+// argsPart returns the query arguments selected by the comma separated list
+// of patterns. Patterns starting with `-` exclude the matching arguments. If
+// there are no including patterns every argument which is not excluded is used.
+func argsPart(list string) keyTemplatePart {
+	var included, excluded []string
+	for _, pattern := range strings.Split(list, ",") {
+		if pattern = strings.TrimSpace(pattern); pattern == "" {
+			continue
+		}
+		if strings.HasPrefix(pattern, "-") {
+			excluded = append(excluded, pattern[1:])
+		} else {
+			included = append(included, pattern)
+		}
+	}
+
+	return func(req *http.Request, buf []byte) []byte {
+		var args = req.URL.Query()
+		for name := range args {
+			if len(included) > 0 && !matchesAnyArg(included, name) || matchesAnyArg(excluded, name) {
+				delete(args, name)
+			}
+		}
+		// Encode sorts the arguments by name
+		return append(buf, args.Encode()...)
+	}
+}
+
+func matchesAnyArg(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(name, pattern[:len(pattern)-1]) {
+				return true
+			}
+		} else if pattern == name {
+			return true
+		}
+	}
+	return false
+}
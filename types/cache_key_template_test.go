@@ -0,0 +1,87 @@
+package types
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestCacheKeyTemplateExecute(t *testing.T) {
+	t.Parallel()
+	var tests = []struct {
+		template string
+		url      string
+		headers  map[string]string
+		expected string
+	}{
+		{"{path}", "http://example.com/a/b?c=d", nil, "/a/b"},
+		{"{host}{path}", "http://example.com/a/b?c=d", nil, "example.com/a/b"},
+		{"{path}?{args}", "http://example.com/a?z=1&a=2&m=3", nil, "/a?a=2&m=3&z=1"},
+		{"{path}?{args:id,q}", "http://example.com/a?q=1&token=2&id=3", nil, "/a?id=3&q=1"},
+		{"{path}?{args:-utm_*,-token}", "http://example.com/a?utm_source=x&utm_medium=y&token=1&page=2",
+			nil, "/a?page=2"},
+		{"{path}?{args:-utm_*,-token}", "http://example.com/a?page=2&token=3&utm_campaign=z",
+			nil, "/a?page=2"},
+		{"{path}?{args:id*,-idx}", "http://example.com/a?idx=1&id=2&id2=3&other=4", nil, "/a?id=2&id2=3"},
+		{"{path}|{header:x-variant}", "http://example.com/a", map[string]string{"X-Variant": "mobile"},
+			"/a|mobile"},
+		{"{path}|{cookie:lang}", "http://example.com/a", map[string]string{"Cookie": "a=b; lang=bg"},
+			"/a|bg"},
+		{"{path}|{cookie:lang}|{header:X-Missing}", "http://example.com/a", nil, "/a||"},
+		{"static", "http://example.com/a", nil, "static"},
+		{"{header:X-Missing}{cookie:lang}", "http://example.com/a/b?c=d", nil, "/a/b"},
+		{"{args:id}", "http://example.com", nil, "/"},
+	}
+
+	for _, test := range tests {
+		tmpl, err := NewCacheKeyTemplate(test.template)
+		if err != nil {
+			t.Errorf("Unexpected error for template `%s`: %s", test.template, err)
+			continue
+		}
+		req, err := http.NewRequest("GET", test.url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range test.headers {
+			req.Header.Set(key, value)
+		}
+		if got := tmpl.Execute(req); got != test.expected {
+			t.Errorf("Expected `%s` for template `%s` and url %s but got `%s`",
+				test.expected, test.template, test.url, got)
+		}
+	}
+}
+
+func TestCacheKeyTemplateErrors(t *testing.T) {
+	t.Parallel()
+	var invalid = []string{
+		"",
+		"{path",
+		"path}",
+		"{unknown}",
+		"{host:arg}",
+		"{path:}",
+		"{header}",
+		"{cookie}",
+	}
+	for _, template := range invalid {
+		if _, err := NewCacheKeyTemplate(template); err == nil {
+			t.Errorf("Expected an error for template `%s`", template)
+		}
+	}
+}
+
+func TestCacheKeyTemplateJSON(t *testing.T) {
+	t.Parallel()
+	var tmpl *CacheKeyTemplate
+	if err := json.Unmarshal([]byte(`"{host}{path}"`), &tmpl); err != nil {
+		t.Fatal(err)
+	}
+	if tmpl.String() != "{host}{path}" {
+		t.Errorf("Unexpected template %s", tmpl)
+	}
+	if err := json.Unmarshal([]byte(`"{path"`), &tmpl); err == nil {
+		t.Error("Expected an error for an invalid template")
+	}
+}
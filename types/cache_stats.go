@@ -2,6 +2,11 @@ package types
 
 // This file contains types for generating the cache statistics page.
 
+import (
+	"fmt"
+	"sync/atomic"
+)
+
 // CacheStats is the common interface that is used so every cache can generate a
 // Stats object which is to be used in the server status page.
 type CacheStats interface {
@@ -25,4 +30,201 @@ type CacheStats interface {
 
 	// Size returns the consumed space in bytes for this cache
 	Size() BytesSize
+
+	// Traffic returns the algorithm independent statistics of the cache zone.
+	// The cache algorithms do not know about them so they are filled in by
+	// CacheZone.Stats.
+	Traffic() ZoneTraffic
+}
+
+// ZoneTraffic contains the statistics of a cache zone which do not depend on
+// its cache algorithm.
+type ZoneTraffic struct {
+	// CachedBytes is the number of bytes served from the storage
+	CachedBytes uint64 `json:"cached_bytes"`
+
+	// UpstreamBytes is the number of bytes fetched from the upstream
+	UpstreamBytes uint64 `json:"upstream_bytes"`
+
+	// Insertions is the number of parts saved in the storage
+	Insertions uint64 `json:"insertions"`
+
+	// EvictedParts is the number of parts removed from the storage by the
+	// cache algorithm
+	EvictedParts uint64 `json:"evicted_parts"`
+
+	// EvictedObjects is the number of whole objects removed from the storage by
+	// the cache algorithm
+	EvictedObjects uint64 `json:"evicted_objects"`
+
+	// Expirations is the number of objects removed because they have expired
+	Expirations uint64 `json:"expirations"`
+
+	// Discards is the number of objects discarded by the handlers, for example
+	// because they were purged or have changed in the upstream
+	Discards uint64 `json:"discards"`
+}
+
+// ByteHitPrc returns a string such as '53%' which represents the part of the
+// served bytes which came from the cache.
+func (zt ZoneTraffic) ByteHitPrc() string {
+	var all = zt.CachedBytes + zt.UpstreamBytes
+	if all == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%.f%%", (float64(zt.CachedBytes)/float64(all))*100)
+}
+
+// TrafficCounters collects the ZoneTraffic of a cache zone. It is safe for
+// concurrent use and its zero value is ready to be used. Its counters are
+// accessed atomically, so it must be 64-bit aligned when it is embedded in
+// another struct.
+type TrafficCounters struct {
+	cachedBytes    uint64
+	upstreamBytes  uint64
+	insertions     uint64
+	evictedParts   uint64
+	evictedObjects uint64
+	expirations    uint64
+	discards       uint64
+}
+
+// AddCachedBytes records that n bytes were served from the storage.
+func (tc *TrafficCounters) AddCachedBytes(n uint64) {
+	atomic.AddUint64(&tc.cachedBytes, n)
+}
+
+// AddUpstreamBytes records that n bytes were fetched from the upstream.
+func (tc *TrafficCounters) AddUpstreamBytes(n uint64) {
+	atomic.AddUint64(&tc.upstreamBytes, n)
+}
+
+// Inserted records that a part was saved in the storage.
+func (tc *TrafficCounters) Inserted() {
+	atomic.AddUint64(&tc.insertions, 1)
+}
+
+// EvictedPart records that a part was evicted by the cache algorithm.
+func (tc *TrafficCounters) EvictedPart() {
+	atomic.AddUint64(&tc.evictedParts, 1)
+}
+
+// EvictedObject records that a whole object was evicted by the cache algorithm.
+func (tc *TrafficCounters) EvictedObject() {
+	atomic.AddUint64(&tc.evictedObjects, 1)
+}
+
+// Expired records that an object was removed because it has expired.
+func (tc *TrafficCounters) Expired() {
+	atomic.AddUint64(&tc.expirations, 1)
+}
+
+// Discarded records that an object was discarded by a handler.
+func (tc *TrafficCounters) Discarded() {
+	atomic.AddUint64(&tc.discards, 1)
+}
+
+// Traffic returns the current values of the counters.
+func (tc *TrafficCounters) Traffic() ZoneTraffic {
+	return ZoneTraffic{
+		CachedBytes:    atomic.LoadUint64(&tc.cachedBytes),
+		UpstreamBytes:  atomic.LoadUint64(&tc.upstreamBytes),
+		Insertions:     atomic.LoadUint64(&tc.insertions),
+		EvictedParts:   atomic.LoadUint64(&tc.evictedParts),
+		EvictedObjects: atomic.LoadUint64(&tc.evictedObjects),
+		Expirations:    atomic.LoadUint64(&tc.expirations),
+		Discards:       atomic.LoadUint64(&tc.discards),
+	}
+}
+
+// LookupCounter counts the lookups in a cache algorithm and how many of them
+// were hits. It is not safe for concurrent use, the algorithms update it while
+// holding their own locks.
+type LookupCounter struct {
+	requests uint64
+	hits     uint64
+}
+
+// Record counts a lookup and returns whether it was a hit.
+func (lc *LookupCounter) Record(hit bool) bool {
+	lc.requests++
+	if hit {
+		lc.hits++
+	}
+	return hit
+}
+
+// Stats returns the CacheStats of an algorithm with the counted lookups.
+func (lc *LookupCounter) Stats(id string, objects uint64, size BytesSize) *AlgorithmStats {
+	return NewAlgorithmStats(id, lc.hits, lc.requests, objects, size)
+}
+
+// AlgorithmStats is a CacheStats implementation which can be used by all the
+// cache algorithms. Its Traffic is always empty.
+type AlgorithmStats struct {
+	id       string
+	hits     uint64
+	requests uint64
+	size     BytesSize
+	objects  uint64
+}
+
+// NewAlgorithmStats returns the CacheStats of a cache algorithm.
+func NewAlgorithmStats(id string, hits, requests, objects uint64, size BytesSize) *AlgorithmStats {
+	return &AlgorithmStats{
+		id:       id,
+		hits:     hits,
+		requests: requests,
+		size:     size,
+		objects:  objects,
+	}
+}
+
+// CacheHitPrc implements part of CacheStats interface
+func (as *AlgorithmStats) CacheHitPrc() string {
+	if as.requests == 0 {
+		return ""
+	}
+	return fmt.Sprintf("%.f%%", (float32(as.Hits())/float32(as.Requests()))*100)
+}
+
+// ID implements part of CacheStats interface
+func (as *AlgorithmStats) ID() string {
+	return as.id
+}
+
+// Hits implements part of CacheStats interface
+func (as *AlgorithmStats) Hits() uint64 {
+	return as.hits
+}
+
+// Size implements part of CacheStats interface
+func (as *AlgorithmStats) Size() BytesSize {
+	return as.size
+}
+
+// Objects implements part of CacheStats interface
+func (as *AlgorithmStats) Objects() uint64 {
+	return as.objects
+}
+
+// Requests implements part of CacheStats interface
+func (as *AlgorithmStats) Requests() uint64 {
+	return as.requests
+}
+
+// Traffic implements part of CacheStats interface
+func (as *AlgorithmStats) Traffic() ZoneTraffic {
+	return ZoneTraffic{}
+}
+
+// zoneStats adds the traffic of a cache zone to the stats of its algorithm.
+type zoneStats struct {
+	CacheStats
+	traffic ZoneTraffic
+}
+
+// Traffic implements part of CacheStats interface
+func (zs *zoneStats) Traffic() ZoneTraffic {
+	return zs.traffic
 }
@@ -0,0 +1,121 @@
+package types
+
+import (
+	"testing"
+)
+
+func TestStatsPercentsStringRepresentation(t *testing.T) {
+	t.Parallel()
+	stats := NewAlgorithmStats("/nana", 15, 100, 23, 7322)
+
+	found := stats.CacheHitPrc()
+	expected := "15%"
+
+	if found != expected {
+		t.Errorf("Calculating percents failed. Expected %s but got %s", expected, found)
+	}
+
+	stats.requests = 0
+
+	found = stats.CacheHitPrc()
+
+	if found != "" {
+		t.Errorf("Calculating percents when no requests returned %s", found)
+	}
+
+	stats.requests = 107
+
+	found = stats.CacheHitPrc()
+	expected = "14%"
+
+	if found != expected {
+		t.Errorf("Calculating percents failed. Expected %s but got %s", expected, found)
+	}
+}
+
+func TestLookupCounter(t *testing.T) {
+	t.Parallel()
+	var lc LookupCounter
+	for _, hit := range []bool{true, false, false, true} {
+		if found := lc.Record(hit); found != hit {
+			t.Errorf("Expected Record(%t) to return %t", hit, hit)
+		}
+	}
+
+	stats := lc.Stats("/nana", 3, 30)
+	if stats.Hits() != 2 || stats.Requests() != 4 {
+		t.Errorf("Expected 2 hits of 4 requests but got %d of %d", stats.Hits(), stats.Requests())
+	}
+	if stats.ID() != "/nana" || stats.Objects() != 3 || stats.Size() != 30 {
+		t.Errorf("Unexpected stats %+v", stats)
+	}
+}
+
+func TestTrafficCounters(t *testing.T) {
+	t.Parallel()
+	var tc TrafficCounters
+	if found := tc.Traffic().ByteHitPrc(); found != "" {
+		t.Errorf("Calculating byte hit percents without traffic returned %s", found)
+	}
+
+	tc.AddCachedBytes(300)
+	tc.AddCachedBytes(100)
+	tc.AddUpstreamBytes(600)
+	tc.Inserted()
+	tc.Inserted()
+	tc.EvictedPart()
+	tc.EvictedPart()
+	tc.EvictedObject()
+	tc.Expired()
+	tc.Discarded()
+	tc.Discarded()
+	tc.Discarded()
+
+	var expected = ZoneTraffic{
+		CachedBytes:    400,
+		UpstreamBytes:  600,
+		Insertions:     2,
+		EvictedParts:   2,
+		EvictedObjects: 1,
+		Expirations:    1,
+		Discards:       3,
+	}
+	if found := tc.Traffic(); found != expected {
+		t.Errorf("Expected traffic %+v but got %+v", expected, found)
+	}
+	if found := tc.Traffic().ByteHitPrc(); found != "40%" {
+		t.Errorf("Expected 40%% of the bytes to be served from the cache but got %s", found)
+	}
+}
+
+type statsAlgorithm struct {
+	CacheAlgorithm
+	stats CacheStats
+}
+
+func (sa *statsAlgorithm) Stats() CacheStats {
+	return sa.stats
+}
+
+func TestCacheZoneStats(t *testing.T) {
+	t.Parallel()
+	var cz = &CacheZone{
+		ID:        "zone",
+		Algorithm: &statsAlgorithm{stats: NewAlgorithmStats("zone", 1, 2, 3, 4)},
+	}
+	cz.Traffic.AddUpstreamBytes(42)
+	cz.Traffic.EvictedPart()
+
+	var stats = cz.Stats()
+	if stats.Hits() != 1 || stats.Requests() != 2 || stats.Objects() != 3 || stats.Size() != 4 {
+		t.Errorf("The algorithm stats were not kept: %+v", stats)
+	}
+	if traffic := stats.Traffic(); traffic.UpstreamBytes != 42 || traffic.EvictedParts != 1 {
+		t.Errorf("Unexpected zone traffic %+v", traffic)
+	}
+
+	cz.Algorithm = &statsAlgorithm{}
+	if stats := cz.Stats(); stats != nil {
+		t.Errorf("Expected nil stats when the algorithm has none but got %+v", stats)
+	}
+}
@@ -1,11 +1,44 @@
 package types
 
+import "sync"
+
 // CacheZone is the combination of a Storage for storing object parts and an
 // `CacheAlgorithm` which determines what should be stored.
 type CacheZone struct {
+	// Traffic counts what happens in the zone regardless of its algorithm. Its
+	// counters are accessed atomically, so it must be the first field for them
+	// to be 64-bit aligned on the 32-bit platforms.
+	Traffic TrafficCounters
+
 	ID        string
 	PartSize  BytesSize
 	Algorithm CacheAlgorithm
 	Scheduler Scheduler
 	Storage   Storage
+
+	// inFlight is shared by all the handlers which use the zone
+	inFlightOnce sync.Once
+	inFlight     interface{}
+}
+
+// InFlight returns the registry of the upstream requests which are in flight
+// for the zone. It is shared by all the handlers which use the zone, so that
+// they do not download the same parts at the same time. The registry is
+// created with newRegistry by the first caller. It is not a concrete type
+// because the registry belongs to the caching handler.
+func (cz *CacheZone) InFlight(newRegistry func() interface{}) interface{} {
+	cz.inFlightOnce.Do(func() {
+		cz.inFlight = newRegistry()
+	})
+	return cz.inFlight
+}
+
+// Stats returns the stats of the cache algorithm together with the traffic of
+// the zone.
+func (cz *CacheZone) Stats() CacheStats {
+	var stats = cz.Algorithm.Stats()
+	if stats == nil {
+		return nil
+	}
+	return &zoneStats{CacheStats: stats, traffic: cz.Traffic.Traffic()}
 }
@@ -13,6 +13,7 @@ type Location struct {
 	CacheKey              string
 	CacheDefaultDuration  time.Duration
 	CacheKeyIncludesQuery bool
+	CacheKeyTemplate      *CacheKeyTemplate
 	Cache                 *CacheZone //!TODO: move to the cache handler settings (plus all Cache* settings)
 	Upstream              Upstream
 	Logger                Logger
@@ -29,3 +30,13 @@ func (l *Location) NewObjectIDForURL(u *url.URL) *ObjectID {
 	}
 	return NewObjectID(l.CacheKey, u.Path)
 }
+
+// NewObjectIDForRequest returns new ObjectID for the request. If the location
+// has a cache key template it is used for the ObjectID's path. Otherwise the
+// result is the same as NewObjectIDForURL for the request's URL.
+func (l *Location) NewObjectIDForRequest(req *http.Request) *ObjectID {
+	if l.CacheKeyTemplate != nil {
+		return NewObjectID(l.CacheKey, l.CacheKeyTemplate.Execute(req))
+	}
+	return l.NewObjectIDForURL(req.URL)
+}
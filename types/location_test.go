@@ -1,6 +1,7 @@
 package types
 
 import (
+	"net/http"
 	"net/url"
 	"testing"
 )
@@ -42,3 +43,24 @@ func TestNewObjectIDForURL(t *testing.T) {
 	}
 
 }
+
+func TestNewObjectIDForRequest(t *testing.T) {
+	tmpl, err := NewCacheKeyTemplate("{host}{path}?{args:-token}")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var withTemplate = &Location{CacheKey: "1", CacheKeyTemplate: tmpl}
+	var withoutTemplate = &Location{CacheKey: "2"}
+
+	first, _ := http.NewRequest("GET", "http://example.com/path?b=1&token=abc", nil)
+	second, _ := http.NewRequest("GET", "http://example.com/path?token=def&b=1", nil)
+	if a, b := withTemplate.NewObjectIDForRequest(first), withTemplate.NewObjectIDForRequest(second); a.Hash() != b.Hash() {
+		t.Errorf("Expected %s and %s to be the same object", a, b)
+	}
+	if got := withTemplate.NewObjectIDForRequest(first).Path(); got != "example.com/path?b=1" {
+		t.Errorf("Unexpected path %s", got)
+	}
+	if got := withoutTemplate.NewObjectIDForRequest(first); *got != *withoutTemplate.NewObjectIDForURL(first.URL) {
+		t.Errorf("Expected the object ID %s to be the same as the one for the url", got)
+	}
+}
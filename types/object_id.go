@@ -18,11 +18,14 @@ type ObjectIDHash [ObjectIDHashSize]byte
 type ObjectID struct {
 	cacheKey string
 	path     string
+	variant  string
 	hash     ObjectIDHash
-	//!TODO: add vary headers information
 }
 
 func (oid *ObjectID) String() string {
+	if oid.variant != "" {
+		return fmt.Sprintf("{%x:%s:%s:%q}", oid.Hash(), oid.cacheKey, oid.path, oid.variant)
+	}
 	return fmt.Sprintf("{%x:%s:%s}", oid.Hash(), oid.cacheKey, oid.path)
 }
 
@@ -36,6 +39,20 @@ func (oid *ObjectID) Path() string {
 	return oid.path
 }
 
+// Variant returns the key of the variant of the object, selected by the request
+// headers listed in its Vary response header. It is empty for primary objects.
+func (oid *ObjectID) Variant() string {
+	return oid.variant
+}
+
+// Primary returns the ID of the object without the variant information.
+func (oid *ObjectID) Primary() *ObjectID {
+	if oid.variant == "" {
+		return oid
+	}
+	return NewObjectID(oid.cacheKey, oid.path)
+}
+
 // Hash returns the pre-calculated sha1 hash of the object id.
 func (oid *ObjectID) Hash() ObjectIDHash {
 	return oid.hash
@@ -48,6 +65,9 @@ func (oid *ObjectID) StrHash() string {
 
 // MarshalJSON is used to help the JSON library marshal the unexported vars.
 func (oid *ObjectID) MarshalJSON() ([]byte, error) {
+	if oid.variant != "" {
+		return json.Marshal([]string{oid.cacheKey, oid.path, oid.variant})
+	}
 	return json.Marshal([]string{oid.cacheKey, oid.path})
 }
 
@@ -58,9 +78,16 @@ func (oid *ObjectID) UnmarshalJSON(buf []byte) error {
 		return err
 	}
 
-	if len(data) != 2 || data[0] == "" || data[1] == "" {
+	if len(data) < 2 || len(data) > 3 || data[0] == "" || data[1] == "" {
 		return fmt.Errorf("Invalid ObjectID %s", buf)
 	}
+	if len(data) == 3 {
+		if data[2] == "" {
+			return fmt.Errorf("Invalid ObjectID %s", buf)
+		}
+		*oid = *NewVariantObjectID(data[0], data[1], data[2])
+		return nil
+	}
 	*oid = *NewObjectID(data[0], data[1])
 	return nil
 }
@@ -73,3 +100,18 @@ func NewObjectID(cacheKey, path string) *ObjectID {
 		hash:     sha1.Sum([]byte(cacheKey + "/" + path)),
 	}
 }
+
+// NewVariantObjectID creates and returns the ID of a variant of the object
+// with the supplied cache key and path. An empty variant means the primary
+// object itself.
+func NewVariantObjectID(cacheKey, path, variant string) *ObjectID {
+	if variant == "" {
+		return NewObjectID(cacheKey, path)
+	}
+	return &ObjectID{
+		cacheKey: cacheKey,
+		path:     path,
+		variant:  variant,
+		hash:     sha1.Sum([]byte(cacheKey + "/" + path + "\n" + variant)),
+	}
+}
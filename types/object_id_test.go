@@ -76,3 +76,33 @@ func TestObjectIDStringersWithSensibleData(t *testing.T) {
 	}
 
 }
+
+func TestVariantObjectID(t *testing.T) {
+	t.Parallel()
+	primary := NewObjectID("1.2", "/somewhere")
+	variant := NewVariantObjectID("1.2", "/somewhere", "Accept-Language: bg")
+	if variant.Hash() == primary.Hash() {
+		t.Error("The variant has the same hash as the primary object")
+	}
+	if !reflect.DeepEqual(variant.Primary(), primary) {
+		t.Errorf("Expected the primary object of %s to be %s", variant, primary)
+	}
+	if !reflect.DeepEqual(NewVariantObjectID("1.2", "/somewhere", ""), primary) {
+		t.Error("Expected an empty variant to be the primary object")
+	}
+
+	resM, err := json.Marshal(variant)
+	if err != nil {
+		t.Fatalf("Could not marshal ObjectID: %s", err)
+	}
+	resU := &ObjectID{}
+	if err := json.Unmarshal(resM, resU); err != nil {
+		t.Fatalf("Could not unmarshal ObjectID: %s", err)
+	}
+	if !reflect.DeepEqual(variant, resU) {
+		t.Fatalf("The original object %#v is different from the unmarshalled %#v", variant, resU)
+	}
+	if err := json.Unmarshal([]byte(`["1.2","/somewhere",""]`), resU); err == nil {
+		t.Error("Expected an error for an empty variant")
+	}
+}
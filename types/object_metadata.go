@@ -28,4 +28,23 @@ type ObjectMetadata struct {
 	// The time at which this object can be considered stale. After this time
 	// the object must be revalidated or discarded. This value is a unix timestamp.
 	ExpiresAt int64
+
+	// For how many seconds after ExpiresAt the stale object may be served
+	// while it is being revalidated in the background (stale-while-revalidate).
+	StaleWhileRevalidate int64
+
+	// For how many seconds after ExpiresAt the stale object may be served if
+	// the upstream fails while revalidating it (stale-if-error).
+	StaleIfError int64
+
+	// The time until which the object is kept in the storage. It may be after
+	// ExpiresAt so that stale objects can be revalidated with conditional
+	// requests or served stale. Zero means ExpiresAt. This value is a unix
+	// timestamp.
+	KeepUntil int64
+
+	// The variant keys of the cached variants of the object. They are kept
+	// in the metadata of the primary object so that all the variants can be
+	// found when the object is purged.
+	Variants []string `json:",omitempty"`
 }
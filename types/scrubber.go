@@ -0,0 +1,35 @@
+package types
+
+import (
+	"context"
+	"time"
+)
+
+// Scrubber is implemented by storages which can check their contents in the
+// background. Scrubbing removes the files left by interrupted writes, the
+// parts without metadata and the objects which can not be read.
+type Scrubber interface {
+	// Scrub checks all of the stored objects once. It returns when all of
+	// them have been checked or when the context is canceled.
+	Scrub(ctx context.Context) error
+
+	// ScrubProgress returns the progress of the current or the last scrub.
+	ScrubProgress() ScrubProgress
+}
+
+// ScrubProgress describes what a storage scrub has done so far.
+type ScrubProgress struct {
+	Running  bool      `json:"running"`
+	Started  time.Time `json:"started"`
+	Finished time.Time `json:"finished"`
+
+	// How many of the directories in the storage have been checked
+	DirsChecked uint64 `json:"dirs_checked"`
+	DirsTotal   uint64 `json:"dirs_total"`
+
+	ObjectsChecked     uint64 `json:"objects_checked"`
+	RemovedTempFiles   uint64 `json:"removed_temp_files"`
+	RemovedOrphanParts uint64 `json:"removed_orphan_parts"`
+	RemovedObjects     uint64 `json:"removed_objects"`
+	RepairedObjects    uint64 `json:"repaired_objects"`
+}
@@ -0,0 +1,64 @@
+package types
+
+// SpaceLimits computes how much a storage is over its max_size and
+// min_free_space limits. Getting the free space of a storage is a system
+// call, so it is done again only after the storage has grown by at least a
+// part since the last time. In between the free space is estimated from the
+// change of the used bytes. SpaceLimits is not safe for concurrent use, the
+// cache algorithms use it while holding their own locks.
+type SpaceLimits struct {
+	usage        UsageReporter
+	maxSize      uint64
+	minFreeSpace uint64
+	partSize     uint64
+
+	// The used and the free bytes at the last check of the free space
+	checked     bool
+	checkedUsed uint64
+	checkedFree uint64
+}
+
+// NewSpaceLimits returns the limits for the storage with the supplied usage.
+// Zero limits are not enforced.
+func NewSpaceLimits(usage UsageReporter, maxSize, minFreeSpace, partSize uint64) *SpaceLimits {
+	return &SpaceLimits{
+		usage:        usage,
+		maxSize:      maxSize,
+		minFreeSpace: minFreeSpace,
+		partSize:     partSize,
+	}
+}
+
+// Excess returns how many bytes have to be removed from the storage for it to
+// be within its limits. When the free space can not be checked only the
+// max_size limit is taken into account and the error is returned too.
+func (sl *SpaceLimits) Excess() (uint64, error) {
+	if sl == nil || sl.usage == nil || sl.maxSize == 0 && sl.minFreeSpace == 0 {
+		return 0, nil
+	}
+
+	var excess uint64
+	var used = sl.usage.BytesUsed()
+	if sl.maxSize != 0 && used > sl.maxSize {
+		excess = used - sl.maxSize
+	}
+	if sl.minFreeSpace == 0 {
+		return excess, nil
+	}
+
+	if !sl.checked || used >= sl.checkedUsed+sl.partSize {
+		free, err := sl.usage.FreeSpace()
+		if err != nil {
+			return excess, err
+		}
+		sl.checked, sl.checkedUsed, sl.checkedFree = true, used, free
+	}
+	var free = sl.checkedFree + sl.checkedUsed - used
+	if used > sl.checkedUsed+sl.checkedFree {
+		free = 0
+	}
+	if free < sl.minFreeSpace && sl.minFreeSpace-free > excess {
+		excess = sl.minFreeSpace - free
+	}
+	return excess, nil
+}
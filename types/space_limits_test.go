@@ -0,0 +1,73 @@
+package types
+
+import (
+	"errors"
+	"testing"
+)
+
+type countingUsage struct {
+	used, free  uint64
+	err         error
+	freeChecked int
+}
+
+func (cu *countingUsage) BytesUsed() uint64 {
+	return cu.used
+}
+
+func (cu *countingUsage) FreeSpace() (uint64, error) {
+	cu.freeChecked++
+	return cu.free, cu.err
+}
+
+func (cu *countingUsage) change(delta int64) {
+	cu.used = uint64(int64(cu.used) + delta)
+	cu.free = uint64(int64(cu.free) - delta)
+}
+
+func TestSpaceLimitsExcess(t *testing.T) {
+	t.Parallel()
+	var usage = &countingUsage{used: 50, free: 50}
+	var limits = NewSpaceLimits(usage, 80, 60, 10)
+
+	var steps = []struct {
+		delta  int64
+		excess uint64
+		checks int
+	}{
+		{0, 10, 1},
+		{5, 15, 1},
+		{5, 20, 2},
+		{-20, 0, 2},
+		{30, 30, 3},
+		{9, 39, 3},
+	}
+	for i, step := range steps {
+		usage.change(step.delta)
+		excess, err := limits.Excess()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if excess != step.excess {
+			t.Errorf("Step %d: expected an excess of %d but got %d", i, step.excess, excess)
+		}
+		if usage.freeChecked != step.checks {
+			t.Errorf("Step %d: expected %d checks of the free space but got %d",
+				i, step.checks, usage.freeChecked)
+		}
+	}
+}
+
+func TestSpaceLimitsErrors(t *testing.T) {
+	t.Parallel()
+	var usage = &countingUsage{used: 100, err: errors.New("statfs failed")}
+	excess, err := NewSpaceLimits(usage, 80, 60, 10).Excess()
+	if err != usage.err || excess != 20 {
+		t.Errorf("Expected the max_size excess of 20 and an error but got %d and %v", excess, err)
+	}
+
+	var limits *SpaceLimits
+	if excess, err := limits.Excess(); excess != 0 || err != nil {
+		t.Errorf("Expected no excess without limits but got %d and %v", excess, err)
+	}
+}
@@ -1,6 +1,9 @@
 package types
 
-import "io"
+import (
+	"context"
+	"io"
+)
 
 // Storage represents a single unit of storage.
 type Storage interface {
@@ -43,3 +46,42 @@ type Storage interface {
 }
 
 //!TODO: use custom error type instead of os.ErrNotExist?
+
+// PartPromoter is implemented by storages which keep the most used parts in a
+// faster tier. PromotePart is called every time the part has been promoted by
+// the cache algorithm.
+type PartPromoter interface {
+	PromotePart(*ObjectIndex)
+}
+
+// HealthReporter is implemented by storages which detect failures of their
+// underlying devices. While the storage is not healthy its cache zone is
+// bypassed and the requests are proxied directly to the upstream.
+type HealthReporter interface {
+	Healthy() bool
+}
+
+// HealthProber is implemented by the HealthReporter storages which check in
+// the background whether their failed devices work again. The checks stop
+// when the supplied context is done.
+type HealthProber interface {
+	SetProbeContext(context.Context)
+}
+
+// UsageReporter is implemented by storages which know how much space they
+// actually take. It is used for keeping cache zones within their max_size and
+// min_free_space limits.
+type UsageReporter interface {
+	// BytesUsed returns the bytes taken by the stored parts and metadata.
+	BytesUsed() uint64
+
+	// FreeSpace returns how many bytes are still available to the storage.
+	FreeSpace() (uint64, error)
+}
+
+// RemovalNotifier is implemented by storages which remove parts on their own,
+// for example because they are corrupted. The supplied function is called with
+// the removed parts so that they can be removed from the cache algorithm too.
+type RemovalNotifier interface {
+	SetRemovedFunc(func(...*ObjectIndex))
+}
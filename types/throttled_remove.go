@@ -0,0 +1,40 @@
+package types
+
+import (
+	"runtime"
+	"time"
+)
+
+// ThrottledRemove is used by the cache algorithms for removing the parts which
+// do not fit in them any more after they are resized down. The parts are passed
+// to remove in bulks of bulkCount with a pause of bulkTimeout between them, so
+// that the storage is not overloaded. remove should skip the parts which were
+// cached again in the meantime. All of the parts are removed at once if
+// bulkCount is 0. A panic in remove is logged and stops the removal.
+func ThrottledRemove(indexes []ObjectIndex, bulkCount int, bulkTimeout time.Duration,
+	remove func(...ObjectIndex), logger Logger) {
+	defer func() {
+		if msg := recover(); msg != nil {
+			const size = 64 << 10
+			buf := make([]byte, size)
+			buf = buf[:runtime.Stack(buf, false)]
+			logger.Errorf(
+				"Panic during throttled remove after resize down: %v\n%s",
+				msg, buf)
+		}
+	}()
+
+	if bulkCount <= 0 {
+		bulkCount = len(indexes)
+	}
+	for i := 0; i < len(indexes); i += bulkCount {
+		if i > 0 {
+			time.Sleep(bulkTimeout)
+		}
+		end := i + bulkCount
+		if end > len(indexes) {
+			end = len(indexes)
+		}
+		remove(indexes[i:end]...)
+	}
+}
@@ -0,0 +1,37 @@
+package types
+
+import (
+	"testing"
+	"time"
+)
+
+func TestThrottledRemove(t *testing.T) {
+	t.Parallel()
+	var indexes = make([]ObjectIndex, 5)
+	const timeout = 20 * time.Millisecond
+
+	var bulks []int
+	var started = time.Now()
+	var waits []time.Duration
+	ThrottledRemove(indexes, 2, timeout, func(removed ...ObjectIndex) {
+		waits = append(waits, time.Since(started))
+		started = time.Now()
+		bulks = append(bulks, len(removed))
+	}, nil)
+	if len(bulks) != 3 || bulks[0] != 2 || bulks[1] != 2 || bulks[2] != 1 {
+		t.Errorf("Expected bulks of 2, 2 and 1 parts but got %v", bulks)
+	}
+	for i, wait := range waits[1:] {
+		if wait < timeout {
+			t.Errorf("Expected a pause of at least %s before bulk %d but it was %s", timeout, i+1, wait)
+		}
+	}
+
+	bulks = nil
+	ThrottledRemove(indexes, 0, time.Hour, func(removed ...ObjectIndex) {
+		bulks = append(bulks, len(removed))
+	}, nil)
+	if len(bulks) != 1 || bulks[0] != len(indexes) {
+		t.Errorf("Expected all the parts to be removed at once but got %v", bulks)
+	}
+}
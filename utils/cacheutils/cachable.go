@@ -2,6 +2,7 @@ package cacheutils
 
 import (
 	"net/http"
+	"sort"
 	"strings"
 	"time"
 
@@ -24,8 +25,9 @@ func CacheSatisfiesRequest(obj *types.ObjectMetadata, req *http.Request) bool {
 
 // IsResponseCacheable returs whether the upstream server allows the requested
 // content to be saved in the cache. True result and 0 duration means that the
-// response has no expiry date.
-func IsResponseCacheable(code int, headers http.Header) bool {
+// response has no expiry date. Responses with content encodings other than the
+// allowed ones are not cacheable.
+func IsResponseCacheable(code int, headers http.Header, allowedEncodings ...string) bool {
 	//!TODO: write a better custom implementation or fork the cacheobject - the API sucks
 	//!TODO: correctly handle cache-control, pragma, etag and vary headers
 	//!TODO: write unit tests
@@ -34,9 +36,14 @@ func IsResponseCacheable(code int, headers http.Header) bool {
 		return false
 	}
 
-	// For now, we do not cache encoded responses
-	if headers.Get("Content-Encoding") != "" {
-		return false
+	if encoding := headers.Get("Content-Encoding"); encoding != "" {
+		var allowed bool
+		for _, allowedEncoding := range allowedEncodings {
+			allowed = allowed || strings.EqualFold(encoding, allowedEncoding)
+		}
+		if !allowed {
+			return false
+		}
 	}
 
 	// We do not cache multipart range responses
@@ -44,6 +51,14 @@ func IsResponseCacheable(code int, headers http.Header) bool {
 		return false
 	}
 
+	// Responses that vary on things other than the request headers can not
+	// be matched to future requests
+	for _, field := range VaryFields(headers) {
+		if field == "*" {
+			return false
+		}
+	}
+
 	respDir, err := cacheobject.ParseResponseCacheControl(headers.Get("Cache-Control"))
 	if err != nil || respDir.NoCachePresent || respDir.NoStore || respDir.PrivatePresent {
 		return false
@@ -79,3 +94,64 @@ func ResponseExpiresIn(headers http.Header, ifNotAny time.Duration) time.Duratio
 
 	return ifNotAny
 }
+
+// ResponseStaleDurations returns the durations from the stale-while-revalidate
+// and stale-if-error Cache-Control extensions (RFC 5861) of the upstream
+// headers. Zero is returned for any of them which is not present.
+func ResponseStaleDurations(headers http.Header) (whileRevalidate, ifError time.Duration) {
+	respDir, err := cacheobject.ParseResponseCacheControl(headers.Get("Cache-Control"))
+	if err != nil {
+		return 0, 0
+	}
+
+	if respDir.StaleWhileRevalidate > 0 {
+		whileRevalidate = time.Duration(respDir.StaleWhileRevalidate) * time.Second
+	}
+	if respDir.StaleIfError > 0 {
+		ifError = time.Duration(respDir.StaleIfError) * time.Second
+	}
+	return
+}
+
+// HasValidators returns whether the object can be revalidated with a
+// conditional request, i.e. it has an ETag or a Last-Modified header.
+func HasValidators(obj *types.ObjectMetadata) bool {
+	return obj.Headers.Get("ETag") != "" || obj.Headers.Get("Last-Modified") != ""
+}
+
+// VaryFields returns the canonical names of the request headers listed in the
+// Vary response headers, sorted and without duplicates.
+func VaryFields(headers http.Header) []string {
+	var fields []string
+	for _, value := range headers["Vary"] {
+		for _, field := range strings.Split(value, ",") {
+			if field = strings.TrimSpace(field); field != "" {
+				fields = append(fields, http.CanonicalHeaderKey(field))
+			}
+		}
+	}
+	sort.Strings(fields)
+
+	var result = fields[:0]
+	for i, field := range fields {
+		if i == 0 || field != fields[i-1] {
+			result = append(result, field)
+		}
+	}
+	return result
+}
+
+// VariantKey returns the key which selects the variant of an object with the
+// supplied Vary response headers that matches the request headers. An empty
+// key means that the object has no variants. Accept-Encoding is not part of
+// the key as the content encoding of the variants is selected separately.
+func VariantKey(respHeaders, reqHeaders http.Header) string {
+	var key []string
+	for _, field := range VaryFields(respHeaders) {
+		if field == "Accept-Encoding" {
+			continue
+		}
+		key = append(key, field+": "+strings.Join(reqHeaders[field], ", "))
+	}
+	return strings.Join(key, "\n")
+}
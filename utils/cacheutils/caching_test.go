@@ -6,6 +6,7 @@ import (
 	"io"
 	"net/http"
 	"net/textproto"
+	"reflect"
 	"testing"
 	"time"
 )
@@ -90,6 +91,32 @@ var responseCacheabilityMatrix = []struct {
 		headers:   "Content-Encoding: tea\nExpires: " + time.Now().Add(30*time.Second).Format(time.RFC1123),
 		cacheable: false,
 	},
+
+	{
+		code:      http.StatusOK,
+		headers:   "Vary: Accept-Language\nCache-Control: max-age=30",
+		cacheable: true,
+		expiresIN: time.Second * 30,
+	},
+	{
+		code:      http.StatusOK,
+		headers:   "Vary: Accept-Language, *\nCache-Control: max-age=30",
+		cacheable: false,
+	},
+}
+
+func TestIsResponseCacheableWithEncodings(t *testing.T) {
+	t.Parallel()
+	var headers = http.Header{"Content-Encoding": []string{"gzip"}}
+	if IsResponseCacheable(http.StatusOK, headers) {
+		t.Error("Expected encoded responses not to be cacheable by default")
+	}
+	if !IsResponseCacheable(http.StatusOK, headers, "br", "gzip") {
+		t.Error("Expected responses with allowed encodings to be cacheable")
+	}
+	if IsResponseCacheable(http.StatusOK, headers, "br") {
+		t.Error("Expected responses with other encodings not to be cacheable")
+	}
 }
 
 func TestIsResponseCacheable(t *testing.T) {
@@ -127,3 +154,51 @@ func TestResponseExpiresInDurationParsing(t *testing.T) {
 		}
 	}
 }
+
+func TestResponseStaleDurations(t *testing.T) {
+	t.Parallel()
+	var tests = []struct {
+		cacheControl    string
+		whileRevalidate time.Duration
+		ifError         time.Duration
+	}{
+		{"", 0, 0},
+		{"max-age=30", 0, 0},
+		{"max-age=30, stale-while-revalidate=60", time.Minute, 0},
+		{"max-age=30, stale-if-error=120", 0, 2 * time.Minute},
+		{"stale-while-revalidate=5, stale-if-error=10", 5 * time.Second, 10 * time.Second},
+		{"max-age", 0, 0},
+	}
+
+	for index, test := range tests {
+		headers := http.Header{"Cache-Control": []string{test.cacheControl}}
+		swr, sie := ResponseStaleDurations(headers)
+		if swr != test.whileRevalidate || sie != test.ifError {
+			t.Errorf("for index %d expected %s and %s but got %s and %s",
+				index, test.whileRevalidate, test.ifError, swr, sie)
+		}
+	}
+}
+
+func TestVariantKey(t *testing.T) {
+	t.Parallel()
+	var respHeaders = http.Header{"Vary": []string{"x-custom, Accept-Language", "accept-language, accept-encoding"}}
+	if fields := VaryFields(respHeaders); !reflect.DeepEqual(fields, []string{"Accept-Encoding", "Accept-Language", "X-Custom"}) {
+		t.Errorf("Unexpected vary fields %v", fields)
+	}
+
+	var key = VariantKey(respHeaders, http.Header{
+		"Accept-Language": []string{"bg"},
+		"Accept-Encoding": []string{"gzip"},
+		"User-Agent":      []string{"test"},
+	})
+	if expected := "Accept-Language: bg\nX-Custom: "; key != expected {
+		t.Errorf("Expected variant key %q but got %q", expected, key)
+	}
+	if key == VariantKey(respHeaders, http.Header{"Accept-Language": []string{"en"}}) {
+		t.Error("Expected different variant keys for different request headers")
+	}
+	if key := VariantKey(http.Header{}, http.Header{"Accept-Language": []string{"bg"}}); key != "" {
+		t.Errorf("Expected empty variant key without Vary but got %q", key)
+	}
+}
@@ -3,6 +3,7 @@ package utils
 
 import (
 	"errors"
+	"net/http"
 	"os"
 	"path/filepath"
 	"strings"
@@ -27,6 +28,35 @@ func IsMetadataFresh(obj *types.ObjectMetadata) bool {
 	return time.Unix(obj.ExpiresAt, 0).After(time.Now())
 }
 
+// MetadataKeepUntil returns the time after which the object should be removed
+// from the storage, even if it is stale and could still be revalidated.
+func MetadataKeepUntil(obj *types.ObjectMetadata) time.Time {
+	if obj.KeepUntil > obj.ExpiresAt {
+		return time.Unix(obj.KeepUntil, 0)
+	}
+	return time.Unix(obj.ExpiresAt, 0)
+}
+
+// IsMetadataKept checks whether the supplied metadata, even if it is stale,
+// should still be kept in the storage.
+func IsMetadataKept(obj *types.ObjectMetadata) bool {
+	return MetadataKeepUntil(obj).After(time.Now())
+}
+
+// CopyMetadata returns a copy of the supplied metadata which does not share
+// its headers with the original.
+func CopyMetadata(obj *types.ObjectMetadata) *types.ObjectMetadata {
+	var metadata = *obj
+	metadata.Headers = make(http.Header, len(obj.Headers))
+	for key, values := range obj.Headers {
+		metadata.Headers[key] = CopyStringSlice(values)
+	}
+	if obj.Variants != nil {
+		metadata.Variants = CopyStringSlice(obj.Variants)
+	}
+	return &metadata
+}
+
 // ProjectPath returns a path to the project source as an absolute directory name.
 func ProjectPath() (string, error) {
 	gopath := os.ExpandEnv("$GOPATH")
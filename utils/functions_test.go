@@ -88,3 +88,25 @@ func TestIsMetadataFresh(t *testing.T) {
 
 	}
 }
+
+func TestCopyMetadata(t *testing.T) {
+	obj := &types.ObjectMetadata{
+		ID:       types.NewObjectID("key", "/path"),
+		Size:     535,
+		Headers:  http.Header{"X-Test": {"first", "second"}},
+		Variants: []string{"Accept-Language: bg"},
+	}
+	copied := CopyMetadata(obj)
+	if copied.ID != obj.ID || copied.Size != obj.Size || copied.Headers.Get("X-Test") != "first" {
+		t.Errorf("Unexpected copy %+v of %+v", copied, obj)
+	}
+	copied.Headers["X-Test"][0] = "changed"
+	copied.Headers.Set("X-Other", "value")
+	if obj.Headers.Get("X-Test") != "first" || obj.Headers.Get("X-Other") != "" {
+		t.Errorf("The original headers were changed: %v", obj.Headers)
+	}
+	copied.Variants[0] = "Accept-Language: en"
+	if obj.Variants[0] != "Accept-Language: bg" {
+		t.Errorf("The original variants were changed: %v", obj.Variants)
+	}
+}
@@ -0,0 +1,149 @@
+package httputils
+
+// This file has been based on http://golang.org/src/net/http/fs.go
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+	"time"
+)
+
+// CheckPreconditions evaluates the conditional headers of the request against
+// the validators (ETag and Last-Modified) in the supplied response headers
+// as per RFC 7232, section 6. It returns http.StatusOK if the request should
+// be served normally, http.StatusNotModified or http.StatusPreconditionFailed
+// otherwise.
+func CheckPreconditions(req *http.Request, headers http.Header) int {
+	var etag = headers.Get("ETag")
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" {
+		if !etagListMatches(ifMatch, etag, true) {
+			return http.StatusPreconditionFailed
+		}
+	} else if ifUnmodifiedSince := req.Header.Get("If-Unmodified-Since"); ifUnmodifiedSince != "" {
+		if modified, ok := isModifiedSince(headers, ifUnmodifiedSince); ok && modified {
+			return http.StatusPreconditionFailed
+		}
+	}
+
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" {
+		if etagListMatches(ifNoneMatch, etag, false) {
+			if req.Method == "GET" || req.Method == "HEAD" {
+				return http.StatusNotModified
+			}
+			return http.StatusPreconditionFailed
+		}
+	} else if ifModifiedSince := req.Header.Get("If-Modified-Since"); ifModifiedSince != "" {
+		if req.Method == "GET" || req.Method == "HEAD" {
+			if modified, ok := isModifiedSince(headers, ifModifiedSince); ok && !modified {
+				return http.StatusNotModified
+			}
+		}
+	}
+
+	return http.StatusOK
+}
+
+// CheckIfRange returns whether the Range header of the request should be
+// honoured according to its If-Range header (RFC 7233, section 3.2). If it
+// returns false the full representation should be sent instead.
+func CheckIfRange(req *http.Request, headers http.Header) bool {
+	ifRange := textproto.TrimString(req.Header.Get("If-Range"))
+	if ifRange == "" {
+		return true
+	}
+
+	if etag, _ := scanETag(ifRange); etag != "" {
+		return etagStrongMatch(etag, headers.Get("ETag"))
+	}
+
+	// A date validator must match exactly
+	lastModified, err := http.ParseTime(headers.Get("Last-Modified"))
+	if err != nil {
+		return false
+	}
+	ifRangeTime, err := http.ParseTime(ifRange)
+	return err == nil && lastModified.Equal(ifRangeTime)
+}
+
+// isModifiedSince returns whether the Last-Modified time in the headers is
+// after the supplied HTTP date. The second result is false when any of the
+// dates is missing or invalid and the comparison has to be ignored.
+func isModifiedSince(headers http.Header, date string) (modified bool, ok bool) {
+	lastModified, err := http.ParseTime(headers.Get("Last-Modified"))
+	if err != nil {
+		return false, false
+	}
+	since, err := http.ParseTime(date)
+	if err != nil {
+		return false, false
+	}
+	// The Last-Modified header has only a second precision
+	return lastModified.Truncate(time.Second).After(since), true
+}
+
+// etagListMatches checks whether the etag is in the comma separated list of
+// entity tags from If-Match or If-None-Match headers. The "*" list matches
+// any existing representation.
+func etagListMatches(list, etag string, strong bool) bool {
+	for {
+		list = textproto.TrimString(list)
+		if len(list) == 0 {
+			return false
+		}
+		if list[0] == ',' {
+			list = list[1:]
+			continue
+		}
+		if list[0] == '*' {
+			return true
+		}
+		candidate, remain := scanETag(list)
+		if candidate == "" {
+			return false
+		}
+		if strong && etagStrongMatch(candidate, etag) ||
+			!strong && etagWeakMatch(candidate, etag) {
+			return true
+		}
+		list = remain
+	}
+}
+
+// scanETag determines if a syntactically valid ETag is present at s. If so,
+// the ETag and remaining text after consuming ETag is returned. Otherwise,
+// it returns "", "".
+func scanETag(s string) (etag string, remain string) {
+	s = textproto.TrimString(s)
+	start := 0
+	if strings.HasPrefix(s, "W/") {
+		start = 2
+	}
+	if len(s[start:]) < 2 || s[start] != '"' {
+		return "", ""
+	}
+	// ETag is either W/"text" or "text".
+	// See RFC 7232 2.3.
+	for i := start + 1; i < len(s); i++ {
+		c := s[i]
+		switch {
+		// Character values allowed in ETags.
+		case c == 0x21 || c >= 0x23 && c <= 0x7E || c >= 0x80:
+		case c == '"':
+			return s[:i+1], s[i+1:]
+		default:
+			return "", ""
+		}
+	}
+	return "", ""
+}
+
+// etagStrongMatch reports whether a and b match using strong ETag comparison.
+func etagStrongMatch(a, b string) bool {
+	return a == b && a != "" && a[0] == '"'
+}
+
+// etagWeakMatch reports whether a and b match using weak ETag comparison.
+func etagWeakMatch(a, b string) bool {
+	return strings.TrimPrefix(a, "W/") == strings.TrimPrefix(b, "W/") && b != ""
+}
@@ -0,0 +1,101 @@
+package httputils
+
+import (
+	"net/http"
+	"testing"
+)
+
+const (
+	testLastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	testEarlier      = "Mon, 02 Jan 2006 15:04:04 GMT"
+	testLater        = "Mon, 02 Jan 2006 15:04:06 GMT"
+)
+
+var testValidators = http.Header{
+	"Etag":          []string{`"strong"`},
+	"Last-Modified": []string{testLastModified},
+}
+
+type preconditionTest struct {
+	method   string
+	headers  map[string]string
+	expected int
+}
+
+var preconditionTests = []preconditionTest{
+	{headers: nil, expected: http.StatusOK},
+	{headers: map[string]string{"If-None-Match": `"strong"`}, expected: http.StatusNotModified},
+	{headers: map[string]string{"If-None-Match": `W/"strong"`}, expected: http.StatusNotModified},
+	{headers: map[string]string{"If-None-Match": `"other", "strong"`}, expected: http.StatusNotModified},
+	{headers: map[string]string{"If-None-Match": `*`}, expected: http.StatusNotModified},
+	{headers: map[string]string{"If-None-Match": `"other"`}, expected: http.StatusOK},
+	{method: "POST", headers: map[string]string{"If-None-Match": `"strong"`},
+		expected: http.StatusPreconditionFailed},
+	{headers: map[string]string{"If-Modified-Since": testLastModified}, expected: http.StatusNotModified},
+	{headers: map[string]string{"If-Modified-Since": testLater}, expected: http.StatusNotModified},
+	{headers: map[string]string{"If-Modified-Since": testEarlier}, expected: http.StatusOK},
+	{headers: map[string]string{"If-Modified-Since": "invalid"}, expected: http.StatusOK},
+	{headers: map[string]string{
+		"If-None-Match":     `"other"`,
+		"If-Modified-Since": testLater,
+	}, expected: http.StatusOK},
+	{headers: map[string]string{"If-Match": `"strong"`}, expected: http.StatusOK},
+	{headers: map[string]string{"If-Match": `*`}, expected: http.StatusOK},
+	{headers: map[string]string{"If-Match": `W/"strong"`}, expected: http.StatusPreconditionFailed},
+	{headers: map[string]string{"If-Match": `"other"`}, expected: http.StatusPreconditionFailed},
+	{headers: map[string]string{"If-Unmodified-Since": testLastModified}, expected: http.StatusOK},
+	{headers: map[string]string{"If-Unmodified-Since": testEarlier},
+		expected: http.StatusPreconditionFailed},
+	{headers: map[string]string{
+		"If-Match":            `"strong"`,
+		"If-Unmodified-Since": testEarlier,
+	}, expected: http.StatusOK},
+	{headers: map[string]string{
+		"If-Match":      `"strong"`,
+		"If-None-Match": `"strong"`,
+	}, expected: http.StatusNotModified},
+}
+
+func TestCheckPreconditions(t *testing.T) {
+	t.Parallel()
+	for _, test := range preconditionTests {
+		var method = test.method
+		if method == "" {
+			method = "GET"
+		}
+		req, err := http.NewRequest(method, "http://example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, value := range test.headers {
+			req.Header.Set(key, value)
+		}
+		if got := CheckPreconditions(req, testValidators); got != test.expected {
+			t.Errorf("Expected %d for %s %v but got %d", test.expected, method, test.headers, got)
+		}
+	}
+}
+
+func TestCheckIfRange(t *testing.T) {
+	t.Parallel()
+	var tests = map[string]bool{
+		"":                 true,
+		`"strong"`:         true,
+		`W/"strong"`:       false,
+		`"other"`:          false,
+		testLastModified:   true,
+		testLater:          false,
+		"not a valid date": false,
+	}
+	for ifRange, expected := range tests {
+		req, err := http.NewRequest("GET", "http://example.com/", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Range", "bytes=0-1")
+		req.Header.Set("If-Range", ifRange)
+		if got := CheckIfRange(req, testValidators); got != expected {
+			t.Errorf("Expected %t for If-Range %q but got %t", expected, ifRange, got)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package httputils
+
+import (
+	"strconv"
+	"strings"
+)
+
+// AcceptsEncoding returns whether the content coding is acceptable according
+// to the supplied Accept-Encoding request header (RFC 7231, section 5.3.4).
+func AcceptsEncoding(acceptEncoding, encoding string) bool {
+	var wildcard bool
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		var coding, params = strings.TrimSpace(item), ""
+		if i := strings.Index(coding, ";"); i >= 0 {
+			coding, params = strings.TrimSpace(coding[:i]), coding[i+1:]
+		}
+		var acceptable = qualityOf(params) > 0
+		if strings.EqualFold(coding, encoding) {
+			return acceptable
+		} else if coding == "*" {
+			wildcard = acceptable
+		}
+	}
+	return wildcard
+}
+
+// qualityOf returns the value of the `q` parameter, which is 1 by default.
+func qualityOf(params string) float64 {
+	for _, param := range strings.Split(params, ";") {
+		param = strings.TrimSpace(param)
+		if len(param) < 2 || (param[0] != 'q' && param[0] != 'Q') || param[1] != '=' {
+			continue
+		}
+		q, err := strconv.ParseFloat(strings.TrimSpace(param[2:]), 64)
+		if err != nil {
+			return 0
+		}
+		return q
+	}
+	return 1
+}
@@ -0,0 +1,30 @@
+package httputils
+
+import "testing"
+
+func TestAcceptsEncoding(t *testing.T) {
+	t.Parallel()
+	var tests = []struct {
+		acceptEncoding, encoding string
+		expected                 bool
+	}{
+		{"", "gzip", false},
+		{"gzip", "gzip", true},
+		{"GZIP", "gzip", true},
+		{"deflate, gzip;q=1.0, *;q=0.5", "gzip", true},
+		{"deflate, gzip;q=1.0, *;q=0.5", "br", true},
+		{"br;q=0, *", "br", false},
+		{"gzip; q=0.001", "gzip", true},
+		{"gzip;q=0", "gzip", false},
+		{"gzip;q=0.0", "gzip", false},
+		{"gzip;q=invalid", "gzip", false},
+		{"deflate", "gzip", false},
+		{"*;q=0", "gzip", false},
+	}
+	for _, test := range tests {
+		if got := AcceptsEncoding(test.acceptEncoding, test.encoding); got != test.expected {
+			t.Errorf("Expected %t for %s with Accept-Encoding `%s` but got %t",
+				test.expected, test.encoding, test.acceptEncoding, got)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package httputils
+
+// This file has been based on http://golang.org/src/net/http/fs.go
+
+import (
+	"mime/multipart"
+	"net/textproto"
+)
+
+// RangePartHeader returns the MIME header of a single body part in a
+// multipart/byteranges response (RFC 7233, section 4.1).
+func RangePartHeader(r Range, contentType string, size uint64) textproto.MIMEHeader {
+	var header = textproto.MIMEHeader{
+		"Content-Range": {r.ContentRange(size)},
+	}
+	if contentType != "" {
+		header.Set("Content-Type", contentType)
+	}
+	return header
+}
+
+// MultipartByterangesSize returns the length of the multipart/byteranges body
+// with the supplied boundary that contains the supplied ranges.
+func MultipartByterangesSize(ranges []Range, boundary, contentType string, size uint64) uint64 {
+	var w countingWriter
+	var mw = multipart.NewWriter(&w)
+	var encSize uint64
+	// The boundary is always valid as it was generated by multipart.Writer
+	_ = mw.SetBoundary(boundary)
+	for _, r := range ranges {
+		_, _ = mw.CreatePart(RangePartHeader(r, contentType, size))
+		encSize += r.Length
+	}
+	_ = mw.Close()
+	return encSize + uint64(w)
+}
+
+// MultipartByterangesContentType returns the Content-Type header value of a
+// multipart/byteranges response with the supplied boundary.
+func MultipartByterangesContentType(boundary string) string {
+	return "multipart/byteranges; boundary=" + boundary
+}
+
+// RangesSize returns the sum of the lengths of all ranges.
+func RangesSize(ranges []Range) uint64 {
+	var size uint64
+	for _, r := range ranges {
+		size += r.Length
+	}
+	return size
+}
+
+type countingWriter uint64
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	*w += countingWriter(len(p))
+	return len(p), nil
+}
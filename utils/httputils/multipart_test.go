@@ -0,0 +1,63 @@
+package httputils
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"strings"
+	"testing"
+)
+
+func TestMultipartByterangesSize(t *testing.T) {
+	t.Parallel()
+	const contents = "0123456789abcdefghijklmnopqrstuvwxyz"
+	var size = uint64(len(contents))
+	var ranges = []Range{{0, 1}, {5, 10}, {30, 6}}
+
+	var buf bytes.Buffer
+	var mw = multipart.NewWriter(&buf)
+	for _, r := range ranges {
+		part, err := mw.CreatePart(RangePartHeader(r, "text/plain", size))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := part.Write([]byte(contents[r.Start : r.Start+r.Length])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := mw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	got := MultipartByterangesSize(ranges, mw.Boundary(), "text/plain", size)
+	if got != uint64(buf.Len()) {
+		t.Errorf("Expected size %d but got %d", buf.Len(), got)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(MultipartByterangesContentType(mw.Boundary()))
+	if err != nil || mediaType != "multipart/byteranges" {
+		t.Fatalf("Unexpected content type %s: %v", mediaType, err)
+	}
+	var reader = multipart.NewReader(&buf, params["boundary"])
+	for _, r := range ranges {
+		part, err := reader.NextPart()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if cr := part.Header.Get("Content-Range"); cr != r.ContentRange(size) {
+			t.Errorf("Expected Content-Range %s but got %s", r.ContentRange(size), cr)
+		}
+		body, err := ioutil.ReadAll(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasPrefix(contents[r.Start:], string(body)) || uint64(len(body)) != r.Length {
+			t.Errorf("Unexpected body %q for range %v", body, r)
+		}
+	}
+
+	if RangesSize(ranges) != 17 {
+		t.Errorf("Expected ranges size 17 but got %d", RangesSize(ranges))
+	}
+}
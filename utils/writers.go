@@ -63,3 +63,40 @@ func MultiWriteCloser(writers ...io.WriteCloser) io.WriteCloser {
 	copy(w, writers)
 	return &multiWriteCloser{w}
 }
+
+type rangeWriteCloser struct {
+	io.WriteCloser
+	skip, length uint64
+}
+
+func (r *rangeWriteCloser) Write(p []byte) (int, error) {
+	var written = len(p)
+	if r.skip > 0 {
+		skipped := r.skip
+		if skipped > uint64(len(p)) {
+			skipped = uint64(len(p))
+		}
+		p = p[skipped:]
+		r.skip -= skipped
+	}
+	if uint64(len(p)) > r.length {
+		p = p[:r.length]
+	}
+	if len(p) > 0 {
+		n, err := r.WriteCloser.Write(p)
+		r.length -= uint64(n)
+		if err != nil {
+			return n, err
+		}
+		if n != len(p) {
+			return n, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
+// RangeWriteCloser returns a WriteCloser that passes to w only the `length`
+// bytes after the first `skip` ones. Everything else is silently discarded.
+func RangeWriteCloser(w io.WriteCloser, skip, length uint64) io.WriteCloser {
+	return &rangeWriteCloser{WriteCloser: w, skip: skip, length: length}
+}
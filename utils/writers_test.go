@@ -38,3 +38,37 @@ func TestMultiWriterWithNWriters(t *testing.T) {
 func unwrapNopCloser(input io.Writer) io.Writer {
 	return input.(nopCloser).Writer
 }
+
+func TestRangeWriteCloser(t *testing.T) {
+	t.Parallel()
+	var input = []byte(`Hello, World!`)
+	var tests = []struct {
+		skip, length uint64
+		expected     string
+	}{
+		{0, 100, `Hello, World!`},
+		{0, 5, `Hello`},
+		{7, 5, `World`},
+		{3, 0, ``},
+		{20, 5, ``},
+	}
+	for _, test := range tests {
+		for step := 1; step <= len(input); step++ {
+			var buf bytes.Buffer
+			var w = RangeWriteCloser(NopCloser(&buf), test.skip, test.length)
+			for i := 0; i < len(input); i += step {
+				end := i + step
+				if end > len(input) {
+					end = len(input)
+				}
+				if n, err := w.Write(input[i:end]); err != nil || n != end-i {
+					t.Fatalf("Unexpected write result %d, %v", n, err)
+				}
+			}
+			if buf.String() != test.expected {
+				t.Errorf("Expected `%s` for %d+%d on steps of %d but got `%s`",
+					test.expected, test.skip, test.length, step, buf.String())
+			}
+		}
+	}
+}